@@ -2,14 +2,40 @@ package main
 
 import (
 	"context"
+	"net/http"
 
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/thataway/common-lib/app/tracing/ot"
 	"github.com/thataway/common-lib/logger"
 	pkgNet "github.com/thataway/common-lib/pkg/net"
 	"github.com/thataway/common-lib/server"
+	"github.com/thataway/ipvs/internal/admission"
+	"github.com/thataway/ipvs/internal/api/ipvs"
 	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/audit"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/caller"
 	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/discovery"
+	"github.com/thataway/ipvs/internal/guard"
+	"github.com/thataway/ipvs/internal/healthcheck"
+	"github.com/thataway/ipvs/internal/journal"
+	"github.com/thataway/ipvs/internal/jwtauth"
+	"github.com/thataway/ipvs/internal/lease"
+	"github.com/thataway/ipvs/internal/meta"
+	"github.com/thataway/ipvs/internal/mtls"
+	"github.com/thataway/ipvs/internal/notify"
+	"github.com/thataway/ipvs/internal/ownership"
+	"github.com/thataway/ipvs/internal/peercred"
+	"github.com/thataway/ipvs/internal/policy"
+	"github.com/thataway/ipvs/internal/ratelimit"
+	"github.com/thataway/ipvs/internal/rules"
+	"github.com/thataway/ipvs/internal/statestore"
+	"github.com/thataway/ipvs/internal/watch"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
@@ -17,15 +43,7 @@ func main() {
 	ctx := app.Context()
 	logger.SetLevel(zap.InfoLevel)
 	logger.Info(ctx, "--== HELLO ==--")
-	err := config.InitGlobalConfig(
-		config.WithAcceptEnvironment{EnvPrefix: "IPVS"},
-		config.WithSourceFile{FileName: app.ConfigFile},
-		config.WithDefValue{Key: app.LoggerLevel, Val: "INFO"},
-		config.WithDefValue{Key: app.MetricsEnable, Val: false},
-		config.WithDefValue{Key: app.TraceEnable, Val: false},
-		config.WithDefValue{Key: app.ServerGracefulShutdown, Val: "10s"},
-		config.WithDefValue{Key: app.ServerEndpoint, Val: "tcp://127.0.0.1:9006"},
-	)
+	err := initConfig()
 	if err != nil {
 		logger.Fatal(ctx, err)
 	}
@@ -38,9 +56,64 @@ func main() {
 	if err = setupTracer(); err != nil {
 		logger.Fatalf(ctx, "setup tracer: %v", err)
 	}
-	var srv *server.APIServer
-	if srv, err = setupServer(ctx); err != nil {
-		logger.Fatalf(ctx, "setup server: %v", err)
+	var owners *ownership.Registry
+	if owners, err = setupOwnership(ctx); err != nil {
+		logger.Fatalf(ctx, "setup ownership: %v", err)
+	}
+	var notifier *notify.Notifier
+	if notifier, err = setupNotify(ctx); err != nil {
+		logger.Fatalf(ctx, "setup notify: %v", err)
+	}
+	adm := owners.Admin(ipvsAdm.NewAdmin(ctx))
+	apiAdm := notifier.Admin(adm, notify.SourceAPI)
+	var store *statestore.Store
+	if store, err = setupStateStore(ctx, notifier.Admin(adm, notify.SourceDrift)); err != nil {
+		logger.Fatalf(ctx, "setup state store: %v", err)
+	}
+	if store != nil {
+		apiAdm = store.Admin(apiAdm)
+	}
+	events := watch.NewHub()
+	var serverOpts []server.APIServerOption
+	var hc *healthcheck.Manager
+	if hc, err = setupHealthcheck(ctx, notifier.Admin(adm, notify.SourceHealthcheck), events); err != nil {
+		logger.Fatalf(ctx, "setup healthcheck: %v", err)
+	}
+	var leases *lease.Registry
+	if leases, err = setupLeases(ctx, notifier.Admin(adm, notify.SourceLease)); err != nil {
+		logger.Fatalf(ctx, "setup leases: %v", err)
+	}
+	var rec *discovery.Reconciler
+	if rec, err = setupDiscovery(ctx, notifier.Admin(adm, notify.SourceDiscovery), owners, hc); err != nil {
+		logger.Fatalf(ctx, "setup discovery: %v", err)
+	}
+	var jour *journal.Journal
+	if jour, err = setupJournal(ctx); err != nil {
+		logger.Fatalf(ctx, "setup journal: %v", err)
+	}
+	var md *meta.Store
+	if md, err = setupMetadata(ctx); err != nil {
+		logger.Fatalf(ctx, "setup metadata: %v", err)
+	}
+	var pol *policy.Policy
+	if pol, err = setupPolicy(ctx); err != nil {
+		logger.Fatalf(ctx, "setup policy: %v", err)
+	}
+	var ruleSet *rules.RuleSet
+	if ruleSet, err = setupRules(ctx); err != nil {
+		logger.Fatalf(ctx, "setup rules: %v", err)
+	}
+	var admit *admission.Controller
+	if admit, err = setupAdmission(ctx); err != nil {
+		logger.Fatalf(ctx, "setup admission: %v", err)
+	}
+	serviceOpts := []ipvs.ServiceOption{
+		ipvs.WithJournal{Journal: jour},
+		ipvs.WithOwnership{Registry: owners},
+		ipvs.WithMetadata{Store: md},
+		ipvs.WithPolicy{Policy: pol},
+		ipvs.WithRules{RuleSet: ruleSet},
+		ipvs.WithAdmission{Controller: admit},
 	}
 	var endPointAddress string
 	if endPointAddress, err = app.ServerEndpoint.Maybe(ctx); err != nil {
@@ -50,8 +123,117 @@ func main() {
 	if ep, err = pkgNet.ParseEndpoint(endPointAddress); err != nil {
 		logger.Fatalf(ctx, "parse server endpoint (%s): %v", endPointAddress, err)
 	}
+	var serveEp *pkgNet.Endpoint
+	if serveEp, err = setupTLS(ctx, ep); err != nil {
+		logger.Fatalf(ctx, "setup TLS: %v", err)
+	}
+	var resolvers []authz.Resolver
+	var proxy *caller.TrustedProxy
+	if serveEp != ep {
+		//subjects of client certificates are trusted only on connections from TLS front
+		if proxy, err = caller.NewTrustedProxy(serveEp); err != nil {
+			logger.Fatalf(ctx, "setup TLS: %v", err)
+		}
+		resolvers = append(resolvers, mtls.Principals)
+	}
+	var unixEp *pkgNet.Endpoint
+	var peerAuth bool
+	if unixEp, peerAuth, err = setupUnixSocket(ctx, ep, serveEp); err != nil {
+		logger.Fatalf(ctx, "setup unix socket: %v", err)
+	}
+	var creds credentials.TransportCredentials
+	if peerAuth {
+		resolvers = append(resolvers, peercred.Principals)
+		creds = peercred.NewCredentials()
+	}
+	if proxy != nil {
+		creds = proxy.Credentials(creds)
+	}
+	if creds != nil {
+		serverOpts = append(serverOpts, server.WithGrpcServerOptions(grpc.Creds(creds)))
+	}
+	var tokens *jwtauth.Authenticator
+	if tokens, err = setupJWT(ctx); err != nil {
+		logger.Fatalf(ctx, "setup JWT: %v", err)
+	}
+	if tokens != nil {
+		resolvers = append(resolvers, tokens.Principals)
+		serverOpts = append(serverOpts, server.WithUnaryInterceptors(tokens.UnaryInterceptor))
+	}
+	for _, r := range resolvers {
+		serviceOpts = append(serviceOpts, ipvs.WithResolver{Resolver: r})
+	}
+	//calls gateway makes are told apart by addresses of HTTP clients
+	serverOpts = append(serverOpts, server.WithGatewayOptions(runtime.WithMetadata(proxy.GatewayMetadata)))
+	var auditLog *audit.Log
+	if auditLog, err = setupAudit(ctx, resolvers...); err != nil {
+		logger.Fatalf(ctx, "setup audit: %v", err)
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
+		serviceOpts = append(serviceOpts, ipvs.WithAudit{Log: auditLog})
+		//calls authorizer refuses do not reach the service, they are audited ahead of it
+		serverOpts = append(serverOpts, server.WithUnaryInterceptors(ipvs.AuditRefusals(auditLog)))
+	}
+	var authorizer *authz.Authorizer
+	if authorizer, err = setupAuthz(ctx, resolvers...); err != nil {
+		logger.Fatalf(ctx, "setup authz: %v", err)
+	}
+	if authorizer != nil {
+		serverOpts = append(serverOpts, server.WithUnaryInterceptors(authorizer.UnaryInterceptor))
+	}
+	var limiter *ratelimit.Limiter
+	if limiter, err = setupRateLimit(ctx, resolvers...); err != nil {
+		logger.Fatalf(ctx, "setup rate limit: %v", err)
+	}
+	if limiter != nil {
+		serviceOpts = append(serviceOpts, ipvs.WithRateLimit{Limiter: limiter})
+	}
+	//HTTP endpoints are guarded like gRPC calls
+	guardOpts := []guard.Option{
+		guard.WithAuthenticator{Authenticator: tokens},
+		guard.WithAuthorizer{Authorizer: authorizer},
+		guard.WithRateLimit{Limiter: limiter},
+		guard.WithMetadata{Store: md},
+		guard.WithTrustedProxy{TrustedProxy: proxy},
+	}
+	for _, r := range resolvers {
+		guardOpts = append(guardOpts, guard.WithResolver{Resolver: r})
+	}
+	if auditLog != nil {
+		guardOpts = append(guardOpts, guard.WithRefusals{Refused: ipvs.AuditRefusal(auditLog)})
+	}
+	g := guard.New(guardOpts...)
+	serverOpts = append(serverOpts, server.WithHttpHandler("/watch", g.Handler(events, nil)))
+	if rec != nil {
+		serverOpts = append(serverOpts, server.WithHttpHandler("/discovery", g.Handler(rec, nil)))
+	}
+	if hc != nil {
+		serverOpts = append(serverOpts, server.WithHttpHandler("/healthcheck",
+			g.Handler(healthcheck.NewHandler(hc, g.VirtualServer), guard.Methods{http.MethodPost: authz.MethodOverridePriorityGroup})))
+	}
+	if leases != nil {
+		serverOpts = append(serverOpts, server.WithHttpHandler("/leases",
+			g.Handler(lease.NewHandler(leases, g.VirtualServer, g.Principals), guard.Methods{
+				http.MethodPost:   authz.MethodUpdateLeases,
+				http.MethodDelete: authz.MethodUpdateLeases,
+			})))
+	}
+	serverOpts = append(serverOpts, server.WithHttpHandler("/metadata",
+		g.Handler(meta.NewHandler(md, g.Metadata), guard.Methods{
+			http.MethodPut:    authz.MethodUpdateMetadata,
+			http.MethodDelete: authz.MethodUpdateMetadata,
+		})))
+	var srv *server.APIServer
+	if srv, err = setupServer(ctx, apiAdm, serviceOpts, g, serverOpts...); err != nil {
+		logger.Fatalf(ctx, "setup server: %v", err)
+	}
 	gracefulDuration, _ := app.ServerGracefulShutdown.Maybe(ctx)
-	if err = srv.Run(ctx, ep, server.RunWithGracefulStop(gracefulDuration)); err != nil {
+	runOpts := []server.RunAPIServersOption{server.RunWithGracefulStop(gracefulDuration)}
+	if unixEp != nil {
+		runOpts = append(runOpts, server.RunWithAPIServer(unixEp, srv))
+	}
+	if err = srv.Run(ctx, serveEp, runOpts...); err != nil {
 		logger.Fatalf(ctx, "run server: %v", err)
 	}
 	WhenHaveTracerProvider(func(tp ot.TracerProvider) {
@@ -59,3 +241,31 @@ func main() {
 	})
 	logger.Info(ctx, "--== BYE ==--")
 }
+
+//configSources environment and config file application config is read from
+func configSources() []config.Option {
+	return []config.Option{
+		config.WithAcceptEnvironment{EnvPrefix: "IPVS"},
+		config.WithSourceFile{FileName: app.ConfigFile},
+	}
+}
+
+func initConfig() error {
+	return config.InitGlobalConfig(append(configSources(),
+		config.WithDefValue{Key: app.LoggerLevel, Val: "INFO"},
+		config.WithDefValue{Key: app.MetricsEnable, Val: false},
+		config.WithDefValue{Key: app.TraceEnable, Val: false},
+		config.WithDefValue{Key: app.ServerGracefulShutdown, Val: "10s"},
+		config.WithDefValue{Key: app.ServerEndpoint, Val: "tcp://127.0.0.1:9006"},
+		config.WithDefValue{Key: app.ServerTLSMinVersion, Val: "1.2"},
+		config.WithDefValue{Key: app.ServerTLSInternalEndpoint, Val: "unix:///run/ipvs/api/internal.sock"},
+		config.WithDefValue{Key: app.ServerUnixSocketMode, Val: "0660"},
+		config.WithDefValue{Key: app.StateStoreEnable, Val: false},
+		config.WithDefValue{Key: app.StateStoreDir, Val: "/var/lib/ipvs"},
+		config.WithDefValue{Key: app.StateStoreCheckInterval, Val: "10s"},
+		config.WithDefValue{Key: app.JournalMaxEntries, Val: 1000},
+		config.WithDefValue{Key: app.OwnershipFile, Val: "/var/lib/ipvs/owned.json"},
+		config.WithDefValue{Key: app.OwnershipStrict, Val: false},
+		config.WithDefValue{Key: app.HealthcheckWeightsFile, Val: "/var/lib/ipvs/healthcheck-weights.json"},
+	)...)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/admission"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+)
+
+func setupAdmission(ctx context.Context) (*admission.Controller, error) {
+	var conf admission.Config
+	err := app.AdmissionConfig.Maybe(ctx, &conf)
+	if errors.Is(err, config.ErrNotFound) || (err == nil && len(conf.Webhooks) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return admission.New(conf)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/audit"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/config"
+)
+
+//defAuditHeadFile chain head is kept in when audit records go to journald only
+const defAuditHeadFile = "/var/lib/ipvs/audit-head.json"
+
+//setupAudit makes audit log of mutating calls; resolvers tell principals of callers
+func setupAudit(ctx context.Context, resolvers ...authz.Resolver) (*audit.Log, error) {
+	var conf audit.Config
+	err := app.AuditConfig.Maybe(ctx, &conf)
+	if errors.Is(err, config.ErrNotFound) || (err == nil && conf.File == "" && !conf.Journald) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conf.File == "" && conf.HeadFile == "" {
+		conf.HeadFile = defAuditHeadFile
+	}
+	var opts []audit.Option
+	for _, r := range resolvers {
+		opts = append(opts, audit.WithResolver{Resolver: r})
+	}
+	var l *audit.Log
+	if l, err = audit.New(conf, opts...); err != nil {
+		return nil, err
+	}
+	WhenHaveMetricsRegistry(func(r *prometheus.Registry) {
+		err = r.Register(l)
+	})
+	if err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "register audit metrics")
+	}
+	return l, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/config"
+)
+
+//setupAuthz makes authorizer; resolvers tell principals of callers
+func setupAuthz(ctx context.Context, resolvers ...authz.Resolver) (*authz.Authorizer, error) {
+	var conf authz.Config
+	err := app.AuthzConfig.Maybe(ctx, &conf)
+	if errors.Is(err, config.ErrNotFound) || (err == nil && len(conf.Roles) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var opts []authz.Option
+	for _, r := range resolvers {
+		opts = append(opts, authz.WithResolver{Resolver: r})
+	}
+	var a *authz.Authorizer
+	if a, err = authz.New(conf, opts...); err != nil {
+		return nil, err
+	}
+	WhenHaveMetricsRegistry(func(r *prometheus.Registry) {
+		err = r.Register(a)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "register authz metrics")
+	}
+	return a, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/discovery"
+	"github.com/thataway/ipvs/internal/discovery/k8s"
+	"github.com/thataway/ipvs/internal/healthcheck"
+	"github.com/thataway/ipvs/internal/ownership"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func setupDiscovery(ctx context.Context, adm ipvsAdm.Admin, owners *ownership.Registry,
+	hc *healthcheck.Manager) (*discovery.Reconciler, error) {
+
+	var runners []func(context.Context)
+	rec := discovery.NewReconciler(adm,
+		discovery.WithOwnership{Registry: owners},
+		discovery.WithHealthChecked{Manages: hc.Manages},
+	)
+
+	err := app.Services.Maybe(ctx, &discovery.ConfigSourceConfig{})
+	if err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		var src *discovery.ConfigSource
+		if src, err = discovery.NewConfigSource(ctx, rec, loadServicesConfig()); err != nil {
+			return nil, err
+		}
+		//declared services are in the table before API is up
+		if err = src.Apply(ctx); err != nil {
+			return nil, err
+		}
+		runners = append(runners, src.Run)
+	}
+
+	var filesConf discovery.FileSourceConfig
+	err = app.DiscoveryFiles.Maybe(ctx, &filesConf)
+	if err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	if err == nil && filesConf.Dir != "" {
+		var src *discovery.FileSource
+		if src, err = discovery.NewFileSource(rec, filesConf); err != nil {
+			return nil, err
+		}
+		runners = append(runners, src.Run)
+	}
+
+	var dnsConf discovery.DNSSourceConfig
+	err = app.DiscoveryDNS.Maybe(ctx, &dnsConf)
+	if err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	if err == nil && len(dnsConf.Services) > 0 {
+		var src *discovery.DNSSource
+		if src, err = discovery.NewDNSSource(rec, dnsConf); err != nil {
+			return nil, err
+		}
+		runners = append(runners, src.Run)
+	}
+
+	var consulConf discovery.ConsulSourceConfig
+	err = app.DiscoveryConsul.Maybe(ctx, &consulConf)
+	if err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	if err == nil && len(consulConf.Services) > 0 {
+		var src *discovery.ConsulSource
+		if src, err = discovery.NewConsulSource(rec, consulConf); err != nil {
+			return nil, err
+		}
+		runners = append(runners, src.Run)
+	}
+
+	var k8sConf k8s.Config
+	err = app.DiscoveryKubernetes.Maybe(ctx, &k8sConf)
+	if err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		client, e := k8s.NewClient(k8sConf.Kubeconfig)
+		if e != nil {
+			return nil, e
+		}
+		runners = append(runners, k8s.NewSource(rec, client, k8sConf).Run)
+	}
+
+	if len(runners) == 0 {
+		return nil, nil
+	}
+	for _, run := range runners {
+		go run(ctx)
+	}
+	return rec, nil
+}
+
+//loadServicesConfig reads 'services' section; every call but the first one re-reads it from config file
+//into config of its own, so global config the rest of service is set up by stays as is
+func loadServicesConfig() discovery.ConfigLoader {
+	var loaded bool
+	return func(ctx context.Context) (discovery.ConfigSourceConfig, error) {
+		var ret discovery.ConfigSourceConfig
+		var err error
+		if loaded {
+			err = app.Services.MaybeFrom(ctx, &ret, configSources()...)
+		} else {
+			err = app.Services.Maybe(ctx, &ret)
+		}
+		loaded = true
+		if errors.Is(err, config.ErrNotFound) {
+			err = nil
+		}
+		return ret, err
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/healthcheck"
+	"github.com/thataway/ipvs/internal/watch"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func setupHealthcheck(ctx context.Context, adm ipvsAdm.Admin, events *watch.Hub) (*healthcheck.Manager, error) {
+	var confs []healthcheck.ServiceConfig
+	err := app.HealthcheckServices.Maybe(ctx, &confs)
+	if err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	if len(confs) == 0 {
+		return nil, nil
+	}
+	var weightsFile string
+	if weightsFile, err = app.HealthcheckWeightsFile.Maybe(ctx); err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	var m *healthcheck.Manager
+	m, err = healthcheck.NewManager(adm, confs,
+		healthcheck.WithEvents{Hub: events},
+		healthcheck.WithWeightsFile{File: weightsFile},
+	)
+	if err != nil {
+		return nil, err
+	}
+	WhenHaveMetricsRegistry(func(reg *prometheus.Registry) {
+		err = reg.Register(m)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "register healthcheck metrics")
+	}
+	go m.Run(ctx)
+	return m, nil
+}
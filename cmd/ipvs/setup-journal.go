@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/journal"
+)
+
+func setupJournal(ctx context.Context) (*journal.Journal, error) {
+	var conf journal.Config
+	var err error
+	if conf.File, err = app.JournalFile.Maybe(ctx); err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	if conf.MaxEntries, err = app.JournalMaxEntries.Maybe(ctx); err != nil {
+		return nil, err
+	}
+	return journal.Open(conf)
+}
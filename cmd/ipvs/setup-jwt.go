@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/jwtauth"
+)
+
+func setupJWT(ctx context.Context) (*jwtauth.Authenticator, error) {
+	var conf jwtauth.Config
+	err := app.JWTConfig.Maybe(ctx, &conf)
+	if errors.Is(err, config.ErrNotFound) || (err == nil && conf.JWKSFile == "" && conf.JWKSURL == "") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var a *jwtauth.Authenticator
+	if a, err = jwtauth.New(conf); err != nil {
+		return nil, err
+	}
+	go a.Run(ctx)
+	return a, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/lease"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+//defLeasesFile leases are kept in unless config tells other file
+const defLeasesFile = "/var/lib/ipvs/leases.json"
+
+func setupLeases(ctx context.Context, adm ipvsAdm.Admin) (*lease.Registry, error) {
+	var conf lease.Config
+	err := app.LeasesConfig.Maybe(ctx, &conf)
+	if errors.Is(err, config.ErrNotFound) || (err == nil && len(conf.VirtualServers) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conf.File == "" {
+		conf.File = defLeasesFile
+	}
+	var reg *lease.Registry
+	if reg, err = lease.NewRegistry(adm, conf); err != nil {
+		return nil, err
+	}
+	WhenHaveMetricsRegistry(func(r *prometheus.Registry) {
+		err = r.Register(reg)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "register lease metrics")
+	}
+	go reg.Run(ctx)
+	return reg, nil
+}
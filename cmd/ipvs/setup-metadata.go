@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/meta"
+)
+
+func setupMetadata(ctx context.Context) (*meta.Store, error) {
+	var conf meta.Config
+	var err error
+	if conf.File, err = app.MetadataFile.Maybe(ctx); err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	return meta.Open(conf)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/notify"
+)
+
+func setupNotify(ctx context.Context) (*notify.Notifier, error) {
+	var conf notify.Config
+	err := app.NotifyConfig.Maybe(ctx, &conf)
+	if errors.Is(err, config.ErrNotFound) || (err == nil && len(conf.Webhooks) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var n *notify.Notifier
+	if n, err = notify.New(conf); err != nil {
+		return nil, err
+	}
+	go n.Run(ctx)
+	return n, nil
+}
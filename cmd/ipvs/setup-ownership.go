@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/ownership"
+)
+
+func setupOwnership(ctx context.Context) (*ownership.Registry, error) {
+	var conf ownership.Config
+	var err error
+	if conf.File, err = app.OwnershipFile.Maybe(ctx); err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, err
+	}
+	if conf.Strict, err = app.OwnershipStrict.Maybe(ctx); err != nil {
+		return nil, err
+	}
+	return ownership.Open(conf)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/policy"
+)
+
+func setupPolicy(ctx context.Context) (*policy.Policy, error) {
+	var conf policy.Config
+	err := app.PolicyConfig.Maybe(ctx, &conf)
+	if errors.Is(err, config.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return policy.New(conf)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/ratelimit"
+)
+
+//setupRateLimit makes limiter of Update* calls; resolvers tell principals callers are told apart by
+func setupRateLimit(ctx context.Context, resolvers ...authz.Resolver) (*ratelimit.Limiter, error) {
+	var conf ratelimit.Config
+	err := app.RateLimitConfig.Maybe(ctx, &conf)
+	if errors.Is(err, config.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conf.Rate == 0 && conf.MaxBatchSize == 0 && len(conf.Overrides) == 0 {
+		return nil, nil
+	}
+	var opts []ratelimit.Option
+	for _, r := range resolvers {
+		opts = append(opts, ratelimit.WithResolver{Resolver: r})
+	}
+	var l *ratelimit.Limiter
+	if l, err = ratelimit.New(conf, opts...); err != nil {
+		return nil, err
+	}
+	WhenHaveMetricsRegistry(func(r *prometheus.Registry) {
+		err = r.Register(l)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "register rate limit metrics")
+	}
+	return l, nil
+}
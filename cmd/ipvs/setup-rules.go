@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/rules"
+)
+
+func setupRules(ctx context.Context) (*rules.RuleSet, error) {
+	var confs []rules.Config
+	err := app.Rules.Maybe(ctx, &confs)
+	if errors.Is(err, config.ErrNotFound) || (err == nil && len(confs) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rules.New(confs)
+}
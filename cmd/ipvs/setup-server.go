@@ -13,6 +13,8 @@ import (
 	serverPrometheusMetrics "github.com/thataway/common-lib/server/metrics/prometheus"
 	serverTracing "github.com/thataway/common-lib/server/trace/ot"
 	"github.com/thataway/ipvs/internal/api/ipvs"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/guard"
 	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
 )
 
@@ -38,8 +40,8 @@ func pprofHandler() http.Handler { //TODO: Maybe it`s better to place 'pprofHand
 	return r
 }
 
-func setupServer(ctx context.Context) (*server.APIServer, error) {
-	service := ipvs.NewIpvsAdminService(ctx, ipvsAdm.NewAdmin(ctx))
+func setupServer(ctx context.Context, adm ipvsAdm.Admin, serviceOpts []ipvs.ServiceOption, g *guard.Guard, extraOpts ...server.APIServerOption) (*server.APIServer, error) {
+	service := ipvs.NewIpvsAdminService(ctx, adm, serviceOpts...)
 	doc, err := ipvs.GetSwaggerDocs()
 	if err != nil {
 		return nil, err
@@ -49,6 +51,11 @@ func setupServer(ctx context.Context) (*server.APIServer, error) {
 		server.WithServices(service),
 		server.WithDocs(doc, ""),
 	}
+	if h := ipvs.NewJournalHandler(service); h != nil {
+		opts = append(opts, server.WithHttpHandler("/journal",
+			g.Handler(h, guard.Methods{http.MethodPost: authz.MethodRollback})))
+	}
+	opts = append(opts, extraOpts...)
 
 	//если есть регистр Прометеуса то - подклчим метрики
 	WhenHaveMetricsRegistry(func(reg *prometheus.Registry) {
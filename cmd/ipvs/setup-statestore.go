@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/statestore"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func setupStateStore(ctx context.Context, adm ipvsAdm.Admin) (*statestore.Store, error) {
+	enable, err := app.StateStoreEnable.Maybe(ctx)
+	if err != nil || !enable {
+		return nil, err
+	}
+	var conf statestore.Config
+	if conf.Dir, err = app.StateStoreDir.Maybe(ctx); err != nil {
+		return nil, err
+	}
+	if conf.CheckInterval, err = app.StateStoreCheckInterval.Maybe(ctx); err != nil {
+		return nil, err
+	}
+	var store *statestore.Store
+	if store, err = statestore.Open(conf); err != nil {
+		return nil, err
+	}
+	replay := !app.SkipStateReplay
+	if !replay {
+		logger.Warn(ctx, "statestore: replay is skipped by command line flag")
+	} else if err = store.Replay(ctx, adm); err != nil {
+		logger.Errorf(ctx, "%v", err)
+	}
+	go store.Run(ctx, adm, replay)
+	return store, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	pkgNet "github.com/thataway/common-lib/pkg/net"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/mtls"
+)
+
+//setupTLS puts mutual TLS front on public endpoint when it is configured;
+//it gives endpoint API server has to listen on
+func setupTLS(ctx context.Context, public *pkgNet.Endpoint) (*pkgNet.Endpoint, error) {
+	var conf mtls.Config
+	var err error
+	if conf.Cert, err = app.ServerTLSCert.Maybe(ctx); errors.Is(err, config.ErrNotFound) || (err == nil && conf.Cert == "") {
+		return public, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conf.Key, err = app.ServerTLSKey.Maybe(ctx); err != nil {
+		return nil, errors.Wrap(err, "server/tls/key")
+	}
+	if conf.ClientCA, err = app.ServerTLSClientCA.Maybe(ctx); err != nil {
+		return nil, errors.Wrap(err, "server/tls/client-ca")
+	}
+	if conf.MinVersion, err = app.ServerTLSMinVersion.Maybe(ctx); err != nil {
+		return nil, err
+	}
+	var reloader *mtls.Reloader
+	if reloader, err = mtls.NewReloader(conf); err != nil {
+		return nil, err
+	}
+	var internalAddr string
+	if internalAddr, err = app.ServerTLSInternalEndpoint.Maybe(ctx); err != nil {
+		return nil, err
+	}
+	var internal *pkgNet.Endpoint
+	if internal, err = pkgNet.ParseEndpoint(internalAddr); err != nil {
+		return nil, err
+	}
+	if !internal.IsUnixDomain() {
+		return nil, errors.Errorf("internal endpoint '%s' must be unix domain socket", internalAddr)
+	}
+	//only owner of directory reaches API behind front
+	sock, _ := internal.Address()
+	if err = os.MkdirAll(filepath.Dir(sock), 0700); err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(filepath.Dir(sock), 0700); err != nil {
+		return nil, err
+	}
+	var front *mtls.Front
+	if front, err = mtls.NewFront(reloader, internal); err != nil {
+		return nil, err
+	}
+	go func() {
+		if e := front.Serve(ctx, public); e != nil {
+			logger.Fatalf(ctx, "serve TLS front: %v", e)
+		}
+	}()
+	return internal, nil
+}
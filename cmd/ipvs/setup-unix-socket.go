@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	pkgNet "github.com/thataway/common-lib/pkg/net"
+	"github.com/thataway/ipvs/internal/app"
+	"github.com/thataway/ipvs/internal/config"
+	"github.com/thataway/ipvs/internal/peercred"
+)
+
+//setupUnixSocket gives additional unix domain socket endpoint if it is configured and sets mode and owner of
+//every unix domain socket API is exposed on; peerAuth tells callers on them are identified by peer credentials
+func setupUnixSocket(ctx context.Context, public, serve *pkgNet.Endpoint) (extra *pkgNet.Endpoint, peerAuth bool, err error) {
+	var addr string
+	if addr, err = app.ServerUnixSocketEndpoint.Maybe(ctx); err != nil && !errors.Is(err, config.ErrNotFound) {
+		return nil, false, err
+	}
+	if addr != "" {
+		if extra, err = pkgNet.ParseEndpoint(addr); err != nil {
+			return nil, false, err
+		}
+		if !extra.IsUnixDomain() {
+			return nil, false, errors.Errorf("endpoint '%s' must be unix domain socket", addr)
+		}
+	}
+	var sockets []*pkgNet.Endpoint
+	if public.IsUnixDomain() {
+		sockets = append(sockets, public)
+	}
+	if extra != nil {
+		sockets = append(sockets, extra)
+	}
+	if len(sockets) == 0 {
+		return nil, false, nil
+	}
+	var conf peercred.SocketConfig
+	conf.Mode, _ = app.ServerUnixSocketMode.Maybe(ctx)
+	conf.Owner, _ = app.ServerUnixSocketOwner.Maybe(ctx)
+	conf.Group, _ = app.ServerUnixSocketGroup.Maybe(ctx)
+	var access peercred.SocketAccess
+	if access, err = conf.Access(); err != nil {
+		return nil, false, err
+	}
+	for _, ep := range sockets {
+		path, _ := ep.Address()
+		stale, _ := os.Stat(path)
+		go func() {
+			if e := access.Apply(ctx, path, stale); e != nil && ctx.Err() == nil {
+				logger.Fatalf(ctx, "set access to socket '%s': %v", path, e)
+			}
+		}()
+	}
+	//behind TLS front public socket is served by front so its callers are not local processes
+	return extra, extra != nil || (serve == public && public.IsUnixDomain()), nil
+}
@@ -0,0 +1,185 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/ipvs/internal/caller"
+)
+
+/*//Sample of config
+admission:
+  webhooks:
+    - name: change-management
+      url: http://127.0.0.1:8088/admit
+      timeout: 2s
+      failure-policy: fail
+*/
+
+//Failure policies of webhook
+const (
+	//FailClosed call is refused when webhook can not be reached
+	FailClosed = "fail"
+
+	//FailOpen call goes on when webhook can not be reached
+	FailOpen = "ignore"
+)
+
+//ErrUnavailable webhook can not be reached and it fails closed
+var ErrUnavailable = errors.New("admission webhook is unavailable")
+
+type (
+	//Config admission config
+	Config struct {
+		Webhooks []WebhookConfig `mapstructure:"webhooks"`
+	}
+
+	//WebhookConfig one admission webhook
+	WebhookConfig struct {
+		Name          string        `mapstructure:"name"`
+		URL           string        `mapstructure:"url"`
+		Timeout       time.Duration `mapstructure:"timeout"`
+		FailurePolicy string        `mapstructure:"failure-policy"`
+	}
+
+	//Review body is POSTed to webhook
+	Review struct {
+		UID        string          `json:"uid"`
+		Method     string          `json:"method"`
+		Caller     string          `json:"caller"`
+		Principals []string        `json:"principals,omitempty"`
+		Request    json.RawMessage `json:"request"`
+	}
+
+	//Verdict webhook answer
+	Verdict struct {
+		UID     string `json:"uid"`
+		Allowed bool   `json:"allowed"`
+		Message string `json:"message,omitempty"`
+	}
+
+	//DeniedError webhook does not approve call
+	DeniedError struct {
+		Webhook string
+		Message string
+	}
+
+	//Controller asks webhooks to approve mutating calls
+	Controller struct {
+		webhooks []WebhookConfig
+		client   *http.Client
+	}
+)
+
+const defTimeout = 5 * time.Second
+
+//New makes admission controller
+func New(conf Config) (*Controller, error) {
+	const api = "admission/New"
+
+	ret := &Controller{client: &http.Client{}}
+	for i, wh := range conf.Webhooks {
+		if wh.Name == "" {
+			return nil, errors.Errorf("%s: webhook #%v has no name", api, i)
+		}
+		u, err := url.Parse(wh.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("%s: webhook '%s' has bad URL '%s'", api, wh.Name, wh.URL)
+		}
+		switch wh.FailurePolicy {
+		case "":
+			wh.FailurePolicy = FailClosed
+		case FailClosed, FailOpen:
+		default:
+			return nil, errors.Errorf("%s: webhook '%s' has unknown failure-policy '%s'", api, wh.Name, wh.FailurePolicy)
+		}
+		if wh.Timeout <= 0 {
+			wh.Timeout = defTimeout
+		}
+		ret.webhooks = append(ret.webhooks, wh)
+	}
+	return ret, nil
+}
+
+//Admit asks every webhook in order to approve call; *DeniedError is returned on first refusal
+func (c *Controller) Admit(ctx context.Context, method string, who caller.Identity, request interface{}) error {
+	const api = "admission/Admit"
+
+	if len(c.webhooks) == 0 {
+		return nil
+	}
+	review := Review{UID: newUID(), Method: method, Caller: who.Address, Principals: who.Principals}
+	var err error
+	if review.Request, err = json.Marshal(request); err != nil {
+		return errors.Wrap(err, api)
+	}
+	var body []byte
+	if body, err = json.Marshal(review); err != nil {
+		return errors.Wrap(err, api)
+	}
+	for _, wh := range c.webhooks {
+		var v Verdict
+		if v, err = c.ask(ctx, wh, body); err != nil {
+			if wh.FailurePolicy == FailOpen {
+				logger.Warnf(ctx, "admission: webhook '%s' is ignored: %v", wh.Name, err)
+				continue
+			}
+			return errors.Wrapf(ErrUnavailable, "%s: webhook '%s': %v", api, wh.Name, err)
+		}
+		if !v.Allowed {
+			return &DeniedError{Webhook: wh.Name, Message: v.Message}
+		}
+	}
+	return nil
+}
+
+func (c *Controller) ask(ctx context.Context, wh WebhookConfig, body []byte) (Verdict, error) {
+	var ret Verdict
+	ctx, cancel := context.WithTimeout(ctx, wh.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return ret, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var resp *http.Response
+	if resp, err = c.client.Do(req); err != nil {
+		return ret, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return ret, errors.Errorf("unexpected status '%s'", resp.Status)
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&ret); err != nil {
+		return ret, errors.Wrap(err, "decode verdict")
+	}
+	return ret, nil
+}
+
+//Error impl error
+func (e *DeniedError) Error() string {
+	msg := "admission webhook '" + e.Webhook + "' denied the request"
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func newUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,97 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thataway/ipvs/internal/caller"
+)
+
+func Test_Admit(t *testing.T) {
+	var reviews []Review
+	approve := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rv Review
+		_ = json.NewDecoder(r.Body).Decode(&rv)
+		reviews = append(reviews, rv)
+		_ = json.NewEncoder(w).Encode(Verdict{UID: rv.UID, Allowed: true})
+	}))
+	defer approve.Close()
+	deny := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Verdict{Allowed: false, Message: "change freeze"})
+	}))
+	defer deny.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	ctx := context.Background()
+	request := map[string]interface{}{"delete": []string{"tcp://10.0.0.1:80"}}
+
+	c, err := New(Config{Webhooks: []WebhookConfig{{Name: "a", URL: approve.URL}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, c.Admit(ctx, "UpdateVirtualServers", caller.Identity{Address: "10.1.1.1", Principals: []string{"mtls:ops"}}, request))
+	if assert.Len(t, reviews, 1) {
+		assert.NotEmpty(t, reviews[0].UID)
+		assert.Equal(t, "UpdateVirtualServers", reviews[0].Method)
+		assert.Equal(t, "10.1.1.1", reviews[0].Caller)
+		assert.Equal(t, []string{"mtls:ops"}, reviews[0].Principals)
+		assert.JSONEq(t, `{"delete":["tcp://10.0.0.1:80"]}`, string(reviews[0].Request))
+	}
+
+	c, err = New(Config{Webhooks: []WebhookConfig{
+		{Name: "a", URL: approve.URL},
+		{Name: "d", URL: deny.URL},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = c.Admit(ctx, "UpdateVirtualServers", caller.Identity{}, request)
+	var denied *DeniedError
+	if assert.True(t, errors.As(err, &denied)) {
+		assert.Equal(t, "d", denied.Webhook)
+		assert.Equal(t, "change freeze", denied.Message)
+	}
+
+	for _, wh := range []WebhookConfig{
+		{Name: "b", URL: broken.URL},
+		{Name: "s", URL: slow.URL, Timeout: 50 * time.Millisecond},
+	} {
+		c, err = New(Config{Webhooks: []WebhookConfig{wh}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, errors.Is(c.Admit(ctx, "UpdateRealServers", caller.Identity{}, request), ErrUnavailable), wh.Name)
+
+		wh.FailurePolicy = FailOpen
+		c, err = New(Config{Webhooks: []WebhookConfig{wh}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, c.Admit(ctx, "UpdateRealServers", caller.Identity{}, request), wh.Name)
+	}
+
+	for _, wh := range []WebhookConfig{
+		{URL: approve.URL},
+		{Name: "a", URL: "unix:///tmp/sock"},
+		{Name: "a", URL: approve.URL, FailurePolicy: "maybe"},
+	} {
+		_, err = New(Config{Webhooks: []WebhookConfig{wh}})
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,36 @@
+package ipvs
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/pkg/jsonview"
+	"github.com/thataway/ipvs/internal/admission"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+)
+
+//admit asks admission webhooks to approve batch is going to be applied
+func (srv *ipvsAdminSrv) admit(ctx context.Context, method string, batch interface{}) error {
+	if srv.admission == nil {
+		return nil
+	}
+	err := srv.admission.Admit(ctx, method, srv.identify(ctx), jsonview.Marshaler(batch))
+	if err == nil {
+		return nil
+	}
+	var denied *admission.DeniedError
+	if errors.As(err, &denied) {
+		return srv.errWithDetails(codes.FailedPrecondition, denied.Error(), &errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{{
+				Type:        "ADMISSION",
+				Subject:     denied.Webhook,
+				Description: denied.Message,
+			}},
+		})
+	}
+	if errors.Is(err, admission.ErrUnavailable) {
+		return srv.errWithDetails(codes.Unavailable, err.Error())
+	}
+	return err
+}
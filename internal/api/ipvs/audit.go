@@ -0,0 +1,262 @@
+package ipvs
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/common-lib/pkg/jsonview"
+	"github.com/thataway/ipvs/internal/audit"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/caller"
+	"github.com/thataway/ipvs/internal/journal"
+	"github.com/thataway/ipvs/internal/jwtauth"
+	"github.com/thataway/ipvs/internal/peercred"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+//auditTx audit record of one mutating call; nil when service has no audit log
+type auditTx struct {
+	log      *audit.Log
+	rec      audit.Record
+	applying bool
+
+	//virtualServer real servers of call belong to
+	virtualServer string
+}
+
+const (
+	auditOpDelete = "delete"
+	auditOpUpdate = "update"
+)
+
+//beginAudit starts audit record of mutating call
+func (srv *ipvsAdminSrv) beginAudit(ctx context.Context, method string, req interface{}) *auditTx {
+	if reached, _ := ctx.Value(reachedKey{}).(*bool); reached != nil {
+		*reached = true
+	}
+	if srv.audit == nil {
+		return nil
+	}
+	tx := &auditTx{log: srv.audit, rec: audit.Record{Method: method, Caller: auditCaller(ctx, srv.audit)}}
+	tx.rec.Request, _ = jsonview.Marshaler(req).MarshalJSON()
+	return tx
+}
+
+//reachedKey call has reached the service and the service audits it by itself
+type reachedKey struct{}
+
+//auditedMethods mutating methods of IpvsAdmin
+var auditedMethods = map[string]bool{
+	"UpdateVirtualServers": true,
+	"UpdateRealServers":    true,
+}
+
+//AuditRefusals makes interceptor writes audit records of mutating calls are refused before they reach
+//the service, like ones authorizer denies; it goes ahead of authorizer
+func AuditRefusals(log *audit.Log) grpc.UnaryServerInterceptor {
+	prefix := "/" + ipvs.IpvsAdmin_ServiceDesc.ServiceName + "/"
+	refused := AuditRefusal(log)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := strings.TrimPrefix(info.FullMethod, prefix)
+		if !strings.HasPrefix(info.FullMethod, prefix) || !auditedMethods[method] {
+			return handler(ctx, req)
+		}
+		reached := new(bool)
+		resp, err := handler(context.WithValue(ctx, reachedKey{}, reached), req)
+		if err != nil && !*reached {
+			refused(ctx, method, req, err)
+		}
+		return resp, err
+	}
+}
+
+//AuditRefusal makes func writes audit record of mutating call is refused before it reaches the service
+func AuditRefusal(log *audit.Log) func(ctx context.Context, method string, req interface{}, err error) {
+	return func(ctx context.Context, method string, req interface{}, err error) {
+		rec := audit.Record{
+			Method: method,
+			Caller: auditCaller(ctx, log),
+			Code:   status.Code(err).String(),
+			Error:  err.Error(),
+		}
+		rec.Request, _ = jsonview.Marshaler(req).MarshalJSON()
+		if e := log.Write(ctx, rec); e != nil {
+			logger.Errorf(ctx, "audit '%s': %v", method, e)
+		}
+	}
+}
+
+func auditCaller(ctx context.Context, log *audit.Log) audit.Caller {
+	ret := audit.Caller{Address: caller.Address(ctx), Principals: log.Principals(ctx)}
+	if g := authz.GrantsFrom(ctx); g != nil {
+		ret.Roles = g.Roles()
+	}
+	if claims := jwtauth.ClaimsFrom(ctx); claims != nil {
+		ret.Claims, _ = json.Marshal(claims)
+	}
+	if info, ok := peercred.FromContext(ctx); ok {
+		ret.Peer = &audit.Peer{UID: info.UID, GID: info.GID, PID: info.PID}
+	}
+	return ret
+}
+
+//plan items call is going to apply
+func (tx *auditTx) plan(op, virtualServer string, realServers ...string) {
+	if tx == nil {
+		return
+	}
+	if len(realServers) == 0 {
+		tx.rec.Items = append(tx.rec.Items, audit.Item{Op: op, VirtualServer: virtualServer})
+	}
+	for _, rs := range realServers {
+		tx.rec.Items = append(tx.rec.Items, audit.Item{Op: op, VirtualServer: virtualServer, RealServer: rs})
+	}
+}
+
+//apply marks items are being applied; failure after it may leave some of them applied
+func (tx *auditTx) apply() {
+	if tx != nil {
+		tx.applying = true
+	}
+}
+
+//issue marks item as not applied with reason; item is added if it is not planned
+func (tx *auditTx) issue(op, virtualServer, realServer string, reason *ipvs.IssueReason) {
+	if tx == nil {
+		return
+	}
+	for i := range tx.rec.Items {
+		it := &tx.rec.Items[i]
+		if it.Op == op && it.VirtualServer == virtualServer && it.RealServer == realServer {
+			it.Outcome, it.Reason = audit.OutcomeIssue, reason.GetMessage()
+			return
+		}
+	}
+	tx.rec.Items = append(tx.rec.Items, audit.Item{
+		Op:            op,
+		VirtualServer: virtualServer,
+		RealServer:    realServer,
+		Outcome:       audit.OutcomeIssue,
+		Reason:        reason.GetMessage(),
+	})
+}
+
+//end writes record with outcome of call
+func (tx *auditTx) end(ctx context.Context, issues interface{}, err error) {
+	if tx == nil {
+		return
+	}
+	outcome := audit.OutcomeApplied
+	if err != nil {
+		outcome = audit.OutcomeRejected
+		if tx.applying {
+			outcome = audit.OutcomeFailed
+		}
+		tx.rec.Error = err.Error()
+	}
+	switch t := issues.(type) {
+	case []*ipvs.VirtualServerIssue:
+		if len(t) > 0 {
+			tx.virtualServerIssues(t)
+			tx.rec.Issues, _ = jsonview.Marshaler(t).MarshalJSON()
+		}
+	case []*ipvs.RealServerIssue:
+		if len(t) > 0 {
+			tx.realServerIssues(t)
+			tx.rec.Issues, _ = jsonview.Marshaler(t).MarshalJSON()
+		}
+	}
+	for i := range tx.rec.Items {
+		if tx.rec.Items[i].Outcome == "" {
+			tx.rec.Items[i].Outcome = outcome
+		}
+	}
+	tx.rec.Code = status.Code(err).String()
+	if e := tx.log.Write(ctx, tx.rec); e != nil {
+		logger.Errorf(ctx, "audit '%s': %v", tx.rec.Method, e)
+	}
+}
+
+//auditVirtualServers plans virtual servers and marks those with issues
+func (tx *auditTx) auditVirtualServers(del []*ipvs.VirtualServerIdentity, upd []*ipvs.VirtualServer, issues []*ipvs.VirtualServerIssue) {
+	if tx == nil {
+		return
+	}
+	for _, d := range del {
+		tx.plan(auditOpDelete, vsString(d))
+	}
+	for _, u := range upd {
+		tx.plan(auditOpUpdate, vsString(u.GetIdentity()))
+	}
+	tx.virtualServerIssues(issues)
+}
+
+func (tx *auditTx) virtualServerIssues(issues []*ipvs.VirtualServerIssue) {
+	for _, iss := range issues {
+		if d := iss.GetDelete(); d != nil {
+			tx.issue(auditOpDelete, vsString(d), "", iss.GetReason())
+		} else {
+			tx.issue(auditOpUpdate, vsString(iss.GetUpdate().GetIdentity()), "", iss.GetReason())
+		}
+	}
+}
+
+//auditRealServers plans real servers and marks those with issues
+func (tx *auditTx) auditRealServers(vs *ipvs.VirtualServerIdentity, del []*ipvs.RealServerAddress, upd []*ipvs.RealServer, issues []*ipvs.RealServerIssue) {
+	if tx == nil {
+		return
+	}
+	tx.virtualServer = vsString(vs)
+	for _, d := range del {
+		tx.plan(auditOpDelete, tx.virtualServer, rsString(d))
+	}
+	for _, u := range upd {
+		tx.plan(auditOpUpdate, tx.virtualServer, rsString(u.GetAddress()))
+	}
+	tx.realServerIssues(issues)
+}
+
+func (tx *auditTx) realServerIssues(issues []*ipvs.RealServerIssue) {
+	virtualServer := tx.virtualServer
+	for _, iss := range issues {
+		if d := iss.GetDelete(); d != nil {
+			tx.issue(auditOpDelete, virtualServer, rsString(d), iss.GetReason())
+		} else {
+			tx.issue(auditOpUpdate, virtualServer, rsString(iss.GetUpdate().GetAddress()), iss.GetReason())
+		}
+	}
+}
+
+//auditRollback records rollback of journal with changes it has made
+func (srv *ipvsAdminSrv) auditRollback(ctx context.Context, revision uint64, entry journal.Entry, err error) {
+	tx := srv.beginAudit(ctx, "Rollback", struct {
+		Revision uint64 `json:"revision"`
+	}{revision})
+	if tx == nil {
+		return
+	}
+	tx.apply()
+	for _, c := range entry.Changes {
+		tx.rec.Items = append(tx.rec.Items, audit.Item{Op: c.Op, VirtualServer: c.VirtualServer, RealServer: c.RealServer})
+	}
+	tx.end(ctx, nil, err)
+}
+
+func vsString(id *ipvs.VirtualServerIdentity) string {
+	var conv VirtualServerIdentityConv
+	if conv.FromPb(id) != nil {
+		return jsonview.Stringer(id).String()
+	}
+	return ipvsAdm.IdentityString(conv.Identity)
+}
+
+func rsString(a *ipvs.RealServerAddress) string {
+	return net.JoinHostPort(a.GetHost(), strconv.Itoa(int(a.GetPort())))
+}
@@ -0,0 +1,35 @@
+package ipvs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/thataway/ipvs/internal/authz"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+//granted tells if virtual server is in scope of roles caller is granted; true if authorization is off
+func (srv *ipvsAdminSrv) granted(ctx context.Context, identity ipvsAdm.VirtualServerIdentity) bool {
+	return authz.GrantsFrom(ctx).Allows(identity, func(sel labels.Selector) bool {
+		return srv.matches(sel, identity, "")
+	})
+}
+
+//checkGrants refuses call if it touches virtual servers are out of scope of roles caller is granted
+func (srv *ipvsAdminSrv) checkGrants(ctx context.Context, identities ...ipvsAdm.VirtualServerIdentity) error {
+	g := authz.GrantsFrom(ctx)
+	if g == nil {
+		return nil
+	}
+	var out []string
+	for _, identity := range identities {
+		if !srv.granted(ctx, identity) {
+			out = append(out, ipvsAdm.IdentityString(identity))
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return g.Deny(ctx, "virtual server(s) "+strings.Join(out, ", ")+" are out of scope of roles "+strings.Join(g.Roles(), ", "))
+}
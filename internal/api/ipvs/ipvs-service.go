@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"net/url"
-	"runtime"
 	"strconv"
 	"sync"
 
@@ -16,6 +15,15 @@ import (
 	"github.com/thataway/common-lib/pkg/jsonview"
 	"github.com/thataway/common-lib/pkg/parallel"
 	"github.com/thataway/common-lib/server"
+	"github.com/thataway/ipvs/internal/admission"
+	"github.com/thataway/ipvs/internal/audit"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/journal"
+	"github.com/thataway/ipvs/internal/meta"
+	"github.com/thataway/ipvs/internal/ownership"
+	"github.com/thataway/ipvs/internal/policy"
+	"github.com/thataway/ipvs/internal/ratelimit"
+	"github.com/thataway/ipvs/internal/rules"
 	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
 	apiUtils "github.com/thataway/protos/pkg/api"
 	"github.com/thataway/protos/pkg/api/ipvs"
@@ -25,18 +33,115 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
+type (
+	//ServiceOption option of ipvs admin service
+	ServiceOption interface {
+		isServiceOption()
+	}
+
+	//WithJournal records mutating calls into journal
+	WithJournal struct {
+		*journal.Journal
+	}
+
+	//WithOwnership protects virtual servers are not created by this service
+	WithOwnership struct {
+		*ownership.Registry
+	}
+
+	//WithMetadata labels and annotations of virtual and real servers; selectors match their labels
+	WithMetadata struct {
+		*meta.Store
+	}
+
+	//WithPolicy guardrails are checked before changes are applied
+	WithPolicy struct {
+		*policy.Policy
+	}
+
+	//WithRules CEL rules are checked before changes are applied; failed changes are reported as issues
+	WithRules struct {
+		*rules.RuleSet
+	}
+
+	//WithAdmission webhooks are to approve batch before it is applied
+	WithAdmission struct {
+		*admission.Controller
+	}
+
+	//WithAudit every mutating call is recorded to audit log
+	WithAudit struct {
+		*audit.Log
+	}
+
+	//WithResolver adds resolver of caller principals are recorded to journal and told to admission webhooks
+	WithResolver struct {
+		authz.Resolver
+	}
+
+	//WithRateLimit limits rate and batch size of Update* calls of every caller; batches are counted
+	//after delete selectors are expanded
+	WithRateLimit struct {
+		*ratelimit.Limiter
+	}
+)
+
+func (WithJournal) isServiceOption() {}
+
+func (WithOwnership) isServiceOption() {}
+
+func (WithMetadata) isServiceOption() {}
+
+func (WithPolicy) isServiceOption() {}
+
+func (WithRules) isServiceOption() {}
+
+func (WithAdmission) isServiceOption() {}
+
+func (WithAudit) isServiceOption() {}
+
+func (WithResolver) isServiceOption() {}
+
+func (WithRateLimit) isServiceOption() {}
+
 //NewIpvsAdminService creates roure service
-func NewIpvsAdminService(ctx context.Context, adm ipvsAdm.Admin) server.APIService {
+func NewIpvsAdminService(ctx context.Context, adm ipvsAdm.Admin, opts ...ServiceOption) server.APIService {
 	ret := &ipvsAdminSrv{
 		appCtx: ctx,
-		sema:   make(chan struct{}, 1),
 		admin:  adm,
+		locks:  newTableLocks(),
+	}
+	for _, o := range opts {
+		switch t := o.(type) {
+		case WithJournal:
+			ret.journal = t.Journal
+		case WithOwnership:
+			ret.owners = t.Registry
+		case WithMetadata:
+			ret.meta = t.Store
+		case WithPolicy:
+			ret.policy = t.Policy
+		case WithRules:
+			ret.rules = t.RuleSet
+		case WithAdmission:
+			ret.admission = t.Controller
+		case WithAudit:
+			ret.audit = t.Log
+		case WithResolver:
+			ret.resolvers = append(ret.resolvers, t.Resolver)
+		case WithRateLimit:
+			ret.limiter = t.Limiter
+		}
+	}
+	if ret.meta != nil {
+		ret.admin = ret.meta.Admin(ret.admin)
+	}
+	if ret.journal != nil {
+		ret.admin = ret.journal.Admin(ret.admin)
 	}
-	runtime.SetFinalizer(ret, func(o *ipvsAdminSrv) {
-		close(o.sema)
-	})
 	return ret
 }
 
@@ -51,9 +156,19 @@ var (
 
 type ipvsAdminSrv struct {
 	ipvs.UnimplementedIpvsAdminServer
-	appCtx context.Context
-	admin  ipvsAdm.Admin
-	sema   chan struct{}
+	appCtx  context.Context
+	admin   ipvsAdm.Admin
+	locks   *tableLocks
+	journal *journal.Journal
+	owners  *ownership.Registry
+	meta    *meta.Store
+	policy  *policy.Policy
+	rules   *rules.RuleSet
+
+	admission *admission.Controller
+	audit     *audit.Log
+	resolvers []authz.Resolver
+	limiter   *ratelimit.Limiter
 }
 
 //Description impl server.APIService
@@ -92,9 +207,22 @@ func (srv *ipvsAdminSrv) ListVirtualServers(ctx context.Context, req *ipvs.ListV
 		}
 	)
 	var ids []mT
+	var listed []ipvsAdm.VirtualServerIdentity
+	var sel labels.Selector
+	if sel, err = srv.selectorFrom(ctx, SelectorMetadata); err != nil {
+		return
+	}
 	includeReals := req.GetIncludeReals()
+	var leave func()
+	if leave, err = srv.enterRead(ctx); err != nil {
+		return
+	}
+	defer leave()
 	resp = new(ipvs.ListVirtualServersResponse)
 	err = srv.admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		if !srv.matches(sel, vs.Identity, "") || !srv.granted(ctx, vs.Identity) {
+			return nil
+		}
 		v, e := VirtualServerConv{VirtualServer: vs}.ToPb()
 		if e != nil {
 			return e
@@ -103,6 +231,7 @@ func (srv *ipvsAdminSrv) ListVirtualServers(ctx context.Context, req *ipvs.ListV
 			VirtualServer: v,
 		}
 		resp.VirtualServers = append(resp.VirtualServers, item)
+		listed = append(listed, vs.Identity)
 		if includeReals {
 			ids = append(ids, mT{keyT: vs.Identity, itemT: item})
 		}
@@ -111,9 +240,15 @@ func (srv *ipvsAdminSrv) ListVirtualServers(ctx context.Context, req *ipvs.ListV
 	if err != nil {
 		return
 	}
+	srv.reportOwners(ctx, listed...)
 	err = parallel.ExecAbstract(len(ids), 10, func(i int) error {
 		k := ids[i]
 		item := k.itemT
+		unlock, e := srv.readVirtualServer(ctx, k.keyT)
+		if e != nil {
+			return e
+		}
+		defer unlock()
 		return srv.admin.ListRealServers(ctx, k.keyT, func(rs ipvsAdm.RealServer) error {
 			c, e := RealServerConv{RealServer: rs}.ToPb()
 			if e != nil {
@@ -144,6 +279,14 @@ func (srv *ipvsAdminSrv) FindVirtualServer(ctx context.Context, req *ipvs.FindVi
 		err = srv.errWithDetails(codes.InvalidArgument, err.Error(), identity)
 		return
 	}
+	if err = srv.checkGrants(ctx, conv.Identity); err != nil {
+		return
+	}
+	var leave func()
+	if leave, err = srv.enterRead(ctx, conv.Identity); err != nil {
+		return
+	}
+	defer leave()
 	errSuccess := errors.New("1")
 	err = srv.admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
 		if !ipvsAdm.IsIdentitiesEq(vs.Identity, conv.Identity) {
@@ -173,6 +316,7 @@ func (srv *ipvsAdminSrv) FindVirtualServer(ctx context.Context, req *ipvs.FindVi
 	if err != nil {
 		if errors.Is(err, errSuccess) {
 			err = nil
+			srv.reportOwners(ctx, conv.Identity)
 		}
 		return
 	}
@@ -185,12 +329,17 @@ func (srv *ipvsAdminSrv) FindVirtualServer(ctx context.Context, req *ipvs.FindVi
 //UpdateVirtualServers impl service
 func (srv *ipvsAdminSrv) UpdateVirtualServers(ctx context.Context, req *ipvs.UpdateVirtualServersRequest) (resp *ipvs.UpdateVirtualServersResponse, err error) {
 	var leave func()
-	if leave, err = srv.enter(ctx); err != nil {
+	if leave, err = srv.enterVirtualServers(ctx, req); err != nil {
 		return
 	}
+	var commit func(error)
+	ctx, commit = srv.beginJournal(ctx, "UpdateVirtualServers", req)
+	tx := srv.beginAudit(ctx, "UpdateVirtualServers", req)
 	defer func() {
+		commit(err)
 		leave()
 		err = srv.correctError(err)
+		tx.end(ctx, resp.GetIssues(), err)
 	}()
 	var mx sync.Mutex
 	seen := make(map[string]bool)
@@ -212,8 +361,46 @@ func (srv *ipvsAdminSrv) UpdateVirtualServers(ctx context.Context, req *ipvs.Upd
 		attribute.Bool("force-upsert", forceUpsert),
 	)
 
-	resp = new(ipvs.UpdateVirtualServersResponse)
-	if del := req.GetDelete(); len(del) > 0 {
+	var scope labels.Selector
+	if scope, err = srv.selectorFrom(ctx, SelectorMetadata); err != nil {
+		return
+	}
+	var toDelete []*ipvs.VirtualServerIdentity
+	if toDelete, err = srv.deleteVirtualServersBySelector(ctx, req.GetDelete()); err != nil {
+		return
+	}
+	if err = srv.limit(ctx, "UpdateVirtualServers", len(toDelete)+len(req.GetUpdate())); err != nil {
+		return
+	}
+	touched := touchedVirtualServers(toDelete, req.GetUpdate())
+	if err = srv.checkScope(scope, touched...); err != nil {
+		return
+	}
+	if err = srv.checkGrants(ctx, touched...); err != nil {
+		return
+	}
+	if err = srv.checkOwnership(ctx, touched...); err != nil {
+		return
+	}
+	if err = srv.checkVirtualServersPolicy(ctx, toDelete, req.GetUpdate(), forceUpsert); err != nil {
+		return
+	}
+	var toUpdate []*ipvs.VirtualServer
+	var ruleIssues []*ipvs.VirtualServerIssue
+	if toDelete, toUpdate, ruleIssues, err = srv.checkVirtualServersRules(ctx, toDelete, req.GetUpdate()); err != nil {
+		return
+	}
+	tx.auditVirtualServers(toDelete, toUpdate, ruleIssues)
+	if len(toDelete)+len(toUpdate) > 0 {
+		batch := &ipvs.UpdateVirtualServersRequest{Delete: toDelete, Update: toUpdate, ForceUpsert: forceUpsert}
+		if err = srv.admit(ctx, "UpdateVirtualServers", batch); err != nil {
+			return
+		}
+	}
+	tx.apply()
+
+	resp = &ipvs.UpdateVirtualServersResponse{Issues: ruleIssues}
+	if del := toDelete; len(del) > 0 {
 		srv.addSpanDbgEvent(ctx, span, "delete", trace.WithAttributes(
 			attribute.Stringer("virtual-servers", jsonview.Stringer(del)),
 		))
@@ -237,7 +424,7 @@ func (srv *ipvsAdminSrv) UpdateVirtualServers(ctx context.Context, req *ipvs.Upd
 			return
 		}
 	}
-	if upd := req.GetUpdate(); len(upd) > 0 {
+	if upd := toUpdate; len(upd) > 0 {
 		srv.addSpanDbgEvent(ctx, span, "update", trace.WithAttributes(
 			attribute.Stringer("virtual-servers", jsonview.Stringer(upd)),
 		))
@@ -267,12 +454,18 @@ func (srv *ipvsAdminSrv) UpdateVirtualServers(ctx context.Context, req *ipvs.Upd
 //UpdateRealServers impl service
 func (srv *ipvsAdminSrv) UpdateRealServers(ctx context.Context, req *ipvs.UpdateRealServersRequest) (resp *ipvs.UpdateRealServersResponse, err error) {
 	var leave func()
-	if leave, err = srv.enter(ctx); err != nil {
+	vsID := req.GetVirtualServerIdentity()
+	if leave, err = srv.enter(ctx, touchedVirtualServers([]*ipvs.VirtualServerIdentity{vsID}, nil)...); err != nil {
 		return
 	}
+	var commit func(error)
+	ctx, commit = srv.beginJournal(ctx, "UpdateRealServers", req)
+	tx := srv.beginAudit(ctx, "UpdateRealServers", req)
 	defer func() {
+		commit(err)
 		leave()
 		err = srv.correctError(err)
+		tx.end(ctx, resp.GetIssues(), err)
 	}()
 
 	var mx sync.Mutex
@@ -288,7 +481,6 @@ func (srv *ipvsAdminSrv) UpdateRealServers(ctx context.Context, req *ipvs.Update
 		return ret
 	}
 	forceUpsert := req.GetForceUpsert()
-	vsID := req.GetVirtualServerIdentity()
 
 	span := trace.SpanFromContext(ctx)
 	span.SetAttributes(
@@ -303,9 +495,45 @@ func (srv *ipvsAdminSrv) UpdateRealServers(ctx context.Context, req *ipvs.Update
 		err = srv.errWithDetails(codes.InvalidArgument, err.Error(), vsID)
 		return
 	}
+	var scope labels.Selector
+	if scope, err = srv.selectorFrom(ctx, SelectorMetadata); err != nil {
+		return
+	}
+	if err = srv.checkScope(scope, vsIDConv.Identity); err != nil {
+		return
+	}
+	if err = srv.checkGrants(ctx, vsIDConv.Identity); err != nil {
+		return
+	}
+	if err = srv.checkOwnership(ctx, vsIDConv.Identity); err != nil {
+		return
+	}
+	var toDelete []*ipvs.RealServerAddress
+	if toDelete, err = srv.deleteRealServersBySelector(ctx, vsIDConv.Identity, req.GetDelete()); err != nil {
+		return
+	}
+	if err = srv.limit(ctx, "UpdateRealServers", len(toDelete)+len(req.GetUpdate())); err != nil {
+		return
+	}
+	if err = srv.checkRealServersPolicy(ctx, vsIDConv.Identity, toDelete, req.GetUpdate(), forceUpsert); err != nil {
+		return
+	}
+	var toUpdate []*ipvs.RealServer
+	var ruleIssues []*ipvs.RealServerIssue
+	if toDelete, toUpdate, ruleIssues, err = srv.checkRealServersRules(ctx, vsIDConv.Identity, toDelete, req.GetUpdate(), forceUpsert); err != nil {
+		return
+	}
+	tx.auditRealServers(vsID, toDelete, toUpdate, ruleIssues)
+	if len(toDelete)+len(toUpdate) > 0 {
+		batch := &ipvs.UpdateRealServersRequest{VirtualServerIdentity: vsID, Delete: toDelete, Update: toUpdate, ForceUpsert: forceUpsert}
+		if err = srv.admit(ctx, "UpdateRealServers", batch); err != nil {
+			return
+		}
+	}
+	tx.apply()
 
-	resp = new(ipvs.UpdateRealServersResponse)
-	if del := req.GetDelete(); len(del) > 0 {
+	resp = &ipvs.UpdateRealServersResponse{Issues: ruleIssues}
+	if del := toDelete; len(del) > 0 {
 		srv.addSpanDbgEvent(ctx, span, "delete", trace.WithAttributes(
 			attribute.Stringer("real-servers", jsonview.Stringer(del)),
 		))
@@ -329,7 +557,7 @@ func (srv *ipvsAdminSrv) UpdateRealServers(ctx context.Context, req *ipvs.Update
 			return
 		}
 	}
-	if upd := req.GetUpdate(); len(upd) > 0 {
+	if upd := toUpdate; len(upd) > 0 {
 		srv.addSpanDbgEvent(ctx, span, "update", trace.WithAttributes(
 			attribute.Stringer("real-servers", jsonview.Stringer(upd)),
 		))
@@ -482,25 +710,6 @@ func (srv *ipvsAdminSrv) correctError(err error) error {
 	return err
 }
 
-func (srv *ipvsAdminSrv) enter(ctx context.Context) (leave func(), err error) {
-	select {
-	case <-srv.appCtx.Done():
-		err = srv.appCtx.Err()
-	case <-ctx.Done():
-		err = ctx.Err()
-	case srv.sema <- struct{}{}:
-		var o sync.Once
-		leave = func() {
-			o.Do(func() {
-				<-srv.sema
-			})
-		}
-		return
-	}
-	err = status.FromContextError(err).Err()
-	return
-}
-
 func (srv *ipvsAdminSrv) ifReason(err error) *ipvs.IssueReason {
 	if err == nil {
 		return nil
@@ -0,0 +1,695 @@
+package ipvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thataway/ipvs/internal/admission"
+	"github.com/thataway/ipvs/internal/audit"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/caller"
+	"github.com/thataway/ipvs/internal/journal"
+	"github.com/thataway/ipvs/internal/meta"
+	"github.com/thataway/ipvs/internal/ownership"
+	"github.com/thataway/ipvs/internal/policy"
+	"github.com/thataway/ipvs/internal/ratelimit"
+	"github.com/thataway/ipvs/internal/rules"
+	"github.com/thataway/ipvs/internal/statestore"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func Test_Ownership(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "ownership")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	reg, err := ownership.Open(ownership.Config{File: filepath.Join(dir, "owned.json"), Strict: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	foreign, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.2:80")
+	assert.NoError(t, kernel.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: foreign, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	srv := NewIpvsAdminService(ctx, reg.Admin(kernel), WithOwnership{Registry: reg}).(*ipvsAdminSrv)
+
+	own, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	ownPb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: own, ScheduleMethod: "rr"}}.ToPb()
+	foreignPb, _ := VirtualServerIdentityConv{Identity: foreign}.ToPb()
+	_, err = srv.UpdateVirtualServers(ctx, &ipvs.UpdateVirtualServersRequest{
+		Update:      []*ipvs.VirtualServer{ownPb},
+		ForceUpsert: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ownership.OwnerSelf, reg.Owner(own))
+
+	req := &ipvs.UpdateVirtualServersRequest{Delete: []*ipvs.VirtualServerIdentity{foreignPb}}
+	_, err = srv.UpdateVirtualServers(ctx, req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	ctxOverride := metadata.NewIncomingContext(ctx, metadata.Pairs(OverrideOwnershipMetadata, "true"))
+	_, err = srv.UpdateVirtualServers(ctxOverride, req)
+	assert.NoError(t, err)
+}
+
+func Test_Selectors(t *testing.T) {
+	ctx := context.Background()
+	md, err := meta.Open(meta.Config{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	srv := NewIpvsAdminService(ctx, kernel, WithMetadata{Store: md}).(*ipvsAdminSrv)
+	var pbs []*ipvs.VirtualServer
+	for _, s := range []string{"tcp://10.0.0.1:80", "tcp://10.0.0.2:80", "tcp://10.0.0.3:80"} {
+		identity, _ := ipvsAdm.ParseVirtualServerIdentity(s)
+		pb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}}.ToPb()
+		pbs = append(pbs, pb)
+	}
+	_, err = srv.UpdateVirtualServers(ctx, &ipvs.UpdateVirtualServersRequest{Update: pbs, ForceUpsert: true})
+	assert.NoError(t, err)
+	_, _ = md.Set(meta.Item{VirtualServer: "tcp://10.0.0.1:80", Labels: map[string]string{"env": "prod"}})
+	_, _ = md.Set(meta.Item{VirtualServer: "tcp://10.0.0.2:80", Labels: map[string]string{"env": "stage"}})
+	_, _ = md.Set(meta.Item{VirtualServer: "tcp://10.0.0.3:80", Labels: map[string]string{"env": "stage"}})
+	withMD := func(kv ...string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(kv...))
+	}
+
+	resp, err := srv.ListVirtualServers(withMD(SelectorMetadata, "env=prod"), &ipvs.ListVirtualServersRequest{})
+	if assert.NoError(t, err) {
+		assert.Len(t, resp.GetVirtualServers(), 1)
+	}
+	_, err = srv.ListVirtualServers(withMD(SelectorMetadata, "env in ("), &ipvs.ListVirtualServersRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	//scope refuses the whole batch
+	_, err = srv.UpdateVirtualServers(withMD(SelectorMetadata, "env=stage"), &ipvs.UpdateVirtualServersRequest{Update: pbs})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	//batch is limited once delete selector is expanded
+	limiter, err := ratelimit.New(ratelimit.Config{Limits: ratelimit.Limits{MaxBatchSize: 1}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	limited := NewIpvsAdminService(ctx, kernel, WithMetadata{Store: md}, WithRateLimit{Limiter: limiter}).(*ipvsAdminSrv)
+	_, err = limited.UpdateVirtualServers(withMD(DeleteSelectorMetadata, "env=stage"), &ipvs.UpdateVirtualServersRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	//bulk delete
+	_, err = srv.UpdateVirtualServers(withMD(DeleteSelectorMetadata, "env=stage"), &ipvs.UpdateVirtualServersRequest{})
+	assert.NoError(t, err)
+	resp, err = srv.ListVirtualServers(ctx, &ipvs.ListVirtualServersRequest{})
+	if assert.NoError(t, err) && assert.Len(t, resp.GetVirtualServers(), 1) {
+		assert.Len(t, md.List(nil, ""), 1)
+	}
+}
+
+func Test_Policy(t *testing.T) {
+	ctx := context.Background()
+	pol, err := policy.New(policy.Config{
+		VirtualServerCIDRs: []string{"10.0.0.0/24"},
+		PacketForwarders:   []string{"dr"},
+		MaxRealServers:     1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := NewIpvsAdminService(ctx, ipvsAdm.NewMemoryAdmin(), WithPolicy{Policy: pol}).(*ipvsAdminSrv)
+	vs := func(s string) *ipvs.VirtualServer {
+		identity, _ := ipvsAdm.ParseVirtualServerIdentity(s)
+		pb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}}.ToPb()
+		return pb
+	}
+	rs := func(addr string, pf ipvsAdm.PacketForwarder) *ipvs.RealServer {
+		pb, _ := RealServerConv{RealServer: ipvsAdm.RealServer{Address: ipvsAdm.Address(addr), PacketForwarder: pf}}.ToPb()
+		return pb
+	}
+	_, err = srv.UpdateVirtualServers(ctx, &ipvs.UpdateVirtualServersRequest{
+		Update: []*ipvs.VirtualServer{vs("tcp://10.0.0.1:80"), vs("tcp://10.1.0.1:80")}, ForceUpsert: true,
+	})
+	if assert.Equal(t, codes.InvalidArgument, status.Code(err)) {
+		assert.Len(t, status.Convert(err).Details(), 1)
+	}
+	_, err = srv.UpdateVirtualServers(ctx, &ipvs.UpdateVirtualServersRequest{
+		Update: []*ipvs.VirtualServer{vs("tcp://10.0.0.1:80")}, ForceUpsert: true,
+	})
+	assert.NoError(t, err)
+	identity := vs("tcp://10.0.0.1:80").GetIdentity()
+	_, err = srv.UpdateRealServers(ctx, &ipvs.UpdateRealServersRequest{
+		VirtualServerIdentity: identity,
+		Update:                []*ipvs.RealServer{rs("10.0.1.1:80", "nat")},
+		ForceUpsert:           true,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = srv.UpdateRealServers(ctx, &ipvs.UpdateRealServersRequest{
+		VirtualServerIdentity: identity,
+		Update:                []*ipvs.RealServer{rs("10.0.1.1:80", "dr"), rs("10.0.1.2:80", "dr")},
+		ForceUpsert:           true,
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = srv.UpdateRealServers(ctx, &ipvs.UpdateRealServersRequest{
+		VirtualServerIdentity: identity,
+		Update:                []*ipvs.RealServer{rs("10.0.1.1:80", "dr")},
+		ForceUpsert:           true,
+	})
+	assert.NoError(t, err)
+
+	//limit of virtual servers does not count foreign ones
+	if pol, err = policy.New(policy.Config{MaxVirtualServers: 1}); !assert.NoError(t, err) {
+		return
+	}
+	owners, _ := ownership.Open(ownership.Config{})
+	kernel := ipvsAdm.NewMemoryAdmin()
+	foreign, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.9:80")
+	assert.NoError(t, kernel.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: foreign, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	srv = NewIpvsAdminService(ctx, owners.Admin(kernel),
+		WithPolicy{Policy: pol}, WithOwnership{Registry: owners}).(*ipvsAdminSrv)
+	_, err = srv.UpdateVirtualServers(ctx, &ipvs.UpdateVirtualServersRequest{
+		Update: []*ipvs.VirtualServer{vs("tcp://10.0.0.1:80")}, ForceUpsert: true,
+	})
+	assert.NoError(t, err)
+	_, err = srv.UpdateVirtualServers(ctx, &ipvs.UpdateVirtualServersRequest{
+		Update: []*ipvs.VirtualServer{vs("tcp://10.0.0.2:80")}, ForceUpsert: true,
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func Test_Rules(t *testing.T) {
+	ctx := context.Background()
+	rs, err := rules.New([]rules.Config{
+		{Name: "no-privileged-ports", Target: rules.TargetVirtualServer, Expression: `op == "delete" || virtualServer.port >= 1024`},
+		{Name: "weights-sum-100", Target: rules.TargetRealServer, Expression: `totalWeight == 100`, Message: "weights must sum to 100"},
+		{Name: "dr-only", Target: rules.TargetRealServer, Expression: `op == "delete" || realServer.packetForwarder == "dr"`},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := NewIpvsAdminService(ctx, ipvsAdm.NewMemoryAdmin(), WithRules{RuleSet: rs}).(*ipvsAdminSrv)
+	vs := func(s string) *ipvs.VirtualServer {
+		identity, _ := ipvsAdm.ParseVirtualServerIdentity(s)
+		pb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}}.ToPb()
+		return pb
+	}
+	rsFwd := func(addr string, w uint32, fwd ipvsAdm.PacketForwarder) *ipvs.RealServer {
+		pb, _ := RealServerConv{RealServer: ipvsAdm.RealServer{Address: ipvsAdm.Address(addr), PacketForwarder: fwd, Weight: w}}.ToPb()
+		return pb
+	}
+	rsPb := func(addr string, w uint32) *ipvs.RealServer {
+		return rsFwd(addr, w, "dr")
+	}
+	resp, err := srv.UpdateVirtualServers(ctx, &ipvs.UpdateVirtualServersRequest{
+		Update: []*ipvs.VirtualServer{vs("tcp://10.0.0.1:8080"), vs("tcp://10.0.0.1:80")}, ForceUpsert: true,
+	})
+	if assert.NoError(t, err) && assert.Len(t, resp.GetIssues(), 1) {
+		assert.Contains(t, resp.GetIssues()[0].GetReason().GetMessage(), "no-privileged-ports")
+	}
+	identity := vs("tcp://10.0.0.1:8080").GetIdentity()
+	resp2, err := srv.UpdateRealServers(ctx, &ipvs.UpdateRealServersRequest{
+		VirtualServerIdentity: identity,
+		Update:                []*ipvs.RealServer{rsPb("10.0.1.1:80", 50), rsPb("10.0.1.2:80", 40)},
+		ForceUpsert:           true,
+	})
+	if assert.NoError(t, err) {
+		assert.Len(t, resp2.GetIssues(), 2)
+	}
+	resp2, err = srv.UpdateRealServers(ctx, &ipvs.UpdateRealServersRequest{
+		VirtualServerIdentity: identity,
+		Update:                []*ipvs.RealServer{rsPb("10.0.1.1:80", 60), rsPb("10.0.1.2:80", 40)},
+		ForceUpsert:           true,
+	})
+	if assert.NoError(t, err) {
+		assert.Empty(t, resp2.GetIssues())
+	}
+	//change which fails rules refuses the whole batch: the rest of it would leave group rules have not seen
+	resp2, err = srv.UpdateRealServers(ctx, &ipvs.UpdateRealServersRequest{
+		VirtualServerIdentity: identity,
+		Update:                []*ipvs.RealServer{rsPb("10.0.1.1:80", 70), rsFwd("10.0.1.2:80", 30, "nat")},
+	})
+	if assert.NoError(t, err) && assert.Len(t, resp2.GetIssues(), 2) {
+		assert.Contains(t, resp2.GetIssues()[0].GetReason().GetMessage(), "dr-only")
+		assert.Contains(t, resp2.GetIssues()[1].GetReason().GetMessage(), "refused as a whole")
+	}
+	var idConv VirtualServerIdentityConv
+	if assert.NoError(t, idConv.FromPb(identity)) {
+		weights := make(map[ipvsAdm.Address]uint32)
+		_ = srv.admin.ListRealServers(ctx, idConv.Identity, func(rs ipvsAdm.RealServer) error {
+			weights[rs.Address] = rs.Weight
+			return nil
+		})
+		assert.Equal(t, map[ipvsAdm.Address]uint32{"10.0.1.1:80": 60, "10.0.1.2:80": 40}, weights)
+	}
+}
+
+func Test_Admission(t *testing.T) {
+	ctx := context.Background()
+	allowed := true
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(admission.Verdict{Allowed: allowed, Message: "change freeze"})
+	}))
+	defer hook.Close()
+	ctl, err := admission.New(admission.Config{Webhooks: []admission.WebhookConfig{{Name: "freeze", URL: hook.URL}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	srv := NewIpvsAdminService(ctx, kernel, WithAdmission{Controller: ctl}).(*ipvsAdminSrv)
+	identity, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	pb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}}.ToPb()
+	req := &ipvs.UpdateVirtualServersRequest{Update: []*ipvs.VirtualServer{pb}, ForceUpsert: true}
+
+	allowed = false
+	_, err = srv.UpdateVirtualServers(ctx, req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	n := 0
+	_ = kernel.ListVirtualServers(ctx, func(ipvsAdm.VirtualServer) error {
+		n++
+		return nil
+	})
+	assert.Equal(t, 0, n)
+
+	allowed = true
+	_, err = srv.UpdateVirtualServers(ctx, req)
+	assert.NoError(t, err)
+	_ = kernel.ListVirtualServers(ctx, func(ipvsAdm.VirtualServer) error {
+		n++
+		return nil
+	})
+	assert.Equal(t, 1, n)
+}
+
+func Test_Authz(t *testing.T) {
+	ctx := context.Background()
+	a, err := authz.New(authz.Config{
+		Roles: []authz.RoleConfig{{
+			Name:               "web",
+			Methods:            []string{"ListVirtualServers", "UpdateVirtualServers"},
+			VirtualServerCIDRs: []string{"10.0.0.0/24"},
+		}},
+		Bindings: []authz.BindingConfig{{Role: "web", Principals: []string{"*"}}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	foreign, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.1.1:80")
+	assert.NoError(t, kernel.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: foreign, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	srv := NewIpvsAdminService(ctx, kernel).(*ipvsAdminSrv)
+	call := func(method string, req interface{}, h grpc.UnaryHandler) (interface{}, error) {
+		return a.UnaryInterceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/ipvs.IpvsAdmin/" + method}, h)
+	}
+	vs := func(s string) *ipvs.VirtualServer {
+		identity, _ := ipvsAdm.ParseVirtualServerIdentity(s)
+		pb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}}.ToPb()
+		return pb
+	}
+	update := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.UpdateVirtualServers(ctx, req.(*ipvs.UpdateVirtualServersRequest))
+	}
+	_, err = call("UpdateVirtualServers", &ipvs.UpdateVirtualServersRequest{
+		Update: []*ipvs.VirtualServer{vs("tcp://10.0.0.1:80")}, ForceUpsert: true,
+	}, update)
+	assert.NoError(t, err)
+	_, err = call("UpdateVirtualServers", &ipvs.UpdateVirtualServersRequest{
+		Delete: []*ipvs.VirtualServerIdentity{vs("tcp://10.0.1.1:80").GetIdentity()},
+	}, update)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	resp, err := call("ListVirtualServers", &ipvs.ListVirtualServersRequest{},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.ListVirtualServers(ctx, req.(*ipvs.ListVirtualServersRequest))
+		})
+	if assert.NoError(t, err) && assert.Len(t, resp.(*ipvs.ListVirtualServersResponse).GetVirtualServers(), 1) {
+		assert.Equal(t, "10.0.0.1", resp.(*ipvs.ListVirtualServersResponse).GetVirtualServers()[0].GetVirtualServer().GetIdentity().GetAddress().GetHost())
+	}
+	_, err = call("FindVirtualServer", &ipvs.FindVirtualServerRequest{}, nil)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func Test_Rollback(t *testing.T) {
+	ctx := context.Background()
+	j, err := journal.Open(journal.Config{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	rs, err := rules.New([]rules.Config{
+		{Name: "weights-sum-100", Target: rules.TargetRealServer, Expression: `totalWeight == 100`},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	srv := NewIpvsAdminService(ctx, kernel, WithJournal{Journal: j}, WithRules{RuleSet: rs}).(*ipvsAdminSrv)
+	identity, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	vsPb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}}.ToPb()
+	rsPb := func(addr string, w uint32) *ipvs.RealServer {
+		pb, _ := RealServerConv{RealServer: ipvsAdm.RealServer{Address: ipvsAdm.Address(addr), PacketForwarder: "dr", Weight: w}}.ToPb()
+		return pb
+	}
+	weights := func() map[ipvsAdm.Address]uint32 {
+		ret := make(map[ipvsAdm.Address]uint32)
+		_ = kernel.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+			ret[rs.Address] = rs.Weight
+			return nil
+		})
+		return ret
+	}
+	_, err = srv.UpdateVirtualServers(ctx, &ipvs.UpdateVirtualServersRequest{Update: []*ipvs.VirtualServer{vsPb}, ForceUpsert: true})
+	assert.NoError(t, err)
+	for _, w := range []uint32{60, 70} {
+		_, err = srv.UpdateRealServers(ctx, &ipvs.UpdateRealServersRequest{
+			VirtualServerIdentity: vsPb.GetIdentity(),
+			Update:                []*ipvs.RealServer{rsPb("10.0.1.1:80", w), rsPb("10.0.1.2:80", 100-w)},
+			ForceUpsert:           true,
+		})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, uint64(3), j.Revision())
+
+	//rollback out of scope of roles is refused
+	a, err := authz.New(authz.Config{
+		Roles:    []authz.RoleConfig{{Name: "other", Methods: []string{authz.MethodRollback}, VirtualServerCIDRs: []string{"10.0.9.0/24"}}},
+		Bindings: []authz.BindingConfig{{Role: "other", Principals: []string{"*"}}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	authorized, err := a.Authorize(ctx, authz.MethodRollback)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = srv.rollback(authorized, 2)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	//rollback which breaks rules is refused as a whole
+	_, err = srv.rollback(ctx, 1)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.0.1.1:80": 70, "10.0.1.2:80": 30}, weights())
+
+	e, err := srv.rollback(ctx, 2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Rollback", e.Method)
+	}
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.0.1.1:80": 60, "10.0.1.2:80": 40}, weights())
+}
+
+func Test_Audit(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := audit.New(audit.Config{File: file})
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	srv := NewIpvsAdminService(ctx, kernel, WithAudit{Log: log}).(*ipvsAdminSrv)
+	identity, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	pb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}}.ToPb()
+	missing, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.2:80")
+	missingPb, _ := VirtualServerIdentityConv{Identity: missing}.ToPb()
+
+	//forwarded-for address is told by trusted proxy
+	callCtx := peer.NewContext(metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", "192.0.2.1")),
+		&peer.Peer{Addr: &net.UnixAddr{Name: "@", Net: "unix"}, AuthInfo: caller.ProxyAuthInfo{}})
+	_, err = srv.UpdateVirtualServers(callCtx, &ipvs.UpdateVirtualServersRequest{
+		Update:      []*ipvs.VirtualServer{pb},
+		Delete:      []*ipvs.VirtualServerIdentity{missingPb},
+		ForceUpsert: true,
+	})
+	assert.NoError(t, err)
+	_, err = srv.UpdateRealServers(callCtx, &ipvs.UpdateRealServersRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	log.Close()
+
+	data, _ := ioutil.ReadFile(file)
+	if _, err = audit.Verify(bytes.NewReader(data), ""); !assert.NoError(t, err) {
+		return
+	}
+	var records []audit.Record
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var r audit.Record
+		_ = json.Unmarshal(line, &r)
+		records = append(records, r)
+	}
+	if !assert.Len(t, records, 2) {
+		return
+	}
+	vs := records[0]
+	assert.Equal(t, "UpdateVirtualServers", vs.Method)
+	assert.Equal(t, "192.0.2.1", vs.Caller.Address)
+	assert.Equal(t, "OK", vs.Code)
+	assert.NotEmpty(t, vs.Request)
+	outcomes := make(map[string]string)
+	for _, it := range vs.Items {
+		outcomes[it.Op+" "+it.VirtualServer] = it.Outcome
+	}
+	assert.Equal(t, map[string]string{
+		"update tcp://10.0.0.1:80": audit.OutcomeApplied,
+		"delete tcp://10.0.0.2:80": audit.OutcomeIssue,
+	}, outcomes)
+	assert.NotEmpty(t, vs.Issues)
+
+	rs := records[1]
+	assert.Equal(t, "UpdateRealServers", rs.Method)
+	assert.Equal(t, codes.InvalidArgument.String(), rs.Code)
+	assert.NotEmpty(t, rs.Error)
+}
+
+func Test_AuditRefusals(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := audit.New(audit.Config{File: file})
+	if !assert.NoError(t, err) {
+		return
+	}
+	a, err := authz.New(authz.Config{
+		Roles: []authz.RoleConfig{{
+			Name:               "web",
+			Methods:            []string{"UpdateVirtualServers"},
+			VirtualServerCIDRs: []string{"10.0.0.0/24"},
+		}},
+		Bindings: []authz.BindingConfig{{Role: "web", Principals: []string{"*"}}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := NewIpvsAdminService(ctx, ipvsAdm.NewMemoryAdmin(), WithAudit{Log: log}).(*ipvsAdminSrv)
+	refusals := AuditRefusals(log)
+	call := func(method string, req interface{}, h grpc.UnaryHandler) error {
+		info := &grpc.UnaryServerInfo{FullMethod: "/ipvs.IpvsAdmin/" + method}
+		_, e := refusals(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return a.UnaryInterceptor(ctx, req, info, h)
+		})
+		return e
+	}
+	identity, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.1.1:80")
+	pb, _ := VirtualServerConv{VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}}.ToPb()
+
+	//the service refuses virtual server out of scope of role and audits it by itself
+	err = call("UpdateVirtualServers", &ipvs.UpdateVirtualServersRequest{Update: []*ipvs.VirtualServer{pb}, ForceUpsert: true},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.UpdateVirtualServers(ctx, req.(*ipvs.UpdateVirtualServersRequest))
+		})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	//authorizer refuses method before the call reaches the service
+	err = call("UpdateRealServers", &ipvs.UpdateRealServersRequest{VirtualServerIdentity: pb.GetIdentity()},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.UpdateRealServers(ctx, req.(*ipvs.UpdateRealServersRequest))
+		})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	log.Close()
+
+	data, _ := ioutil.ReadFile(file)
+	if _, err = audit.Verify(bytes.NewReader(data), ""); !assert.NoError(t, err) {
+		return
+	}
+	var records []audit.Record
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var r audit.Record
+		_ = json.Unmarshal(line, &r)
+		records = append(records, r)
+	}
+	if !assert.Len(t, records, 2) {
+		return
+	}
+	assert.Equal(t, "UpdateVirtualServers", records[0].Method)
+	assert.Equal(t, codes.PermissionDenied.String(), records[0].Code)
+	refused := records[1]
+	assert.Equal(t, "UpdateRealServers", refused.Method)
+	assert.Equal(t, codes.PermissionDenied.String(), refused.Code)
+	assert.NotEmpty(t, refused.Error)
+	assert.NotEmpty(t, refused.Request)
+}
+
+func Test_Locks(t *testing.T) {
+	ctx := context.Background()
+	l := newTableLocks()
+	a, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	b, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.2:80")
+	tryLock := func(f func(context.Context) (func(), error)) bool {
+		c, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		unlock, err := f(c)
+		if err == nil {
+			unlock()
+		}
+		return err == nil
+	}
+	lockVS := func(exclusive bool, ids ...ipvsAdm.VirtualServerIdentity) func(context.Context) (func(), error) {
+		return func(c context.Context) (func(), error) {
+			return l.lock(c, exclusive, ids...)
+		}
+	}
+
+	unlock, err := l.lock(ctx, true, a)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, tryLock(lockVS(true, b)))
+	assert.False(t, tryLock(lockVS(false, a)))
+	assert.False(t, tryLock(lockVS(true, b, a)))
+	assert.False(t, tryLock(l.lockTable))
+	unlock()
+	unlock()
+
+	unlock, _ = l.lock(ctx, false, a)
+	assert.True(t, tryLock(lockVS(false, a)))
+	assert.False(t, tryLock(lockVS(true, a)))
+	unlock()
+	assert.Empty(t, l.vs)
+
+	//batches of the same virtual servers in different order do not deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		ids := []ipvsAdm.VirtualServerIdentity{a, b}
+		if i%2 == 1 {
+			ids = []ipvsAdm.VirtualServerIdentity{b, a}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if u, e := l.lock(ctx, true, ids...); assert.NoError(t, e) {
+				time.Sleep(time.Millisecond)
+				u()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, l.vs)
+
+	//service stop aborts waiting callers
+	appCtx, stop := context.WithCancel(ctx)
+	srv := NewIpvsAdminService(appCtx, ipvsAdm.NewMemoryAdmin()).(*ipvsAdminSrv)
+	leave, _ := srv.enter(ctx, a)
+	go stop()
+	_, err = srv.enter(ctx, a)
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	leave()
+}
+
+//slowAdmin emulates latency of the kernel table
+type slowAdmin struct {
+	ipvsAdm.Admin
+}
+
+func (impl slowAdmin) UpdateRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, rs ipvsAdm.RealServer, opts ...ipvsAdm.AdminOption) error {
+	time.Sleep(100 * time.Microsecond)
+	return impl.Admin.UpdateRealServer(ctx, identity, rs, opts...)
+}
+
+//Benchmark_UpdateRealServers compares parallel calls touching the same virtual server
+//(the way every call was serialised by one global lock) and distinct ones; 'production' stack
+//decorates the kernel table the way service does: ownership, state store, journal and metadata
+//are kept in files
+func Benchmark_UpdateRealServers(b *testing.B) {
+	for _, stack := range []string{"bare", "production"} {
+		for _, distinct := range []bool{false, true} {
+			name := stack + "/same-virtual-server"
+			if distinct {
+				name = stack + "/distinct-virtual-servers"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkUpdateRealServers(b, stack == "production", distinct)
+			})
+		}
+	}
+}
+
+func benchmarkUpdateRealServers(b *testing.B, production, distinct bool) {
+	ctx := context.Background()
+	var adm ipvsAdm.Admin = slowAdmin{Admin: ipvsAdm.NewMemoryAdmin()}
+	var opts []ServiceOption
+	if production {
+		dir, err := ioutil.TempDir("", "bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		owners, err := ownership.Open(ownership.Config{File: filepath.Join(dir, "owned.json")})
+		if err != nil {
+			b.Fatal(err)
+		}
+		store, err := statestore.Open(statestore.Config{Dir: dir})
+		if err != nil {
+			b.Fatal(err)
+		}
+		j, err := journal.Open(journal.Config{File: filepath.Join(dir, "journal.jsonl")})
+		if err != nil {
+			b.Fatal(err)
+		}
+		md, err := meta.Open(meta.Config{File: filepath.Join(dir, "metadata.json")})
+		if err != nil {
+			b.Fatal(err)
+		}
+		adm = store.Admin(owners.Admin(adm))
+		opts = append(opts, WithOwnership{Registry: owners}, WithJournal{Journal: j}, WithMetadata{Store: md})
+	}
+	srv := NewIpvsAdminService(ctx, adm, opts...).(*ipvsAdminSrv)
+	var n int32
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		if distinct {
+			i = int(atomic.AddInt32(&n, 1))
+		}
+		identity, _ := ipvsAdm.ParseVirtualServerIdentity(fmt.Sprintf("tcp://10.0.%v.%v:80", i/250, i%250+1))
+		_ = adm.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"},
+			ipvsAdm.ForceAddIfNotExist{})
+		vsPb, _ := VirtualServerIdentityConv{Identity: identity}.ToPb()
+		var reqs []*ipvs.UpdateRealServersRequest
+		for _, w := range []uint32{1, 2} {
+			rs, _ := RealServerConv{RealServer: ipvsAdm.RealServer{Address: "10.0.1.1:8080", PacketForwarder: "dr", Weight: w}}.ToPb()
+			reqs = append(reqs, &ipvs.UpdateRealServersRequest{
+				VirtualServerIdentity: vsPb,
+				Update:                []*ipvs.RealServer{rs},
+				ForceUpsert:           true,
+			})
+		}
+		for k := 0; pb.Next(); k++ {
+			if _, err := srv.UpdateRealServers(ctx, reqs[k%2]); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
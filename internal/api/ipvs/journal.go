@@ -0,0 +1,170 @@
+package ipvs
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/thataway/common-lib/pkg/jsonview"
+	"github.com/thataway/common-lib/server"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/caller"
+	"github.com/thataway/ipvs/internal/journal"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+)
+
+//NewJournalHandler exposes journal of service with rollback; nil if service has no journal.
+//History and rollback are served over HTTP deliberately: API of IpvsAdmin is defined by external protos
+//module and does not change with this service; the handler is to be guarded like gRPC calls (see guard.Guard)
+func NewJournalHandler(service server.APIService) http.Handler {
+	srv, _ := service.(*ipvsAdminSrv)
+	if srv == nil || srv.journal == nil {
+		return nil
+	}
+	return journal.NewHandler(srv.journal, srv.rollback)
+}
+
+func (srv *ipvsAdminSrv) rollback(ctx context.Context, revision uint64) (journal.Entry, error) {
+	leave, err := srv.enterTable(ctx)
+	if err != nil {
+		return journal.Entry{}, err
+	}
+	defer leave()
+	var entry journal.Entry
+	var plan []journal.Change
+	if plan, err = srv.journal.RollbackPlan(revision); err == nil {
+		err = srv.checkRollback(ctx, plan)
+	}
+	if err == nil {
+		entry, err = srv.journal.ApplyRollback(ctx, srv.admin, revision, srv.identify(ctx), plan)
+	}
+	srv.auditRollback(ctx, revision, entry, err)
+	return entry, err
+}
+
+//checkRollback passes plan of rollback through checks of mutating calls; rollback is refused as a whole
+//when any change of it fails them because partial rollback brings the table to no revision
+func (srv *ipvsAdminSrv) checkRollback(ctx context.Context, plan []journal.Change) error {
+	var (
+		identities []ipvsAdm.VirtualServerIdentity
+		vsDel      []*ipvs.VirtualServerIdentity
+		vsUpd      []*ipvs.VirtualServer
+		rsDel      = make(map[string][]*ipvs.RealServerAddress)
+		rsUpd      = make(map[string][]*ipvs.RealServer)
+		seen       = make(map[string]bool)
+	)
+	//only the last change of every item tells state the table is going to have
+	type itemKey struct{ vs, rs string }
+	last := make(map[itemKey]int, len(plan))
+	for i, c := range plan {
+		last[itemKey{c.VirtualServer, c.RealServer}] = i
+	}
+	for i, c := range plan {
+		if last[itemKey{c.VirtualServer, c.RealServer}] != i {
+			continue
+		}
+		identity, err := ipvsAdm.ParseVirtualServerIdentity(c.VirtualServer)
+		if err != nil {
+			return err
+		}
+		key := ipvsAdm.IdentityString(identity)
+		if !seen[key] {
+			seen[key] = true
+			identities = append(identities, identity)
+		}
+		switch {
+		case c.RealServer == "" && c.Op == journal.OpRemove:
+			var id *ipvs.VirtualServerIdentity
+			if id, err = (VirtualServerIdentityConv{Identity: identity}).ToPb(); err == nil {
+				vsDel = append(vsDel, id)
+			}
+		case c.RealServer == "" && c.After != nil:
+			var vs *ipvs.VirtualServer
+			if vs, err = (VirtualServerConv{VirtualServer: c.After.VirtualServer(identity)}).ToPb(); err == nil {
+				vsUpd = append(vsUpd, vs)
+			}
+		case c.RealServer != "" && c.Op == journal.OpRemove:
+			var host string
+			var port uint32
+			if host, port, err = ipvsAdm.Address(c.RealServer).ToHostPort(); err == nil {
+				rsDel[key] = append(rsDel[key], &ipvs.RealServerAddress{Host: host, Port: port})
+			}
+		case c.RealServer != "" && c.After != nil:
+			var rs *ipvs.RealServer
+			if rs, err = (RealServerConv{RealServer: c.After.RealServer(ipvsAdm.Address(c.RealServer))}).ToPb(); err == nil {
+				rsUpd[key] = append(rsUpd[key], rs)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := srv.checkGrants(ctx, identities...); err != nil {
+		return err
+	}
+	if err := srv.checkOwnership(ctx, identities...); err != nil {
+		return err
+	}
+	if err := srv.checkVirtualServersPolicy(ctx, vsDel, vsUpd, true); err != nil {
+		return err
+	}
+	_, _, vsIssues, err := srv.checkVirtualServersRules(ctx, vsDel, vsUpd)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, issue := range vsIssues {
+		failed = append(failed, issue.GetReason().GetMessage())
+	}
+	for _, identity := range identities {
+		key := ipvsAdm.IdentityString(identity)
+		if err = srv.checkRealServersPolicy(ctx, identity, rsDel[key], rsUpd[key], true); err != nil {
+			return err
+		}
+		var rsIssues []*ipvs.RealServerIssue
+		if _, _, rsIssues, err = srv.checkRealServersRules(ctx, identity, rsDel[key], rsUpd[key], true); err != nil {
+			return err
+		}
+		for _, issue := range rsIssues {
+			failed = append(failed, issue.GetReason().GetMessage())
+		}
+	}
+	if len(failed) > 0 {
+		violations := make([]*errdetails.PreconditionFailure_Violation, 0, len(failed))
+		for _, msg := range failed {
+			violations = append(violations, &errdetails.PreconditionFailure_Violation{
+				Type:        "RULES",
+				Description: msg,
+			})
+		}
+		return srv.errWithDetails(codes.FailedPrecondition, "rollback breaks rule(s): "+strings.Join(failed, "; "),
+			&errdetails.PreconditionFailure{Violations: violations})
+	}
+	return srv.admit(ctx, "Rollback", plan)
+}
+
+//beginJournal starts journal entry of mutating call; commit is called with error the call ends with
+func (srv *ipvsAdminSrv) beginJournal(ctx context.Context, method string, req interface{}) (context.Context, func(error)) {
+	if srv.journal == nil {
+		return ctx, func(error) {}
+	}
+	ctx, tx := srv.journal.Begin(ctx, method, srv.identify(ctx), jsonview.Marshaler(req))
+	return ctx, func(err error) {
+		tx.Commit(ctx, err)
+	}
+}
+
+//identify address and principals of caller
+func (srv *ipvsAdminSrv) identify(ctx context.Context) caller.Identity {
+	ret := caller.Identity{Address: caller.Address(ctx)}
+	for _, r := range srv.resolvers {
+		ret.Principals = append(ret.Principals, r(ctx)...)
+	}
+	if len(ret.Principals) == 0 {
+		ret.Principals = []string{authz.PrincipalAnonymous}
+	}
+	return ret
+}
@@ -0,0 +1,199 @@
+package ipvs
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc/status"
+)
+
+//maxHolders weight of exclusive lock; shared holders take one unit each
+const maxHolders = 1 << 30
+
+type (
+	//tableLocks guards the kernel table against concurrent calls of API:
+	//  - calls touching known virtual servers hold table shared and those virtual servers exclusive;
+	//    virtual servers are locked in order of their identities so batches of many of them never deadlock
+	//  - calls touching set of virtual servers is not known in advance hold table exclusive
+	//  - reads hold table and virtual servers they read shared
+	//semaphores are FIFO so waiting exclusive holder is not starved by shared ones
+	tableLocks struct {
+		table *semaphore.Weighted
+
+		mx sync.Mutex
+		vs map[string]*vsLock
+	}
+
+	vsLock struct {
+		sem  *semaphore.Weighted
+		refs int
+	}
+)
+
+func newTableLocks() *tableLocks {
+	return &tableLocks{
+		table: semaphore.NewWeighted(maxHolders),
+		vs:    make(map[string]*vsLock),
+	}
+}
+
+//lockTable locks the whole table exclusive
+func (l *tableLocks) lockTable(ctx context.Context) (func(), error) {
+	if err := l.table.Acquire(ctx, maxHolders); err != nil {
+		return nil, err
+	}
+	var o sync.Once
+	return func() {
+		o.Do(func() {
+			l.table.Release(maxHolders)
+		})
+	}, nil
+}
+
+//lock locks table shared and virtual servers exclusive or shared
+func (l *tableLocks) lock(ctx context.Context, exclusive bool, identities ...ipvsAdm.VirtualServerIdentity) (func(), error) {
+	if err := l.table.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	unlock, err := l.lockVirtualServers(ctx, exclusive, identities...)
+	if err != nil {
+		l.table.Release(1)
+		return nil, err
+	}
+	var o sync.Once
+	return func() {
+		o.Do(func() {
+			unlock()
+			l.table.Release(1)
+		})
+	}, nil
+}
+
+//lockVirtualServers locks virtual servers in order of their identities; caller must hold table
+func (l *tableLocks) lockVirtualServers(ctx context.Context, exclusive bool, identities ...ipvsAdm.VirtualServerIdentity) (func(), error) {
+	weight := int64(1)
+	if exclusive {
+		weight = maxHolders
+	}
+	keys := make([]string, 0, len(identities))
+	seen := make(map[string]bool, len(identities))
+	for _, identity := range identities {
+		if k := ipvsAdm.IdentityString(identity); !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	locks := l.ref(keys)
+	held := 0
+	unlock := func() {
+		for i := held - 1; i >= 0; i-- {
+			locks[i].sem.Release(weight)
+		}
+		l.unref(keys)
+	}
+	for _, vl := range locks {
+		if err := vl.sem.Acquire(ctx, weight); err != nil {
+			unlock()
+			return nil, err
+		}
+		held++
+	}
+	return unlock, nil
+}
+
+func (l *tableLocks) ref(keys []string) []*vsLock {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	ret := make([]*vsLock, 0, len(keys))
+	for _, k := range keys {
+		vl := l.vs[k]
+		if vl == nil {
+			vl = &vsLock{sem: semaphore.NewWeighted(maxHolders)}
+			l.vs[k] = vl
+		}
+		vl.refs++
+		ret = append(ret, vl)
+	}
+	return ret
+}
+
+func (l *tableLocks) unref(keys []string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	for _, k := range keys {
+		if vl := l.vs[k]; vl != nil {
+			if vl.refs--; vl.refs == 0 {
+				delete(l.vs, k)
+			}
+		}
+	}
+}
+
+//appContext context of call which is also done when service is stopped
+func (srv *ipvsAdminSrv) appContext(ctx context.Context) (context.Context, func()) {
+	ret, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-srv.appCtx.Done():
+			cancel()
+		case <-ret.Done():
+		}
+	}()
+	return ret, cancel
+}
+
+//enterTable locks the whole table for mutating call
+func (srv *ipvsAdminSrv) enterTable(ctx context.Context) (leave func(), err error) {
+	lctx, cancel := srv.appContext(ctx)
+	defer cancel()
+	if leave, err = srv.locks.lockTable(lctx); err != nil {
+		err = status.FromContextError(lctx.Err()).Err()
+	}
+	return leave, err
+}
+
+//enter locks virtual servers for mutating call
+func (srv *ipvsAdminSrv) enter(ctx context.Context, identities ...ipvsAdm.VirtualServerIdentity) (leave func(), err error) {
+	lctx, cancel := srv.appContext(ctx)
+	defer cancel()
+	if leave, err = srv.locks.lock(lctx, true, identities...); err != nil {
+		err = status.FromContextError(lctx.Err()).Err()
+	}
+	return leave, err
+}
+
+//enterRead locks virtual servers for reading
+func (srv *ipvsAdminSrv) enterRead(ctx context.Context, identities ...ipvsAdm.VirtualServerIdentity) (leave func(), err error) {
+	lctx, cancel := srv.appContext(ctx)
+	defer cancel()
+	if leave, err = srv.locks.lock(lctx, false, identities...); err != nil {
+		err = status.FromContextError(lctx.Err()).Err()
+	}
+	return leave, err
+}
+
+//enterVirtualServers locks virtual servers of 'UpdateVirtualServers'; the whole table is locked
+//when batch is extended by delete selector or it may add virtual servers over limit of policy
+func (srv *ipvsAdminSrv) enterVirtualServers(ctx context.Context, req *ipvs.UpdateVirtualServersRequest) (leave func(), err error) {
+	sel, e := srv.selectorFrom(ctx, DeleteSelectorMetadata)
+	if e != nil || sel != nil ||
+		(req.GetForceUpsert() && len(req.GetUpdate()) > 0 && srv.policy.LimitsVirtualServersCount()) {
+		return srv.enterTable(ctx)
+	}
+	return srv.enter(ctx, touchedVirtualServers(req.GetDelete(), req.GetUpdate())...)
+}
+
+//readVirtualServer locks virtual server shared while table is held by enterRead
+func (srv *ipvsAdminSrv) readVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity) (leave func(), err error) {
+	lctx, cancel := srv.appContext(ctx)
+	defer cancel()
+	if leave, err = srv.locks.lockVirtualServers(lctx, false, identity); err != nil {
+		err = status.FromContextError(lctx.Err()).Err()
+	}
+	return leave, err
+}
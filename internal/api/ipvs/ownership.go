@@ -0,0 +1,101 @@
+package ipvs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	//OverrideOwnershipMetadata request metadata key; 'true' allows changes of foreign virtual servers
+	OverrideOwnershipMetadata = "x-ipvs-override-ownership"
+
+	//OwnerMetadata response header key; values are '<virtual-server>=<owner>'
+	OwnerMetadata = "x-ipvs-owner"
+
+	//WarningMetadata response header key; warnings are not failing the call
+	WarningMetadata = "x-ipvs-warning"
+)
+
+//checkOwnership refuses changes of foreign virtual servers in strict mode, otherwise warns about them
+func (srv *ipvsAdminSrv) checkOwnership(ctx context.Context, identities ...ipvsAdm.VirtualServerIdentity) error {
+	if srv.owners == nil {
+		return nil
+	}
+	foreign, err := srv.owners.Foreign(ctx, srv.admin, identities...)
+	if err != nil || len(foreign) == 0 {
+		return err
+	}
+	if overridden(ctx) {
+		logger.Warnf(ctx, "ownership: foreign virtual server(s) %v are changed by override", foreign)
+		return nil
+	}
+	if srv.owners.Strict() {
+		violations := make([]*errdetails.PreconditionFailure_Violation, 0, len(foreign))
+		for _, s := range foreign {
+			violations = append(violations, &errdetails.PreconditionFailure_Violation{
+				Type:        "OWNERSHIP",
+				Subject:     s,
+				Description: "virtual server is not created by this service",
+			})
+		}
+		return srv.errWithDetails(codes.FailedPrecondition,
+			"changes of foreign virtual server(s) "+strings.Join(foreign, ", ")+" need '"+OverrideOwnershipMetadata+"' override",
+			&errdetails.PreconditionFailure{Violations: violations})
+	}
+	logger.Warnf(ctx, "ownership: foreign virtual server(s) %v are changed", foreign)
+	warnings := make([]string, 0, len(foreign))
+	for _, s := range foreign {
+		warnings = append(warnings, "virtual server "+s+" is foreign")
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(WarningMetadata, strings.Join(warnings, "; ")))
+	return nil
+}
+
+//reportOwners tells owners of virtual servers by response header
+func (srv *ipvsAdminSrv) reportOwners(ctx context.Context, identities ...ipvsAdm.VirtualServerIdentity) {
+	if srv.owners == nil || len(identities) == 0 {
+		return
+	}
+	kv := make([]string, 0, 2*len(identities))
+	for _, identity := range identities {
+		kv = append(kv, OwnerMetadata, ipvsAdm.IdentityString(identity)+"="+srv.owners.Owner(identity))
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(kv...))
+}
+
+func overridden(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(OverrideOwnershipMetadata) {
+		if b, e := strconv.ParseBool(v); e == nil && b {
+			return true
+		}
+	}
+	return false
+}
+
+//touchedVirtualServers virtual servers are going to be changed by request; invalid ones are refused later
+func touchedVirtualServers(del []*ipvs.VirtualServerIdentity, upd []*ipvs.VirtualServer) []ipvsAdm.VirtualServerIdentity {
+	var ret []ipvsAdm.VirtualServerIdentity
+	for _, d := range del {
+		var conv VirtualServerIdentityConv
+		if conv.FromPb(d) == nil {
+			ret = append(ret, conv.Identity)
+		}
+	}
+	for _, u := range upd {
+		var conv VirtualServerConv
+		if conv.FromPb(u) == nil {
+			ret = append(ret, conv.VirtualServer.Identity)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,142 @@
+package ipvs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/policy"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+)
+
+//checkVirtualServersPolicy refuses batch of virtual servers if it breaks policy
+func (srv *ipvsAdminSrv) checkVirtualServersPolicy(ctx context.Context, del []*ipvs.VirtualServerIdentity, upd []*ipvs.VirtualServer, forceUpsert bool) error {
+	if srv.policy == nil {
+		return nil
+	}
+	var violations []policy.Violation
+	var toUpd []ipvsAdm.VirtualServer
+	for _, u := range upd {
+		var conv VirtualServerConv
+		if conv.FromPb(u) == nil {
+			toUpd = append(toUpd, conv.VirtualServer)
+			violations = append(violations, srv.policy.CheckVirtualServer(conv.VirtualServer)...)
+		}
+	}
+	if len(violations) > 0 {
+		return srv.policyError(codes.InvalidArgument, violations)
+	}
+	//foreign virtual servers are not counted; virtual servers upsert adds become owned
+	existing := make(map[string]bool)
+	n := 0
+	err := srv.admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		owned := srv.owners == nil || srv.owners.IsOwned(vs.Identity)
+		existing[ipvsAdm.IdentityString(vs.Identity)] = owned
+		if owned {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, identity := range touchedVirtualServers(del, nil) {
+		key := ipvsAdm.IdentityString(identity)
+		if owned, ok := existing[key]; ok {
+			delete(existing, key)
+			if owned {
+				n--
+			}
+		}
+	}
+	for _, vs := range toUpd {
+		if key := ipvsAdm.IdentityString(vs.Identity); forceUpsert {
+			if _, ok := existing[key]; !ok {
+				existing[key] = true
+				n++
+			}
+		}
+	}
+	if violations = srv.policy.CheckVirtualServersCount(n); len(violations) > 0 {
+		return srv.policyError(codes.FailedPrecondition, violations)
+	}
+	return nil
+}
+
+//checkRealServersPolicy refuses batch of real servers if it breaks policy
+func (srv *ipvsAdminSrv) checkRealServersPolicy(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, del []*ipvs.RealServerAddress, upd []*ipvs.RealServer, forceUpsert bool) error {
+	if srv.policy == nil {
+		return nil
+	}
+	var violations []policy.Violation
+	var toUpd []ipvsAdm.RealServer
+	for _, u := range upd {
+		var conv RealServerConv
+		if conv.FromPb(u) == nil {
+			toUpd = append(toUpd, conv.RealServer)
+			violations = append(violations, srv.policy.CheckRealServer(identity, conv.RealServer)...)
+		}
+	}
+	if len(violations) > 0 {
+		return srv.policyError(codes.InvalidArgument, violations)
+	}
+	existing := make(map[ipvsAdm.Address]bool)
+	err := srv.admin.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+		existing[rs.Address] = true
+		return nil
+	})
+	if errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n := len(existing)
+	for _, d := range del {
+		var conv AddressConv
+		if conv.FromPb(d); existing[conv.Address] {
+			delete(existing, conv.Address)
+			n--
+		}
+	}
+	for _, rs := range toUpd {
+		if forceUpsert && !existing[rs.Address] {
+			existing[rs.Address] = true
+			n++
+		}
+	}
+	if violations = srv.policy.CheckRealServersCount(identity, n); len(violations) > 0 {
+		return srv.policyError(codes.FailedPrecondition, violations)
+	}
+	return nil
+}
+
+func (srv *ipvsAdminSrv) policyError(code codes.Code, violations []policy.Violation) error {
+	descr := make([]string, 0, len(violations))
+	for _, v := range violations {
+		descr = append(descr, v.Subject+": "+v.Description)
+	}
+	msg := "policy violation(s): " + strings.Join(descr, "; ")
+	if code == codes.InvalidArgument {
+		details := new(errdetails.BadRequest)
+		for _, v := range violations {
+			details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       v.Field,
+				Description: v.Subject + ": " + v.Description,
+			})
+		}
+		return srv.errWithDetails(code, msg, details)
+	}
+	details := new(errdetails.PreconditionFailure)
+	for _, v := range violations {
+		details.Violations = append(details.Violations, &errdetails.PreconditionFailure_Violation{
+			Type:        "POLICY",
+			Subject:     v.Subject,
+			Description: v.Field + ": " + v.Description,
+		})
+	}
+	return srv.errWithDetails(code, msg, details)
+}
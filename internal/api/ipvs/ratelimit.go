@@ -0,0 +1,13 @@
+package ipvs
+
+import (
+	"context"
+)
+
+//limit takes tokens of caller for batch of size items; size counts items delete selectors add to batch
+func (srv *ipvsAdminSrv) limit(ctx context.Context, method string, size int) error {
+	if srv.limiter == nil {
+		return nil
+	}
+	return srv.limiter.Allow(ctx, method, size)
+}
@@ -0,0 +1,165 @@
+package ipvs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/rules"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+)
+
+//checkVirtualServersRules evaluates CEL rules; changes are failed them are dropped from batch and reported as issues
+func (srv *ipvsAdminSrv) checkVirtualServersRules(ctx context.Context, del []*ipvs.VirtualServerIdentity, upd []*ipvs.VirtualServer) ([]*ipvs.VirtualServerIdentity, []*ipvs.VirtualServer, []*ipvs.VirtualServerIssue, error) {
+	if srv.rules == nil {
+		return del, upd, nil, nil
+	}
+	existing := make(map[string]ipvsAdm.VirtualServer)
+	err := srv.admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		existing[ipvsAdm.IdentityString(vs.Identity)] = vs
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var issues []*ipvs.VirtualServerIssue
+	var retDel []*ipvs.VirtualServerIdentity
+	for _, d := range del {
+		var conv VirtualServerIdentityConv
+		if conv.FromPb(d) == nil {
+			vs, found := existing[ipvsAdm.IdentityString(conv.Identity)]
+			if !found {
+				vs.Identity = conv.Identity
+			}
+			if ff := srv.rules.CheckVirtualServer(rules.OpDelete, vs); len(ff) > 0 {
+				issues = append(issues, &ipvs.VirtualServerIssue{
+					When:   &ipvs.VirtualServerIssue_Delete{Delete: d},
+					Reason: rulesReason(ff),
+				})
+				continue
+			}
+		}
+		retDel = append(retDel, d)
+	}
+	var retUpd []*ipvs.VirtualServer
+	for _, u := range upd {
+		var conv VirtualServerConv
+		if conv.FromPb(u) == nil {
+			if ff := srv.rules.CheckVirtualServer(rules.OpUpdate, conv.VirtualServer); len(ff) > 0 {
+				issues = append(issues, &ipvs.VirtualServerIssue{
+					When:   &ipvs.VirtualServerIssue_Update{Update: u},
+					Reason: rulesReason(ff),
+				})
+				continue
+			}
+		}
+		retUpd = append(retUpd, u)
+	}
+	return retDel, retUpd, issues, nil
+}
+
+//checkRealServersRules evaluates CEL rules; if any change fails them the whole batch is dropped and
+//its changes are reported as issues
+func (srv *ipvsAdminSrv) checkRealServersRules(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, del []*ipvs.RealServerAddress, upd []*ipvs.RealServer, forceUpsert bool) ([]*ipvs.RealServerAddress, []*ipvs.RealServer, []*ipvs.RealServerIssue, error) {
+	if srv.rules == nil || !srv.rules.HasRealServerRules() {
+		return del, upd, nil, nil
+	}
+	vs := ipvsAdm.VirtualServer{Identity: identity}
+	err := srv.admin.ListVirtualServers(ctx, func(v ipvsAdm.VirtualServer) error {
+		if ipvsAdm.IsIdentitiesEq(v.Identity, identity) {
+			vs = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	//real servers virtual server is going to have after batch
+	group := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+	err = srv.admin.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+		group[rs.Address] = rs
+		return nil
+	})
+	if err != nil && !errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+		return nil, nil, nil, err
+	}
+	for _, d := range del {
+		var conv AddressConv
+		conv.FromPb(d)
+		delete(group, conv.Address)
+	}
+	for _, u := range upd {
+		var conv RealServerConv
+		if conv.FromPb(u) == nil {
+			if _, found := group[conv.RealServer.Address]; found || forceUpsert {
+				group[conv.RealServer.Address] = conv.RealServer
+			}
+		}
+	}
+	reals := make([]ipvsAdm.RealServer, 0, len(group))
+	for _, rs := range group {
+		reals = append(reals, rs)
+	}
+
+	//rules see group batch leaves; dropping some of its changes leaves another group rules have not seen,
+	//so batch is refused as a whole once any of its changes fails
+	var issues []*ipvs.RealServerIssue
+	delFailures := make([][]rules.Failure, len(del))
+	for i, d := range del {
+		var conv AddressConv
+		conv.FromPb(d)
+		delFailures[i] = srv.rules.CheckRealServer(rules.OpDelete, vs, ipvsAdm.RealServer{Address: conv.Address}, reals)
+		if len(delFailures[i]) > 0 {
+			issues = append(issues, &ipvs.RealServerIssue{
+				When:   &ipvs.RealServerIssue_Delete{Delete: d},
+				Reason: rulesReason(delFailures[i]),
+			})
+		}
+	}
+	updFailures := make([][]rules.Failure, len(upd))
+	for i, u := range upd {
+		var conv RealServerConv
+		if conv.FromPb(u) == nil {
+			updFailures[i] = srv.rules.CheckRealServer(rules.OpUpdate, vs, conv.RealServer, reals)
+		}
+		if len(updFailures[i]) > 0 {
+			issues = append(issues, &ipvs.RealServerIssue{
+				When:   &ipvs.RealServerIssue_Update{Update: u},
+				Reason: rulesReason(updFailures[i]),
+			})
+		}
+	}
+	if len(issues) == 0 {
+		return del, upd, nil, nil
+	}
+	refused := &ipvs.IssueReason{
+		Code:    ipvs.IssueReason_Unsupported,
+		Message: "batch is refused as a whole: other changes of it fail rules",
+	}
+	for i, d := range del {
+		if len(delFailures[i]) == 0 {
+			issues = append(issues, &ipvs.RealServerIssue{When: &ipvs.RealServerIssue_Delete{Delete: d}, Reason: refused})
+		}
+	}
+	for i, u := range upd {
+		if len(updFailures[i]) == 0 {
+			issues = append(issues, &ipvs.RealServerIssue{When: &ipvs.RealServerIssue_Update{Update: u}, Reason: refused})
+		}
+	}
+	return nil, nil, issues, nil
+}
+
+//rulesReason reason of changes rules refuse; IssueReason has no code of its own for them so they are
+//reported as Unsupported: the change is valid but unsupported by rules of this service, and messages of
+//failed rules tell which
+func rulesReason(ff []rules.Failure) *ipvs.IssueReason {
+	msgs := make([]string, 0, len(ff))
+	for _, f := range ff {
+		msgs = append(msgs, f.String())
+	}
+	return &ipvs.IssueReason{
+		Code:    ipvs.IssueReason_Unsupported,
+		Message: strings.Join(msgs, "; "),
+	}
+}
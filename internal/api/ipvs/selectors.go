@@ -0,0 +1,168 @@
+package ipvs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/meta"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	//SelectorMetadata request metadata key; label selector filters 'ListVirtualServers' and
+	//scopes 'Update*' calls: every virtual server they touch must be matched
+	SelectorMetadata = "x-ipvs-selector"
+
+	//DeleteSelectorMetadata request metadata key; label selector adds to 'delete' of 'UpdateVirtualServers'
+	//all virtual servers it matches and to 'delete' of 'UpdateRealServers' all matched real servers
+	DeleteSelectorMetadata = "x-ipvs-delete-selector"
+)
+
+//selectorFrom reads label selector from request metadata; nil if there is no one
+func (srv *ipvsAdminSrv) selectorFrom(ctx context.Context, key string) (labels.Selector, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get(key)
+	if len(v) == 0 || strings.TrimSpace(strings.Join(v, ",")) == "" {
+		return nil, nil
+	}
+	sel, err := meta.ParseSelector(strings.Join(v, ","))
+	if err != nil {
+		return nil, srv.errWithDetails(codes.InvalidArgument, err.Error(), &errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: key, Description: err.Error()}},
+		})
+	}
+	return sel, nil
+}
+
+//matches tells if labels of virtual server or, if realServer is not empty, of real server are matched by selector
+func (srv *ipvsAdminSrv) matches(sel labels.Selector, identity ipvsAdm.VirtualServerIdentity, realServer ipvsAdm.Address) bool {
+	if sel == nil {
+		return true
+	}
+	if srv.meta == nil {
+		return sel.Matches(labels.Set(nil))
+	}
+	return srv.meta.Matches(sel, identity, realServer)
+}
+
+//checkScope refuses call if it touches virtual servers are not matched by selector
+func (srv *ipvsAdminSrv) checkScope(sel labels.Selector, identities ...ipvsAdm.VirtualServerIdentity) error {
+	if sel == nil {
+		return nil
+	}
+	var violations []*errdetails.PreconditionFailure_Violation
+	var out []string
+	for _, identity := range identities {
+		if !srv.matches(sel, identity, "") {
+			s := ipvsAdm.IdentityString(identity)
+			out = append(out, s)
+			violations = append(violations, &errdetails.PreconditionFailure_Violation{
+				Type:        "SELECTOR",
+				Subject:     s,
+				Description: "virtual server is not matched by selector '" + sel.String() + "'",
+			})
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return srv.errWithDetails(codes.FailedPrecondition,
+		"virtual server(s) "+strings.Join(out, ", ")+" are out of selector '"+sel.String()+"'",
+		&errdetails.PreconditionFailure{Violations: violations})
+}
+
+//selectVirtualServers lists virtual servers are matched by selector
+func (srv *ipvsAdminSrv) selectVirtualServers(ctx context.Context, sel labels.Selector) ([]*ipvs.VirtualServerIdentity, error) {
+	var ret []*ipvs.VirtualServerIdentity
+	err := srv.admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		if !srv.matches(sel, vs.Identity, "") {
+			return nil
+		}
+		pb, e := VirtualServerIdentityConv{Identity: vs.Identity}.ToPb()
+		if e == nil {
+			ret = append(ret, pb)
+		}
+		return e
+	})
+	return ret, err
+}
+
+//selectRealServers lists real servers of virtual server are matched by selector
+func (srv *ipvsAdminSrv) selectRealServers(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, sel labels.Selector) ([]*ipvs.RealServerAddress, error) {
+	var ret []*ipvs.RealServerAddress
+	err := srv.admin.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+		if !srv.matches(sel, identity, rs.Address) {
+			return nil
+		}
+		host, port, e := rs.Address.ToHostPort()
+		if e == nil {
+			ret = append(ret, &ipvs.RealServerAddress{Host: host, Port: port})
+		}
+		return e
+	})
+	return ret, err
+}
+
+//deleteVirtualServersBySelector adds to del virtual servers are matched by delete selector
+func (srv *ipvsAdminSrv) deleteVirtualServersBySelector(ctx context.Context, del []*ipvs.VirtualServerIdentity) ([]*ipvs.VirtualServerIdentity, error) {
+	sel, err := srv.selectorFrom(ctx, DeleteSelectorMetadata)
+	if err != nil || sel == nil {
+		return del, err
+	}
+	var selected []*ipvs.VirtualServerIdentity
+	if selected, err = srv.selectVirtualServers(ctx, sel); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, d := range del {
+		var conv VirtualServerIdentityConv
+		if conv.FromPb(d) == nil {
+			seen[ipvsAdm.IdentityString(conv.Identity)] = true
+		}
+	}
+	ret := append([]*ipvs.VirtualServerIdentity(nil), del...)
+	for _, d := range selected {
+		var conv VirtualServerIdentityConv
+		if conv.FromPb(d) == nil && !seen[ipvsAdm.IdentityString(conv.Identity)] {
+			ret = append(ret, d)
+		}
+	}
+	return ret, nil
+}
+
+//deleteRealServersBySelector adds to del real servers of virtual server are matched by delete selector
+func (srv *ipvsAdminSrv) deleteRealServersBySelector(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, del []*ipvs.RealServerAddress) ([]*ipvs.RealServerAddress, error) {
+	sel, err := srv.selectorFrom(ctx, DeleteSelectorMetadata)
+	if err != nil || sel == nil {
+		return del, err
+	}
+	var selected []*ipvs.RealServerAddress
+	selected, err = srv.selectRealServers(ctx, identity, sel)
+	if errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+		return del, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[ipvsAdm.Address]bool)
+	for _, d := range del {
+		var conv AddressConv
+		conv.FromPb(d)
+		seen[conv.Address] = true
+	}
+	ret := append([]*ipvs.RealServerAddress(nil), del...)
+	for _, d := range selected {
+		var conv AddressConv
+		conv.FromPb(d)
+		if !seen[conv.Address] {
+			ret = append(ret, d)
+		}
+	}
+	return ret, nil
+}
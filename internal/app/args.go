@@ -4,10 +4,16 @@ import (
 	"flag"
 )
 
-//ConfigFile file with actual app config
-var ConfigFile string
+var (
+	//ConfigFile file with actual app config
+	ConfigFile string
+
+	//SkipStateReplay do not replay state store into the kernel table
+	SkipStateReplay bool
+)
 
 func init() {
 	flag.StringVar(&ConfigFile, "config", "", "app config file")
+	flag.BoolVar(&SkipStateReplay, "skip-state-replay", false, "do not replay stored state into the kernel table")
 	flag.Parse()
 }
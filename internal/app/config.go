@@ -17,6 +17,157 @@ metrics:
 server:
   endpoint: tcp://127.0.0.1:9006
   graceful-shutdown: 30s
+  tls:
+    cert: /etc/ipvs/tls/server.crt
+    key: /etc/ipvs/tls/server.key
+    client-ca: /etc/ipvs/tls/clients-ca.crt
+    min-version: "1.2"
+  unix-socket:
+    endpoint: unix:///run/ipvs/api.sock
+    mode: "0660"
+    owner: root
+    group: ipvs
+
+state-store:
+  enable: true
+  dir: /var/lib/ipvs
+  check-interval: 10s
+
+journal:
+  file: /var/lib/ipvs/journal.jsonl
+  max-entries: 1000
+
+ownership:
+  file: /var/lib/ipvs/owned.json
+  strict: true
+
+metadata:
+  file: /var/lib/ipvs/metadata.json
+
+policy:
+  virtual-server-cidrs: [10.0.0.0/24]
+  virtual-server-ports: ["80", "443", "8000-8999"]
+  real-server-cidrs: [10.0.1.0/24]
+  schedule-methods: [rr, wrr, wlc]
+  packet-forwarders: [dr, tun]
+  max-real-servers: 100
+
+rules:
+  - name: sh-needs-dr
+    target: real-server
+    expression: 'virtualServer.scheduleMethod != "sh" || realServer.packetForwarder == "dr"'
+    message: sh scheduler needs dr forwarder
+
+admission:
+  webhooks:
+    - name: change-management
+      url: http://127.0.0.1:8088/admit
+      timeout: 2s
+      failure-policy: fail
+
+notify:
+  webhooks:
+    - name: cmdb
+      url: http://127.0.0.1:8089/ipvs-events
+      secret: s3cr3t
+      sources: [api, discovery, drift]
+  max-attempts: 5
+  backoff: 1s
+  dead-letter-file: /var/lib/ipvs/notify-dead-letter.jsonl
+
+authz:
+  roles:
+    - name: viewer
+      methods: [ListVirtualServers, FindVirtualServer]
+    - name: admin
+      methods: ["*"]
+  bindings:
+    - role: admin
+      principals: ["mtls:ops-*", "unix-user:root"]
+    - role: viewer
+      principals: ["*"]
+
+jwt:
+  jwks-file: /etc/ipvs/jwks.json
+  issuer: https://idp.example
+  audience: ipvs
+  groups-claim: groups
+
+audit:
+  file: /var/log/ipvs/audit.jsonl
+  max-size-mb: 100
+  max-backups: 10
+  journald: true
+
+rate-limit:
+  rate: 100
+  burst: 1000
+  max-batch-size: 1000
+  overrides:
+    - principals: ["mtls:ops-*", "unix-user:root"]
+      rate: 1000
+      burst: 10000
+      max-batch-size: 10000
+
+services:
+  reassert-interval: 1m
+  reassert-on-sighup: true
+  virtual-servers:
+    - virtual-server: tcp://10.0.0.1:80
+      schedule-method: wrr
+      real-servers:
+        - address: 10.0.1.1:8080
+          packet-forwarder: nat
+          weight: 1
+
+healthcheck:
+  weights-file: /var/lib/ipvs/healthcheck-weights.json
+  services:
+    - virtual-server: tcp://10.0.0.1:80
+      on-failure: quiesce
+      check:
+        type: http
+        interval: 5s
+        timeout: 2s
+        rise: 2
+        fall: 3
+        http:
+          path: /healthz
+          expect-status: [200]
+      sorry-server:
+        address: 10.0.9.1:80
+        packet-forwarder: nat
+        weight: 1
+
+leases:
+  file: /var/lib/ipvs/leases.json
+  default-ttl: 30s
+  max-ttl: 5m
+  drain-period: 10s
+  virtual-servers:
+    - virtual-server: tcp://10.0.0.1:80
+      owners: ["mtls:team-a-*"]
+
+discovery:
+  files:
+    dir: /etc/ipvs/services.d
+    rescan-interval: 1m
+  dns:
+    nameserver: 127.0.0.1:53
+    services:
+      - virtual-server: tcp://10.0.0.1:80
+        name: _http._tcp.backend.service.local
+        type: srv
+        srv-weights: true
+  kubernetes:
+    kubeconfig: /etc/ipvs/kubeconfig
+    namespace: default
+  consul:
+    address: http://127.0.0.1:8500
+    services:
+      - virtual-server: tcp://10.0.0.3:80
+        service: web
+        tag: ipvs
 */
 
 const (
@@ -28,9 +179,97 @@ const (
 	//ServerGracefulShutdown ...
 	ServerGracefulShutdown = config.ValueDuration("server/graceful-shutdown")
 
+	//ServerTLSCert server certificate; mutual TLS is enabled when it is set
+	ServerTLSCert = config.ValueString("server/tls/cert")
+	//ServerTLSKey private key of server certificate
+	ServerTLSKey = config.ValueString("server/tls/key")
+	//ServerTLSClientCA CA client certificates are verified by
+	ServerTLSClientCA = config.ValueString("server/tls/client-ca")
+	//ServerTLSMinVersion minimal TLS version
+	ServerTLSMinVersion = config.ValueString("server/tls/min-version")
+	//ServerTLSInternalEndpoint plain endpoint API server listens on behind TLS front
+	ServerTLSInternalEndpoint = config.ValueString("server/tls/internal-endpoint")
+
+	//ServerUnixSocketEndpoint additional unix domain socket endpoint API server listens on
+	ServerUnixSocketEndpoint = config.ValueString("server/unix-socket/endpoint")
+	//ServerUnixSocketMode file mode of unix domain socket
+	ServerUnixSocketMode = config.ValueString("server/unix-socket/mode")
+	//ServerUnixSocketOwner owner (user name or uid) of unix domain socket
+	ServerUnixSocketOwner = config.ValueString("server/unix-socket/owner")
+	//ServerUnixSocketGroup group (name or gid) of unix domain socket
+	ServerUnixSocketGroup = config.ValueString("server/unix-socket/group")
+
 	//MetricsEnable ...
 	MetricsEnable = config.ValueBool("metrics/enable")
 
 	//TraceEnable ...
 	TraceEnable = config.ValueBool("trace/enable")
+
+	//StateStoreEnable keep state accepted by API on disk and replay it
+	StateStoreEnable = config.ValueBool("state-store/enable")
+	//StateStoreDir directory of state store
+	StateStoreDir = config.ValueString("state-store/dir")
+	//StateStoreCheckInterval how often the kernel table is checked for being empty
+	StateStoreCheckInterval = config.ValueDuration("state-store/check-interval")
+
+	//JournalFile file journal of mutating calls is kept in; journal is kept in memory only if empty
+	JournalFile = config.ValueString("journal/file")
+	//JournalMaxEntries how many latest journal entries are kept
+	JournalMaxEntries = config.ValueInt("journal/max-entries")
+
+	//OwnershipFile file virtual servers are created by this service are remembered in
+	OwnershipFile = config.ValueString("ownership/file")
+	//OwnershipStrict refuse changes of foreign virtual servers unless they are overridden
+	OwnershipStrict = config.ValueBool("ownership/strict")
+
+	//MetadataFile file labels and annotations of virtual and real servers are kept in
+	MetadataFile = config.ValueString("metadata/file")
+
+	//PolicyConfig guardrails of changes are accepted by API
+	PolicyConfig = config.ValueObject("policy")
+
+	//Rules CEL rules changes accepted by API are checked by
+	Rules = config.ValueObject("rules")
+
+	//AdmissionConfig webhooks approve changes accepted by API before they are applied
+	AdmissionConfig = config.ValueObject("admission")
+
+	//NotifyConfig webhooks changes of the kernel table are sent to
+	NotifyConfig = config.ValueObject("notify")
+
+	//AuthzConfig roles of callers and methods they are allowed to call
+	AuthzConfig = config.ValueObject("authz")
+
+	//JWTConfig bearer token authentication
+	JWTConfig = config.ValueObject("jwt")
+
+	//AuditConfig audit log of mutating calls
+	AuditConfig = config.ValueObject("audit")
+
+	//RateLimitConfig rate and batch size limits of Update* calls of every caller
+	RateLimitConfig = config.ValueObject("rate-limit")
+
+	//HealthcheckServices health checks of virtual servers
+	HealthcheckServices = config.ValueObject("healthcheck/services")
+
+	//HealthcheckWeightsFile weights of real servers health checks quiesce and priority group overrides are kept in
+	HealthcheckWeightsFile = config.ValueString("healthcheck/weights-file")
+
+	//LeasesConfig real server self-registration by leases
+	LeasesConfig = config.ValueObject("leases")
+
+	//Services virtual servers with their real servers are applied at startup
+	Services = config.ValueObject("services")
+
+	//DiscoveryFiles services are discovered from directory of YAML/JSON files
+	DiscoveryFiles = config.ValueObject("discovery/files")
+
+	//DiscoveryDNS real servers of virtual servers are discovered from DNS SRV or A/AAAA records
+	DiscoveryDNS = config.ValueObject("discovery/dns")
+
+	//DiscoveryKubernetes virtual servers are discovered from annotated Services and their EndpointSlices
+	DiscoveryKubernetes = config.ValueObject("discovery/kubernetes")
+
+	//DiscoveryConsul real servers of virtual servers are discovered from passing instances of Consul services
+	DiscoveryConsul = config.ValueObject("discovery/consul")
 )
@@ -0,0 +1,302 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thataway/common-lib/logger"
+)
+
+/*//Sample of config
+audit:
+  file: /var/log/ipvs/audit.jsonl
+  max-size-mb: 100
+  max-backups: 10
+  journald: true
+  head-file: /var/lib/ipvs/audit-head.json
+*/
+
+//Outcomes of item
+const (
+	//OutcomeApplied item is applied
+	OutcomeApplied = "applied"
+
+	//OutcomeIssue item is not applied and is reported as issue
+	OutcomeIssue = "issue"
+
+	//OutcomeRejected call is refused before any item is applied
+	OutcomeRejected = "rejected"
+
+	//OutcomeFailed call is failed while items were being applied; item may be applied or not
+	OutcomeFailed = "failed"
+)
+
+type (
+	//Config audit config; records go to rotating file and/or journald; head file keeps the last record
+	//seq and hash, it is required when records go to journald only, since journald is not read back
+	Config struct {
+		File       string `mapstructure:"file"`
+		MaxSizeMB  int    `mapstructure:"max-size-mb"`
+		MaxBackups int    `mapstructure:"max-backups"`
+		Journald   bool   `mapstructure:"journald"`
+		HeadFile   string `mapstructure:"head-file"`
+	}
+
+	//Record one mutating call; Hash is SHA-256 of record with empty Hash and it covers PrevHash
+	//so records are chained and change or removal of any of them breaks the chain
+	Record struct {
+		Seq      uint64          `json:"seq"`
+		Time     time.Time       `json:"time"`
+		Method   string          `json:"method"`
+		Caller   Caller          `json:"caller"`
+		Request  json.RawMessage `json:"request,omitempty"`
+		Items    []Item          `json:"items"`
+		Issues   json.RawMessage `json:"issues,omitempty"`
+		Code     string          `json:"code"`
+		Error    string          `json:"error,omitempty"`
+		PrevHash string          `json:"prevHash"`
+		Hash     string          `json:"hash,omitempty"`
+	}
+
+	//Caller identity of caller
+	Caller struct {
+		Address    string          `json:"address,omitempty"`
+		Principals []string        `json:"principals,omitempty"`
+		Roles      []string        `json:"roles,omitempty"`
+		Claims     json.RawMessage `json:"claims,omitempty"`
+		Peer       *Peer           `json:"peer,omitempty"`
+	}
+
+	//Peer credentials of local process called over unix domain socket
+	Peer struct {
+		UID uint32 `json:"uid"`
+		GID uint32 `json:"gid"`
+		PID int32  `json:"pid"`
+	}
+
+	//Item outcome of one item of call
+	Item struct {
+		Op            string `json:"op"`
+		VirtualServer string `json:"virtualServer"`
+		RealServer    string `json:"realServer,omitempty"`
+		Outcome       string `json:"outcome"`
+		Reason        string `json:"reason,omitempty"`
+	}
+
+	//Option option of audit log
+	Option interface {
+		isAuditOption()
+	}
+
+	//WithResolver adds resolver of caller principals
+	WithResolver struct {
+		Resolver func(ctx context.Context) []string
+	}
+
+	//Log writes records chained by hash to sinks
+	Log struct {
+		sinks     []sink
+		resolvers []func(ctx context.Context) []string
+		records   prometheus.Counter
+		errs      *prometheus.CounterVec
+
+		mx       sync.Mutex
+		seq      uint64
+		prevHash string
+	}
+
+	sink interface {
+		name() string
+		write(r Record, line []byte) error
+		close() error
+	}
+)
+
+func (WithResolver) isAuditOption() {}
+
+const (
+	defMaxSizeMB  = 100
+	defMaxBackups = 10
+)
+
+//New makes audit log; chain goes on from the last record of file or head file if there is one
+func New(conf Config, opts ...Option) (*Log, error) {
+	const api = "audit/New"
+
+	if conf.File == "" && !conf.Journald {
+		return nil, errors.Errorf("%s: neither file nor journald is set", api)
+	}
+	if conf.File == "" && conf.HeadFile == "" {
+		return nil, errors.Errorf("%s: head file is not set; chain would restart from zero", api)
+	}
+	if conf.MaxSizeMB <= 0 {
+		conf.MaxSizeMB = defMaxSizeMB
+	}
+	if conf.MaxBackups <= 0 {
+		conf.MaxBackups = defMaxBackups
+	}
+	ret := newLog()
+	for _, o := range opts {
+		if r, ok := o.(WithResolver); ok && r.Resolver != nil {
+			ret.resolvers = append(ret.resolvers, r.Resolver)
+		}
+	}
+	if conf.File != "" {
+		f, last, err := openFileSink(conf.File, int64(conf.MaxSizeMB)<<20, conf.MaxBackups)
+		if err != nil {
+			return nil, errors.Wrap(err, api)
+		}
+		ret.sinks = append(ret.sinks, f)
+		ret.goOn(last)
+	}
+	if conf.Journald {
+		j, err := openJournald()
+		if err != nil {
+			ret.Close()
+			return nil, errors.Wrap(err, api)
+		}
+		ret.sinks = append(ret.sinks, j)
+	}
+	//head goes the last, so it never runs ahead of records are written
+	if conf.HeadFile != "" {
+		h, last, err := openHeadSink(conf.HeadFile)
+		if err != nil {
+			ret.Close()
+			return nil, errors.Wrap(err, api)
+		}
+		ret.sinks = append(ret.sinks, h)
+		ret.goOn(last)
+	}
+	return ret, nil
+}
+
+func newLog() *Log {
+	return &Log{
+		records: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ipvs_audit_records_total",
+			Help: "audit records are written",
+		}),
+		errs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ipvs_audit_write_errors_total",
+			Help: "audit records are failed to be written",
+		}, []string{"sink"}),
+	}
+}
+
+//goOn makes chain go on from the latest of records sinks have kept
+func (l *Log) goOn(last *Record) {
+	if last != nil && last.Seq > l.seq {
+		l.seq, l.prevHash = last.Seq, last.Hash
+	}
+}
+
+//Principals of caller given by resolvers
+func (l *Log) Principals(ctx context.Context) []string {
+	var ret []string
+	for _, r := range l.resolvers {
+		ret = append(ret, r(ctx)...)
+	}
+	return ret
+}
+
+//Write numbers, chains and writes record to every sink; error is given when any of sinks fails
+func (l *Log) Write(ctx context.Context, r Record) error {
+	const api = "audit/Write"
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	r.Seq, r.Time, r.PrevHash, r.Hash = l.seq+1, time.Now().UTC(), l.prevHash, ""
+	h, err := Hash(r)
+	if err != nil {
+		return errors.Wrap(err, api)
+	}
+	r.Hash = h
+	var line []byte
+	if line, err = json.Marshal(r); err != nil {
+		return errors.Wrap(err, api)
+	}
+	l.seq, l.prevHash = r.Seq, r.Hash
+	l.records.Inc()
+	var ret error
+	for _, s := range l.sinks {
+		if e := s.write(r, line); e != nil {
+			l.errs.WithLabelValues(s.name()).Inc()
+			logger.Errorf(ctx, "audit: write record #%v to %s: %v", r.Seq, s.name(), e)
+			if ret == nil {
+				ret = errors.Wrapf(e, "%s: %s", api, s.name())
+			}
+		}
+	}
+	return ret
+}
+
+//Close closes sinks
+func (l *Log) Close() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	for _, s := range l.sinks {
+		_ = s.close()
+	}
+	l.sinks = nil
+}
+
+//Describe impl prometheus.Collector
+func (l *Log) Describe(ch chan<- *prometheus.Desc) {
+	l.records.Describe(ch)
+	l.errs.Describe(ch)
+}
+
+//Collect impl prometheus.Collector
+func (l *Log) Collect(ch chan<- prometheus.Metric) {
+	l.records.Collect(ch)
+	l.errs.Collect(ch)
+}
+
+//Hash hex of SHA-256 of record with empty hash
+func Hash(r Record) (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//Verify checks chain of records read from r; prevHash is hash of record preceding the first one
+//(empty for the very first record); it gives the last record
+func Verify(r io.Reader, prevHash string) (last Record, err error) {
+	const api = "audit/Verify"
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	var seq uint64
+	for n := 1; sc.Scan(); n++ {
+		var rec Record
+		if err = json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return last, errors.Wrapf(err, "%s: line %v", api, n)
+		}
+		var h string
+		if h, err = Hash(rec); err != nil {
+			return last, errors.Wrapf(err, "%s: line %v", api, n)
+		}
+		switch {
+		case h != rec.Hash:
+			return last, errors.Errorf("%s: line %v: record #%v is altered", api, n, rec.Seq)
+		case rec.PrevHash != prevHash:
+			return last, errors.Errorf("%s: line %v: record #%v does not follow previous one", api, n, rec.Seq)
+		case seq != 0 && rec.Seq != seq+1:
+			return last, errors.Errorf("%s: line %v: record #%v follows #%v", api, n, rec.Seq, seq)
+		}
+		last, prevHash, seq = rec, rec.Hash, rec.Seq
+	}
+	return last, errors.Wrap(sc.Err(), api)
+}
@@ -0,0 +1,190 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Log(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := New(Config{File: file}, WithResolver{Resolver: func(context.Context) []string {
+		return []string{"mtls:ops"}
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"mtls:ops"}, l.Principals(ctx))
+	for _, m := range []string{"UpdateVirtualServers", "UpdateRealServers"} {
+		assert.NoError(t, l.Write(ctx, Record{
+			Method:  m,
+			Caller:  Caller{Address: "127.0.0.1:5000", Principals: []string{"mtls:ops"}},
+			Request: json.RawMessage(`{"update":[{"identity":{"firewallMark":5}}]}`),
+			Items:   []Item{{Op: "update", VirtualServer: "fwmark://5", Outcome: OutcomeApplied}},
+			Code:    "OK",
+		}))
+	}
+	l.Close()
+	assert.Equal(t, 2.0, testutil.ToFloat64(l.records))
+
+	data, _ := ioutil.ReadFile(file)
+	last, err := Verify(bytes.NewReader(data), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(2), last.Seq)
+		assert.Equal(t, "UpdateRealServers", last.Method)
+	}
+
+	//chain goes on after restart
+	if l, err = New(Config{File: file}); !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, l.Write(ctx, Record{Method: "Rollback", Code: "OK"}))
+	l.Close()
+	data, _ = ioutil.ReadFile(file)
+	last, err = Verify(bytes.NewReader(data), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(3), last.Seq)
+	}
+
+	//altered, removed and reordered records break chain
+	lines := strings.SplitAfter(strings.TrimSpace(string(data)), "\n")
+	_, err = Verify(strings.NewReader(strings.Replace(string(data), "127.0.0.1:5000", "127.0.0.2:5000", 1)), "")
+	assert.Error(t, err)
+	_, err = Verify(strings.NewReader(lines[0]+lines[2]), "")
+	assert.Error(t, err)
+	_, err = Verify(strings.NewReader(lines[1]+lines[0]), "")
+	assert.Error(t, err)
+
+	//torn last record is dropped and chain goes on from the previous one
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _ = f.Write([]byte(`{"seq":4,"method":"Upd`))
+	_ = f.Close()
+	if l, err = New(Config{File: file}); !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, l.Write(ctx, Record{Method: "Rollback", Code: "OK"}))
+	l.Close()
+	data, _ = ioutil.ReadFile(file)
+	last, err = Verify(bytes.NewReader(data), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(4), last.Seq)
+	}
+
+	_, err = New(Config{})
+	assert.Error(t, err)
+	_, err = New(Config{Journald: true})
+	assert.Error(t, err)
+}
+
+func Test_Rotation(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	s, _, err := openFileSink(file, 1024, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l := newLog()
+	l.sinks = []sink{s}
+	big := json.RawMessage(`"` + strings.Repeat("x", 600) + `"`)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, l.Write(ctx, Record{Method: "UpdateVirtualServers", Request: big, Code: "OK"}))
+	}
+	l.Close()
+	_, err = os.Stat(backupName(file, 3))
+	assert.True(t, os.IsNotExist(err))
+
+	//backups and current file make one chain; the oldest backups are dropped
+	var prev string
+	var last Record
+	for i, p := range []string{backupName(file, 2), backupName(file, 1), file} {
+		data, e := ioutil.ReadFile(p)
+		if !assert.NoError(t, e) {
+			return
+		}
+		if i == 0 {
+			var first Record
+			_ = json.Unmarshal(bytes.SplitN(data, []byte("\n"), 2)[0], &first)
+			assert.Equal(t, uint64(3), first.Seq)
+			prev = first.PrevHash
+		}
+		last, err = Verify(bytes.NewReader(data), prev)
+		if !assert.NoError(t, err) {
+			return
+		}
+		prev = last.Hash
+	}
+	assert.Equal(t, uint64(5), last.Seq)
+
+	//chain is restored from the latest backup when file is just rotated
+	assert.NoError(t, os.Rename(file, backupName(file, 1)))
+	var r *Record
+	if _, r, err = openFileSink(file, 1024, 2); assert.NoError(t, err) && assert.NotNil(t, r) {
+		assert.Equal(t, uint64(5), r.Seq)
+	}
+}
+
+func Test_Journald(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("journald is linux only")
+	}
+	sock := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	prev := journaldSocket
+	journaldSocket = sock
+	defer func() { journaldSocket = prev }()
+
+	head := filepath.Join(t.TempDir(), "audit-head.json")
+	l, err := New(Config{Journald: true, HeadFile: head})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	assert.NoError(t, l.Write(context.Background(), Record{Method: "UpdateVirtualServers", Code: "OK"}))
+	buf := make([]byte, 64<<10)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFromUnix(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n") {
+		kv := strings.SplitN(f, "=", 2)
+		fields[kv[0]] = kv[1]
+	}
+	assert.Equal(t, "ipvs-audit", fields["SYSLOG_IDENTIFIER"])
+	assert.Equal(t, "1", fields["IPVS_AUDIT_SEQ"])
+	var r Record
+	if assert.NoError(t, json.Unmarshal([]byte(fields["MESSAGE"]), &r)) {
+		assert.Equal(t, r.Hash, fields["IPVS_AUDIT_HASH"])
+		h, _ := Hash(r)
+		assert.Equal(t, r.Hash, h)
+	}
+
+	//chain goes on from head file after restart
+	l.Close()
+	if l, err = New(Config{Journald: true, HeadFile: head}); !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	assert.Equal(t, uint64(1), l.seq)
+	assert.Equal(t, r.Hash, l.prevHash)
+}
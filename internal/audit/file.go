@@ -0,0 +1,195 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+//fileSink appends records to file; when file grows over max size it is rotated to 'file.1', 'file.2' and so on
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openFileSink(path string, maxSize int64, maxBackups int) (*fileSink, *Record, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, nil, err
+	}
+	if err := truncateTornLine(path); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	ret := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := ret.open(); err != nil {
+		return nil, nil, err
+	}
+	//chain goes on from the last record of file or of its latest backup when file is just rotated
+	var last *Record
+	for _, p := range []string{path, backupName(path, 1)} {
+		line, err := lastLine(p)
+		if err != nil && !os.IsNotExist(err) {
+			_ = ret.close()
+			return nil, nil, err
+		}
+		if len(line) > 0 {
+			var r Record
+			if err = json.Unmarshal(line, &r); err != nil {
+				_ = ret.close()
+				return nil, nil, errors.Wrapf(err, "last record of '%s'", p)
+			}
+			last = &r
+			break
+		}
+	}
+	return ret, last, nil
+}
+
+func (s *fileSink) name() string {
+	return "file"
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	var st os.FileInfo
+	if st, err = f.Stat(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.f, s.size = f, st.Size()
+	return nil
+}
+
+func (s *fileSink) write(_ Record, line []byte) error {
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(line))+1 > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(append(line, '\n'))
+	s.size += int64(n)
+	if err == nil {
+		err = s.f.Sync()
+	}
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	_ = os.Remove(backupName(s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupName(s.path, i), backupName(s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, backupName(s.path, 1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func backupName(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+//lastLine reads file from its end until the last complete line is found
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var st os.FileInfo
+	if st, err = f.Stat(); err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	for chunk := int64(64 << 10); ; chunk *= 2 {
+		if chunk > size {
+			chunk = size
+		}
+		buf := make([]byte, chunk)
+		if _, err = f.ReadAt(buf, size-chunk); err != nil && err != io.EOF {
+			return nil, err
+		}
+		end := len(buf)
+		for end > 0 && (buf[end-1] == '\n' || buf[end-1] == '\r') {
+			end--
+		}
+		for i := end - 1; i >= 0; i-- {
+			if buf[i] == '\n' {
+				return buf[i+1 : end], nil
+			}
+		}
+		if chunk == size {
+			return buf[:end], nil
+		}
+	}
+}
+
+//truncateTornLine drops the last line of file if it is not terminated by newline; such line is left
+//by write broken off by crash, so the record is not complete and chain goes on from the previous one
+func truncateTornLine(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var st os.FileInfo
+	if st, err = f.Stat(); err != nil {
+		return err
+	}
+	size := st.Size()
+	if size == 0 {
+		return nil
+	}
+	end := size
+	buf := make([]byte, 64<<10)
+	for end > 0 {
+		chunk := int64(len(buf))
+		if chunk > end {
+			chunk = end
+		}
+		if _, err = f.ReadAt(buf[:chunk], end-chunk); err != nil && err != io.EOF {
+			return err
+		}
+		if end == size && buf[chunk-1] == '\n' {
+			return nil
+		}
+		if i := bytes.LastIndexByte(buf[:chunk], '\n'); i >= 0 {
+			end = end - chunk + int64(i) + 1
+			break
+		}
+		end -= chunk
+	}
+	if err = f.Truncate(end); err == nil {
+		err = f.Sync()
+	}
+	return err
+}
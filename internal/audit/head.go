@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+//headSink keeps seq and hash of the last record, so chain goes on after restart when records go to journald only
+type headSink struct {
+	path string
+}
+
+type chainHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+func openHeadSink(path string) (*headSink, *Record, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, nil, err
+	}
+	ret := &headSink{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ret, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var h chainHead
+	if err = json.Unmarshal(data, &h); err != nil {
+		return nil, nil, errors.Wrapf(err, "'%s'", path)
+	}
+	return ret, &Record{Seq: h.Seq, Hash: h.Hash}, nil
+}
+
+func (s *headSink) name() string {
+	return "head-file"
+}
+
+//write writes head file atomically
+func (s *headSink) write(r Record, _ []byte) error {
+	data, err := json.Marshal(chainHead{Seq: r.Seq, Hash: r.Hash})
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*"); err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *headSink) close() error {
+	return nil
+}
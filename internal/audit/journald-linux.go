@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package audit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+//journaldSocket socket of journald native protocol
+var journaldSocket = "/run/systemd/journal/socket"
+
+//journaldSink sends records to journald by native protocol; record is in MESSAGE field
+type journaldSink struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+func openJournald() (*journaldSink, error) {
+	addr := &net.UnixAddr{Name: journaldSocket, Net: "unixgram"}
+	if _, err := os.Stat(journaldSocket); err != nil {
+		return nil, errors.Wrap(err, "journald socket")
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn: conn, addr: addr}, nil
+}
+
+func (s *journaldSink) name() string {
+	return "journald"
+}
+
+func (s *journaldSink) write(r Record, line []byte) error {
+	var b bytes.Buffer
+	field := func(k string, v []byte) {
+		if bytes.IndexByte(v, '\n') < 0 {
+			b.WriteString(k + "=")
+			b.Write(v)
+			b.WriteByte('\n')
+			return
+		}
+		b.WriteString(k + "\n")
+		_ = binary.Write(&b, binary.LittleEndian, uint64(len(v)))
+		b.Write(v)
+		b.WriteByte('\n')
+	}
+	field("MESSAGE", line)
+	field("PRIORITY", []byte("6"))
+	field("SYSLOG_IDENTIFIER", []byte("ipvs-audit"))
+	field("IPVS_AUDIT_SEQ", []byte(strconv.FormatUint(r.Seq, 10)))
+	field("IPVS_AUDIT_METHOD", []byte(r.Method))
+	field("IPVS_AUDIT_HASH", []byte(r.Hash))
+	_, _, err := s.conn.WriteMsgUnix(b.Bytes(), nil, s.addr)
+	if err == nil || !isTooLarge(err) {
+		return err
+	}
+	//large entries are passed by descriptor of unlinked file
+	return s.writeByFile(b.Bytes())
+}
+
+func (s *journaldSink) writeByFile(data []byte) error {
+	f, err := ioutil.TempFile("/dev/shm", "ipvs-audit-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_ = os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	_, _, err = s.conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), s.addr)
+	return err
+}
+
+func (s *journaldSink) close() error {
+	return s.conn.Close()
+}
+
+func isTooLarge(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package audit
+
+import (
+	"github.com/pkg/errors"
+)
+
+func openJournald() (sink, error) {
+	return nil, errors.New("journald is not supported on this platform")
+}
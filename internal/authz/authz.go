@@ -0,0 +1,388 @@
+package authz
+
+import (
+	"context"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+/*//Sample of config
+authz:
+  roles:
+    - name: viewer
+      methods: [ListVirtualServers, FindVirtualServer]
+    - name: web-backends
+      methods: [ListVirtualServers, FindVirtualServer, UpdateRealServers]
+      virtual-server-cidrs: [10.0.0.0/24]
+      virtual-server-ports: ["80", "443"]
+      selector: team=web
+    - name: admin
+      methods: ["*"]
+    - name: web-operators
+      methods: [UpdateRealServers, UpdateMetadata, UpdateLeases, OverridePriorityGroup]
+      selector: team=web
+  bindings:
+    - role: admin
+      principals: ["mtls:ops-*", "unix-user:root"]
+    - role: web-backends
+      principals: ["mtls:web-deployer"]
+    - role: viewer
+      principals: ["*"]
+*/
+
+//PrincipalAnonymous principal of caller nobody has identified
+const PrincipalAnonymous = "anonymous"
+
+//AllMethods allows every method of API
+const AllMethods = "*"
+
+//Methods of API are served over HTTP; roles grant them like gRPC methods
+const (
+	//MethodRollback rolls the kernel table back to revision of journal
+	MethodRollback = "Rollback"
+
+	//MethodUpdateMetadata sets and removes labels and annotations
+	MethodUpdateMetadata = "UpdateMetadata"
+
+	//MethodUpdateLeases registers, renews and releases leases of real servers
+	MethodUpdateLeases = "UpdateLeases"
+
+	//MethodOverridePriorityGroup overrides active priority group of virtual server
+	MethodOverridePriorityGroup = "OverridePriorityGroup"
+)
+
+//MethodListVirtualServers gRPC method reads of state over HTTP are granted as
+const MethodListVirtualServers = "ListVirtualServers"
+
+//HTTPMethods methods of API are served over HTTP
+var HTTPMethods = []string{MethodRollback, MethodUpdateMetadata, MethodUpdateLeases, MethodOverridePriorityGroup}
+
+type (
+	//Config authorization config; callers get roles bound to their principals
+	Config struct {
+		Roles    []RoleConfig    `mapstructure:"roles"`
+		Bindings []BindingConfig `mapstructure:"bindings"`
+	}
+
+	//RoleConfig methods role allows; empty CIDRs, ports and selector do not restrict virtual servers
+	RoleConfig struct {
+		Name               string   `mapstructure:"name"`
+		Methods            []string `mapstructure:"methods"`
+		VirtualServerCIDRs []string `mapstructure:"virtual-server-cidrs"`
+		VirtualServerPorts []string `mapstructure:"virtual-server-ports"`
+		Selector           string   `mapstructure:"selector"`
+	}
+
+	//BindingConfig gives role to principals; principals are glob patterns like 'mtls:ops-*'
+	BindingConfig struct {
+		Role       string   `mapstructure:"role"`
+		Principals []string `mapstructure:"principals"`
+	}
+
+	//Resolver tells principals of caller, like 'mtls:<subject>'
+	Resolver func(ctx context.Context) []string
+
+	//Option option of authorizer
+	Option interface {
+		isAuthzOption()
+	}
+
+	//WithResolver adds source of caller principals
+	WithResolver struct {
+		Resolver
+	}
+
+	//Authorizer grants calls of API by roles of caller
+	Authorizer struct {
+		roles     map[string]*role
+		bindings  []binding
+		resolvers []Resolver
+		denials   *prometheus.CounterVec
+	}
+
+	//Grants roles which allow method to caller; virtual servers caller touches must be in scope of one of them
+	Grants struct {
+		a          *Authorizer
+		method     string
+		principals []string
+		roles      []*role
+	}
+
+	role struct {
+		name     string
+		methods  map[string]bool
+		nets     []*net.IPNet
+		ports    []portRange
+		selector labels.Selector
+	}
+
+	binding struct {
+		role     *role
+		patterns []string
+	}
+
+	portRange struct {
+		from, to uint32
+	}
+
+	grantsKey struct{}
+)
+
+func (WithResolver) isAuthzOption() {}
+
+var _ prometheus.Collector = (*Authorizer)(nil)
+
+//New makes authorizer
+func New(conf Config, opts ...Option) (*Authorizer, error) {
+	const api = "authz/New"
+
+	known := make(map[string]bool)
+	for _, m := range ipvs.IpvsAdmin_ServiceDesc.Methods {
+		known[m.MethodName] = true
+	}
+	for _, m := range HTTPMethods {
+		known[m] = true
+	}
+	ret := &Authorizer{
+		roles: make(map[string]*role),
+		denials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ipvs",
+			Subsystem: "authz",
+			Name:      "denials_total",
+			Help:      "Count of API calls are denied by authorization",
+		}, []string{"method"}),
+	}
+	for i, rc := range conf.Roles {
+		if rc.Name == "" {
+			return nil, errors.Errorf("%s: role #%v has no name", api, i)
+		}
+		if ret.roles[rc.Name] != nil {
+			return nil, errors.Errorf("%s: role '%s' is duplicated", api, rc.Name)
+		}
+		r := &role{name: rc.Name, methods: make(map[string]bool)}
+		for _, m := range rc.Methods {
+			if m != AllMethods && !known[m] {
+				return nil, errors.Errorf("%s: role '%s' has unknown method '%s'", api, rc.Name, m)
+			}
+			r.methods[m] = true
+		}
+		for _, s := range rc.VirtualServerCIDRs {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: role '%s'", api, rc.Name)
+			}
+			r.nets = append(r.nets, n)
+		}
+		for _, s := range rc.VirtualServerPorts {
+			pr, err := parsePortRange(s)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: role '%s'", api, rc.Name)
+			}
+			r.ports = append(r.ports, pr)
+		}
+		if rc.Selector != "" {
+			var err error
+			if r.selector, err = labels.Parse(rc.Selector); err != nil {
+				return nil, errors.Wrapf(err, "%s: role '%s'", api, rc.Name)
+			}
+		}
+		ret.roles[rc.Name] = r
+	}
+	for i, bc := range conf.Bindings {
+		r := ret.roles[bc.Role]
+		if r == nil {
+			return nil, errors.Errorf("%s: binding #%v refers to unknown role '%s'", api, i, bc.Role)
+		}
+		for _, p := range bc.Principals {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, errors.Errorf("%s: binding #%v has bad principal pattern '%s'", api, i, p)
+			}
+		}
+		ret.bindings = append(ret.bindings, binding{role: r, patterns: bc.Principals})
+	}
+	for _, o := range opts {
+		switch t := o.(type) {
+		case WithResolver:
+			ret.resolvers = append(ret.resolvers, t.Resolver)
+		}
+	}
+	return ret, nil
+}
+
+//UnaryInterceptor refuses calls of API methods caller has no role for; other services pass as is
+func (a *Authorizer) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	prefix := "/" + ipvs.IpvsAdmin_ServiceDesc.ServiceName + "/"
+	if !strings.HasPrefix(info.FullMethod, prefix) {
+		return handler(ctx, req)
+	}
+	ctx, err := a.Authorize(ctx, strings.TrimPrefix(info.FullMethod, prefix))
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+//Authorize refuses call of method caller has no role for with PermissionDenied error;
+//it puts grants of call to context
+func (a *Authorizer) Authorize(ctx context.Context, method string) (context.Context, error) {
+	g := a.grants(ctx, method)
+	if len(g.roles) == 0 {
+		return ctx, g.Deny(ctx, "no role allows method")
+	}
+	return context.WithValue(ctx, grantsKey{}, g), nil
+}
+
+//Principals of caller; anonymous if nobody has identified caller
+func (a *Authorizer) Principals(ctx context.Context) []string {
+	var ret []string
+	for _, r := range a.resolvers {
+		ret = append(ret, r(ctx)...)
+	}
+	if len(ret) == 0 {
+		ret = []string{PrincipalAnonymous}
+	}
+	return ret
+}
+
+func (a *Authorizer) grants(ctx context.Context, method string) *Grants {
+	g := &Grants{a: a, method: method, principals: a.Principals(ctx)}
+	seen := make(map[*role]bool)
+	for _, b := range a.bindings {
+		if seen[b.role] || !(b.role.methods[method] || b.role.methods[AllMethods]) {
+			continue
+		}
+		if matchesAny(b.patterns, g.principals) {
+			seen[b.role] = true
+			g.roles = append(g.roles, b.role)
+		}
+	}
+	return g
+}
+
+//Describe impl prometheus.Collector
+func (a *Authorizer) Describe(ch chan<- *prometheus.Desc) {
+	a.denials.Describe(ch)
+}
+
+//Collect impl prometheus.Collector
+func (a *Authorizer) Collect(ch chan<- prometheus.Metric) {
+	a.denials.Collect(ch)
+}
+
+//GrantsFrom grants of call; nil if authorization is off
+func GrantsFrom(ctx context.Context) *Grants {
+	g, _ := ctx.Value(grantsKey{}).(*Grants)
+	return g
+}
+
+//Allows tells if virtual server is in scope of any granted role; matches tells if its labels are matched by selector
+func (g *Grants) Allows(identity ipvsAdm.VirtualServerIdentity, matches func(labels.Selector) bool) bool {
+	if g == nil {
+		return true
+	}
+	for _, r := range g.roles {
+		if r.allows(identity, matches) {
+			return true
+		}
+	}
+	return false
+}
+
+//Deny logs and counts denial; it gives PermissionDenied error
+func (g *Grants) Deny(ctx context.Context, reason string) error {
+	g.a.denials.WithLabelValues(g.method).Inc()
+	who := strings.Join(g.principals, ",")
+	logger.Warnf(ctx, "authz: '%s' is denied to '%s': %s", g.method, who, reason)
+	return status.Errorf(codes.PermissionDenied, "'%s' is denied to '%s': %s", g.method, who, reason)
+}
+
+//Roles names of granted roles
+func (g *Grants) Roles() []string {
+	ret := make([]string, 0, len(g.roles))
+	for _, r := range g.roles {
+		ret = append(ret, r.name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (r *role) allows(identity ipvsAdm.VirtualServerIdentity, matches func(labels.Selector) bool) bool {
+	if len(r.nets) > 0 || len(r.ports) > 0 {
+		addr, ok := identity.(ipvsAdm.VirtualServerAddress)
+		if !ok {
+			return false
+		}
+		host, port, err := addr.Address.ToHostPort()
+		if err != nil {
+			return false
+		}
+		if len(r.nets) > 0 && !containsIP(r.nets, net.ParseIP(host)) {
+			return false
+		}
+		if len(r.ports) > 0 && !containsPort(r.ports, port) {
+			return false
+		}
+	}
+	return r.selector == nil || matches(r.selector)
+}
+
+func matchesAny(patterns, principals []string) bool {
+	for _, p := range patterns {
+		for _, s := range principals {
+			if ok, _ := path.Match(p, s); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []portRange, port uint32) bool {
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+//parsePortRange parses range like '80' or '8000-8999'
+func parsePortRange(s string) (portRange, error) {
+	var ret portRange
+	bounds := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	from, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+	if err != nil {
+		return ret, errors.Errorf("bad port range '%s'", s)
+	}
+	ret.from, ret.to = uint32(from), uint32(from)
+	if len(bounds) == 2 {
+		var to uint64
+		if to, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16); err != nil || uint32(to) < ret.from {
+			return ret, errors.Errorf("bad port range '%s'", s)
+		}
+		ret.to = uint32(to)
+	}
+	return ret, nil
+}
@@ -0,0 +1,105 @@
+package authz
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type principalKey struct{}
+
+func Test_Authorizer(t *testing.T) {
+	a, err := New(Config{
+		Roles: []RoleConfig{
+			{Name: "viewer", Methods: []string{"ListVirtualServers", "FindVirtualServer"}},
+			{
+				Name:               "web",
+				Methods:            []string{"UpdateRealServers"},
+				VirtualServerCIDRs: []string{"10.0.0.0/24"},
+				VirtualServerPorts: []string{"80", "8000-8999"},
+				Selector:           "team=web",
+			},
+			{Name: "admin", Methods: []string{AllMethods}},
+		},
+		Bindings: []BindingConfig{
+			{Role: "viewer", Principals: []string{"*"}},
+			{Role: "web", Principals: []string{"mtls:web-*"}},
+			{Role: "admin", Principals: []string{"mtls:ops"}},
+		},
+	}, WithResolver{Resolver: func(ctx context.Context) []string {
+		if p, _ := ctx.Value(principalKey{}).(string); p != "" {
+			return []string{p}
+		}
+		return nil
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	call := func(principal, method string) (*Grants, error) {
+		ctx := context.WithValue(context.Background(), principalKey{}, principal)
+		var g *Grants
+		_, e := a.UnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/ipvs.IpvsAdmin/" + method},
+			func(ctx context.Context, _ interface{}) (interface{}, error) {
+				g = GrantsFrom(ctx)
+				return nil, nil
+			})
+		return g, e
+	}
+
+	_, err = call("", "ListVirtualServers")
+	assert.NoError(t, err)
+	_, err = call("", "UpdateVirtualServers")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = call("mtls:web-deployer", "UpdateVirtualServers")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = call("mtls:ops", "UpdateVirtualServers")
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, testutil.ToFloat64(a.denials.WithLabelValues("UpdateVirtualServers")))
+
+	//other services are not guarded
+	_, err = a.UnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"},
+		func(context.Context, interface{}) (interface{}, error) { return nil, nil })
+	assert.NoError(t, err)
+
+	g, err := call("mtls:web-deployer", "UpdateRealServers")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"web"}, g.Roles())
+	web := func(sel labels.Selector) bool {
+		return sel.Matches(labels.Set{"team": "web"})
+	}
+	db := func(sel labels.Selector) bool {
+		return sel.Matches(labels.Set{"team": "db"})
+	}
+	id := func(s string) ipvsAdm.VirtualServerIdentity {
+		ret, _ := ipvsAdm.ParseVirtualServerIdentity(s)
+		return ret
+	}
+	assert.True(t, g.Allows(id("tcp://10.0.0.1:80"), web))
+	assert.True(t, g.Allows(id("tcp://10.0.0.1:8080"), web))
+	assert.False(t, g.Allows(id("tcp://10.0.0.1:80"), db))
+	assert.False(t, g.Allows(id("tcp://10.0.1.1:80"), web))
+	assert.False(t, g.Allows(id("tcp://10.0.0.1:443"), web))
+	assert.False(t, g.Allows(id("fwmark://5"), web))
+	assert.True(t, (*Grants)(nil).Allows(id("fwmark://5"), db))
+
+	for _, c := range []Config{
+		{Roles: []RoleConfig{{Methods: []string{"ListVirtualServers"}}}},
+		{Roles: []RoleConfig{{Name: "a", Methods: []string{"DropEverything"}}}},
+		{Roles: []RoleConfig{{Name: "a", VirtualServerCIDRs: []string{"10.0.0.0/33"}}}},
+		{Roles: []RoleConfig{{Name: "a", VirtualServerPorts: []string{"90-80"}}}},
+		{Roles: []RoleConfig{{Name: "a", Selector: "a in (b"}}},
+		{Bindings: []BindingConfig{{Role: "nope", Principals: []string{"*"}}}},
+	} {
+		_, err = New(c)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,65 @@
+package caller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+//gatewayMetadata address of HTTP client gateway of this process calls API on behalf of
+const gatewayMetadata = "x-ipvs-gateway-client"
+
+//gatewayToken signs addresses gateway of this process tells; clients do not know it so they can not forge them
+var gatewayToken = newGatewayToken()
+
+type (
+	//Identity who makes call: address it comes from and principals resolvers tell
+	Identity struct {
+		Address    string
+		Principals []string
+	}
+)
+
+func newGatewayToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//Address address call comes from; it is told by
+//  - gateway of this process for calls it makes on behalf of HTTP clients
+//  - forwarded-for address trusted proxy sets for calls it passes
+//  - peer address otherwise
+//forwarded-for addresses clients set themselves are never trusted
+func Address(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(gatewayMetadata) {
+		if parts := strings.SplitN(v, " ", 2); len(parts) == 2 &&
+			subtle.ConstantTimeCompare([]byte(parts[0]), []byte(gatewayToken)) == 1 {
+			return parts[1]
+		}
+	}
+	if FromTrustedProxy(ctx) {
+		if v := md.Get("x-forwarded-for"); len(v) > 0 && v[0] != "" {
+			return strings.TrimSpace(strings.Split(v[0], ",")[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+//GatewayMetadata annotator of gateway (runtime.WithMetadata); it stamps calls gateway makes with address
+//of HTTP client so API does not take gateway for caller
+func (p *TrustedProxy) GatewayMetadata(_ context.Context, r *http.Request) metadata.MD {
+	return metadata.Pairs(gatewayMetadata, gatewayToken+" "+Address(FromHTTP(r, p)))
+}
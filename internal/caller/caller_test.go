@@ -0,0 +1,99 @@
+package caller
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pkgNet "github.com/thataway/common-lib/pkg/net"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func Test_TrustedProxy(t *testing.T) {
+	dir := t.TempDir()
+	ep, _ := pkgNet.ParseEndpoint("unix://" + filepath.Join(dir, "internal.sock"))
+	proxy, err := NewTrustedProxy(ep)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tcp, _ := pkgNet.ParseEndpoint("tcp://127.0.0.1:9006")
+	_, err = NewTrustedProxy(tcp)
+	assert.Error(t, err)
+
+	handshake := func(sock string) credentials.AuthInfo {
+		l, e := net.Listen("unix", sock)
+		if !assert.NoError(t, e) {
+			return nil
+		}
+		defer l.Close()
+		go func() {
+			if c, e2 := net.Dial("unix", sock); e2 == nil {
+				defer c.Close()
+				_, _ = c.Read(make([]byte, 1))
+			}
+		}()
+		conn, e := l.Accept()
+		if !assert.NoError(t, e) {
+			return nil
+		}
+		defer conn.Close()
+		_, info, e := proxy.Credentials(nil).ServerHandshake(conn)
+		assert.NoError(t, e)
+		return info
+	}
+	info := handshake(filepath.Join(dir, "internal.sock"))
+	assert.IsType(t, ProxyAuthInfo{}, info)
+	assert.True(t, FromTrustedProxy(peer.NewContext(context.Background(), &peer.Peer{AuthInfo: info})))
+
+	//connections on other sockets are not trusted
+	info = handshake(filepath.Join(dir, "api.sock"))
+	assert.Nil(t, info)
+	assert.False(t, FromTrustedProxy(peer.NewContext(context.Background(), &peer.Peer{AuthInfo: info})))
+	assert.False(t, FromTrustedProxy(context.Background()))
+}
+
+func Test_Address(t *testing.T) {
+	dir := t.TempDir()
+	ep, _ := pkgNet.ParseEndpoint("unix://" + filepath.Join(dir, "internal.sock"))
+	proxy, err := NewTrustedProxy(ep)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tcpPeer := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+	forged := metadata.Pairs("x-forwarded-for", "192.0.2.1", gatewayMetadata, "guess 192.0.2.2")
+
+	//client can not tell its address itself
+	ctx := peer.NewContext(metadata.NewIncomingContext(context.Background(), forged), tcpPeer)
+	assert.Equal(t, "127.0.0.1:5000", Address(ctx))
+
+	//trusted proxy tells it
+	ctx = peer.NewContext(metadata.NewIncomingContext(context.Background(), forged),
+		&peer.Peer{Addr: &net.UnixAddr{Name: "@", Net: "unix"}, AuthInfo: ProxyAuthInfo{}})
+	assert.Equal(t, "192.0.2.1", Address(ctx))
+
+	//gateway tells address of HTTP client
+	r := httptest.NewRequest(http.MethodPost, "/v1/virtual-servers", nil)
+	r.RemoteAddr = "198.51.100.1:4000"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	md := metadata.Join(forged, proxy.GatewayMetadata(context.Background(), r))
+	ctx = peer.NewContext(metadata.NewIncomingContext(context.Background(), md), tcpPeer)
+	assert.Equal(t, "198.51.100.1:4000", Address(ctx))
+
+	//HTTP requests from trusted proxy tell forwarded-for address
+	addr, _ := ep.Address()
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: addr, Net: "unix"}))
+	r.Header.Set("Grpc-Metadata-X-Ipvs-Client-Subject", "operator")
+	ctx = FromHTTP(r, proxy)
+	assert.True(t, FromTrustedProxy(ctx))
+	assert.Equal(t, "192.0.2.1", Address(ctx))
+	in, _ := metadata.FromIncomingContext(ctx)
+	assert.Equal(t, []string{"operator"}, in.Get("x-ipvs-client-subject"))
+	assert.False(t, FromTrustedProxy(FromHTTP(r, nil)))
+	assert.Equal(t, "198.51.100.1:4000", Address(FromHTTP(r, nil)))
+}
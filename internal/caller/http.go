@@ -0,0 +1,53 @@
+package caller
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+//gatewayPrefix headers with it are passed to gRPC metadata by gateway
+const gatewayPrefix = "grpc-metadata-"
+
+type remoteAddr struct {
+	network, addr string
+}
+
+//Network impl net.Addr
+func (a remoteAddr) Network() string {
+	return a.network
+}
+
+//String impl net.Addr
+func (a remoteAddr) String() string {
+	return a.addr
+}
+
+//FromHTTP context of HTTP request the way gRPC calls see theirs: headers are incoming metadata
+//('Grpc-Metadata-' prefix is cut like gateway does) and remote address is peer; requests accepted
+//on socket of trusted proxy are tagged like its gRPC connections, so resolvers of caller identity
+//work with HTTP handlers
+func FromHTTP(r *http.Request, proxy *TrustedProxy) context.Context {
+	md := make(metadata.MD, len(r.Header))
+	for k, vals := range r.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, gatewayPrefix) {
+			k = strings.TrimPrefix(k, gatewayPrefix)
+		}
+		md.Append(k, vals...)
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	p := &peer.Peer{Addr: remoteAddr{network: "unix", addr: r.RemoteAddr}}
+	if _, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		p.Addr = remoteAddr{network: "tcp", addr: r.RemoteAddr}
+	}
+	if local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr); proxy.Accepted(local) {
+		p.AuthInfo = ProxyAuthInfo{CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity}}
+	}
+	return peer.NewContext(ctx, p)
+}
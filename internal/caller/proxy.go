@@ -0,0 +1,114 @@
+package caller
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	pkgNet "github.com/thataway/common-lib/pkg/net"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+//ProxyAuthType auth type of connections accepted from trusted proxy
+const ProxyAuthType = "trusted-proxy"
+
+type (
+	//ProxyAuthInfo tags connection accepted on socket of trusted proxy; calls over it tell identity of caller
+	//in metadata the proxy sets
+	ProxyAuthInfo struct {
+		credentials.CommonAuthInfo
+	}
+
+	//TrustedProxy unix domain socket trusted proxy (TLS front) passes calls over; nobody else must reach it
+	TrustedProxy struct {
+		socket string
+	}
+
+	proxyCredentials struct {
+		proxy *TrustedProxy
+		next  credentials.TransportCredentials
+	}
+)
+
+//AuthType implements credentials.AuthInfo
+func (ProxyAuthInfo) AuthType() string {
+	return ProxyAuthType
+}
+
+//NewTrustedProxy trusted proxy passes calls over unix domain socket endpoint
+func NewTrustedProxy(ep *pkgNet.Endpoint) (*TrustedProxy, error) {
+	if !ep.IsUnixDomain() {
+		return nil, errors.Errorf("caller/NewTrustedProxy: '%s' is not unix domain socket", ep.FQN())
+	}
+	addr, err := ep.Address()
+	if err != nil {
+		return nil, errors.Wrap(err, "caller/NewTrustedProxy")
+	}
+	return &TrustedProxy{socket: filepath.Clean(addr)}, nil
+}
+
+//Accepted tells if connection with local address is accepted on socket of proxy
+func (p *TrustedProxy) Accepted(local net.Addr) bool {
+	return p != nil && local != nil && local.Network() == "unix" && filepath.Clean(local.String()) == p.socket
+}
+
+//Credentials makes gRPC server transport credentials which tag connections accepted on socket of proxy
+//by ProxyAuthInfo; other connections are handshaked by next credentials if there are ones
+func (p *TrustedProxy) Credentials(next credentials.TransportCredentials) credentials.TransportCredentials {
+	return proxyCredentials{proxy: p, next: next}
+}
+
+//FromTrustedProxy tells if call is passed by trusted proxy
+func FromTrustedProxy(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	_, ok = p.AuthInfo.(ProxyAuthInfo)
+	return ok
+}
+
+//ClientHandshake implements credentials.TransportCredentials
+func (c proxyCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if c.next != nil {
+		return c.next.ClientHandshake(ctx, authority, conn)
+	}
+	return conn, nil, nil
+}
+
+//ServerHandshake implements credentials.TransportCredentials
+func (c proxyCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if c.proxy.Accepted(conn.LocalAddr()) {
+		return conn, ProxyAuthInfo{CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity}}, nil
+	}
+	if c.next != nil {
+		return c.next.ServerHandshake(conn)
+	}
+	return conn, nil, nil
+}
+
+//Info implements credentials.TransportCredentials
+func (c proxyCredentials) Info() credentials.ProtocolInfo {
+	if c.next != nil {
+		return c.next.Info()
+	}
+	return credentials.ProtocolInfo{SecurityProtocol: ProxyAuthType}
+}
+
+//Clone implements credentials.TransportCredentials
+func (c proxyCredentials) Clone() credentials.TransportCredentials {
+	if c.next != nil {
+		c.next = c.next.Clone()
+	}
+	return c
+}
+
+//OverrideServerName implements credentials.TransportCredentials
+func (c proxyCredentials) OverrideServerName(name string) error {
+	if c.next != nil {
+		return c.next.OverrideServerName(name) //nolint:staticcheck
+	}
+	return nil
+}
@@ -30,6 +30,9 @@ const (
 
 	//FloatType float point value
 	FloatType
+
+	//ObjectType structured value
+	ObjectType
 )
 
 var (
@@ -93,4 +96,11 @@ type (
 		Must(ctx context.Context) float64
 		Maybe(ctx context.Context) (float64, error)
 	}
+
+	//Object structured value reader
+	Object interface {
+		Value
+		Must(ctx context.Context, dest interface{})
+		Maybe(ctx context.Context, dest interface{}) error
+	}
 )
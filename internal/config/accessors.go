@@ -6,6 +6,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cast"
+	"github.com/spf13/viper"
 	"github.com/thataway/common-lib/logger"
 )
 
@@ -33,6 +34,9 @@ type (
 
 	//ValueFloat float accessor
 	ValueFloat string
+
+	//ValueObject structured value accessor
+	ValueObject string
 )
 
 //----------------------------------------------- NONE-----------------------------------------------
@@ -237,3 +241,43 @@ func (v ValueFloat) Maybe(_ context.Context) (float64, error) {
 	x, e := cast.ToFloat64E(a)
 	return x, errors.Wrapf(e, "%s: from('%s')", api, v)
 }
+
+//----------------------------------------------- OBJECT-----------------------------------------------
+
+//Is ...
+func (v ValueObject) Is() ValueType {
+	return ObjectType
+}
+
+//Must ...
+func (v ValueObject) Must(ctx context.Context, dest interface{}) {
+	if e := v.Maybe(ctx, dest); e != nil {
+		logger.Fatal(ctx, e)
+	}
+}
+
+//Maybe decodes value into 'dest' using 'mapstructure' tags
+func (v ValueObject) Maybe(_ context.Context, dest interface{}) error {
+	const api = "config/ValueObject"
+
+	return v.decode(api, configStore(), dest)
+}
+
+//MaybeFrom decodes value into 'dest' from config is made of 'opts'; global config stays as is
+func (v ValueObject) MaybeFrom(_ context.Context, dest interface{}, opts ...Option) error {
+	const api = "config/ValueObject"
+
+	store, e := newConfig(api, opts...)
+	if e != nil {
+		return e
+	}
+	return v.decode(api, store, dest)
+}
+
+func (v ValueObject) decode(api string, store *viper.Viper, dest interface{}) error {
+	if !store.IsSet(string(v)) {
+		return errors.Wrapf(ErrNotFound, "%s: key('%v')", api, v)
+	}
+	e := store.UnmarshalKey(string(v), dest)
+	return errors.Wrapf(e, "%s: from('%s')", api, v)
+}
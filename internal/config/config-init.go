@@ -58,6 +58,16 @@ func configStore() *viper.Viper {
 func InitGlobalConfig(opts ...Option) error {
 	const api = "InitGlobalConfig"
 
+	cfgHolder, err := newConfig(api, opts...)
+	if err != nil {
+		return err
+	}
+	globalConfig.Store(cfgHolder)
+	return nil
+}
+
+//newConfig makes config from options
+func newConfig(api string, opts ...Option) (*viper.Viper, error) {
 	cfgHolder := viper.NewWithOptions(viper.KeyDelimiter("/"),
 		viper.EnvKeyReplacer(strings.NewReplacer("/", "_")))
 
@@ -67,7 +77,7 @@ func InitGlobalConfig(opts ...Option) error {
 		switch t := opt.(type) {
 		case WithDefValue:
 			if !reflect.TypeOf(t.Key).ConvertibleTo(keyType) {
-				return errors.Wrapf(errors.New("no possible set default with key)"),
+				return nil, errors.Wrapf(errors.New("no possible set default with key)"),
 					"%s: key type '%T'", api, t)
 			}
 			k := reflect.ValueOf(t.Key).Convert(keyType).Interface().(string)
@@ -78,34 +88,33 @@ func InitGlobalConfig(opts ...Option) error {
 			}
 			ext := filepath.Ext(t.FileName)
 			if len(ext) == 0 {
-				return errors.Wrapf(errors.New("no file type provided"),
+				return nil, errors.Wrapf(errors.New("no file type provided"),
 					"%s: open file '%s'", api, t.FileName)
 			}
 			f, e := os.Open(t.FileName)
 			if e != nil {
-				return errors.Wrapf(e, "%s: open file '%s'", api, t.FileName)
+				return nil, errors.Wrapf(e, "%s: open file '%s'", api, t.FileName)
 			}
 			cfgHolder.SetConfigType(ext[1:])
 			e = cfgHolder.MergeConfig(f)
 			_ = f.Close()
 			if e != nil {
-				return errors.Wrapf(e, "%s: consume config file '%s'", api, t.FileName)
+				return nil, errors.Wrapf(e, "%s: consume config file '%s'", api, t.FileName)
 			}
 		case WithSource:
 			cfgHolder.SetConfigType(t.Type)
 			if e := cfgHolder.MergeConfig(t.Source); e != nil {
-				return errors.Wrapf(e, "%s: consume source type '%s'", api, t.Type)
+				return nil, errors.Wrapf(e, "%s: consume source type '%s'", api, t.Type)
 			}
 		case WithAcceptEnvironment:
 			cfgHolder.AutomaticEnv()
 			cfgHolder.SetEnvPrefix(t.EnvPrefix)
 		default:
-			return errors.Wrapf(errors.New("unexpected option"),
+			return nil, errors.Wrapf(errors.New("unexpected option"),
 				"%s: consume source type '%T'", api, opt)
 		}
 	}
-	globalConfig.Store(cfgHolder)
-	return nil
+	return cfgHolder, nil
 }
 
 func init() {
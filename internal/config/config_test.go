@@ -140,6 +140,52 @@ values:
 	assert.NoError(t, err)
 }
 
+func Test_Object(t *testing.T) {
+	const data = `
+values:
+  items:
+    - name: a
+      timeout: 1s
+    - name: b
+      timeout: 2s
+`
+	err := InitGlobalConfig(WithSource{
+		Source: bytes.NewBuffer([]byte(data)),
+		Type:   "yaml",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	type item struct {
+		Name    string        `mapstructure:"name"`
+		Timeout time.Duration `mapstructure:"timeout"`
+	}
+	const (
+		o       ValueObject = "values/items"
+		missing ValueObject = "values/missing"
+	)
+	var items []item
+	ctx := context.Background()
+	if !assert.NoError(t, o.Maybe(ctx, &items)) {
+		return
+	}
+	assert.Equal(t, []item{{"a", time.Second}, {"b", 2 * time.Second}}, items)
+	assert.ErrorIs(t, missing.Maybe(ctx, &items), ErrNotFound)
+
+	//value is read from config of its own; global config stays as is
+	items = nil
+	err = o.MaybeFrom(ctx, &items, WithSource{
+		Source: bytes.NewBuffer([]byte("values: {items: [{name: c, timeout: 3s}]}")),
+		Type:   "yaml",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []item{{"c", 3 * time.Second}}, items)
+	}
+	items = nil
+	assert.NoError(t, o.Maybe(ctx, &items))
+	assert.Len(t, items, 2)
+}
+
 /*//
 func Test_S(t *testing.T) {
 
@@ -0,0 +1,188 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+services:
+  reassert-interval: 1m
+  reassert-on-sighup: true
+  virtual-servers:
+    - virtual-server: tcp://10.0.0.1:80
+      schedule-method: wrr
+      real-servers:
+        - address: 10.0.1.1:8080
+          packet-forwarder: nat
+          weight: 1
+        - address: 10.0.1.2:8080
+          packet-forwarder: nat
+          weight: 1
+          upper-threshold: 100
+          lower-threshold: 50
+*/
+
+//ConfigSourceName name of source is made by ConfigSource
+const ConfigSourceName = "config:services"
+
+type (
+	//ConfigSourceConfig services are declared in application config
+	ConfigSourceConfig struct {
+		ReassertInterval time.Duration         `mapstructure:"reassert-interval"`
+		ReassertOnSighup bool                  `mapstructure:"reassert-on-sighup"`
+		VirtualServers   []VirtualServerConfig `mapstructure:"virtual-servers"`
+	}
+
+	//VirtualServerConfig virtual server with its real servers
+	VirtualServerConfig struct {
+		VirtualServer  string             `mapstructure:"virtual-server"`
+		ScheduleMethod string             `mapstructure:"schedule-method"`
+		RealServers    []RealServerConfig `mapstructure:"real-servers"`
+	}
+
+	//RealServerConfig real server
+	RealServerConfig struct {
+		Address         string `mapstructure:"address"`
+		PacketForwarder string `mapstructure:"packet-forwarder"`
+		Weight          uint32 `mapstructure:"weight"`
+		UpperThreshold  uint32 `mapstructure:"upper-threshold"`
+		LowerThreshold  uint32 `mapstructure:"lower-threshold"`
+	}
+
+	//ConfigLoader reads services section of application config
+	ConfigLoader func(ctx context.Context) (ConfigSourceConfig, error)
+
+	//ConfigSource declares services from application config; they are re-asserted
+	//periodically and on SIGHUP, the latter re-reads services section of config before
+	ConfigSource struct {
+		rec    *Reconciler
+		load   ConfigLoader
+		conf   ConfigSourceConfig
+		hangup chan os.Signal
+	}
+)
+
+//NewConfigSource makes config source of services
+func NewConfigSource(ctx context.Context, rec *Reconciler, load ConfigLoader) (*ConfigSource, error) {
+	const api = "discovery/NewConfigSource"
+
+	conf, err := load(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	if _, err = conf.Services(); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	return &ConfigSource{rec: rec, load: load, conf: conf}, nil
+}
+
+//Apply applies services are declared in config
+func (src *ConfigSource) Apply(ctx context.Context) error {
+	const api = "discovery/ConfigSource/Apply"
+
+	services, err := src.conf.Services()
+	if err != nil {
+		src.rec.Fail(ConfigSourceName, err)
+		return errors.Wrap(err, api)
+	}
+	return errors.Wrap(src.rec.Update(ctx, ConfigSourceName, services), api)
+}
+
+//Run re-asserts services until context is done
+func (src *ConfigSource) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	if src.conf.ReassertInterval > 0 {
+		ticker := time.NewTicker(src.conf.ReassertInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var hangup chan os.Signal
+	if src.conf.ReassertOnSighup {
+		hangup = make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		defer signal.Stop(hangup)
+	}
+	if tick == nil && hangup == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			if err := src.rec.Reconcile(ctx); err != nil {
+				logger.Errorf(ctx, "discovery: re-assert services: %v", err)
+			}
+		case <-hangup:
+			logger.Info(ctx, "discovery: caught SIGHUP; reload services from config")
+			conf, err := src.load(ctx)
+			if err == nil {
+				_, err = conf.Services()
+			}
+			if err != nil {
+				//services are declared before stay as is
+				src.rec.Fail(ConfigSourceName, err)
+				logger.Errorf(ctx, "discovery: reload services: %v", err)
+				continue
+			}
+			src.conf.VirtualServers = conf.VirtualServers
+			if err = src.Apply(ctx); err != nil {
+				logger.Errorf(ctx, "discovery: %v", err)
+			}
+		}
+	}
+}
+
+//Services validates config and converts it to services
+func (c ConfigSourceConfig) Services() ([]Service, error) {
+	ret := make([]Service, 0, len(c.VirtualServers))
+	for _, vsConf := range c.VirtualServers {
+		identity, err := ipvsAdm.ParseVirtualServerIdentity(vsConf.VirtualServer)
+		if err != nil {
+			return nil, err
+		}
+		svc := Service{VirtualServer: ipvsAdm.VirtualServer{
+			Identity:       identity,
+			ScheduleMethod: ipvsAdm.ScheduleMethod(vsConf.ScheduleMethod),
+		}}
+		if svc.VirtualServer.ScheduleMethod == "" {
+			svc.VirtualServer.ScheduleMethod = defScheduler
+		}
+		if err = svc.VirtualServer.ScheduleMethod.Valid(); err != nil {
+			return nil, errors.Wrapf(err, "'%s'", vsConf.VirtualServer)
+		}
+		for _, rsConf := range vsConf.RealServers {
+			rs := ipvsAdm.RealServer{
+				Address:         ipvsAdm.Address(rsConf.Address),
+				PacketForwarder: ipvsAdm.PacketForwarder(rsConf.PacketForwarder),
+				Weight:          rsConf.Weight,
+				UpperThreshold:  rsConf.UpperThreshold,
+				LowerThreshold:  rsConf.LowerThreshold,
+			}
+			if rs.PacketForwarder == "" {
+				rs.PacketForwarder = defForwarder
+			}
+			if _, _, err = rs.Address.ToHostPort(); err != nil {
+				return nil, errors.Wrapf(err, "'%s' real server '%s'", vsConf.VirtualServer, rsConf.Address)
+			}
+			if err = rs.PacketForwarder.Valid(); err != nil {
+				return nil, errors.Wrapf(err, "'%s' real server '%s'", vsConf.VirtualServer, rsConf.Address)
+			}
+			if rs.LowerThreshold > rs.UpperThreshold {
+				return nil, errors.Errorf("'%s' real server '%s' has lowerThreshold(%v) > upperThreshold(%v)",
+					vsConf.VirtualServer, rsConf.Address, rs.LowerThreshold, rs.UpperThreshold)
+			}
+			svc.RealServers = append(svc.RealServers, rs)
+		}
+		ret = append(ret, svc)
+	}
+	return ret, nil
+}
@@ -0,0 +1,336 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+discovery:
+  consul:
+    address: http://127.0.0.1:8500
+    token: secret
+    datacenter: dc1
+    wait: 5m
+    retry-interval: 5s
+    services:
+      - virtual-server: tcp://10.0.0.1:80
+        service: web
+        tag: ipvs
+        schedule-method: wrr
+        packet-forwarder: dr
+        weight: 1
+        weight-meta-key: ipvs-weight
+*/
+
+//ConsulSourcePrefix prefix of source names are made by ConsulSource
+const ConsulSourcePrefix = "consul:"
+
+type (
+	//ConsulSourceConfig Consul catalog discovery config
+	ConsulSourceConfig struct {
+		Address       string                `mapstructure:"address"`
+		Token         string                `mapstructure:"token"`
+		Datacenter    string                `mapstructure:"datacenter"`
+		Wait          time.Duration         `mapstructure:"wait"`
+		RetryInterval time.Duration         `mapstructure:"retry-interval"`
+		Services      []ConsulServiceConfig `mapstructure:"services"`
+	}
+
+	//ConsulServiceConfig virtual server takes its real servers from passing instances of Consul service
+	ConsulServiceConfig struct {
+		VirtualServer   string `mapstructure:"virtual-server"`
+		ScheduleMethod  string `mapstructure:"schedule-method"`
+		Service         string `mapstructure:"service"`
+		Tag             string `mapstructure:"tag"`
+		PacketForwarder string `mapstructure:"packet-forwarder"`
+		Weight          uint32 `mapstructure:"weight"`
+		WeightMetaKey   string `mapstructure:"weight-meta-key"`
+	}
+
+	//HTTPDoer sends HTTP requests; *http.Client does it
+	HTTPDoer interface {
+		Do(req *http.Request) (*http.Response, error)
+	}
+
+	//ConsulSourceOption Consul source option
+	ConsulSourceOption interface {
+		isConsulSourceOption()
+	}
+
+	//WithHTTPClient use custom HTTP client to talk to Consul
+	WithHTTPClient struct {
+		Client HTTPDoer
+	}
+
+	//ConsulSource declares real servers of virtual servers from Consul health API;
+	//every service is a separate source
+	ConsulSource struct {
+		rec      *Reconciler
+		conf     ConsulSourceConfig
+		client   HTTPDoer
+		base     *url.URL
+		services []consulService
+	}
+
+	consulService struct {
+		ConsulServiceConfig
+		virtualServer ipvsAdm.VirtualServer
+	}
+
+	consulServiceEntry struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+			Meta    map[string]string
+		}
+	}
+)
+
+func (WithHTTPClient) isConsulSourceOption() {}
+
+const (
+	defConsulAddress       = "http://127.0.0.1:8500"
+	defConsulWait          = 5 * time.Minute
+	defConsulRetryInterval = 5 * time.Second
+	defConsulWeightMetaKey = "ipvs-weight"
+)
+
+//NewConsulSource makes Consul discovery source
+func NewConsulSource(rec *Reconciler, conf ConsulSourceConfig, opts ...ConsulSourceOption) (*ConsulSource, error) {
+	const api = "discovery/NewConsulSource"
+
+	if conf.Address == "" {
+		conf.Address = defConsulAddress
+	}
+	if conf.Wait <= 0 {
+		conf.Wait = defConsulWait
+	}
+	if conf.RetryInterval <= 0 {
+		conf.RetryInterval = defConsulRetryInterval
+	}
+	base, err := url.Parse(conf.Address)
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, errors.Errorf("%s: wrong address '%s'", api, conf.Address)
+	}
+	ret := &ConsulSource{
+		rec:  rec,
+		conf: conf,
+		base: base,
+		//blocking queries may be held by Consul up to 'wait' plus 1/16 jitter
+		client: &http.Client{Timeout: conf.Wait + conf.Wait/16 + 10*time.Second},
+	}
+	for _, o := range opts {
+		switch t := o.(type) {
+		case WithHTTPClient:
+			if t.Client != nil {
+				ret.client = t.Client
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, c := range conf.Services {
+		var svc consulService
+		if svc, err = newConsulService(c); err != nil {
+			return nil, errors.Wrap(err, api)
+		}
+		vs := ipvsAdm.IdentityString(svc.virtualServer.Identity)
+		if seen[vs] {
+			return nil, errors.Errorf("%s: virtual server '%s' is declared twice", api, vs)
+		}
+		seen[vs] = true
+		ret.services = append(ret.services, svc)
+	}
+	return ret, nil
+}
+
+func newConsulService(c ConsulServiceConfig) (consulService, error) {
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(c.VirtualServer)
+	if err != nil {
+		return consulService{}, err
+	}
+	ret := consulService{ConsulServiceConfig: c}
+	if ret.Service == "" {
+		return ret, errors.Errorf("'%s' has no Consul service", c.VirtualServer)
+	}
+	if ret.ScheduleMethod == "" {
+		ret.ScheduleMethod = defScheduler
+	}
+	ret.virtualServer = ipvsAdm.VirtualServer{
+		Identity:       identity,
+		ScheduleMethod: ipvsAdm.ScheduleMethod(ret.ScheduleMethod),
+	}
+	if err = ret.virtualServer.ScheduleMethod.Valid(); err != nil {
+		return ret, errors.Wrapf(err, "'%s'", c.VirtualServer)
+	}
+	if ret.PacketForwarder == "" {
+		ret.PacketForwarder = defForwarder
+	}
+	if err = ipvsAdm.PacketForwarder(ret.PacketForwarder).Valid(); err != nil {
+		return ret, errors.Wrapf(err, "'%s'", c.VirtualServer)
+	}
+	if ret.Weight == 0 {
+		ret.Weight = 1
+	}
+	if ret.WeightMetaKey == "" {
+		ret.WeightMetaKey = defConsulWeightMetaKey
+	}
+	return ret, nil
+}
+
+//Run long-polls Consul for every service until context is done
+func (src *ConsulSource) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := range src.services {
+		svc := src.services[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src.runService(ctx, svc)
+		}()
+	}
+	wg.Wait()
+}
+
+func (src *ConsulSource) runService(ctx context.Context, svc consulService) {
+	source := ConsulSourcePrefix + ipvsAdm.IdentityString(svc.virtualServer.Identity)
+	var index uint64
+	for {
+		next, err := src.poll(ctx, svc, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			index = next
+			continue
+		}
+		logger.Errorf(ctx, "discovery: '%s': %v", source, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(src.conf.RetryInterval):
+		}
+	}
+}
+
+//poll makes blocking query of passing instances and updates real servers; returns index for next query
+func (src *ConsulSource) poll(ctx context.Context, svc consulService, index uint64) (uint64, error) {
+	const api = "discovery/ConsulSource/poll"
+
+	source := ConsulSourcePrefix + ipvsAdm.IdentityString(svc.virtualServer.Identity)
+	entries, next, err := src.fetch(ctx, svc, index)
+	if err != nil {
+		//real servers fetched before stay as is
+		src.rec.Fail(source, err)
+		return index, errors.Wrap(err, api)
+	}
+	if next < index {
+		//index went backwards, Consul state is reset
+		next = 0
+	}
+	if next == index && index != 0 {
+		//wait is timed out, nothing changed
+		return next, nil
+	}
+	err = src.rec.Update(ctx, source, []Service{{
+		VirtualServer: svc.virtualServer,
+		RealServers:   consulRealServers(svc, entries),
+	}})
+	if err != nil {
+		return index, errors.Wrap(err, api)
+	}
+	return next, nil
+}
+
+func (src *ConsulSource) fetch(ctx context.Context, svc consulService, index uint64) ([]consulServiceEntry, uint64, error) {
+	u := *src.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/health/service/" + url.PathEscape(svc.Service)
+	q := url.Values{}
+	q.Set("passing", "true")
+	if svc.Tag != "" {
+		q.Set("tag", svc.Tag)
+	}
+	if src.conf.Datacenter != "" {
+		q.Set("dc", src.conf.Datacenter)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", strconv.FormatInt(int64(src.conf.Wait/time.Second), 10)+"s")
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if src.conf.Token != "" {
+		req.Header.Set("X-Consul-Token", src.conf.Token)
+	}
+	var resp *http.Response
+	if resp, err = src.client.Do(req); err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("'%s' responded with status %v", u.Path, resp.StatusCode)
+	}
+	var next uint64
+	if next, err = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64); err != nil {
+		return nil, 0, errors.Wrap(err, "X-Consul-Index")
+	}
+	var entries []consulServiceEntry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, next, nil
+}
+
+func consulRealServers(svc consulService, entries []consulServiceEntry) []ipvsAdm.RealServer {
+	byAddr := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		if host == "" || e.Service.Port <= 0 || e.Service.Port > 0xFFFF {
+			continue
+		}
+		weight := svc.Weight
+		if s, ok := e.Service.Meta[svc.WeightMetaKey]; ok {
+			if w, err := strconv.ParseUint(s, 10, 16); err == nil {
+				weight = uint32(w)
+			}
+		}
+		addr := ipvsAdm.Address(net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+		byAddr[addr] = ipvsAdm.RealServer{
+			Address:         addr,
+			PacketForwarder: ipvsAdm.PacketForwarder(svc.PacketForwarder),
+			Weight:          weight,
+		}
+	}
+	ret := make([]ipvsAdm.RealServer, 0, len(byAddr))
+	for _, rs := range byAddr {
+		ret = append(ret, rs)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Address < ret[j].Address
+	})
+	return ret
+}
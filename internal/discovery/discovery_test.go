@@ -0,0 +1,546 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thataway/ipvs/internal/healthcheck"
+	"github.com/thataway/ipvs/internal/ownership"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	webYaml = `
+virtualServers:
+  - virtualServer:
+      identity:
+        address: {network: TCP, host: 10.0.0.1, port: 80}
+      scheduleMethod: WeightedRoundRobin
+    realServers:
+      - address: {host: 10.0.1.1, port: 8080}
+        packetForwarder: Masquerading
+        weight: 2
+      - address: {host: 10.0.1.2, port: 8080}
+        packetForwarder: Masquerading
+        weight: 1
+`
+	dnsJSON = `{"virtualServers": [{
+  "virtualServer": {"identity": {"address": {"network": "UDP", "host": "10.0.0.2", "port": 53}}},
+  "realServers": [{"address": {"host": "10.0.2.1", "port": 53}, "weight": 1}]
+}]}`
+	dnsYaml = `
+  - virtualServer:
+      identity:
+        address: {network: UDP, host: 10.0.0.2, port: 53}
+    realServers:
+      - address: {host: 10.0.2.1, port: 53}
+        weight: 1
+`
+	badYaml = `
+virtualServers:
+  - virtualServer:
+      identity:
+        address: {network: TCP, host: 10.0.0.3, port: 80}
+    realServers:
+      - address: {host: 10.0.3.1, port: 80}
+        upperThreshold: 1
+        lowerThreshold: 2
+`
+)
+
+func Test_ParseServicesFile(t *testing.T) {
+	services, err := ParseServicesFile("web.yaml", []byte(webYaml))
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "tcp://10.0.0.1:80", ipvsAdm.IdentityString(services[0].VirtualServer.Identity))
+		assert.Equal(t, ipvsAdm.ScheduleMethod("wrr"), services[0].VirtualServer.ScheduleMethod)
+		assert.Equal(t, []ipvsAdm.RealServer{
+			{Address: "10.0.1.1:8080", PacketForwarder: "nat", Weight: 2},
+			{Address: "10.0.1.2:8080", PacketForwarder: "nat", Weight: 1},
+		}, services[0].RealServers)
+	}
+	services, err = ParseServicesFile("dns.json", []byte(dnsJSON))
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "udp://10.0.0.2:53", ipvsAdm.IdentityString(services[0].VirtualServer.Identity))
+		assert.Equal(t, ipvsAdm.PacketForwarder("dr"), services[0].RealServers[0].PacketForwarder)
+	}
+	_, err = ParseServicesFile("bad.yaml", []byte(badYaml))
+	assert.Error(t, err)
+	_, err = ParseServicesFile("bad.json", []byte(`{"virtualServers": [{}]}`))
+	assert.Error(t, err)
+	_, err = ParseServicesFile("bad.yaml", []byte(`virtualServers: [{unknown: 1}]`))
+	assert.Error(t, err)
+}
+
+func Test_FileSource(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "discovery")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	adm := ipvsAdm.NewMemoryAdmin()
+	rec := NewReconciler(adm)
+	src, err := NewFileSource(rec, FileSourceConfig{Dir: dir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	table := func() map[string][]string {
+		ret := make(map[string][]string)
+		_ = adm.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+			key := ipvsAdm.IdentityString(vs.Identity)
+			ret[key] = []string{}
+			return adm.ListRealServers(ctx, vs.Identity, func(rs ipvsAdm.RealServer) error {
+				ret[key] = append(ret[key], string(rs.Address))
+				sort.Strings(ret[key])
+				return nil
+			})
+		})
+		return ret
+	}
+	write("web.yaml", webYaml)
+	write("dns.json", dnsJSON)
+	write("bad.yaml", badYaml)
+	write("notes.txt", "ignored")
+	src.Rescan(ctx)
+	assert.Equal(t, map[string][]string{
+		"tcp://10.0.0.1:80": {"10.0.1.1:8080", "10.0.1.2:8080"},
+		"udp://10.0.0.2:53": {"10.0.2.1:53"},
+	}, table())
+	if sources := rec.Sources(FileSourcePrefix); assert.Len(t, sources, 3) {
+		assert.NotEmpty(t, sources[0].Error)
+		assert.Empty(t, sources[1].Error)
+		assert.Empty(t, sources[2].Error)
+	}
+
+	//broken file keeps services it has declared before
+	write("web.yaml", "virtualServers: [")
+	src.Rescan(ctx)
+	assert.Len(t, table()["tcp://10.0.0.1:80"], 2)
+
+	//conflicting file is rejected
+	write("dup.json", dnsJSON)
+	src.Rescan(ctx)
+	assert.Len(t, table(), 2)
+	if sources := rec.Sources(FileSourcePrefix + filepath.Join(dir, "dup")); assert.Len(t, sources, 1) {
+		assert.Contains(t, sources[0].Error, "conflict")
+	}
+
+	//foreign real server is left as is
+	vsID, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	assert.NoError(t, adm.UpdateRealServer(ctx, vsID,
+		ipvsAdm.RealServer{Address: "10.0.9.9:8080", PacketForwarder: "dr"}, ipvsAdm.ForceAddIfNotExist{}))
+	write("web.yaml", `
+virtualServers:
+  - virtualServer:
+      identity:
+        address: {network: TCP, host: 10.0.0.1, port: 80}
+    realServers:
+      - address: {host: 10.0.1.2, port: 8080}
+        weight: 1
+`)
+	src.Rescan(ctx)
+	assert.Equal(t, []string{"10.0.1.2:8080", "10.0.9.9:8080"}, table()["tcp://10.0.0.1:80"])
+
+	//drift of the kernel table is repaired on rescan
+	assert.NoError(t, adm.RemoveVirtualServer(ctx, vsID))
+	src.Rescan(ctx)
+	assert.Equal(t, []string{"10.0.1.2:8080"}, table()["tcp://10.0.0.1:80"])
+
+	//removed file drops its services; the conflicting one takes over
+	assert.NoError(t, os.Remove(filepath.Join(dir, "dns.json")))
+	src.Rescan(ctx)
+	assert.Equal(t, map[string][]string{
+		"tcp://10.0.0.1:80": {"10.0.1.2:8080"},
+		"udp://10.0.0.2:53": {"10.0.2.1:53"},
+	}, table())
+	if sources := rec.Sources(FileSourcePrefix + filepath.Join(dir, "dup")); assert.Len(t, sources, 1) {
+		assert.Empty(t, sources[0].Error)
+	}
+}
+
+func Test_ForeignVirtualServer(t *testing.T) {
+	ctx := context.Background()
+	adm := ipvsAdm.NewMemoryAdmin()
+	foreign, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	assert.NoError(t, adm.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: foreign, ScheduleMethod: "wrr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	assert.NoError(t, adm.UpdateRealServer(ctx, foreign,
+		ipvsAdm.RealServer{Address: "10.0.9.9:8080", PacketForwarder: "dr"}, ipvsAdm.ForceAddIfNotExist{}))
+	dir, err := ioutil.TempDir("", "discovery")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	owners, err := ownership.Open(ownership.Config{File: filepath.Join(dir, "owned.json")})
+	if !assert.NoError(t, err) {
+		return
+	}
+	owned := owners.Admin(adm)
+	services, err := ParseServicesFile("web.yaml", []byte(webYaml+dnsYaml))
+	if !assert.NoError(t, err) {
+		return
+	}
+	rec := NewReconciler(owned, WithOwnership{Registry: owners})
+	assert.NoError(t, rec.Update(ctx, "test", services))
+	vss := func() []string {
+		var ret []string
+		_ = adm.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+			ret = append(ret, ipvsAdm.IdentityString(vs.Identity))
+			return nil
+		})
+		sort.Strings(ret)
+		return ret
+	}
+	assert.Equal(t, []string{"tcp://10.0.0.1:80", "udp://10.0.0.2:53"}, vss())
+
+	//restarted reconciler removes virtual server it has created before; foreign one keeps its own real servers
+	rec = NewReconciler(owned, WithOwnership{Registry: owners})
+	assert.NoError(t, rec.Update(ctx, "test", services))
+	assert.NoError(t, rec.Remove(ctx, "test"))
+	assert.Equal(t, []string{"tcp://10.0.0.1:80"}, vss())
+	var reals []string
+	_ = adm.ListRealServers(ctx, foreign, func(rs ipvsAdm.RealServer) error {
+		reals = append(reals, string(rs.Address))
+		return nil
+	})
+	assert.Equal(t, []string{"10.0.9.9:8080"}, reals)
+}
+
+func Test_DNSSource(t *testing.T) {
+	ctx := context.Background()
+	var mx sync.Mutex
+	srv := func(target string, port uint16, prio, weight uint16) dnsmessage.ResourceBody {
+		return &dnsmessage.SRVResource{Priority: prio, Weight: weight, Port: port,
+			Target: dnsmessage.MustNewName(target)}
+	}
+	a := func(ip string) dnsmessage.ResourceBody {
+		var ret dnsmessage.AResource
+		copy(ret.A[:], net.ParseIP(ip).To4())
+		return &ret
+	}
+	type record struct {
+		ttl  uint32
+		body dnsmessage.ResourceBody
+	}
+	zone := map[string][]record{
+		"_http._tcp.web.test.": {
+			{30, srv("a.web.test.", 8080, 10, 5)},
+			{20, srv("b.web.test.", 8081, 10, 3)},
+			{30, srv("backup.web.test.", 8080, 20, 1)},
+		},
+		"a.web.test.":      {{60, a("10.0.1.1")}},
+		"b.web.test.":      {{60, a("10.0.1.2")}},
+		"backup.web.test.": {{60, a("10.0.1.9")}},
+		"dns.test.":        {{1, a("10.0.2.1")}, {1, a("10.0.2.2")}},
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, e := pc.ReadFrom(buf)
+			if e != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if req.Unpack(buf[:n]) != nil || len(req.Questions) != 1 {
+				continue
+			}
+			q := req.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true},
+				Questions: req.Questions,
+			}
+			mx.Lock()
+			records, ok := zone[q.Name.String()]
+			mx.Unlock()
+			if !ok {
+				resp.RCode = dnsmessage.RCodeNameError
+			}
+			for _, r := range records {
+				if resourceType(r.body) == q.Type {
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: r.ttl},
+						Body:   r.body,
+					})
+				}
+			}
+			if packed, e := resp.Pack(); e == nil {
+				_, _ = pc.WriteTo(packed, from)
+			}
+		}
+	}()
+
+	adm := ipvsAdm.NewMemoryAdmin()
+	src, err := NewDNSSource(NewReconciler(adm), DNSSourceConfig{
+		Nameserver: pc.LocalAddr().String(),
+		MinTTL:     time.Second,
+		Services: []DNSServiceConfig{
+			{VirtualServer: "tcp://10.0.0.1:80", Name: "_http._tcp.web.test", Type: "srv", SRVWeights: true},
+			{VirtualServer: "udp://10.0.0.2:53", Name: "dns.test", PacketForwarder: "nat", Weight: 2},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	reals := func(vs string) map[ipvsAdm.Address]ipvsAdm.RealServer {
+		id, _ := ipvsAdm.ParseVirtualServerIdentity(vs)
+		ret := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+		_ = adm.ListRealServers(ctx, id, func(rs ipvsAdm.RealServer) error {
+			ret[rs.Address] = rs
+			return nil
+		})
+		return ret
+	}
+
+	next, err := src.Refresh(ctx, "tcp://10.0.0.1:80")
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Second, next)
+	assert.Equal(t, map[ipvsAdm.Address]ipvsAdm.RealServer{
+		"10.0.1.1:8080": {Address: "10.0.1.1:8080", PacketForwarder: "dr", Weight: 5},
+		"10.0.1.2:8081": {Address: "10.0.1.2:8081", PacketForwarder: "dr", Weight: 3},
+	}, reals("tcp://10.0.0.1:80"))
+
+	next, err = src.Refresh(ctx, "udp://10.0.0.2:53")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, next)
+	assert.Equal(t, map[ipvsAdm.Address]ipvsAdm.RealServer{
+		"10.0.2.1:53": {Address: "10.0.2.1:53", PacketForwarder: "nat", Weight: 2},
+		"10.0.2.2:53": {Address: "10.0.2.2:53", PacketForwarder: "nat", Weight: 2},
+	}, reals("udp://10.0.0.2:53"))
+
+	mx.Lock()
+	zone["dns.test."] = []record{{1, a("10.0.2.2")}, {1, a("10.0.2.3")}}
+	mx.Unlock()
+	_, err = src.Refresh(ctx, "udp://10.0.0.2:53")
+	assert.NoError(t, err)
+	assert.Len(t, reals("udp://10.0.0.2:53"), 2)
+	assert.Contains(t, reals("udp://10.0.0.2:53"), ipvsAdm.Address("10.0.2.3:53"))
+
+	//resolve failure keeps real servers resolved before
+	mx.Lock()
+	delete(zone, "dns.test.")
+	mx.Unlock()
+	_, err = src.Refresh(ctx, "udp://10.0.0.2:53")
+	assert.Error(t, err)
+	assert.Len(t, reals("udp://10.0.0.2:53"), 2)
+}
+
+func resourceType(body dnsmessage.ResourceBody) dnsmessage.Type {
+	switch body.(type) {
+	case *dnsmessage.SRVResource:
+		return dnsmessage.TypeSRV
+	case *dnsmessage.AResource:
+		return dnsmessage.TypeA
+	}
+	return dnsmessage.TypeAAAA
+}
+
+func Test_ConsulSource(t *testing.T) {
+	ctx := context.Background()
+	var mx sync.Mutex
+	index := 10
+	status := http.StatusOK
+	entries := `[
+  {"Node": {"Address": "10.0.1.1"}, "Service": {"Port": 8080, "Meta": {"ipvs-weight": "5"}}},
+  {"Node": {"Address": "10.0.9.9"}, "Service": {"Address": "10.0.1.2", "Port": 8080}}
+]`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		q := r.URL.Query()
+		if r.URL.Path != "/v1/health/service/web" || q.Get("passing") != "true" ||
+			q.Get("tag") != "ipvs" || r.Header.Get("X-Consul-Token") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(entries))
+	}))
+	defer srv.Close()
+
+	adm := ipvsAdm.NewMemoryAdmin()
+	src, err := NewConsulSource(NewReconciler(adm), ConsulSourceConfig{
+		Address: srv.URL,
+		Token:   "secret",
+		Services: []ConsulServiceConfig{
+			{VirtualServer: "tcp://10.0.0.1:80", Service: "web", Tag: "ipvs", PacketForwarder: "nat", Weight: 2},
+		},
+	}, WithHTTPClient{Client: srv.Client()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	svc := src.services[0]
+	reals := func() map[ipvsAdm.Address]uint32 {
+		ret := make(map[ipvsAdm.Address]uint32)
+		_ = adm.ListRealServers(ctx, svc.virtualServer.Identity, func(rs ipvsAdm.RealServer) error {
+			ret[rs.Address] = rs.Weight
+			return nil
+		})
+		return ret
+	}
+
+	next, err := src.poll(ctx, svc, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), next)
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.0.1.1:8080": 5, "10.0.1.2:8080": 2}, reals())
+
+	mx.Lock()
+	index = 11
+	entries = `[{"Node": {"Address": "10.0.1.3"}, "Service": {"Port": 8081, "Meta": {"ipvs-weight": "bad"}}}]`
+	mx.Unlock()
+	next, err = src.poll(ctx, svc, next)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), next)
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.0.1.3:8081": 2}, reals())
+
+	//failed query keeps real servers fetched before
+	mx.Lock()
+	status = http.StatusInternalServerError
+	mx.Unlock()
+	next, err = src.poll(ctx, svc, next)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(11), next)
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.0.1.3:8081": 2}, reals())
+}
+
+func Test_ConfigSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf := ConfigSourceConfig{
+		ReassertInterval: 10 * time.Millisecond,
+		VirtualServers: []VirtualServerConfig{{
+			VirtualServer: "tcp://10.0.0.1:80",
+			RealServers: []RealServerConfig{
+				{Address: "10.0.1.1:8080", Weight: 1},
+				{Address: "10.0.1.2:8080", PacketForwarder: "nat", Weight: 2},
+			},
+		}},
+	}
+	load := func(context.Context) (ConfigSourceConfig, error) {
+		return conf, nil
+	}
+	adm := ipvsAdm.NewMemoryAdmin()
+	src, err := NewConfigSource(ctx, NewReconciler(adm), load)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, src.Apply(ctx))
+	vsID, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	reals := func() map[ipvsAdm.Address]ipvsAdm.RealServer {
+		ret := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+		_ = adm.ListRealServers(ctx, vsID, func(rs ipvsAdm.RealServer) error {
+			ret[rs.Address] = rs
+			return nil
+		})
+		return ret
+	}
+	assert.Equal(t, map[ipvsAdm.Address]ipvsAdm.RealServer{
+		"10.0.1.1:8080": {Address: "10.0.1.1:8080", PacketForwarder: "dr", Weight: 1},
+		"10.0.1.2:8080": {Address: "10.0.1.2:8080", PacketForwarder: "nat", Weight: 2},
+	}, reals())
+
+	//lost table is re-asserted
+	go src.Run(ctx)
+	assert.NoError(t, adm.RemoveVirtualServer(ctx, vsID))
+	assert.Eventually(t, func() bool {
+		return len(reals()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	//drifted weight is re-asserted
+	assert.NoError(t, adm.UpdateRealServer(ctx, vsID,
+		ipvsAdm.RealServer{Address: "10.0.1.2:8080", PacketForwarder: "nat", Weight: 7}))
+	assert.Eventually(t, func() bool {
+		return reals()["10.0.1.2:8080"].Weight == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conf.VirtualServers[0].RealServers[0].LowerThreshold = 10
+	_, err = NewConfigSource(ctx, NewReconciler(adm), load)
+	assert.Error(t, err)
+}
+
+func Test_HealthCheckedVirtualServer(t *testing.T) {
+	healthcheck.RegisterChecker("discovery-fake", func(healthcheck.CheckConfig) (healthcheck.Checker, error) {
+		return healthcheck.CheckerFunc(func(_ context.Context, target healthcheck.Target) error {
+			if target.Host == "10.0.1.2" {
+				return net.ErrClosed
+			}
+			return nil
+		}), nil
+	})
+	vsID, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	for _, onFailure := range []string{healthcheck.OnFailureQuiesce, healthcheck.OnFailureRemove} {
+		ctx, cancel := context.WithCancel(context.Background())
+		conf := ConfigSourceConfig{
+			ReassertInterval: 5 * time.Millisecond,
+			VirtualServers: []VirtualServerConfig{{
+				VirtualServer: "tcp://10.0.0.1:80",
+				RealServers: []RealServerConfig{
+					{Address: "10.0.1.1:8080", Weight: 1},
+					{Address: "10.0.1.2:8080", Weight: 2},
+				},
+			}},
+		}
+		adm := ipvsAdm.NewMemoryAdmin()
+		hc, err := healthcheck.NewManager(adm, []healthcheck.ServiceConfig{{
+			VirtualServer: "tcp://10.0.0.1:80",
+			OnFailure:     onFailure,
+			Check:         healthcheck.CheckConfig{Type: "discovery-fake", Interval: 5 * time.Millisecond, Rise: 1, Fall: 1},
+		}})
+		if !assert.NoError(t, err) {
+			cancel()
+			return
+		}
+		src, err := NewConfigSource(ctx, NewReconciler(adm, WithHealthChecked{Manages: hc.Manages}),
+			func(context.Context) (ConfigSourceConfig, error) {
+				return conf, nil
+			})
+		if !assert.NoError(t, err) {
+			cancel()
+			return
+		}
+		assert.NoError(t, src.Apply(ctx))
+		go src.Run(ctx)
+		go hc.Run(ctx)
+		failed := func() bool {
+			var present bool
+			var weight uint32
+			_ = adm.ListRealServers(ctx, vsID, func(rs ipvsAdm.RealServer) error {
+				if rs.Address == "10.0.1.2:8080" {
+					present, weight = true, rs.Weight
+				}
+				return nil
+			})
+			if onFailure == healthcheck.OnFailureRemove {
+				return !present
+			}
+			return present && weight == 0
+		}
+
+		//failed real server is left to health checker by re-asserts
+		assert.Eventually(t, failed, 5*time.Second, 5*time.Millisecond, onFailure)
+		assert.Never(t, func() bool {
+			return !failed()
+		}, 200*time.Millisecond, 2*time.Millisecond, onFailure)
+		cancel()
+	}
+}
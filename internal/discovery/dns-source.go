@@ -0,0 +1,471 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/*//Sample of config
+discovery:
+  dns:
+    nameserver: 127.0.0.1:53
+    timeout: 2s
+    min-ttl: 5s
+    max-ttl: 5m
+    services:
+      - virtual-server: tcp://10.0.0.1:80
+        schedule-method: wrr
+        name: _http._tcp.backend.service.local
+        type: srv
+        srv-weights: true
+        packet-forwarder: nat
+      - virtual-server: udp://10.0.0.2:53
+        name: resolvers.service.local
+        type: a
+        port: 53
+        weight: 2
+*/
+
+//DNSSourcePrefix prefix of source names are made by DNSSource
+const DNSSourcePrefix = "dns:"
+
+const (
+	//DNSTypeSRV real servers are targets of SRV records
+	DNSTypeSRV = "srv"
+
+	//DNSTypeA real servers are IPv4 addresses of A records
+	DNSTypeA = "a"
+
+	//DNSTypeAAAA real servers are IPv6 addresses of AAAA records
+	DNSTypeAAAA = "aaaa"
+)
+
+type (
+	//DNSSourceConfig DNS discovery config; empty nameserver means the first one from '/etc/resolv.conf'
+	DNSSourceConfig struct {
+		Nameserver string             `mapstructure:"nameserver"`
+		Timeout    time.Duration      `mapstructure:"timeout"`
+		MinTTL     time.Duration      `mapstructure:"min-ttl"`
+		MaxTTL     time.Duration      `mapstructure:"max-ttl"`
+		Services   []DNSServiceConfig `mapstructure:"services"`
+	}
+
+	//DNSServiceConfig virtual server takes its real servers from DNS name
+	DNSServiceConfig struct {
+		VirtualServer   string `mapstructure:"virtual-server"`
+		ScheduleMethod  string `mapstructure:"schedule-method"`
+		Name            string `mapstructure:"name"`
+		Type            string `mapstructure:"type"`
+		Port            uint32 `mapstructure:"port"`
+		PacketForwarder string `mapstructure:"packet-forwarder"`
+		Weight          uint32 `mapstructure:"weight"`
+		SRVWeights      bool   `mapstructure:"srv-weights"`
+	}
+
+	//DNSSource declares real servers of virtual servers from DNS records; every service is a separate source
+	DNSSource struct {
+		rec      *Reconciler
+		conf     DNSSourceConfig
+		services []dnsService
+	}
+
+	dnsService struct {
+		DNSServiceConfig
+		virtualServer ipvsAdm.VirtualServer
+		qtype         dnsmessage.Type
+	}
+)
+
+const (
+	defDNSTimeout = 2 * time.Second
+	defDNSMinTTL  = 5 * time.Second
+	defDNSMaxTTL  = 5 * time.Minute
+	defScheduler  = "wlc"
+	defForwarder  = "dr"
+	defResolvConf = "/etc/resolv.conf"
+)
+
+//NewDNSSource makes DNS discovery source
+func NewDNSSource(rec *Reconciler, conf DNSSourceConfig) (*DNSSource, error) {
+	const api = "discovery/NewDNSSource"
+
+	if conf.Timeout <= 0 {
+		conf.Timeout = defDNSTimeout
+	}
+	if conf.MinTTL <= 0 {
+		conf.MinTTL = defDNSMinTTL
+	}
+	if conf.MaxTTL <= 0 {
+		conf.MaxTTL = defDNSMaxTTL
+	}
+	if conf.MinTTL > conf.MaxTTL {
+		return nil, errors.Errorf("%s: min-ttl(%v) > max-ttl(%v)", api, conf.MinTTL, conf.MaxTTL)
+	}
+	if conf.Nameserver == "" {
+		var err error
+		if conf.Nameserver, err = nameserverFromResolvConf(defResolvConf); err != nil {
+			return nil, errors.Wrap(err, api)
+		}
+	}
+	if _, _, err := net.SplitHostPort(conf.Nameserver); err != nil {
+		conf.Nameserver = net.JoinHostPort(conf.Nameserver, "53")
+	}
+	ret := &DNSSource{
+		rec:  rec,
+		conf: conf,
+	}
+	seen := make(map[string]bool)
+	for _, c := range conf.Services {
+		svc, err := newDNSService(c)
+		if err != nil {
+			return nil, errors.Wrap(err, api)
+		}
+		vs := ipvsAdm.IdentityString(svc.virtualServer.Identity)
+		if seen[vs] {
+			return nil, errors.Errorf("%s: virtual server '%s' is declared twice", api, vs)
+		}
+		seen[vs] = true
+		ret.services = append(ret.services, svc)
+	}
+	return ret, nil
+}
+
+func newDNSService(c DNSServiceConfig) (dnsService, error) {
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(c.VirtualServer)
+	if err != nil {
+		return dnsService{}, err
+	}
+	ret := dnsService{DNSServiceConfig: c}
+	if ret.ScheduleMethod == "" {
+		ret.ScheduleMethod = defScheduler
+	}
+	ret.virtualServer = ipvsAdm.VirtualServer{
+		Identity:       identity,
+		ScheduleMethod: ipvsAdm.ScheduleMethod(ret.ScheduleMethod),
+	}
+	if err = ret.virtualServer.ScheduleMethod.Valid(); err != nil {
+		return ret, errors.Wrapf(err, "'%s'", c.VirtualServer)
+	}
+	if ret.PacketForwarder == "" {
+		ret.PacketForwarder = defForwarder
+	}
+	if err = ipvsAdm.PacketForwarder(ret.PacketForwarder).Valid(); err != nil {
+		return ret, errors.Wrapf(err, "'%s'", c.VirtualServer)
+	}
+	if ret.Weight == 0 {
+		ret.Weight = 1
+	}
+	if ret.Name == "" {
+		return ret, errors.Errorf("'%s' has no DNS name", c.VirtualServer)
+	}
+	switch strings.ToLower(ret.Type) {
+	case DNSTypeSRV:
+		ret.qtype = dnsmessage.TypeSRV
+	case DNSTypeA, "":
+		ret.qtype = dnsmessage.TypeA
+	case DNSTypeAAAA:
+		ret.qtype = dnsmessage.TypeAAAA
+	default:
+		return ret, errors.Errorf("'%s' has unsupported DNS record type '%s'", c.VirtualServer, ret.Type)
+	}
+	if ret.qtype != dnsmessage.TypeSRV && ret.Port == 0 {
+		if a, ok := identity.(ipvsAdm.VirtualServerAddress); ok {
+			_, ret.Port, _ = a.Address.ToHostPort()
+		}
+		if ret.Port == 0 {
+			return ret, errors.Errorf("'%s' needs real servers port", c.VirtualServer)
+		}
+	}
+	if ret.Port > 0xFFFF {
+		return ret, errors.Errorf("'%s' has wrong port(%v)", c.VirtualServer, ret.Port)
+	}
+	return ret, nil
+}
+
+//Run resolves names and re-resolves them on TTL expiry until context is done
+func (src *DNSSource) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := range src.services {
+		svc := src.services[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src.runService(ctx, svc)
+		}()
+	}
+	wg.Wait()
+}
+
+func (src *DNSSource) runService(ctx context.Context, svc dnsService) {
+	source := DNSSourcePrefix + ipvsAdm.IdentityString(svc.virtualServer.Identity)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		next, err := src.Refresh(ctx, svc.VirtualServer)
+		if err != nil {
+			logger.Errorf(ctx, "discovery: '%s': %v", source, err)
+		}
+		timer.Reset(next)
+	}
+}
+
+//Refresh resolves name of virtual server and updates its real servers;
+//returns delay till next refresh
+func (src *DNSSource) Refresh(ctx context.Context, virtualServer string) (time.Duration, error) {
+	const api = "discovery/DNSSource/Refresh"
+
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(virtualServer)
+	if err != nil {
+		return 0, errors.Wrap(err, api)
+	}
+	vs := ipvsAdm.IdentityString(identity)
+	var svc *dnsService
+	for i := range src.services {
+		if ipvsAdm.IdentityString(src.services[i].virtualServer.Identity) == vs {
+			svc = &src.services[i]
+			break
+		}
+	}
+	if svc == nil {
+		return 0, errors.Errorf("%s: '%s' is not declared", api, vs)
+	}
+	source := DNSSourcePrefix + vs
+	reals, ttl, err := src.resolve(ctx, *svc)
+	if err != nil {
+		//real servers resolved before stay as is
+		src.rec.Fail(source, err)
+		return src.conf.MinTTL, errors.Wrap(err, api)
+	}
+	err = src.rec.Update(ctx, source, []Service{{
+		VirtualServer: svc.virtualServer,
+		RealServers:   reals,
+	}})
+	if ttl < src.conf.MinTTL {
+		ttl = src.conf.MinTTL
+	}
+	if ttl > src.conf.MaxTTL {
+		ttl = src.conf.MaxTTL
+	}
+	return ttl, errors.Wrap(err, api)
+}
+
+func (src *DNSSource) resolve(ctx context.Context, svc dnsService) ([]ipvsAdm.RealServer, time.Duration, error) {
+	answer, extra, err := src.query(ctx, svc.Name, svc.qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := src.conf.MaxTTL
+	observe := func(h dnsmessage.ResourceHeader) {
+		if d := time.Duration(h.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	byAddr := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+	add := func(ip net.IP, port uint32, weight uint32) {
+		addr := ipvsAdm.Address(net.JoinHostPort(ip.String(), strconv.FormatUint(uint64(port), 10)))
+		byAddr[addr] = ipvsAdm.RealServer{
+			Address:         addr,
+			PacketForwarder: ipvsAdm.PacketForwarder(svc.PacketForwarder),
+			Weight:          weight,
+		}
+	}
+	if svc.qtype != dnsmessage.TypeSRV {
+		for _, rr := range answer {
+			if ip := resourceIP(rr); ip != nil {
+				observe(rr.Header)
+				add(ip, svc.Port, svc.Weight)
+			}
+		}
+	} else {
+		var records []*dnsmessage.SRVResource
+		for _, rr := range answer {
+			if s, ok := rr.Body.(*dnsmessage.SRVResource); ok {
+				observe(rr.Header)
+				if len(records) == 0 || s.Priority == records[0].Priority {
+					records = append(records, s)
+				} else if s.Priority < records[0].Priority {
+					//only targets of the most preferred priority are in use
+					records = append(records[:0], s)
+				}
+			}
+		}
+		for _, s := range records {
+			weight := svc.Weight
+			if svc.SRVWeights {
+				weight = uint32(s.Weight)
+			}
+			ips, e := src.targetIPs(ctx, s.Target.String(), extra, observe)
+			if e != nil {
+				return nil, 0, e
+			}
+			for _, ip := range ips {
+				add(ip, uint32(s.Port), weight)
+			}
+		}
+	}
+	if len(byAddr) == 0 {
+		return nil, 0, errors.Errorf("'%s' has no usable records", svc.Name)
+	}
+	ret := make([]ipvsAdm.RealServer, 0, len(byAddr))
+	for _, rs := range byAddr {
+		ret = append(ret, rs)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Address < ret[j].Address
+	})
+	return ret, ttl, nil
+}
+
+func (src *DNSSource) targetIPs(ctx context.Context, target string, extra []dnsmessage.Resource,
+	observe func(dnsmessage.ResourceHeader)) ([]net.IP, error) {
+
+	var ret []net.IP
+	for _, rr := range extra {
+		if ip := resourceIP(rr); ip != nil && strings.EqualFold(rr.Header.Name.String(), target) {
+			observe(rr.Header)
+			ret = append(ret, ip)
+		}
+	}
+	if len(ret) > 0 {
+		return ret, nil
+	}
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answer, _, err := src.query(ctx, target, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range answer {
+			if ip := resourceIP(rr); ip != nil {
+				observe(rr.Header)
+				ret = append(ret, ip)
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (src *DNSSource) query(ctx context.Context, name string, qtype dnsmessage.Type) (answer, extra []dnsmessage.Resource, err error) {
+	defer func() {
+		err = errors.Wrapf(err, "query '%s'(%s)", name, strings.TrimPrefix(qtype.String(), "Type"))
+	}()
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	var q dnsmessage.Question
+	if q.Name, err = dnsmessage.NewName(name); err != nil {
+		return nil, nil, err
+	}
+	q.Type, q.Class = qtype, dnsmessage.ClassINET
+	var resp *dnsmessage.Message
+	if resp, err = src.exchange(ctx, "udp", q); err == nil && resp.Truncated {
+		resp, err = src.exchange(ctx, "tcp", q)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, nil, errors.New(strings.TrimPrefix(resp.RCode.String(), "RCode"))
+	}
+	return resp.Answers, resp.Additionals, nil
+}
+
+func (src *DNSSource) exchange(ctx context.Context, network string, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, src.conf.Timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, src.conf.Nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true}, //nolint:gosec
+		Questions: []dnsmessage.Question{q},
+	}
+	var packed []byte
+	if packed, err = req.Pack(); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0xFFFF)
+	var n int
+	if network == "tcp" {
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(packed)))
+		if _, err = conn.Write(append(l[:], packed...)); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(l[:]))
+		_, err = io.ReadFull(conn, buf[:n])
+	} else {
+		if _, err = conn.Write(packed); err != nil {
+			return nil, err
+		}
+		n, err = conn.Read(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err = resp.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	if resp.ID != req.ID || !resp.Response {
+		return nil, errors.New("mismatched response")
+	}
+	return &resp, nil
+}
+
+func resourceIP(rr dnsmessage.Resource) net.IP {
+	switch t := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(t.A[:])
+	case *dnsmessage.AAAAResource:
+		return net.IP(t.AAAA[:])
+	}
+	return nil
+}
+
+func nameserverFromResolvConf(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.Errorf("no nameserver is found in '%s'", fileName)
+}
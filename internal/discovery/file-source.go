@@ -0,0 +1,238 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	apiIpvs "github.com/thataway/ipvs/internal/api/ipvs"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+)
+
+/*//Sample of config
+discovery:
+  files:
+    dir: /etc/ipvs/services.d
+    rescan-interval: 1m
+
+//Sample of file '/etc/ipvs/services.d/web.yaml'; it has the same layout as 'ListVirtualServersResponse'
+virtualServers:
+  - virtualServer:
+      identity:
+        address: {network: TCP, host: 10.0.0.1, port: 80}
+      scheduleMethod: WeightedRoundRobin
+    realServers:
+      - address: {host: 10.0.1.1, port: 8080}
+        packetForwarder: Masquerading
+        weight: 1
+*/
+
+//FileSourcePrefix prefix of source names are made by FileSource
+const FileSourcePrefix = "file:"
+
+type (
+	//FileSourceConfig directory of YAML/JSON service files
+	FileSourceConfig struct {
+		Dir            string        `mapstructure:"dir"`
+		RescanInterval time.Duration `mapstructure:"rescan-interval"`
+	}
+
+	//FileSource declares services from files of directory; every file is a separate source
+	FileSource struct {
+		rec    *Reconciler
+		conf   FileSourceConfig
+		loaded map[string][]byte
+	}
+)
+
+const (
+	defRescanInterval = time.Minute
+	fsEventsDebounce  = 200 * time.Millisecond
+)
+
+//NewFileSource makes file discovery source
+func NewFileSource(rec *Reconciler, conf FileSourceConfig) (*FileSource, error) {
+	const api = "discovery/NewFileSource"
+
+	if conf.Dir == "" {
+		return nil, errors.Errorf("%s: no dir is specified", api)
+	}
+	if conf.RescanInterval <= 0 {
+		conf.RescanInterval = defRescanInterval
+	}
+	return &FileSource{
+		rec:    rec,
+		conf:   conf,
+		loaded: make(map[string][]byte),
+	}, nil
+}
+
+//Run watches directory and rescans it periodically until context is done
+func (fs *FileSource) Run(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Errorf(ctx, "discovery: file watcher: %v; only periodic rescan is in use", err)
+	} else {
+		defer watcher.Close()
+		if err = watcher.Add(fs.conf.Dir); err != nil {
+			logger.Errorf(ctx, "discovery: watch '%s': %v; only periodic rescan is in use", fs.conf.Dir, err)
+		}
+	}
+	var fsEvents <-chan fsnotify.Event
+	var fsErrors <-chan error
+	if watcher != nil {
+		fsEvents, fsErrors = watcher.Events, watcher.Errors
+	}
+	ticker := time.NewTicker(fs.conf.RescanInterval)
+	defer ticker.Stop()
+	debounce := time.NewTimer(0)
+	defer debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fs.Rescan(ctx)
+		case <-debounce.C:
+			fs.Rescan(ctx)
+		case ev, ok := <-fsEvents:
+			if !ok {
+				fsEvents = nil
+				continue
+			}
+			if isServiceFile(ev.Name) {
+				debounce.Reset(fsEventsDebounce)
+			}
+		case e, ok := <-fsErrors:
+			if !ok {
+				fsErrors = nil
+				continue
+			}
+			logger.Warnf(ctx, "discovery: watch '%s': %v", fs.conf.Dir, e)
+		}
+	}
+}
+
+//Rescan reads changed files, drops removed ones and reconciles the kernel table
+func (fs *FileSource) Rescan(ctx context.Context) {
+	entries, err := ioutil.ReadDir(fs.conf.Dir)
+	if err != nil {
+		logger.Errorf(ctx, "discovery: read dir '%s': %v", fs.conf.Dir, err)
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && isServiceFile(e.Name()) {
+			names = append(names, filepath.Join(fs.conf.Dir, e.Name()))
+		}
+	}
+	sort.Strings(names)
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	for name := range fs.loaded {
+		if seen[name] {
+			continue
+		}
+		delete(fs.loaded, name)
+		if err = fs.rec.Remove(ctx, FileSourcePrefix+name); err != nil {
+			logger.Errorf(ctx, "discovery: drop services of '%s': %v", name, err)
+		}
+	}
+	for _, name := range names {
+		fs.load(ctx, name)
+	}
+	if err = fs.rec.Reconcile(ctx); err != nil {
+		logger.Errorf(ctx, "discovery: %v", err)
+	}
+}
+
+func (fs *FileSource) load(ctx context.Context, name string) {
+	source := FileSourcePrefix + name
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fs.rec.Fail(source, err)
+			logger.Errorf(ctx, "discovery: read '%s': %v", name, err)
+		}
+		return
+	}
+	if last := fs.loaded[name]; last != nil && bytes.Equal(last, data) {
+		return
+	}
+	fs.loaded[name] = data
+	var services []Service
+	if services, err = ParseServicesFile(name, data); err != nil {
+		fs.rec.Fail(source, err)
+		logger.Errorf(ctx, "discovery: '%s' is rejected: %v", name, err)
+		return
+	}
+	if err = fs.rec.Update(ctx, source, services); err != nil {
+		//conflicts and kernel errors may go away, so file will be retried on next rescan
+		fs.loaded[name] = nil
+		logger.Errorf(ctx, "discovery: '%s': %v", name, err)
+		return
+	}
+	logger.Infof(ctx, "discovery: '%s' declares %v virtual server(s)", name, len(services))
+}
+
+//ParseServicesFile parses and validates YAML/JSON services file
+func ParseServicesFile(name string, data []byte) ([]Service, error) {
+	const api = "discovery/ParseServicesFile"
+
+	if ext := strings.ToLower(filepath.Ext(name)); ext == ".yaml" || ext == ".yml" {
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, errors.Wrap(err, api)
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, errors.Wrap(err, api)
+		}
+	}
+	var doc ipvs.ListVirtualServersResponse
+	if err := protojson.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	ret := make([]Service, 0, len(doc.GetVirtualServers()))
+	for i, item := range doc.GetVirtualServers() {
+		var vsConv apiIpvs.VirtualServerConv
+		if err := vsConv.FromPb(item.GetVirtualServer()); err != nil {
+			return nil, errors.Wrapf(err, "%s: virtualServers[%v]", api, i)
+		}
+		svc := Service{VirtualServer: vsConv.VirtualServer}
+		for j, rs := range item.GetRealServers() {
+			var rsConv apiIpvs.RealServerConv
+			if err := rsConv.FromPb(rs); err != nil {
+				return nil, errors.Wrapf(err, "%s: virtualServers[%v].realServers[%v]", api, i, j)
+			}
+			svc.RealServers = append(svc.RealServers, rsConv.RealServer)
+		}
+		ret = append(ret, svc)
+	}
+	return ret, nil
+}
+
+func isServiceFile(name string) bool {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
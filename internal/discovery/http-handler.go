@@ -0,0 +1,25 @@
+package discovery
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/thataway/ipvs/internal/httpjson"
+)
+
+//ServeHTTP impl http.Handler; exposes discovery sources states as JSON
+//
+//	GET / - sources with virtual servers they declare and their last errors
+func (rec *Reconciler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimSuffix(r.URL.Path, "/") != "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, struct {
+		Sources []SourceStatus `json:"sources"`
+	}{rec.Sources(r.URL.Query().Get("prefix"))})
+}
@@ -0,0 +1,335 @@
+package k8s
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/ipvs/internal/discovery"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	coreV1 "k8s.io/api/core/v1"
+	discoveryV1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersCoreV1 "k8s.io/client-go/listers/core/v1"
+	listersDiscoveryV1 "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+/*//Sample of config
+discovery:
+  kubernetes:
+    kubeconfig: /etc/ipvs/kubeconfig
+    namespace: default
+    resync-interval: 5m
+
+//Sample of Service is published as 'tcp://10.0.0.1:80'
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  annotations:
+    ipvs.thataway.io/virtual-ip: 10.0.0.1
+    ipvs.thataway.io/schedule-method: wrr
+    ipvs.thataway.io/packet-forwarder: dr
+    ipvs.thataway.io/weight: "1"
+spec:
+  ports:
+    - name: http
+      port: 80
+      targetPort: 8080
+*/
+
+//SourcePrefix prefix of source names are made by Source
+const SourcePrefix = "k8s:"
+
+const (
+	//AnnotationVirtualIP selects Service to be published by virtual IP
+	AnnotationVirtualIP = "ipvs.thataway.io/virtual-ip"
+
+	//AnnotationScheduleMethod schedule method of virtual servers
+	AnnotationScheduleMethod = "ipvs.thataway.io/schedule-method"
+
+	//AnnotationPacketForwarder packet forwarder of real servers
+	AnnotationPacketForwarder = "ipvs.thataway.io/packet-forwarder"
+
+	//AnnotationWeight weight of ready real servers
+	AnnotationWeight = "ipvs.thataway.io/weight"
+)
+
+type (
+	//Config Kubernetes discovery config; empty kubeconfig means in-cluster config,
+	//empty namespace means all namespaces
+	Config struct {
+		Kubeconfig     string        `mapstructure:"kubeconfig"`
+		Namespace      string        `mapstructure:"namespace"`
+		ResyncInterval time.Duration `mapstructure:"resync-interval"`
+	}
+
+	//Source declares virtual servers from annotated Services and their EndpointSlices;
+	//every Service is a separate source
+	Source struct {
+		rec      *discovery.Reconciler
+		conf     Config
+		factory  informers.SharedInformerFactory
+		services listersCoreV1.ServiceLister
+		slices   listersDiscoveryV1.EndpointSliceLister
+		synced   []cache.InformerSynced
+		changed  chan struct{}
+		known    map[string]bool
+	}
+)
+
+const (
+	defResyncInterval = 5 * time.Minute
+	defScheduler      = "wlc"
+	defForwarder      = "dr"
+	syncDebounce      = 200 * time.Millisecond
+)
+
+//NewClient makes Kubernetes client from kubeconfig file or from in-cluster config
+func NewClient(kubeconfig string) (kubernetes.Interface, error) {
+	const api = "k8s/NewClient"
+
+	var restConf *rest.Config
+	var err error
+	if kubeconfig == "" {
+		restConf, err = rest.InClusterConfig()
+	} else {
+		restConf, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	var ret *kubernetes.Clientset
+	ret, err = kubernetes.NewForConfig(restConf)
+	return ret, errors.Wrap(err, api)
+}
+
+//NewSource makes Kubernetes discovery source
+func NewSource(rec *discovery.Reconciler, client kubernetes.Interface, conf Config) *Source {
+	if conf.ResyncInterval <= 0 {
+		conf.ResyncInterval = defResyncInterval
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, conf.ResyncInterval,
+		informers.WithNamespace(conf.Namespace))
+	svcInformer := factory.Core().V1().Services()
+	sliceInformer := factory.Discovery().V1().EndpointSlices()
+	ret := &Source{
+		rec:      rec,
+		conf:     conf,
+		factory:  factory,
+		services: svcInformer.Lister(),
+		slices:   sliceInformer.Lister(),
+		synced: []cache.InformerSynced{
+			svcInformer.Informer().HasSynced,
+			sliceInformer.Informer().HasSynced,
+		},
+		changed: make(chan struct{}, 1),
+		known:   make(map[string]bool),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { ret.notify() },
+		UpdateFunc: func(interface{}, interface{}) { ret.notify() },
+		DeleteFunc: func(interface{}) { ret.notify() },
+	}
+	svcInformer.Informer().AddEventHandler(handler)
+	sliceInformer.Informer().AddEventHandler(handler)
+	return ret
+}
+
+//Start starts informers and waits until their caches are synced
+func (src *Source) Start(ctx context.Context) error {
+	const api = "k8s/Source/Start"
+
+	src.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), src.synced...) {
+		return errors.Errorf("%s: caches are not synced", api)
+	}
+	return nil
+}
+
+//Run follows Services and EndpointSlices changes until context is done
+func (src *Source) Run(ctx context.Context) {
+	if err := src.Start(ctx); err != nil {
+		logger.Errorf(ctx, "discovery: %v", err)
+		return
+	}
+	debounce := time.NewTimer(0)
+	defer debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-src.changed:
+			debounce.Reset(syncDebounce)
+		case <-debounce.C:
+			src.Sync(ctx)
+		}
+	}
+}
+
+//Sync maps annotated Services and their ready endpoints to virtual servers and real servers
+func (src *Source) Sync(ctx context.Context) {
+	services, err := src.services.List(labels.Everything())
+	if err != nil {
+		logger.Errorf(ctx, "discovery: list services: %v", err)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, svc := range services {
+		if svc.Annotations[AnnotationVirtualIP] == "" {
+			continue
+		}
+		source := SourcePrefix + svc.Namespace + "/" + svc.Name
+		seen[source] = true
+		src.known[source] = true
+		declared, e := src.serviceToVirtualServers(svc)
+		if e != nil {
+			src.rec.Fail(source, e)
+			logger.Errorf(ctx, "discovery: '%s' is rejected: %v", source, e)
+			continue
+		}
+		if e = src.rec.Update(ctx, source, declared); e != nil {
+			logger.Errorf(ctx, "discovery: '%s': %v", source, e)
+		}
+	}
+	for source := range src.known {
+		if seen[source] {
+			continue
+		}
+		if e := src.rec.Remove(ctx, source); e != nil {
+			logger.Errorf(ctx, "discovery: drop services of '%s': %v", source, e)
+			continue
+		}
+		delete(src.known, source)
+	}
+}
+
+func (src *Source) notify() {
+	select {
+	case src.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (src *Source) serviceToVirtualServers(svc *coreV1.Service) ([]discovery.Service, error) {
+	vip := net.ParseIP(svc.Annotations[AnnotationVirtualIP])
+	if vip == nil {
+		return nil, errors.Errorf("wrong '%s' annotation '%s'", AnnotationVirtualIP, svc.Annotations[AnnotationVirtualIP])
+	}
+	sm := ipvsAdm.ScheduleMethod(defScheduler)
+	if s := svc.Annotations[AnnotationScheduleMethod]; s != "" {
+		sm = ipvsAdm.ScheduleMethod(s)
+	}
+	if err := sm.Valid(); err != nil {
+		return nil, err
+	}
+	pf := ipvsAdm.PacketForwarder(defForwarder)
+	if s := svc.Annotations[AnnotationPacketForwarder]; s != "" {
+		pf = ipvsAdm.PacketForwarder(s)
+	}
+	if err := pf.Valid(); err != nil {
+		return nil, err
+	}
+	weight := uint32(1)
+	if s := svc.Annotations[AnnotationWeight]; s != "" {
+		w, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, errors.Wrapf(err, "wrong '%s' annotation", AnnotationWeight)
+		}
+		weight = uint32(w)
+	}
+	slices, err := src.slices.EndpointSlices(svc.Namespace).List(labels.SelectorFromSet(labels.Set{
+		discoveryV1.LabelServiceName: svc.Name,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	var ret []discovery.Service
+	for _, port := range svc.Spec.Ports {
+		proto := strings.ToLower(string(port.Protocol))
+		if proto == "" {
+			proto = "tcp"
+		}
+		identity := ipvsAdm.VirtualServerAddress{
+			NetworkProtocol: ipvsAdm.NetworkProtocol(proto),
+			Address:         ipvsAdm.Address(net.JoinHostPort(vip.String(), strconv.Itoa(int(port.Port)))),
+		}
+		if identity.NetworkProtocol.Valid() != nil {
+			//SCTP is not supported
+			continue
+		}
+		ret = append(ret, discovery.Service{
+			VirtualServer: ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: sm},
+			RealServers:   realServers(slices, port, pf, weight),
+		})
+	}
+	return ret, nil
+}
+
+func realServers(slices []*discoveryV1.EndpointSlice, port coreV1.ServicePort,
+	pf ipvsAdm.PacketForwarder, weight uint32) []ipvsAdm.RealServer {
+
+	byAddr := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+	for _, slice := range slices {
+		if slice.AddressType != discoveryV1.AddressTypeIPv4 && slice.AddressType != discoveryV1.AddressTypeIPv6 {
+			continue
+		}
+		var targetPort int32
+		for _, p := range slice.Ports {
+			name := ""
+			if p.Name != nil {
+				name = *p.Name
+			}
+			if name == port.Name && p.Port != nil {
+				targetPort = *p.Port
+				break
+			}
+		}
+		if targetPort == 0 {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			w, ok := endpointWeight(ep.Conditions, weight)
+			if !ok {
+				continue
+			}
+			for _, a := range ep.Addresses {
+				addr := ipvsAdm.Address(net.JoinHostPort(a, strconv.Itoa(int(targetPort))))
+				if prev, dup := byAddr[addr]; dup && prev.Weight >= w {
+					continue
+				}
+				byAddr[addr] = ipvsAdm.RealServer{Address: addr, PacketForwarder: pf, Weight: w}
+			}
+		}
+	}
+	ret := make([]ipvsAdm.RealServer, 0, len(byAddr))
+	for _, rs := range byAddr {
+		ret = append(ret, rs)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Address < ret[j].Address
+	})
+	return ret
+}
+
+//endpointWeight ready endpoint gets weight; terminating but still serving one is quiesced
+//to drain its connections; others are not in use
+func endpointWeight(c discoveryV1.EndpointConditions, weight uint32) (uint32, bool) {
+	if c.Ready == nil || *c.Ready {
+		return weight, true
+	}
+	if c.Serving != nil && *c.Serving && c.Terminating != nil && *c.Terminating {
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,125 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thataway/ipvs/internal/discovery"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	coreV1 "k8s.io/api/core/v1"
+	discoveryV1 "k8s.io/api/discovery/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_Source(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	boolPtr := func(b bool) *bool { return &b }
+	strPtr := func(s string) *string { return &s }
+	int32Ptr := func(i int32) *int32 { return &i }
+
+	web := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{
+			AnnotationVirtualIP:       "10.0.0.1",
+			AnnotationPacketForwarder: "nat",
+			AnnotationWeight:          "3",
+		}},
+		Spec: coreV1.ServiceSpec{Ports: []coreV1.ServicePort{
+			{Name: "http", Port: 80, Protocol: coreV1.ProtocolTCP},
+			{Name: "dns", Port: 53, Protocol: coreV1.ProtocolUDP},
+		}},
+	}
+	other := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "other", Namespace: "default"},
+		Spec:       coreV1.ServiceSpec{Ports: []coreV1.ServicePort{{Port: 80}}},
+	}
+	slice := &discoveryV1.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{Name: "web-1", Namespace: "default", Labels: map[string]string{
+			discoveryV1.LabelServiceName: "web",
+		}},
+		AddressType: discoveryV1.AddressTypeIPv4,
+		Ports: []discoveryV1.EndpointPort{
+			{Name: strPtr("http"), Port: int32Ptr(8080)},
+			{Name: strPtr("dns"), Port: int32Ptr(5353)},
+		},
+		Endpoints: []discoveryV1.Endpoint{
+			{Addresses: []string{"10.1.0.1"}, Conditions: discoveryV1.EndpointConditions{Ready: boolPtr(true)}},
+			{Addresses: []string{"10.1.0.2"}},
+			{Addresses: []string{"10.1.0.3"}, Conditions: discoveryV1.EndpointConditions{Ready: boolPtr(false)}},
+			{Addresses: []string{"10.1.0.4"}, Conditions: discoveryV1.EndpointConditions{
+				Ready: boolPtr(false), Serving: boolPtr(true), Terminating: boolPtr(true),
+			}},
+		},
+	}
+	client := fake.NewSimpleClientset(web, other, slice)
+	adm := ipvsAdm.NewMemoryAdmin()
+	rec := discovery.NewReconciler(adm)
+	src := NewSource(rec, client, Config{})
+	if !assert.NoError(t, src.Start(ctx)) {
+		return
+	}
+	table := func() map[string]map[ipvsAdm.Address]uint32 {
+		ret := make(map[string]map[ipvsAdm.Address]uint32)
+		_ = adm.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+			reals := make(map[ipvsAdm.Address]uint32)
+			ret[ipvsAdm.IdentityString(vs.Identity)] = reals
+			return adm.ListRealServers(ctx, vs.Identity, func(rs ipvsAdm.RealServer) error {
+				reals[rs.Address] = rs.Weight
+				return nil
+			})
+		})
+		return ret
+	}
+
+	src.Sync(ctx)
+	assert.Equal(t, map[string]map[ipvsAdm.Address]uint32{
+		"tcp://10.0.0.1:80": {"10.1.0.1:8080": 3, "10.1.0.2:8080": 3, "10.1.0.4:8080": 0},
+		"udp://10.0.0.1:53": {"10.1.0.1:5353": 3, "10.1.0.2:5353": 3, "10.1.0.4:5353": 0},
+	}, table())
+
+	//readiness changes are followed
+	slice = slice.DeepCopy()
+	slice.Endpoints[0].Conditions.Ready = boolPtr(false)
+	slice.Endpoints = slice.Endpoints[:3]
+	_, err := client.DiscoveryV1().EndpointSlices("default").Update(ctx, slice, metaV1.UpdateOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Eventually(t, func() bool {
+		src.Sync(ctx)
+		return len(table()["tcp://10.0.0.1:80"]) == 1
+	}, waitFor, tick)
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.1.0.2:8080": 3}, table()["tcp://10.0.0.1:80"])
+
+	//bad annotation keeps services are declared before
+	bad := web.DeepCopy()
+	bad.Annotations[AnnotationScheduleMethod] = "unknown"
+	_, err = client.CoreV1().Services("default").Update(ctx, bad, metaV1.UpdateOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Eventually(t, func() bool {
+		src.Sync(ctx)
+		sources := rec.Sources(SourcePrefix)
+		return len(sources) == 1 && sources[0].Error != ""
+	}, waitFor, tick)
+	assert.Len(t, table(), 2)
+
+	//deleted Service drops its virtual servers
+	err = client.CoreV1().Services("default").Delete(ctx, "web", metaV1.DeleteOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Eventually(t, func() bool {
+		src.Sync(ctx)
+		return len(table()) == 0
+	}, waitFor, tick)
+}
+
+const (
+	waitFor = 5 * time.Second
+	tick    = 20 * time.Millisecond
+)
@@ -0,0 +1,345 @@
+package discovery
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/ipvs/internal/ownership"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+//ErrConflict virtual server is declared by another source
+var ErrConflict = errors.New("conflict")
+
+type (
+	//Service virtual server with its real servers is declared by a discovery source
+	Service struct {
+		VirtualServer ipvsAdm.VirtualServer
+		RealServers   []ipvsAdm.RealServer
+	}
+
+	//SourceStatus state of a discovery source
+	SourceStatus struct {
+		Source         string    `json:"source"`
+		VirtualServers []string  `json:"virtualServers"`
+		Error          string    `json:"error,omitempty"`
+		UpdatedAt      time.Time `json:"updatedAt"`
+	}
+
+	//Reconciler merges services declared by discovery sources and keeps the kernel table in sync;
+	//it touches only virtual servers and real servers it has applied itself, and removes only virtual
+	//servers it has created
+	Reconciler struct {
+		admin   ipvsAdm.Admin
+		owners  *ownership.Registry
+		checked func(ipvsAdm.VirtualServerIdentity) bool
+		now     func() time.Time
+
+		mx      sync.Mutex
+		sources map[string]*sourceState
+		applied map[string]*appliedService
+	}
+
+	sourceState struct {
+		services  map[string]Service
+		err       error
+		updatedAt time.Time
+	}
+
+	appliedService struct {
+		virtualServer ipvsAdm.VirtualServer
+		realServers   map[ipvsAdm.Address]ipvsAdm.RealServer
+		created       bool
+	}
+
+	//ReconcilerOption reconciler option
+	ReconcilerOption interface {
+		isReconcilerOption()
+	}
+
+	//WithOwnership virtual servers are owned by this service are taken for created by reconciler,
+	//so ones it has created before restart are removed when they are no longer declared
+	WithOwnership struct {
+		Registry *ownership.Registry
+	}
+
+	//WithHealthChecked tells virtual servers health checker drives weights and presence of real servers of;
+	//reconciler leaves them as they are in the kernel table unless declared real servers change
+	WithHealthChecked struct {
+		Manages func(ipvsAdm.VirtualServerIdentity) bool
+	}
+)
+
+func (WithOwnership) isReconcilerOption() {}
+
+func (WithHealthChecked) isReconcilerOption() {}
+
+//NewReconciler makes reconciler of discovered services
+func NewReconciler(admin ipvsAdm.Admin, opts ...ReconcilerOption) *Reconciler {
+	ret := &Reconciler{
+		admin:   admin,
+		now:     time.Now,
+		sources: make(map[string]*sourceState),
+		applied: make(map[string]*appliedService),
+	}
+	for _, o := range opts {
+		switch t := o.(type) {
+		case WithOwnership:
+			ret.owners = t.Registry
+		case WithHealthChecked:
+			ret.checked = t.Manages
+		}
+	}
+	return ret
+}
+
+//Update replaces services are declared by source and reconciles the kernel table;
+//rejected update keeps services the source has declared before
+func (rec *Reconciler) Update(ctx context.Context, source string, services []Service) error {
+	const api = "discovery/Update"
+
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	st := rec.sourceState(source)
+	st.updatedAt = rec.now()
+	declared, err := rec.validate(source, services)
+	if err != nil {
+		st.err = errors.Wrap(err, api)
+		return st.err
+	}
+	st.services, st.err = declared, nil
+	return errors.Wrap(rec.reconcile(ctx), api)
+}
+
+//Fail marks source as failed; services are declared by source before stay as is
+func (rec *Reconciler) Fail(source string, err error) {
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	st := rec.sourceState(source)
+	st.err, st.updatedAt = err, rec.now()
+}
+
+//Remove drops source and services it has declared
+func (rec *Reconciler) Remove(ctx context.Context, source string) error {
+	const api = "discovery/Remove"
+
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	if _, ok := rec.sources[source]; !ok {
+		return nil
+	}
+	delete(rec.sources, source)
+	return errors.Wrap(rec.reconcile(ctx), api)
+}
+
+//Reconcile brings the kernel table to declared state
+func (rec *Reconciler) Reconcile(ctx context.Context) error {
+	const api = "discovery/Reconcile"
+
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	return errors.Wrap(rec.reconcile(ctx), api)
+}
+
+//Sources lists sources states; prefix filters sources by name
+func (rec *Reconciler) Sources(prefix string) []SourceStatus {
+	rec.mx.Lock()
+	ret := make([]SourceStatus, 0, len(rec.sources))
+	for name, st := range rec.sources {
+		if len(name) < len(prefix) || name[:len(prefix)] != prefix {
+			continue
+		}
+		item := SourceStatus{
+			Source:         name,
+			VirtualServers: make([]string, 0, len(st.services)),
+			UpdatedAt:      st.updatedAt,
+		}
+		for vs := range st.services {
+			item.VirtualServers = append(item.VirtualServers, vs)
+		}
+		sort.Strings(item.VirtualServers)
+		if st.err != nil {
+			item.Error = st.err.Error()
+		}
+		ret = append(ret, item)
+	}
+	rec.mx.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Source < ret[j].Source
+	})
+	return ret
+}
+
+func (rec *Reconciler) sourceState(source string) *sourceState {
+	st := rec.sources[source]
+	if st == nil {
+		st = new(sourceState)
+		rec.sources[source] = st
+	}
+	return st
+}
+
+func (rec *Reconciler) validate(source string, services []Service) (map[string]Service, error) {
+	ret := make(map[string]Service, len(services))
+	for _, svc := range services {
+		vs := ipvsAdm.IdentityString(svc.VirtualServer.Identity)
+		if vs == "" {
+			return nil, errors.New("virtual server has no identity")
+		}
+		if _, dup := ret[vs]; dup {
+			return nil, errors.Errorf("virtual server '%s' is declared twice", vs)
+		}
+		for name, st := range rec.sources {
+			if _, taken := st.services[vs]; taken && name != source {
+				return nil, errors.Wrapf(ErrConflict, "virtual server '%s' is declared by '%s'", vs, name)
+			}
+		}
+		seen := make(map[ipvsAdm.Address]bool, len(svc.RealServers))
+		for _, rs := range svc.RealServers {
+			if seen[rs.Address] {
+				return nil, errors.Errorf("real server '%s' is declared twice in '%s'", rs.Address, vs)
+			}
+			seen[rs.Address] = true
+		}
+		ret[vs] = svc
+	}
+	return ret, nil
+}
+
+func (rec *Reconciler) reconcile(ctx context.Context) error {
+	desired := make(map[string]Service)
+	for _, st := range rec.sources {
+		for vs, svc := range st.services {
+			desired[vs] = svc
+		}
+	}
+	existing := make(map[string]ipvsAdm.VirtualServer)
+	err := rec.admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		existing[ipvsAdm.IdentityString(vs.Identity)] = vs
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for vs, applied := range rec.applied {
+		if _, ok := desired[vs]; ok {
+			continue
+		}
+		if err = rec.withdraw(ctx, applied); err != nil {
+			logger.Errorf(ctx, "discovery: remove virtual server '%s': %v", vs, err)
+			failed = append(failed, vs)
+			continue
+		}
+		delete(rec.applied, vs)
+		if applied.created {
+			logger.Infof(ctx, "discovery: virtual server '%s' is removed", vs)
+		} else {
+			logger.Infof(ctx, "discovery: virtual server '%s' is not created by discovery; only its real servers are removed", vs)
+		}
+	}
+	for vs, svc := range desired {
+		if err = rec.reconcileService(ctx, vs, svc, existing); err != nil {
+			logger.Errorf(ctx, "discovery: reconcile virtual server '%s': %v", vs, err)
+			failed = append(failed, vs)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.Errorf("failed to reconcile virtual servers %v", failed)
+	}
+	return nil
+}
+
+func (rec *Reconciler) reconcileService(ctx context.Context, vs string, svc Service,
+	existing map[string]ipvsAdm.VirtualServer) error {
+
+	identity := svc.VirtualServer.Identity
+	cur, ok := existing[vs]
+	applied := rec.applied[vs]
+	if applied == nil {
+		applied = &appliedService{
+			realServers: make(map[ipvsAdm.Address]ipvsAdm.RealServer),
+			created:     rec.owners != nil && rec.owners.IsOwned(identity),
+		}
+		rec.applied[vs] = applied
+	}
+	if !ok || cur.ScheduleMethod != svc.VirtualServer.ScheduleMethod {
+		err := rec.admin.UpdateVirtualServer(ctx, svc.VirtualServer, ipvsAdm.ForceAddIfNotExist{})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			applied.created = true
+			logger.Infof(ctx, "discovery: virtual server '%s' is added", vs)
+		}
+	}
+	applied.virtualServer = svc.VirtualServer
+
+	//real servers are compared with the kernel table, so weights and thresholds changed behind
+	//reconciler back are brought to declared ones too; weights and presence of real servers are
+	//health checked belong to health checker, they are set only when declaration changes
+	checked := rec.checked != nil && rec.checked(identity)
+	present := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+	if ok {
+		err := rec.admin.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+			present[rs.Address] = rs
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	wanted := make(map[ipvsAdm.Address]bool, len(svc.RealServers))
+	for _, rs := range svc.RealServers {
+		wanted[rs.Address] = true
+		cur, was := present[rs.Address]
+		last, declared := applied.realServers[rs.Address]
+		want := rs
+		if checked && was && (!declared || last.Weight == rs.Weight) {
+			want.Weight = cur.Weight
+		}
+		switch {
+		case was && cur == want:
+		case checked && !was && declared && last == rs:
+			//health checker has removed it
+		default:
+			if err := rec.admin.UpdateRealServer(ctx, identity, want, ipvsAdm.ForceAddIfNotExist{}); err != nil {
+				return err
+			}
+		}
+		applied.realServers[rs.Address] = rs
+	}
+	for addr := range applied.realServers {
+		if wanted[addr] {
+			continue
+		}
+		err := rec.admin.RemoveRealServer(ctx, identity, addr, ipvsAdm.KeepCalmIfNotExist{})
+		if err != nil {
+			return err
+		}
+		delete(applied.realServers, addr)
+	}
+	return nil
+}
+
+//withdraw removes virtual server reconciler has created; virtual server it has found in the kernel table
+//keeps everything but real servers reconciler has applied
+func (rec *Reconciler) withdraw(ctx context.Context, applied *appliedService) error {
+	identity := applied.virtualServer.Identity
+	if applied.created {
+		return rec.admin.RemoveVirtualServer(ctx, identity, ipvsAdm.KeepCalmIfNotExist{})
+	}
+	for addr := range applied.realServers {
+		err := rec.admin.RemoveRealServer(ctx, identity, addr, ipvsAdm.KeepCalmIfNotExist{})
+		if err != nil && !errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+			return err
+		}
+		delete(applied.realServers, addr)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package guard
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/caller"
+	"github.com/thataway/ipvs/internal/httpjson"
+	"github.com/thataway/ipvs/internal/jwtauth"
+	"github.com/thataway/ipvs/internal/meta"
+	"github.com/thataway/ipvs/internal/ratelimit"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type (
+	//Option option of guard
+	Option interface {
+		isGuardOption()
+	}
+
+	//WithAuthenticator verify bearer tokens of callers
+	WithAuthenticator struct {
+		*jwtauth.Authenticator
+	}
+
+	//WithAuthorizer authorize calls by roles of callers
+	WithAuthorizer struct {
+		*authz.Authorizer
+	}
+
+	//WithRateLimit limit rate of calls of every caller
+	WithRateLimit struct {
+		*ratelimit.Limiter
+	}
+
+	//WithMetadata labels of virtual servers are matched by selectors of roles
+	WithMetadata struct {
+		*meta.Store
+	}
+
+	//WithTrustedProxy calls passed by trusted proxy (TLS front) tell identity of caller
+	WithTrustedProxy struct {
+		*caller.TrustedProxy
+	}
+
+	//WithResolver adds resolver of caller principals; handlers take them for owners of what they create
+	WithResolver struct {
+		authz.Resolver
+	}
+
+	//WithRefusals tells about requests to API methods of Methods guard refuses; audit records them
+	WithRefusals struct {
+		Refused func(ctx context.Context, method string, req interface{}, err error)
+	}
+
+	//Methods API methods HTTP methods of endpoint are granted as; requests with other HTTP methods read state
+	//and they are granted as authz.MethodListVirtualServers
+	Methods map[string]string
+
+	//Guard secures HTTP endpoints the way interceptors secure gRPC calls: bearer token of caller is verified,
+	//method is authorized by roles of caller and one token of its rate is taken; handlers check virtual
+	//servers calls touch against scopes of granted roles
+	Guard struct {
+		tokens    *jwtauth.Authenticator
+		authz     *authz.Authorizer
+		limiter   *ratelimit.Limiter
+		meta      *meta.Store
+		proxy     *caller.TrustedProxy
+		resolvers []authz.Resolver
+		refused   func(ctx context.Context, method string, req interface{}, err error)
+	}
+)
+
+func (WithAuthenticator) isGuardOption() {}
+func (WithAuthorizer) isGuardOption()    {}
+func (WithRateLimit) isGuardOption()     {}
+func (WithMetadata) isGuardOption()      {}
+func (WithTrustedProxy) isGuardOption()  {}
+func (WithResolver) isGuardOption()      {}
+func (WithRefusals) isGuardOption()      {}
+
+//New makes guard; guard without options lets every call pass
+func New(opts ...Option) *Guard {
+	ret := new(Guard)
+	for _, o := range opts {
+		switch t := o.(type) {
+		case WithAuthenticator:
+			ret.tokens = t.Authenticator
+		case WithAuthorizer:
+			ret.authz = t.Authorizer
+		case WithRateLimit:
+			ret.limiter = t.Limiter
+		case WithMetadata:
+			ret.meta = t.Store
+		case WithTrustedProxy:
+			ret.proxy = t.TrustedProxy
+		case WithResolver:
+			if t.Resolver != nil {
+				ret.resolvers = append(ret.resolvers, t.Resolver)
+			}
+		case WithRefusals:
+			ret.refused = t.Refused
+		}
+	}
+	return ret
+}
+
+//Handler guards every request to handler; requests are served with context resolvers of caller identity understand
+func (g *Guard) Handler(h http.Handler, methods Methods) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, mutating := methods[r.Method]
+		if !mutating {
+			method = authz.MethodListVirtualServers
+		}
+		ctx, err := g.enter(caller.FromHTTP(r, g.proxy), method)
+		if err != nil {
+			if mutating && g.refused != nil {
+				g.refused(ctx, method, refusedRequest{Method: r.Method, URL: r.URL.String()}, err)
+			}
+			httpjson.Status(w, err)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//refusedRequest HTTP request guard has refused
+type refusedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+func (g *Guard) enter(ctx context.Context, method string) (context.Context, error) {
+	var err error
+	if g.tokens != nil {
+		if ctx, err = g.tokens.Authenticate(ctx, method); err != nil {
+			return ctx, err
+		}
+	}
+	if g.authz != nil {
+		if ctx, err = g.authz.Authorize(ctx, method); err != nil {
+			return ctx, err
+		}
+	}
+	if g.limiter != nil {
+		err = g.limiter.Allow(ctx, method, 1)
+	}
+	return ctx, err
+}
+
+//Principals tells principals of caller guarded handler serves
+func (g *Guard) Principals(ctx context.Context) []string {
+	var ret []string
+	for _, r := range g.resolvers {
+		ret = append(ret, r(ctx)...)
+	}
+	return ret
+}
+
+//VirtualServer refuses call if virtual server is out of scope of roles caller is granted
+func (g *Guard) VirtualServer(ctx context.Context, virtualServer string) error {
+	grants := authz.GrantsFrom(ctx)
+	if grants == nil {
+		return nil
+	}
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(virtualServer)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "virtual server '%s': %v", virtualServer, err)
+	}
+	if !grants.Allows(identity, func(sel labels.Selector) bool { return g.matches(sel, identity) }) {
+		return g.deny(ctx, grants, ipvsAdm.IdentityString(identity))
+	}
+	return nil
+}
+
+//Metadata refuses to set metadata of item unless its virtual server is in scope of roles caller is granted
+//both before and after; labels of real servers do not change scopes
+func (g *Guard) Metadata(ctx context.Context, it meta.Item) error {
+	if err := g.VirtualServer(ctx, it.VirtualServer); err != nil || it.RealServer != "" {
+		return err
+	}
+	grants := authz.GrantsFrom(ctx)
+	if grants == nil {
+		return nil
+	}
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(it.VirtualServer)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "virtual server '%s': %v", it.VirtualServer, err)
+	}
+	after := labels.Set(it.Labels)
+	if !grants.Allows(identity, func(sel labels.Selector) bool { return sel.Matches(after) }) {
+		return g.deny(ctx, grants, ipvsAdm.IdentityString(identity)+" with labels '"+after.String()+"'")
+	}
+	return nil
+}
+
+func (g *Guard) matches(sel labels.Selector, identity ipvsAdm.VirtualServerIdentity) bool {
+	if g.meta == nil {
+		return sel.Matches(labels.Set(nil))
+	}
+	return g.meta.Matches(sel, identity, "")
+}
+
+func (g *Guard) deny(ctx context.Context, grants *authz.Grants, what string) error {
+	return grants.Deny(ctx, "virtual server "+what+" is out of scope of roles "+strings.Join(grants.Roles(), ", "))
+}
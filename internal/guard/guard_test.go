@@ -0,0 +1,94 @@
+package guard
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/meta"
+	"google.golang.org/grpc/metadata"
+)
+
+func Test_Guard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guard")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	md, err := meta.Open(meta.Config{File: filepath.Join(dir, "metadata.json")})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = md.Set(meta.Item{VirtualServer: "tcp://10.0.0.1:80", Labels: map[string]string{"team": "web"}})
+	assert.NoError(t, err)
+	_, err = md.Set(meta.Item{VirtualServer: "tcp://10.0.0.2:80", Labels: map[string]string{"team": "db"}})
+	assert.NoError(t, err)
+
+	a, err := authz.New(authz.Config{
+		Roles: []authz.RoleConfig{
+			{Name: "web", Methods: []string{authz.MethodUpdateMetadata}, Selector: "team=web"},
+			{Name: "viewer", Methods: []string{authz.MethodListVirtualServers}},
+		},
+		Bindings: []authz.BindingConfig{
+			{Role: "web", Principals: []string{"test:web"}},
+			{Role: "viewer", Principals: []string{"test:*"}},
+		},
+	}, authz.WithResolver{Resolver: func(ctx context.Context) []string {
+		m, _ := metadata.FromIncomingContext(ctx)
+		return m.Get("x-test-principal")
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var refused []string
+	g := New(WithAuthorizer{Authorizer: a}, WithMetadata{Store: md},
+		WithRefusals{Refused: func(_ context.Context, method string, _ interface{}, _ error) {
+			refused = append(refused, method)
+		}})
+	h := g.Handler(meta.NewHandler(md, g.Metadata), Methods{
+		http.MethodPut:    authz.MethodUpdateMetadata,
+		http.MethodDelete: authz.MethodUpdateMetadata,
+	})
+	do := func(method, target, principal, body string) int {
+		r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		if principal != "" {
+			r.Header.Set("Grpc-Metadata-X-Test-Principal", principal)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	//reads are granted as ListVirtualServers
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/", "", ""))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/", "test:web", ""))
+	//endpoints without methods that change state are guarded too
+	w := httptest.NewRecorder()
+	g.Handler(http.NotFoundHandler(), nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	//caller without role is refused
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/", "",
+		`{"virtualServer":"tcp://10.0.0.1:80","labels":{"team":"web","tier":"front"}}`))
+	//refused requests that change state are told about, refused reads are not
+	assert.Equal(t, []string{authz.MethodUpdateMetadata}, refused)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/", "test:web",
+		`{"virtualServer":"tcp://10.0.0.1:80","labels":{"team":"web","tier":"front"}}`))
+	//virtual server out of scope can not be relabeled into it
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/", "test:web",
+		`{"virtualServer":"tcp://10.0.0.2:80","labels":{"team":"web"}}`))
+	//virtual server in scope can not be relabeled out of it
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/", "test:web",
+		`{"virtualServer":"tcp://10.0.0.1:80","labels":{"team":"db"}}`))
+	//labels of real servers do not change scopes
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/", "test:web",
+		`{"virtualServer":"tcp://10.0.0.1:80","realServer":"10.1.1.1:80","labels":{"team":"db"}}`))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/?virtual-server=tcp://10.0.0.2:80", "test:web", ""))
+	assert.Equal(t, "db", md.List(nil, "tcp://10.0.0.2:80")[0].Labels["team"])
+}
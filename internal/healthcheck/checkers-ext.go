@@ -0,0 +1,109 @@
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthPb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+//ExecTemplateData data is available in exec check args
+type ExecTemplateData struct {
+	VirtualServer string
+	VirtualHost   string
+	VirtualPort   uint32
+	FirewallMark  uint32
+	RealServer    string
+	RealHost      string
+	RealPort      uint32
+	Port          uint32
+}
+
+func newExecChecker(conf CheckConfig) (Checker, error) {
+	if conf.Exec.Command == "" {
+		return nil, errors.New("exec/command is empty")
+	}
+	args := make([]*template.Template, 0, len(conf.Exec.Args))
+	for i, a := range conf.Exec.Args {
+		t, err := template.New(strconv.Itoa(i)).Option("missingkey=error").Parse(a)
+		if err != nil {
+			return nil, errors.Wrapf(err, "exec/args[%v]", i)
+		}
+		args = append(args, t)
+	}
+	return CheckerFunc(func(ctx context.Context, target Target) error {
+		data := ExecTemplateData{
+			VirtualServer: ipvsAdm.IdentityString(target.VirtualServer),
+			RealServer:    string(target.RealServer.Address),
+			Port:          target.Port,
+		}
+		switch t := target.VirtualServer.(type) {
+		case ipvsAdm.VirtualServerAddress:
+			data.VirtualHost, data.VirtualPort, _ = t.Address.ToHostPort()
+		case ipvsAdm.VirtualServerFMark:
+			data.FirewallMark = t.FirewallMark
+		}
+		data.RealHost, data.RealPort, _ = target.RealServer.Address.ToHostPort()
+		argv := make([]string, 0, len(args))
+		for _, t := range args {
+			var b strings.Builder
+			if err := t.Execute(&b, data); err != nil {
+				return err
+			}
+			argv = append(argv, b.String())
+		}
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, conf.Exec.Command, argv...) //nolint:gosec
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return errors.Wrap(err, msg)
+			}
+			return err
+		}
+		return nil
+	}), nil
+}
+
+func newGRPCChecker(conf CheckConfig) (Checker, error) {
+	creds := insecure.NewCredentials()
+	if conf.GRPC.TLS {
+		creds = credentials.NewTLS(&tls.Config{
+			InsecureSkipVerify: conf.GRPC.InsecureSkipVerify, //nolint:gosec
+		})
+	}
+	service := conf.GRPC.Service
+	return CheckerFunc(func(ctx context.Context, target Target) error {
+		conn, err := grpc.DialContext(ctx, target.HostPort(),
+			grpc.WithTransportCredentials(creds),
+			grpc.WithBlock(),
+		)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var resp *healthPb.HealthCheckResponse
+		resp, err = healthPb.NewHealthClient(conn).Check(ctx,
+			&healthPb.HealthCheckRequest{Service: service})
+		if err != nil {
+			return err
+		}
+		if st := resp.GetStatus(); st != healthPb.HealthCheckResponse_SERVING {
+			return errors.Errorf("service '%s' status is %s", service, st)
+		}
+		return nil
+	}), nil
+}
@@ -0,0 +1,188 @@
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+type (
+	//Target what is checked
+	Target struct {
+		VirtualServer ipvsAdm.VirtualServerIdentity
+		RealServer    ipvsAdm.RealServer
+		Host          string
+		Port          uint32
+	}
+
+	//Checker does a probe of the target
+	Checker interface {
+		Check(ctx context.Context, target Target) error
+	}
+
+	//CheckerFunc func as Checker
+	CheckerFunc func(ctx context.Context, target Target) error
+
+	//CheckerFactory makes Checker from config
+	CheckerFactory func(conf CheckConfig) (Checker, error)
+)
+
+//Check impl Checker
+func (f CheckerFunc) Check(ctx context.Context, target Target) error {
+	return f(ctx, target)
+}
+
+//RegisterChecker registers checker factory for check type
+func RegisterChecker(checkType string, factory CheckerFactory) {
+	checkersMx.Lock()
+	defer checkersMx.Unlock()
+	checkers[checkType] = factory
+}
+
+//MakeChecker makes checker from config
+func MakeChecker(conf CheckConfig) (Checker, error) {
+	const api = "healthcheck/MakeChecker"
+
+	checkersMx.RLock()
+	factory := checkers[conf.Type]
+	checkersMx.RUnlock()
+	if factory == nil {
+		return nil, errors.Errorf("%s: unsupported check type '%s'", api, conf.Type)
+	}
+	ret, err := factory(conf)
+	return ret, errors.Wrapf(err, "%s: check type '%s'", api, conf.Type)
+}
+
+//HostPort address to dial
+func (t Target) HostPort() string {
+	return net.JoinHostPort(t.Host, strconv.FormatUint(uint64(t.Port), 10))
+}
+
+var (
+	checkersMx sync.RWMutex
+	checkers   = map[string]CheckerFactory{
+		"tcp":   newTCPChecker,
+		"http":  newHTTPChecker,
+		"https": newHTTPChecker,
+		"udp":   newUDPChecker,
+		"grpc":  newGRPCChecker,
+		"exec":  newExecChecker,
+	}
+)
+
+func newTCPChecker(_ CheckConfig) (Checker, error) {
+	return CheckerFunc(func(ctx context.Context, target Target) error {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", target.HostPort())
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}), nil
+}
+
+func newHTTPChecker(conf CheckConfig) (Checker, error) {
+	var (
+		reBody *regexp.Regexp
+		err    error
+	)
+	if conf.HTTP.ExpectBody != "" {
+		if reBody, err = regexp.Compile(conf.HTTP.ExpectBody); err != nil {
+			return nil, errors.Wrap(err, "expect-body")
+		}
+	}
+	scheme, path := conf.Type, conf.HTTP.Path
+	if path == "" {
+		path = "/"
+	}
+	expectStatus := conf.HTTP.ExpectStatus
+	if len(expectStatus) == 0 {
+		expectStatus = []int{http.StatusOK}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: conf.HTTP.InsecureSkipVerify, //nolint:gosec
+				ServerName:         conf.HTTP.Host,
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return CheckerFunc(func(ctx context.Context, target Target) error {
+		req, e := http.NewRequestWithContext(ctx, http.MethodGet,
+			scheme+"://"+target.HostPort()+path, nil)
+		if e != nil {
+			return e
+		}
+		if conf.HTTP.Host != "" {
+			req.Host = conf.HTTP.Host
+		}
+		var resp *http.Response
+		if resp, e = client.Do(req); e != nil {
+			return e
+		}
+		defer resp.Body.Close()
+		matched := false
+		for _, c := range expectStatus {
+			if matched = c == resp.StatusCode; matched {
+				break
+			}
+		}
+		if !matched {
+			return errors.Errorf("unexpected status code %v", resp.StatusCode)
+		}
+		if reBody != nil {
+			const maxBody = 64 * 1024
+			var body []byte
+			if body, e = io.ReadAll(io.LimitReader(resp.Body, maxBody)); e != nil {
+				return e
+			}
+			if !reBody.Match(body) {
+				return errors.New("response body does not match")
+			}
+		}
+		return nil
+	}), nil
+}
+
+func newUDPChecker(conf CheckConfig) (Checker, error) {
+	send, expect := []byte(conf.UDP.Send), []byte(conf.UDP.Expect)
+	if len(send) == 0 {
+		return nil, errors.New("udp/send is empty")
+	}
+	return CheckerFunc(func(ctx context.Context, target Target) error {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "udp", target.HostPort())
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = c.SetDeadline(deadline)
+		}
+		if _, err = c.Write(send); err != nil {
+			return err
+		}
+		buf := make([]byte, 64*1024)
+		var n int
+		if n, err = c.Read(buf); err != nil {
+			return err
+		}
+		if len(expect) > 0 && !bytes.Contains(buf[:n], expect) {
+			return errors.New("unexpected response")
+		}
+		return nil
+	}), nil
+}
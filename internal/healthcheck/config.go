@@ -0,0 +1,217 @@
+package healthcheck
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+healthcheck:
+  weights-file: /var/lib/ipvs/healthcheck-weights.json
+  services:
+    - virtual-server: tcp://10.0.0.1:80
+      on-failure: quiesce
+      check:
+        type: http
+        interval: 5s
+        timeout: 2s
+        rise: 2
+        fall: 3
+        port: 8080
+        http:
+          path: /healthz
+          expect-status: [200]
+          expect-body: "ok"
+      sorry-server:
+        address: 10.0.9.1:80
+        packet-forwarder: nat
+        weight: 1
+      priority-groups:
+        - name: primary
+          min-healthy: 2
+          members: [10.0.1.1:8080, 10.0.1.2:8080, 10.0.1.3:8080]
+        - name: backup
+          members: [10.0.2.1:8080, 10.0.2.2:8080]
+    - virtual-server: tcp://10.0.0.2:443
+      check:
+        type: grpc
+        grpc:
+          service: my.Service
+    - virtual-server: fwmark://100
+      check:
+        type: exec
+        port: 80
+        exec:
+          command: /usr/local/bin/check-backend
+          args: ["{{.VirtualHost}}", "{{.RealHost}}", "{{.Port}}"]
+*/
+
+const (
+	//OnFailureQuiesce set weight to 0 for failed real server
+	OnFailureQuiesce = "quiesce"
+
+	//OnFailureRemove remove failed real server from virtual server
+	OnFailureRemove = "remove"
+)
+
+type (
+	//ServiceConfig health check config for a virtual server
+	ServiceConfig struct {
+		VirtualServer string             `mapstructure:"virtual-server"`
+		OnFailure     string             `mapstructure:"on-failure"`
+		Check         CheckConfig        `mapstructure:"check"`
+		SorryServer   *SorryServerConfig `mapstructure:"sorry-server"`
+
+		PriorityGroups []PriorityGroupConfig `mapstructure:"priority-groups"`
+	}
+
+	//PriorityGroupConfig tier of real servers; the first tier in list having at least
+	//'min-healthy' healthy members carries traffic, members of other tiers are quiesced
+	PriorityGroupConfig struct {
+		Name       string   `mapstructure:"name"`
+		MinHealthy int      `mapstructure:"min-healthy"`
+		Members    []string `mapstructure:"members"`
+	}
+
+	//SorryServerConfig fallback real server is used when no healthy real server remains
+	SorryServerConfig struct {
+		Address         string `mapstructure:"address"`
+		PacketForwarder string `mapstructure:"packet-forwarder"`
+		Weight          uint32 `mapstructure:"weight"`
+	}
+
+	//CheckConfig probe config
+	CheckConfig struct {
+		Type     string        `mapstructure:"type"`
+		Interval time.Duration `mapstructure:"interval"`
+		Timeout  time.Duration `mapstructure:"timeout"`
+		Rise     int           `mapstructure:"rise"`
+		Fall     int           `mapstructure:"fall"`
+		Port     uint32        `mapstructure:"port"`
+		HTTP     HTTPConfig    `mapstructure:"http"`
+		UDP      UDPConfig     `mapstructure:"udp"`
+		GRPC     GRPCConfig    `mapstructure:"grpc"`
+		Exec     ExecConfig    `mapstructure:"exec"`
+	}
+
+	//HTTPConfig HTTP(S) probe config
+	HTTPConfig struct {
+		Path               string `mapstructure:"path"`
+		Host               string `mapstructure:"host"`
+		InsecureSkipVerify bool   `mapstructure:"insecure-skip-verify"`
+		ExpectStatus       []int  `mapstructure:"expect-status"`
+		ExpectBody         string `mapstructure:"expect-body"`
+	}
+
+	//UDPConfig UDP request/response probe config
+	UDPConfig struct {
+		Send   string `mapstructure:"send"`
+		Expect string `mapstructure:"expect"`
+	}
+
+	//GRPCConfig 'grpc.health.v1.Health/Check' probe config
+	GRPCConfig struct {
+		Service            string `mapstructure:"service"`
+		TLS                bool   `mapstructure:"tls"`
+		InsecureSkipVerify bool   `mapstructure:"insecure-skip-verify"`
+	}
+
+	//ExecConfig local command probe config; args are Go templates over ExecTemplateData
+	ExecConfig struct {
+		Command string   `mapstructure:"command"`
+		Args    []string `mapstructure:"args"`
+	}
+)
+
+const (
+	defInterval = 5 * time.Second
+	defTimeout  = 2 * time.Second
+	defRise     = 2
+	defFall     = 3
+)
+
+//Normalize fills defaults and validates config
+func (c *ServiceConfig) Normalize() (ipvsAdm.VirtualServerIdentity, error) {
+	const api = "healthcheck/ServiceConfig"
+
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(c.VirtualServer)
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	switch c.OnFailure {
+	case "":
+		c.OnFailure = OnFailureQuiesce
+	case OnFailureQuiesce, OnFailureRemove:
+	default:
+		return nil, errors.Errorf("%s: '%s' unsupported on-failure action '%s'",
+			api, c.VirtualServer, c.OnFailure)
+	}
+	ch := &c.Check
+	if ch.Interval <= 0 {
+		ch.Interval = defInterval
+	}
+	if ch.Timeout <= 0 {
+		ch.Timeout = defTimeout
+	}
+	if ch.Timeout > ch.Interval {
+		ch.Timeout = ch.Interval
+	}
+	if ch.Rise <= 0 {
+		ch.Rise = defRise
+	}
+	if ch.Fall <= 0 {
+		ch.Fall = defFall
+	}
+	if ch.Port > 0xFFFF {
+		return nil, errors.Errorf("%s: '%s' has wrong check port(%v)", api, c.VirtualServer, ch.Port)
+	}
+	if _, isFMark := identity.(ipvsAdm.VirtualServerFMark); isFMark && ch.Port == 0 {
+		return nil, errors.Errorf("%s: '%s' needs check port", api, c.VirtualServer)
+	}
+	if sorry := c.SorryServer; sorry != nil {
+		if _, _, err = ipvsAdm.Address(sorry.Address).ToHostPort(); err != nil {
+			return nil, errors.Wrapf(err, "%s: '%s' sorry-server", api, c.VirtualServer)
+		}
+		if err = ipvsAdm.PacketForwarder(sorry.PacketForwarder).Valid(); err != nil {
+			return nil, errors.Wrapf(err, "%s: '%s' sorry-server", api, c.VirtualServer)
+		}
+		if sorry.Weight == 0 {
+			sorry.Weight = 1
+		}
+	}
+	groups := make(map[string]bool)
+	members := make(map[string]string)
+	for i := range c.PriorityGroups {
+		g := &c.PriorityGroups[i]
+		if g.Name == "" || groups[g.Name] {
+			return nil, errors.Errorf("%s: '%s' has empty or duplicate priority group name '%s'",
+				api, c.VirtualServer, g.Name)
+		}
+		groups[g.Name] = true
+		if g.MinHealthy <= 0 {
+			g.MinHealthy = 1
+		}
+		for _, m := range g.Members {
+			if _, _, err = ipvsAdm.Address(m).ToHostPort(); err != nil {
+				return nil, errors.Wrapf(err, "%s: '%s' priority group '%s'", api, c.VirtualServer, g.Name)
+			}
+			if other, ok := members[m]; ok {
+				return nil, errors.Errorf("%s: '%s' real server '%s' is in priority groups '%s' and '%s'",
+					api, c.VirtualServer, m, other, g.Name)
+			}
+			members[m] = g.Name
+		}
+	}
+	return identity, nil
+}
+
+//RealServer sorry server as real server
+func (c SorryServerConfig) RealServer() ipvsAdm.RealServer {
+	return ipvsAdm.RealServer{
+		Address:         ipvsAdm.Address(c.Address),
+		PacketForwarder: ipvsAdm.PacketForwarder(c.PacketForwarder),
+		Weight:          c.Weight,
+	}
+}
@@ -0,0 +1,108 @@
+package healthcheck
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/httpjson"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+type (
+	//Guard refuses caller to override priority group of virtual server
+	Guard func(ctx context.Context, virtualServer string) error
+
+	handler struct {
+		m     *Manager
+		guard Guard
+	}
+)
+
+//NewHandler makes http.Handler exposes check states as JSON; guard (if any) checks overrides
+//
+//	GET  /                  - real servers check states
+//	GET  /groups            - priority groups states
+//	POST /groups/override   - {"virtualServer": "tcp://10.0.0.1:80", "group": "backup"}; empty group resets override
+func NewHandler(m *Manager, guard Guard) http.Handler {
+	return &handler{m: m, guard: guard}
+}
+
+//ServeHTTP impl http.Handler
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := h.m
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		m.serveStates(w, r)
+	case "/groups":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		groups := m.PriorityGroups()
+		if groups == nil {
+			groups = []PriorityGroupsState{}
+		}
+		httpjson.Write(w, http.StatusOK, struct {
+			VirtualServers []PriorityGroupsState `json:"virtualServers"`
+		}{groups})
+	case "/groups/override":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			VirtualServer string `json:"virtualServer"`
+			Group         string `json:"group"`
+		}
+		if err := httpjson.Decode(w, r, 64*1024, &req); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, err := ipvsAdm.ParseVirtualServerIdentity(req.VirtualServer); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		if h.guard != nil {
+			if err := h.guard(r.Context(), req.VirtualServer); err != nil {
+				httpjson.Status(w, err)
+				return
+			}
+		}
+		err := m.SetPriorityGroupOverride(r.Context(), req.VirtualServer, req.Group)
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, ErrNotFound):
+			httpjson.Error(w, http.StatusNotFound, err)
+		default:
+			httpjson.Error(w, http.StatusInternalServerError, err)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (m *Manager) serveStates(w http.ResponseWriter, r *http.Request) {
+	states := m.States()
+	if vs := r.URL.Query().Get("virtual-server"); vs != "" {
+		filtered := states[:0]
+		for _, st := range states {
+			if st.VirtualServer == vs {
+				filtered = append(filtered, st)
+			}
+		}
+		states = filtered
+	}
+	if states == nil {
+		states = []RealServerState{}
+	}
+	httpjson.Write(w, http.StatusOK, struct {
+		RealServers []RealServerState `json:"realServers"`
+	}{states})
+}
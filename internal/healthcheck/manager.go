@@ -0,0 +1,580 @@
+package healthcheck
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/common-lib/pkg/parallel"
+	"github.com/thataway/ipvs/internal/watch"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+type (
+	//Manager runs health checks of real servers and drives their weights
+	Manager struct {
+		admin    ipvsAdm.Admin
+		services []*service
+		metrics  *managerMetrics
+		events   *watch.Hub
+
+		weightsFile string
+		weightsMx   sync.Mutex
+		weights     map[string]map[ipvsAdm.Address]uint32
+		overrides   map[string]string
+	}
+
+	//Option manager option
+	Option interface {
+		isManagerOption()
+	}
+
+	//WithEvents publish health transitions into events hub
+	WithEvents struct {
+		Hub *watch.Hub
+	}
+
+	//WithWeightsFile weights of real servers are kept in file, so manager restarted restores weights
+	//of real servers it has quiesced before and priority group overrides are set
+	WithWeightsFile struct {
+		File string
+	}
+
+	//RealServerState check state of real server
+	RealServerState struct {
+		VirtualServer string    `json:"virtualServer"`
+		RealServer    string    `json:"realServer"`
+		Healthy       bool      `json:"healthy"`
+		Present       bool      `json:"present"`
+		Fallback      bool      `json:"fallback,omitempty"`
+		Weight        uint32    `json:"weight"`
+		Rises         int       `json:"rises"`
+		Falls         int       `json:"falls"`
+		LastCheck     time.Time `json:"lastCheck"`
+		LastError     string    `json:"lastError,omitempty"`
+	}
+
+	//PriorityGroupsState priority groups state of virtual server
+	PriorityGroupsState struct {
+		VirtualServer string               `json:"virtualServer"`
+		Active        string               `json:"active"`
+		Override      string               `json:"override,omitempty"`
+		Groups        []PriorityGroupState `json:"groups"`
+	}
+
+	//PriorityGroupState state of priority group
+	PriorityGroupState struct {
+		Name       string   `json:"name"`
+		MinHealthy int      `json:"minHealthy"`
+		Healthy    int      `json:"healthy"`
+		Members    []string `json:"members"`
+	}
+
+	service struct {
+		identity ipvsAdm.VirtualServerIdentity
+		name     string
+		conf     ServiceConfig
+		checker  Checker
+		memberOf map[ipvsAdm.Address]int
+
+		mx          sync.Mutex
+		exists      bool
+		reals       map[ipvsAdm.Address]*realState
+		override    string
+		activeGroup string
+	}
+
+	realState struct {
+		desired   ipvsAdm.RealServer
+		observed  ipvsAdm.RealServer
+		present   bool
+		healthy   bool
+		fallback  bool
+		rises     int
+		falls     int
+		lastCheck time.Time
+		lastError string
+	}
+)
+
+func (WithEvents) isManagerOption() {}
+
+func (WithWeightsFile) isManagerOption() {}
+
+const eventSource = "healthcheck"
+
+//ErrNotFound virtual server or priority group is not managed
+var ErrNotFound = errors.New("not found")
+
+//NewManager makes health check manager
+func NewManager(admin ipvsAdm.Admin, confs []ServiceConfig, opts ...Option) (*Manager, error) {
+	const api = "healthcheck/NewManager"
+
+	ret := &Manager{
+		admin:   admin,
+		metrics: newManagerMetrics(),
+	}
+	for _, o := range opts {
+		switch t := o.(type) {
+		case WithEvents:
+			ret.events = t.Hub
+		case WithWeightsFile:
+			ret.weightsFile = t.File
+		default:
+			return nil, errors.Errorf("%s: unexpected option '%T'", api, o)
+		}
+	}
+	if err := ret.loadWeights(); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	seen := make(map[string]bool)
+	for i := range confs {
+		conf := confs[i]
+		identity, err := conf.Normalize()
+		if err != nil {
+			return nil, errors.Wrap(err, api)
+		}
+		name := ipvsAdm.IdentityString(identity)
+		if seen[name] {
+			return nil, errors.Errorf("%s: virtual server '%s' is met more than once", api, name)
+		}
+		seen[name] = true
+		var checker Checker
+		if checker, err = MakeChecker(conf.Check); err != nil {
+			return nil, errors.Wrapf(err, "%s: virtual server '%s'", api, name)
+		}
+		s := &service{
+			identity: identity,
+			name:     name,
+			conf:     conf,
+			checker:  checker,
+			memberOf: make(map[ipvsAdm.Address]int),
+		}
+		for g := range conf.PriorityGroups {
+			for _, a := range conf.PriorityGroups[g].Members {
+				s.memberOf[ipvsAdm.Address(a)] = g
+			}
+		}
+		s.resetReals()
+		for _, g := range conf.PriorityGroups {
+			if g.Name == ret.overrides[name] {
+				s.override = g.Name
+			}
+		}
+		ret.services = append(ret.services, s)
+	}
+	return ret, nil
+}
+
+//Run runs health checks until context is done
+func (m *Manager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range m.services {
+		wg.Add(1)
+		go func(s *service) {
+			defer wg.Done()
+			m.runService(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+//States gets check states of all real servers
+func (m *Manager) States() []RealServerState {
+	var ret []RealServerState
+	for _, s := range m.services {
+		s.mx.Lock()
+		for addr, st := range s.reals {
+			if st.fallback && !st.present {
+				continue
+			}
+			ret = append(ret, RealServerState{
+				VirtualServer: s.name,
+				RealServer:    string(addr),
+				Healthy:       st.healthy,
+				Present:       st.present,
+				Fallback:      st.fallback,
+				Weight:        st.desired.Weight,
+				Rises:         st.rises,
+				Falls:         st.falls,
+				LastCheck:     st.lastCheck,
+				LastError:     st.lastError,
+			})
+		}
+		s.mx.Unlock()
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].VirtualServer != ret[j].VirtualServer {
+			return ret[i].VirtualServer < ret[j].VirtualServer
+		}
+		return ret[i].RealServer < ret[j].RealServer
+	})
+	return ret
+}
+
+//PriorityGroups gets priority groups states
+func (m *Manager) PriorityGroups() []PriorityGroupsState {
+	var ret []PriorityGroupsState
+	for _, s := range m.services {
+		if len(s.conf.PriorityGroups) == 0 {
+			continue
+		}
+		s.mx.Lock()
+		healthy := s.groupsHealthy()
+		item := PriorityGroupsState{
+			VirtualServer: s.name,
+			Active:        s.activeGroup,
+			Override:      s.override,
+		}
+		for i, g := range s.conf.PriorityGroups {
+			item.Groups = append(item.Groups, PriorityGroupState{
+				Name:       g.Name,
+				MinHealthy: g.MinHealthy,
+				Healthy:    healthy[i],
+				Members:    g.Members,
+			})
+		}
+		s.mx.Unlock()
+		ret = append(ret, item)
+	}
+	return ret
+}
+
+//Manages tells if manager drives weights and presence of real servers of virtual server
+func (m *Manager) Manages(identity ipvsAdm.VirtualServerIdentity) bool {
+	if m == nil {
+		return false
+	}
+	for _, s := range m.services {
+		if ipvsAdm.IsIdentitiesEq(s.identity, identity) {
+			return true
+		}
+	}
+	return false
+}
+
+//SetPriorityGroupOverride forces priority group of virtual server to be active; empty group resets override
+func (m *Manager) SetPriorityGroupOverride(ctx context.Context, virtualServer string, group string) error {
+	const api = "healthcheck/SetPriorityGroupOverride"
+
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(virtualServer)
+	if err != nil {
+		return errors.Wrap(err, api)
+	}
+	for _, s := range m.services {
+		if !ipvsAdm.IsIdentitiesEq(s.identity, identity) {
+			continue
+		}
+		found := group == ""
+		for _, g := range s.conf.PriorityGroups {
+			found = found || g.Name == group
+		}
+		if !found {
+			return errors.Wrapf(ErrNotFound, "%s: priority group '%s' of '%s'", api, group, s.name)
+		}
+		if err = m.rememberOverride(s, group); err != nil {
+			return errors.Wrap(err, api)
+		}
+		s.mx.Lock()
+		s.override = group
+		s.mx.Unlock()
+		logger.Infof(ctx, "healthcheck: virtual server '%s': priority group override is set to '%s'",
+			s.name, group)
+		return m.reconcile(ctx, s)
+	}
+	return errors.Wrapf(ErrNotFound, "%s: virtual server '%s'", api, virtualServer)
+}
+
+func (m *Manager) runService(ctx context.Context, s *service) {
+	ticker := time.NewTicker(s.conf.Check.Interval)
+	defer ticker.Stop()
+	for {
+		if err := m.step(ctx, s); err != nil && ctx.Err() == nil {
+			logger.Errorf(ctx, "healthcheck: virtual server '%s': %v", s.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) step(ctx context.Context, s *service) error {
+	if err := m.sync(ctx, s); err != nil {
+		return err
+	}
+	if err := m.rememberWeights(s); err != nil {
+		logger.Errorf(ctx, "healthcheck: virtual server '%s': %v", s.name, err)
+	}
+	m.probe(ctx, s)
+	return m.reconcile(ctx, s)
+}
+
+func (m *Manager) publish(ctx context.Context, s *service, kind string, addr ipvsAdm.Address, msg string) {
+	switch kind {
+	case watch.KindRealServerDown:
+		logger.Warnf(ctx, "healthcheck: virtual server '%s': real server '%s' is DOWN: %s", s.name, addr, msg)
+	case watch.KindPriorityGroupSwitch:
+		logger.Warnf(ctx, "healthcheck: virtual server '%s': %s", s.name, msg)
+	case watch.KindFallbackOn:
+		logger.Warnf(ctx, "healthcheck: virtual server '%s': no healthy real servers remain; sorry server '%s' is ON",
+			s.name, addr)
+	default:
+		logger.Infof(ctx, "healthcheck: virtual server '%s': real server '%s': %s", s.name, addr, kind)
+	}
+	m.metrics.transition(s.name, kind)
+	m.events.Publish(watch.Event{
+		Source:        eventSource,
+		Kind:          kind,
+		VirtualServer: s.name,
+		RealServer:    string(addr),
+		Message:       msg,
+	})
+}
+
+func (s *service) resetReals() {
+	s.reals = make(map[ipvsAdm.Address]*realState)
+	if sorry := s.conf.SorryServer; sorry != nil {
+		rs := sorry.RealServer()
+		s.reals[rs.Address] = &realState{desired: rs, healthy: true, fallback: true}
+	}
+}
+
+//sync consumes actual real servers from the IPVS table; real servers met first with zero weight take
+//weights are saved before, as zeros are what manager leaves in the table for real servers it quiesces
+func (m *Manager) sync(ctx context.Context, s *service) error {
+	observed := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+	err := m.admin.ListRealServers(ctx, s.identity, func(rs ipvsAdm.RealServer) error {
+		observed[rs.Address] = rs
+		return nil
+	})
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.exists = !errors.Is(err, ipvsAdm.ErrVirtualServerNotExist); !s.exists {
+		s.resetReals()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for addr, rs := range observed {
+		st := s.reals[addr]
+		if st == nil {
+			st = &realState{desired: rs, healthy: true}
+			if w := m.savedWeight(s, addr); rs.Weight == 0 && w > 0 {
+				st.desired.Weight = w
+			}
+			s.reals[addr] = st
+		} else if !st.fallback && (!st.present || st.observed != rs) {
+			st.desired = rs
+		}
+		st.observed, st.present = rs, true
+	}
+	for addr, st := range s.reals {
+		if _, ok := observed[addr]; ok {
+			continue
+		}
+		if st.fallback || (!st.healthy && s.conf.OnFailure == OnFailureRemove) {
+			st.present = false
+			continue
+		}
+		delete(s.reals, addr)
+	}
+	return nil
+}
+
+//groupsHealthy counts healthy members of priority groups
+func (s *service) groupsHealthy() []int {
+	ret := make([]int, len(s.conf.PriorityGroups))
+	for addr, st := range s.reals {
+		if g, ok := s.memberOf[addr]; ok && st.healthy && !st.fallback {
+			ret[g]++
+		}
+	}
+	return ret
+}
+
+//pickGroup gives index of priority group to carry traffic or -1
+func (s *service) pickGroup() int {
+	groups := s.conf.PriorityGroups
+	if s.override != "" {
+		for i := range groups {
+			if groups[i].Name == s.override {
+				return i
+			}
+		}
+	}
+	healthy := s.groupsHealthy()
+	for i := range groups {
+		if healthy[i] >= groups[i].MinHealthy {
+			return i
+		}
+	}
+	for i := range groups {
+		if healthy[i] > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Manager) probe(ctx context.Context, s *service) {
+	type result struct {
+		addr ipvsAdm.Address
+		err  error
+	}
+	s.mx.Lock()
+	targets := make([]Target, 0, len(s.reals))
+	for _, st := range s.reals {
+		if st.fallback {
+			continue
+		}
+		t := Target{
+			VirtualServer: s.identity,
+			RealServer:    st.desired,
+			Port:          s.conf.Check.Port,
+		}
+		var port uint32
+		t.Host, port, _ = st.desired.Address.ToHostPort()
+		if t.Port == 0 {
+			t.Port = port
+		}
+		targets = append(targets, t)
+	}
+	s.mx.Unlock()
+
+	results := make([]result, len(targets))
+	_ = parallel.ExecAbstract(len(targets), 10, func(i int) error {
+		t := targets[i]
+		c, cancel := context.WithTimeout(ctx, s.conf.Check.Timeout)
+		defer cancel()
+		var err error
+		if t.Port == 0 {
+			err = errors.New("no port to check")
+		} else {
+			err = s.checker.Check(c, t)
+		}
+		results[i] = result{addr: t.RealServer.Address, err: err}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return
+	}
+
+	now := time.Now()
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, r := range results {
+		st := s.reals[r.addr]
+		if st == nil {
+			continue
+		}
+		st.lastCheck = now
+		if r.err == nil {
+			st.lastError = ""
+			st.falls, st.rises = 0, st.rises+1
+			if !st.healthy && st.rises >= s.conf.Check.Rise {
+				st.healthy = true
+				m.publish(ctx, s, watch.KindRealServerUp, r.addr, "")
+			}
+		} else {
+			st.lastError = r.err.Error()
+			st.rises, st.falls = 0, st.falls+1
+			if st.healthy && st.falls >= s.conf.Check.Fall {
+				st.healthy = false
+				m.publish(ctx, s, watch.KindRealServerDown, r.addr, st.lastError)
+			}
+		}
+	}
+}
+
+//plan gives desired real servers of virtual server; nil value means real server should be absent
+func (s *service) plan() map[ipvsAdm.Address]*ipvsAdm.RealServer {
+	ret := make(map[ipvsAdm.Address]*ipvsAdm.RealServer, len(s.reals))
+	if !s.exists {
+		return ret
+	}
+	active := s.pickGroup()
+	inActiveGroup := func(addr ipvsAdm.Address) bool {
+		g, grouped := s.memberOf[addr]
+		return !grouped || g == active
+	}
+	var healthy int
+	for addr, st := range s.reals {
+		if st.healthy && !st.fallback && inActiveGroup(addr) {
+			healthy++
+		}
+	}
+	for addr, st := range s.reals {
+		rs := st.desired
+		switch {
+		case st.fallback:
+			if healthy > 0 {
+				ret[addr] = nil
+				continue
+			}
+		case st.healthy:
+			if !inActiveGroup(addr) {
+				rs.Weight = 0
+			}
+		case s.conf.OnFailure == OnFailureQuiesce:
+			rs.Weight = 0
+		default:
+			ret[addr] = nil
+			continue
+		}
+		ret[addr] = &rs
+	}
+	return ret
+}
+
+//reconcile brings IPVS table to desired state
+func (m *Manager) reconcile(ctx context.Context, s *service) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if len(s.conf.PriorityGroups) > 0 && s.exists {
+		var active string
+		if i := s.pickGroup(); i >= 0 {
+			active = s.conf.PriorityGroups[i].Name
+		}
+		if active != s.activeGroup {
+			msg := "priority group '" + s.activeGroup + "' -> '" + active + "'"
+			s.activeGroup = active
+			m.publish(ctx, s, watch.KindPriorityGroupSwitch, "", msg)
+		}
+	}
+	var errs []error
+	for addr, want := range s.plan() {
+		st := s.reals[addr]
+		var err error
+		switch {
+		case want == nil && st != nil && st.present:
+			err = m.admin.RemoveRealServer(ctx, s.identity, addr, ipvsAdm.KeepCalmIfNotExist{})
+			if err == nil {
+				st.present = false
+				if st.fallback {
+					m.publish(ctx, s, watch.KindFallbackOff, addr, "")
+				}
+			}
+		case want != nil && (st == nil || !st.present || st.observed != *want):
+			err = m.admin.UpdateRealServer(ctx, s.identity, *want, ipvsAdm.ForceAddIfNotExist{})
+			if err == nil && st != nil {
+				if st.fallback && !st.present {
+					m.publish(ctx, s, watch.KindFallbackOn, addr, "")
+				}
+				st.observed, st.present = *want, true
+			}
+		}
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "real server '%s'", addr))
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package healthcheck
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thataway/ipvs/internal/watch"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthPb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type fakeHealth struct {
+	mx   sync.Mutex
+	down map[string]bool
+}
+
+func (f *fakeHealth) set(host string, down bool) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.down[host] = down
+}
+
+func (f *fakeHealth) Check(_ context.Context, t Target) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.down[t.Host] {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func makeTestTable(t *testing.T, vs string, reals ...ipvsAdm.RealServer) ipvsAdm.Admin {
+	ctx := context.Background()
+	adm := ipvsAdm.NewMemoryAdmin()
+	id, err := ipvsAdm.ParseVirtualServerIdentity(vs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = adm.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: id, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, rs := range reals {
+		if !assert.NoError(t, adm.UpdateRealServer(ctx, id, rs, ipvsAdm.ForceAddIfNotExist{})) {
+			t.FailNow()
+		}
+	}
+	return adm
+}
+
+func listReals(t *testing.T, adm ipvsAdm.Admin, vs string) map[ipvsAdm.Address]ipvsAdm.RealServer {
+	id, _ := ipvsAdm.ParseVirtualServerIdentity(vs)
+	ret := make(map[ipvsAdm.Address]ipvsAdm.RealServer)
+	err := adm.ListRealServers(context.Background(), id, func(rs ipvsAdm.RealServer) error {
+		ret[rs.Address] = rs
+		return nil
+	})
+	assert.NoError(t, err)
+	return ret
+}
+
+func Test_ManagerDrivesWeights(t *testing.T) {
+	const vs = "tcp://10.0.0.1:80"
+	probes := &fakeHealth{down: make(map[string]bool)}
+	RegisterChecker("fake", func(CheckConfig) (Checker, error) {
+		return probes, nil
+	})
+	rs1 := ipvsAdm.RealServer{Address: "10.1.1.1:80", PacketForwarder: "dr", Weight: 5}
+	rs2 := ipvsAdm.RealServer{Address: "10.1.1.2:80", PacketForwarder: "dr", Weight: 7}
+
+	for _, onFailure := range []string{OnFailureQuiesce, OnFailureRemove} {
+		adm := makeTestTable(t, vs, rs1, rs2)
+		m, err := NewManager(adm, []ServiceConfig{{
+			VirtualServer: vs,
+			OnFailure:     onFailure,
+			Check:         CheckConfig{Type: "fake", Rise: 2, Fall: 2},
+		}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		ctx := context.Background()
+		s := m.services[0]
+		probes.set("10.1.1.1", true)
+		assert.NoError(t, m.step(ctx, s))
+		assert.Equal(t, rs1, listReals(t, adm, vs)[rs1.Address])
+		assert.NoError(t, m.step(ctx, s))
+		reals := listReals(t, adm, vs)
+		if onFailure == OnFailureQuiesce {
+			assert.Equal(t, uint32(0), reals[rs1.Address].Weight)
+		} else {
+			assert.NotContains(t, reals, rs1.Address)
+		}
+		assert.Equal(t, rs2, reals[rs2.Address])
+		states := m.States()
+		if assert.Len(t, states, 2) {
+			assert.False(t, states[0].Healthy)
+			assert.Equal(t, uint32(5), states[0].Weight)
+		}
+
+		probes.set("10.1.1.1", false)
+		assert.NoError(t, m.step(ctx, s))
+		assert.NoError(t, m.step(ctx, s))
+		assert.Equal(t, rs1, listReals(t, adm, vs)[rs1.Address])
+	}
+}
+
+func Test_WeightsSurviveRestart(t *testing.T) {
+	const vs = "tcp://10.0.0.1:80"
+	probes := &fakeHealth{down: make(map[string]bool)}
+	RegisterChecker("fake-restart", func(CheckConfig) (Checker, error) {
+		return probes, nil
+	})
+	dir, err := ioutil.TempDir("", "healthcheck")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	rs1 := ipvsAdm.RealServer{Address: "10.1.1.1:80", PacketForwarder: "dr", Weight: 5}
+	adm := makeTestTable(t, vs, rs1)
+	confs := []ServiceConfig{{VirtualServer: vs, Check: CheckConfig{Type: "fake-restart", Rise: 1, Fall: 1}}}
+	file := WithWeightsFile{File: filepath.Join(dir, "weights.json")}
+	ctx := context.Background()
+
+	m, err := NewManager(adm, confs, file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	probes.set("10.1.1.1", true)
+	assert.NoError(t, m.step(ctx, m.services[0]))
+	assert.Equal(t, uint32(0), listReals(t, adm, vs)[rs1.Address].Weight)
+
+	//manager restarted sees zero in the table but restores saved weight
+	if m, err = NewManager(adm, confs, file); !assert.NoError(t, err) {
+		return
+	}
+	probes.set("10.1.1.1", false)
+	assert.NoError(t, m.step(ctx, m.services[0]))
+	assert.Equal(t, rs1, listReals(t, adm, vs)[rs1.Address])
+}
+
+func Test_SorryServer(t *testing.T) {
+	const vs = "tcp://10.0.0.1:80"
+	probes := &fakeHealth{down: make(map[string]bool)}
+	RegisterChecker("fake-sorry", func(CheckConfig) (Checker, error) {
+		return probes, nil
+	})
+	rs1 := ipvsAdm.RealServer{Address: "10.1.1.1:80", PacketForwarder: "dr", Weight: 5}
+	sorry := SorryServerConfig{Address: "10.9.9.9:80", PacketForwarder: "nat"}
+	adm := makeTestTable(t, vs, rs1)
+	hub := watch.NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := hub.Subscribe(ctx, 10)
+	m, err := NewManager(adm, []ServiceConfig{{
+		VirtualServer: vs,
+		OnFailure:     OnFailureRemove,
+		Check:         CheckConfig{Type: "fake-sorry", Rise: 1, Fall: 1},
+		SorryServer:   &sorry,
+	}}, WithEvents{Hub: hub})
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := m.services[0]
+	assert.NoError(t, m.step(ctx, s))
+	assert.NotContains(t, listReals(t, adm, vs), sorry.RealServer().Address)
+
+	probes.set("10.1.1.1", true)
+	assert.NoError(t, m.step(ctx, s))
+	reals := listReals(t, adm, vs)
+	assert.Equal(t, map[ipvsAdm.Address]ipvsAdm.RealServer{
+		"10.9.9.9:80": {Address: "10.9.9.9:80", PacketForwarder: "nat", Weight: 1},
+	}, reals)
+	assert.Equal(t, watch.KindRealServerDown, (<-events).Kind)
+	assert.Equal(t, watch.KindFallbackOn, (<-events).Kind)
+
+	probes.set("10.1.1.1", false)
+	assert.NoError(t, m.step(ctx, s))
+	assert.Equal(t, map[ipvsAdm.Address]ipvsAdm.RealServer{rs1.Address: rs1}, listReals(t, adm, vs))
+	assert.Equal(t, watch.KindRealServerUp, (<-events).Kind)
+	assert.Equal(t, watch.KindFallbackOff, (<-events).Kind)
+}
+
+func Test_Checkers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			_, _ = w.Write([]byte("all is ok"))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	h, p, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(p)
+	target := Target{Host: h, Port: uint32(port)}
+	ctx := context.Background()
+
+	cases := []struct {
+		conf CheckConfig
+		ok   bool
+	}{
+		{CheckConfig{Type: "tcp"}, true},
+		{CheckConfig{Type: "http", HTTP: HTTPConfig{Path: "/healthz", ExpectBody: "ok$"}}, true},
+		{CheckConfig{Type: "http", HTTP: HTTPConfig{Path: "/healthz", ExpectBody: "^ok"}}, false},
+		{CheckConfig{Type: "http", HTTP: HTTPConfig{Path: "/"}}, false},
+		{CheckConfig{Type: "http", HTTP: HTTPConfig{Path: "/", ExpectStatus: []int{503}}}, true},
+	}
+	for i, c := range cases {
+		checker, err := MakeChecker(c.conf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = checker.Check(ctx, target)
+		assert.Equalf(t, c.ok, err == nil, "case #%v: %v", i, err)
+	}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer udp.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, e := udp.ReadFrom(buf)
+			if e != nil {
+				return
+			}
+			_, _ = udp.WriteTo(append([]byte("re:"), buf[:n]...), from)
+		}
+	}()
+	h, p, _ = net.SplitHostPort(udp.LocalAddr().String())
+	port, _ = strconv.Atoi(p)
+	checker, err := MakeChecker(CheckConfig{Type: "udp", UDP: UDPConfig{Send: "ping", Expect: "re:ping"}})
+	if assert.NoError(t, err) {
+		assert.NoError(t, checker.Check(ctx, Target{Host: h, Port: uint32(port)}))
+	}
+}
+
+func Test_ExtCheckers(t *testing.T) {
+	ctx := context.Background()
+	vs, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	target := Target{
+		VirtualServer: vs,
+		RealServer:    ipvsAdm.RealServer{Address: "127.0.0.1:8080"},
+		Host:          "127.0.0.1",
+		Port:          8080,
+	}
+	execConf := func(script string) CheckConfig {
+		return CheckConfig{Type: "exec", Exec: ExecConfig{
+			Command: "sh",
+			Args:    []string{"-c", script},
+		}}
+	}
+	for script, ok := range map[string]bool{
+		`test "{{.VirtualHost}}:{{.VirtualPort}}" = "10.0.0.1:80"`: true,
+		`test "{{.RealServer}}" = "127.0.0.1:8080"`:                true,
+		`exit 1`: false,
+	} {
+		checker, err := MakeChecker(execConf(script))
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = checker.Check(ctx, target)
+		assert.Equalf(t, ok, err == nil, "%s: %v", script, err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus("good", healthPb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("bad", healthPb.HealthCheckResponse_NOT_SERVING)
+	gs := grpc.NewServer()
+	healthPb.RegisterHealthServer(gs, hs)
+	go func() {
+		_ = gs.Serve(lis)
+	}()
+	defer gs.Stop()
+	h, p, _ := net.SplitHostPort(lis.Addr().String())
+	port, _ := strconv.Atoi(p)
+	target.Host, target.Port = h, uint32(port)
+	for service, ok := range map[string]bool{"good": true, "bad": false, "unknown": false} {
+		checker, e := MakeChecker(CheckConfig{Type: "grpc", GRPC: GRPCConfig{Service: service}})
+		if !assert.NoError(t, e) {
+			return
+		}
+		e = checker.Check(ctx, target)
+		assert.Equalf(t, ok, e == nil, "%s: %v", service, e)
+	}
+}
+
+func Test_PriorityGroups(t *testing.T) {
+	const vs = "tcp://10.0.0.1:80"
+	probes := &fakeHealth{down: make(map[string]bool)}
+	RegisterChecker("fake-groups", func(CheckConfig) (Checker, error) {
+		return probes, nil
+	})
+	p1 := ipvsAdm.RealServer{Address: "10.1.1.1:80", PacketForwarder: "dr", Weight: 5}
+	p2 := ipvsAdm.RealServer{Address: "10.1.1.2:80", PacketForwarder: "dr", Weight: 5}
+	b1 := ipvsAdm.RealServer{Address: "10.2.2.1:80", PacketForwarder: "dr", Weight: 3}
+	adm := makeTestTable(t, vs, p1, p2, b1)
+	m, err := NewManager(adm, []ServiceConfig{{
+		VirtualServer: vs,
+		Check:         CheckConfig{Type: "fake-groups", Rise: 1, Fall: 1},
+		PriorityGroups: []PriorityGroupConfig{
+			{Name: "primary", MinHealthy: 2, Members: []string{"10.1.1.1:80", "10.1.1.2:80"}},
+			{Name: "backup", Members: []string{"10.2.2.1:80"}},
+		},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	s := m.services[0]
+	weights := func() map[ipvsAdm.Address]uint32 {
+		ret := make(map[ipvsAdm.Address]uint32)
+		for a, rs := range listReals(t, adm, vs) {
+			ret[a] = rs.Weight
+		}
+		return ret
+	}
+	assert.NoError(t, m.step(ctx, s))
+	assert.Equal(t, map[ipvsAdm.Address]uint32{p1.Address: 5, p2.Address: 5, b1.Address: 0}, weights())
+
+	probes.set("10.1.1.2", true)
+	assert.NoError(t, m.step(ctx, s))
+	assert.Equal(t, map[ipvsAdm.Address]uint32{p1.Address: 0, p2.Address: 0, b1.Address: 3}, weights())
+	if groups := m.PriorityGroups(); assert.Len(t, groups, 1) {
+		assert.Equal(t, "backup", groups[0].Active)
+		assert.Equal(t, 1, groups[0].Groups[0].Healthy)
+	}
+
+	assert.NoError(t, m.SetPriorityGroupOverride(ctx, vs, "primary"))
+	assert.Equal(t, map[ipvsAdm.Address]uint32{p1.Address: 5, p2.Address: 0, b1.Address: 0}, weights())
+	assert.ErrorIs(t, m.SetPriorityGroupOverride(ctx, vs, "unknown"), ErrNotFound)
+
+	assert.NoError(t, m.SetPriorityGroupOverride(ctx, vs, ""))
+	probes.set("10.1.1.2", false)
+	assert.NoError(t, m.step(ctx, s))
+	assert.Equal(t, map[ipvsAdm.Address]uint32{p1.Address: 5, p2.Address: 5, b1.Address: 0}, weights())
+}
+
+func Test_PriorityGroupOverrideSurvivesRestart(t *testing.T) {
+	const vs = "tcp://10.0.0.1:80"
+	probes := &fakeHealth{down: make(map[string]bool)}
+	RegisterChecker("fake-override", func(CheckConfig) (Checker, error) {
+		return probes, nil
+	})
+	p1 := ipvsAdm.RealServer{Address: "10.1.1.1:80", PacketForwarder: "dr", Weight: 5}
+	b1 := ipvsAdm.RealServer{Address: "10.2.2.1:80", PacketForwarder: "dr", Weight: 3}
+	adm := makeTestTable(t, vs, p1, b1)
+	confs := []ServiceConfig{{
+		VirtualServer: vs,
+		Check:         CheckConfig{Type: "fake-override", Rise: 1, Fall: 1},
+		PriorityGroups: []PriorityGroupConfig{
+			{Name: "primary", Members: []string{"10.1.1.1:80"}},
+			{Name: "backup", Members: []string{"10.2.2.1:80"}},
+		},
+	}}
+	file := WithWeightsFile{File: filepath.Join(t.TempDir(), "weights.json")}
+	ctx := context.Background()
+
+	m, err := NewManager(adm, confs, file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, m.step(ctx, m.services[0]))
+	assert.NoError(t, m.SetPriorityGroupOverride(ctx, vs, "backup"))
+	assert.Equal(t, uint32(0), listReals(t, adm, vs)[p1.Address].Weight)
+
+	//manager restarted keeps backup active though primary is healthy
+	if m, err = NewManager(adm, confs, file); !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, m.step(ctx, m.services[0]))
+	if groups := m.PriorityGroups(); assert.Len(t, groups, 1) {
+		assert.Equal(t, "backup", groups[0].Override)
+		assert.Equal(t, "backup", groups[0].Active)
+	}
+	assert.Equal(t, uint32(0), listReals(t, adm, vs)[p1.Address].Weight)
+	assert.Equal(t, b1, listReals(t, adm, vs)[b1.Address])
+
+	//reset override is not restored
+	assert.NoError(t, m.SetPriorityGroupOverride(ctx, vs, ""))
+	if m, err = NewManager(adm, confs, file); !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, m.step(ctx, m.services[0]))
+	assert.Equal(t, p1, listReals(t, adm, vs)[p1.Address])
+}
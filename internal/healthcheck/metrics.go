@@ -0,0 +1,73 @@
+package healthcheck
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type managerMetrics struct {
+	transitions *prometheus.CounterVec
+}
+
+var (
+	_ prometheus.Collector = (*Manager)(nil)
+
+	realServerUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("ipvs", "healthcheck", "real_server_up"),
+		"Health state of real server (1 - up, 0 - down)",
+		[]string{"virtual_server", "real_server"}, nil,
+	)
+
+	fallbackActiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("ipvs", "healthcheck", "fallback_active"),
+		"Sorry server is in use by virtual server (1 - yes, 0 - no)",
+		[]string{"virtual_server"}, nil,
+	)
+)
+
+func newManagerMetrics() *managerMetrics {
+	return &managerMetrics{
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ipvs",
+			Subsystem: "healthcheck",
+			Name:      "transitions_total",
+			Help:      "Count of real server health and sorry server transitions",
+		}, []string{"virtual_server", "kind"}),
+	}
+}
+
+func (mm *managerMetrics) transition(vs string, kind string) {
+	mm.transitions.WithLabelValues(vs, kind).Inc()
+}
+
+//Describe impl prometheus.Collector
+func (m *Manager) Describe(ch chan<- *prometheus.Desc) {
+	ch <- realServerUpDesc
+	ch <- fallbackActiveDesc
+	m.metrics.transitions.Describe(ch)
+}
+
+//Collect impl prometheus.Collector
+func (m *Manager) Collect(ch chan<- prometheus.Metric) {
+	fallbacks := make(map[string]float64, len(m.services))
+	for _, s := range m.services {
+		if s.conf.SorryServer != nil {
+			fallbacks[s.name] = 0
+		}
+	}
+	for _, st := range m.States() {
+		if st.Fallback {
+			fallbacks[st.VirtualServer] = 1
+			continue
+		}
+		var v float64
+		if st.Healthy {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(realServerUpDesc, prometheus.GaugeValue, v,
+			st.VirtualServer, st.RealServer)
+	}
+	for vs, v := range fallbacks {
+		ch <- prometheus.MustNewConstMetric(fallbackActiveDesc, prometheus.GaugeValue, v, vs)
+	}
+	m.metrics.transitions.Collect(ch)
+}
@@ -0,0 +1,162 @@
+package healthcheck
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+//weightsFile weights real servers have before manager quiesces them; the kernel table keeps zeros only,
+//so manager restarted would take them for weights real servers are to have. Priority group overrides
+//are kept along with them since the kernel table does not tell them either
+type weightsFile struct {
+	SavedAt        time.Time                    `json:"savedAt"`
+	VirtualServers map[string]map[string]uint32 `json:"virtualServers"`
+	Overrides      map[string]string            `json:"overrides,omitempty"`
+}
+
+//loadWeights loads weights and priority group overrides are saved before
+func (m *Manager) loadWeights() error {
+	m.weights = make(map[string]map[ipvsAdm.Address]uint32)
+	m.overrides = make(map[string]string)
+	if m.weightsFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.weightsFile), 0700); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(m.weightsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st weightsFile
+	if err = json.Unmarshal(data, &st); err != nil {
+		return errors.Wrapf(err, "'%s'", m.weightsFile)
+	}
+	for vs, reals := range st.VirtualServers {
+		w := make(map[ipvsAdm.Address]uint32, len(reals))
+		for addr, weight := range reals {
+			w[ipvsAdm.Address(addr)] = weight
+		}
+		m.weights[vs] = w
+	}
+	for vs, group := range st.Overrides {
+		m.overrides[vs] = group
+	}
+	return nil
+}
+
+//savedWeight weight of real server is saved before; zero if none
+func (m *Manager) savedWeight(s *service, addr ipvsAdm.Address) uint32 {
+	m.weightsMx.Lock()
+	defer m.weightsMx.Unlock()
+	return m.weights[s.name][addr]
+}
+
+//rememberWeights saves weights real servers of virtual server are to have when they are healthy and active
+func (m *Manager) rememberWeights(s *service) error {
+	s.mx.Lock()
+	weights := make(map[ipvsAdm.Address]uint32, len(s.reals))
+	for addr, st := range s.reals {
+		if !st.fallback {
+			weights[addr] = st.desired.Weight
+		}
+	}
+	s.mx.Unlock()
+
+	m.weightsMx.Lock()
+	defer m.weightsMx.Unlock()
+	if sameWeights(m.weights[s.name], weights) {
+		return nil
+	}
+	m.weights[s.name] = weights
+	if len(weights) == 0 {
+		delete(m.weights, s.name)
+	}
+	return errors.Wrap(m.saveWeightsLocked(), "save weights")
+}
+
+//rememberOverride saves priority group override of virtual server; empty group drops it
+func (m *Manager) rememberOverride(s *service, group string) error {
+	m.weightsMx.Lock()
+	defer m.weightsMx.Unlock()
+	if m.overrides[s.name] == group {
+		return nil
+	}
+	was, had := m.overrides[s.name]
+	if group == "" {
+		delete(m.overrides, s.name)
+	} else {
+		m.overrides[s.name] = group
+	}
+	err := m.saveWeightsLocked()
+	if err != nil {
+		if had {
+			m.overrides[s.name] = was
+		} else {
+			delete(m.overrides, s.name)
+		}
+	}
+	return errors.Wrap(err, "save priority group override")
+}
+
+//saveWeightsLocked writes weights file atomically
+func (m *Manager) saveWeightsLocked() error {
+	if m.weightsFile == "" {
+		return nil
+	}
+	st := weightsFile{SavedAt: time.Now(), VirtualServers: make(map[string]map[string]uint32, len(m.weights))}
+	for vs, reals := range m.weights {
+		w := make(map[string]uint32, len(reals))
+		for addr, weight := range reals {
+			w[string(addr)] = weight
+		}
+		st.VirtualServers[vs] = w
+	}
+	if len(m.overrides) > 0 {
+		st.Overrides = make(map[string]string, len(m.overrides))
+		for vs, group := range m.overrides {
+			st.Overrides[vs] = group
+		}
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(m.weightsFile), filepath.Base(m.weightsFile)+".*"); err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.weightsFile)
+}
+
+func sameWeights(a, b map[ipvsAdm.Address]uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for addr, w := range a {
+		if v, ok := b[addr]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
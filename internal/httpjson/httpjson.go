@@ -0,0 +1,38 @@
+package httpjson
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/status"
+)
+
+//ErrorResponse body of failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+//Write writes v as JSON with status code
+func Write(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+//Error writes error as JSON with status code
+func Error(w http.ResponseWriter, code int, err error) {
+	Write(w, code, ErrorResponse{Error: err.Error()})
+}
+
+//Status writes gRPC status error as JSON with HTTP status code gateway maps its code to
+func Status(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	Error(w, runtime.HTTPStatusFromCode(st.Code()), errors.New(st.Message()))
+}
+
+//Decode decodes JSON body of request which is not larger than maxBytes
+func Decode(w http.ResponseWriter, r *http.Request, maxBytes int64, dest interface{}) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes)).Decode(dest)
+}
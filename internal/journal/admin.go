@@ -0,0 +1,131 @@
+package journal
+
+import (
+	"context"
+
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+type recordingAdmin struct {
+	ipvsAdm.Admin
+}
+
+//Admin wraps admin; successful mutations are recorded into Tx is started by Begin,
+//calls out of Tx pass as is
+func (j *Journal) Admin(admin ipvsAdm.Admin) ipvsAdm.Admin {
+	if r, ok := admin.(*recordingAdmin); ok {
+		return r
+	}
+	return &recordingAdmin{Admin: admin}
+}
+
+//UpdateVirtualServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) UpdateVirtualServer(ctx context.Context, vs ipvsAdm.VirtualServer, opts ...ipvsAdm.AdminOption) error {
+	tx := txFrom(ctx)
+	if tx == nil {
+		return impl.Admin.UpdateVirtualServer(ctx, vs, opts...)
+	}
+	before, found := impl.findVirtualServer(ctx, vs.Identity)
+	if err := impl.Admin.UpdateVirtualServer(ctx, vs, opts...); err != nil {
+		return err
+	}
+	c := Change{Op: OpAdd, VirtualServer: ipvsAdm.IdentityString(vs.Identity), After: virtualServerItem(vs)}
+	if found {
+		if before.ScheduleMethod == vs.ScheduleMethod {
+			return nil
+		}
+		c.Op, c.Before = OpUpdate, virtualServerItem(before)
+	}
+	tx.add(c)
+	return nil
+}
+
+//RemoveVirtualServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) RemoveVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, opts ...ipvsAdm.AdminOption) error {
+	tx := txFrom(ctx)
+	if tx == nil {
+		return impl.Admin.RemoveVirtualServer(ctx, identity, opts...)
+	}
+	before, found := impl.findVirtualServer(ctx, identity)
+	var reals []ipvsAdm.RealServer
+	if found {
+		_ = impl.Admin.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+			reals = append(reals, rs)
+			return nil
+		})
+	}
+	if err := impl.Admin.RemoveVirtualServer(ctx, identity, opts...); err != nil || !found {
+		return err
+	}
+	//reals go first so they are reverted after their virtual server
+	key := ipvsAdm.IdentityString(identity)
+	for _, rs := range reals {
+		tx.add(Change{Op: OpRemove, VirtualServer: key, RealServer: string(rs.Address), Before: realServerItem(rs)})
+	}
+	tx.add(Change{Op: OpRemove, VirtualServer: key, Before: virtualServerItem(before)})
+	return nil
+}
+
+//UpdateRealServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) UpdateRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, rs ipvsAdm.RealServer, opts ...ipvsAdm.AdminOption) error {
+	tx := txFrom(ctx)
+	if tx == nil {
+		return impl.Admin.UpdateRealServer(ctx, identity, rs, opts...)
+	}
+	before, found := impl.findRealServer(ctx, identity, rs.Address)
+	if err := impl.Admin.UpdateRealServer(ctx, identity, rs, opts...); err != nil {
+		return err
+	}
+	c := Change{Op: OpAdd, VirtualServer: ipvsAdm.IdentityString(identity), RealServer: string(rs.Address), After: realServerItem(rs)}
+	if found {
+		if before == rs {
+			return nil
+		}
+		c.Op, c.Before = OpUpdate, realServerItem(before)
+	}
+	tx.add(c)
+	return nil
+}
+
+//RemoveRealServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) RemoveRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, address ipvsAdm.Address, opts ...ipvsAdm.AdminOption) error {
+	tx := txFrom(ctx)
+	if tx == nil {
+		return impl.Admin.RemoveRealServer(ctx, identity, address, opts...)
+	}
+	before, found := impl.findRealServer(ctx, identity, address)
+	if err := impl.Admin.RemoveRealServer(ctx, identity, address, opts...); err != nil || !found {
+		return err
+	}
+	tx.add(Change{Op: OpRemove, VirtualServer: ipvsAdm.IdentityString(identity), RealServer: string(address), Before: realServerItem(before)})
+	return nil
+}
+
+func (impl *recordingAdmin) findVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity) (ipvsAdm.VirtualServer, bool) {
+	var ret ipvsAdm.VirtualServer
+	var found bool
+	_ = impl.Admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		if !found && ipvsAdm.IsIdentitiesEq(vs.Identity, identity) {
+			ret, found = vs, true
+		}
+		return nil
+	})
+	return ret, found
+}
+
+func (impl *recordingAdmin) findRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, address ipvsAdm.Address) (ipvsAdm.RealServer, bool) {
+	var ret ipvsAdm.RealServer
+	var found bool
+	_ = impl.Admin.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+		if !found && rs.Address == address {
+			ret, found = rs, true
+		}
+		return nil
+	})
+	return ret, found
+}
+
+func txFrom(ctx context.Context) *Tx {
+	tx, _ := ctx.Value(txKey{}).(*Tx)
+	return tx
+}
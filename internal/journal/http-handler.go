@@ -0,0 +1,130 @@
+package journal
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/httpjson"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	//RollbackFunc rolls the kernel table back to revision on behalf of caller of context
+	RollbackFunc func(ctx context.Context, revision uint64) (Entry, error)
+
+	//Summary entry without request and changes
+	Summary struct {
+		Revision   uint64   `json:"revision"`
+		Time       string   `json:"time"`
+		Caller     string   `json:"caller"`
+		Principals []string `json:"principals,omitempty"`
+		Method     string   `json:"method"`
+		Changes    int      `json:"changes"`
+		Error      string   `json:"error,omitempty"`
+	}
+
+	handler struct {
+		j        *Journal
+		rollback RollbackFunc
+	}
+)
+
+//NewHandler makes http.Handler exposes journal as JSON
+//
+//	GET  /?before=...&limit=...  - history, newest first
+//	GET  /{revision}             - entry with request and diff
+//	POST /rollback               - {"revision"} rolls back to revision
+func NewHandler(j *Journal, rollback RollbackFunc) http.Handler {
+	return &handler{j: j, rollback: rollback}
+}
+
+//ServeHTTP impl http.Handler
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		q := r.URL.Query()
+		var before uint64
+		limit := 100
+		var err error
+		if s := q.Get("before"); s != "" {
+			if before, err = strconv.ParseUint(s, 10, 64); err != nil {
+				writeError(w, errors.Wrapf(ErrInvalid, "before: %v", err))
+				return
+			}
+		}
+		if s := q.Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil {
+				writeError(w, errors.Wrapf(ErrInvalid, "limit: %v", err))
+				return
+			}
+		}
+		entries := h.j.List(before, limit)
+		ret := make([]Summary, 0, len(entries))
+		for _, e := range entries {
+			ret = append(ret, Summary{
+				Revision:   e.Revision,
+				Time:       e.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+				Caller:     e.Caller,
+				Principals: e.Principals,
+				Method:     e.Method,
+				Changes:    len(e.Changes),
+				Error:      e.Error,
+			})
+		}
+		httpjson.Write(w, http.StatusOK, struct {
+			Revision uint64    `json:"revision"`
+			Entries  []Summary `json:"entries"`
+		}{h.j.Revision(), ret})
+	case path == "rollback" && r.Method == http.MethodPost:
+		var req struct {
+			Revision *uint64 `json:"revision"`
+		}
+		err := httpjson.Decode(w, r, 64*1024, &req)
+		if err == nil && req.Revision == nil {
+			err = errors.New("no revision")
+		}
+		if err != nil {
+			writeError(w, errors.Wrapf(ErrInvalid, "decode request: %v", err))
+			return
+		}
+		e, err := h.rollback(r.Context(), *req.Revision)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, e)
+	case path != "" && !strings.Contains(path, "/") && r.Method == http.MethodGet:
+		rev, err := strconv.ParseUint(path, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var e Entry
+		if e, err = h.j.Get(rev); err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, e)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if _, ok := status.FromError(err); ok {
+		httpjson.Status(w, err)
+		return
+	}
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrInvalid):
+		code = http.StatusBadRequest
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	}
+	httpjson.Error(w, code, err)
+}
@@ -0,0 +1,418 @@
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/ipvs/internal/caller"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+journal:
+  file: /var/lib/ipvs/journal.jsonl
+  max-entries: 1000
+*/
+
+//Ops of change
+const (
+	OpAdd    = "add"
+	OpUpdate = "update"
+	OpRemove = "remove"
+)
+
+var (
+	//ErrNotFound revision is not found in journal
+	ErrNotFound = errors.New("revision is not found")
+
+	//ErrInvalid revision can not be used to roll back to
+	ErrInvalid = errors.New("invalid revision")
+)
+
+type (
+	//Config journal config
+	Config struct {
+		File       string
+		MaxEntries int
+	}
+
+	//Entry one mutating call is recorded in journal
+	Entry struct {
+		Revision   uint64          `json:"revision"`
+		Time       time.Time       `json:"time"`
+		Caller     string          `json:"caller"`
+		Principals []string        `json:"principals,omitempty"`
+		Method     string          `json:"method"`
+		Request    json.RawMessage `json:"request,omitempty"`
+		Changes    []Change        `json:"changes"`
+		Error      string          `json:"error,omitempty"`
+	}
+
+	//Change one change of the kernel table
+	Change struct {
+		Op            string `json:"op"`
+		VirtualServer string `json:"virtualServer"`
+		RealServer    string `json:"realServer,omitempty"`
+		Before        *Item  `json:"before,omitempty"`
+		After         *Item  `json:"after,omitempty"`
+	}
+
+	//Item state of virtual or real server
+	Item struct {
+		ScheduleMethod  string `json:"scheduleMethod,omitempty"`
+		PacketForwarder string `json:"packetForwarder,omitempty"`
+		Weight          uint32 `json:"weight"`
+		UpperThreshold  uint32 `json:"upperThreshold,omitempty"`
+		LowerThreshold  uint32 `json:"lowerThreshold,omitempty"`
+	}
+
+	//Journal keeps latest mutating calls with changes they made
+	Journal struct {
+		conf Config
+
+		mx       sync.Mutex
+		entries  []Entry
+		next     uint64
+		appended int
+	}
+
+	//Tx collects changes of one mutating call
+	Tx struct {
+		j     *Journal
+		entry Entry
+		mx    sync.Mutex
+	}
+
+	txKey struct{}
+)
+
+const defMaxEntries = 1000
+
+//Open opens journal; entries are kept in memory when no file is specified
+func Open(conf Config) (*Journal, error) {
+	const api = "journal/Open"
+
+	if conf.MaxEntries <= 0 {
+		conf.MaxEntries = defMaxEntries
+	}
+	ret := &Journal{conf: conf, next: 1}
+	if conf.File == "" {
+		return ret, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.File), 0700); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	f, err := os.Open(conf.File)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var e Entry
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, errors.Wrapf(err, "%s: '%s' line %v", api, conf.File, line)
+		}
+		ret.pushLocked(e)
+		ret.appended++
+	}
+	if err = sc.Err(); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	return ret, nil
+}
+
+//Begin starts recording of mutating call; admin returned by Admin records into it
+func (j *Journal) Begin(ctx context.Context, method string, who caller.Identity, request interface{}) (context.Context, *Tx) {
+	tx := &Tx{j: j, entry: Entry{Caller: who.Address, Principals: who.Principals, Method: method}}
+	if request != nil {
+		if raw, ok := request.(json.RawMessage); ok {
+			tx.entry.Request = raw
+		} else if data, err := json.Marshal(request); err == nil {
+			tx.entry.Request = data
+		}
+	}
+	return context.WithValue(ctx, txKey{}, tx), tx
+}
+
+//Commit puts call into journal; err is the error the call ends with
+func (tx *Tx) Commit(ctx context.Context, err error) Entry {
+	tx.mx.Lock()
+	e := tx.entry
+	e.Changes = append([]Change(nil), tx.entry.Changes...)
+	tx.mx.Unlock()
+	if e.Changes == nil {
+		e.Changes = []Change{}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return tx.j.put(ctx, e)
+}
+
+func (tx *Tx) add(c Change) {
+	tx.mx.Lock()
+	tx.entry.Changes = append(tx.entry.Changes, c)
+	tx.mx.Unlock()
+}
+
+//List lists entries with revision less than before (all if before is 0) newest first
+func (j *Journal) List(before uint64, limit int) []Entry {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	var ret []Entry
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+		if e := j.entries[i]; before == 0 || e.Revision < before {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+//Get finds entry by revision
+func (j *Journal) Get(revision uint64) (Entry, error) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	if i, ok := j.indexLocked(revision); ok {
+		return j.entries[i], nil
+	}
+	return Entry{}, errors.Wrapf(ErrNotFound, "revision %v", revision)
+}
+
+//Revision the latest revision
+func (j *Journal) Revision() uint64 {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	return j.next - 1
+}
+
+//RollbackPlan changes which revert all changes are made after revision, in order they are to be applied
+func (j *Journal) RollbackPlan(revision uint64) ([]Change, error) {
+	const api = "journal/RollbackPlan"
+
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	if revision >= j.next-1 {
+		return nil, errors.Wrapf(ErrInvalid, "%s: revision %v is not older than the latest one", api, revision)
+	}
+	if len(j.entries) == 0 || revision+1 < j.entries[0].Revision {
+		return nil, errors.Wrapf(ErrInvalid, "%s: changes after revision %v are not kept anymore", api, revision)
+	}
+	var ret []Change
+	i, _ := j.indexLocked(revision + 1)
+	for k := len(j.entries) - 1; k >= i; k-- {
+		changes := j.entries[k].Changes
+		for n := len(changes) - 1; n >= 0; n-- {
+			ret = append(ret, changes[n].inverse())
+		}
+	}
+	return ret, nil
+}
+
+//Rollback reverts all changes are made after revision; rollback is recorded as a new entry
+func (j *Journal) Rollback(ctx context.Context, admin ipvsAdm.Admin, revision uint64, who caller.Identity) (Entry, error) {
+	plan, err := j.RollbackPlan(revision)
+	if err != nil {
+		return Entry{}, err
+	}
+	return j.ApplyRollback(ctx, admin, revision, who, plan)
+}
+
+//ApplyRollback applies plan of rollback to revision is made by RollbackPlan; rollback is recorded as a new entry
+func (j *Journal) ApplyRollback(ctx context.Context, admin ipvsAdm.Admin, revision uint64, who caller.Identity, plan []Change) (Entry, error) {
+	const api = "journal/ApplyRollback"
+
+	ctx, tx := j.Begin(ctx, "Rollback", who, struct {
+		Revision uint64 `json:"revision"`
+	}{revision})
+	adm := j.Admin(admin)
+	var err error
+	for _, c := range plan {
+		if err = c.apply(ctx, adm); err != nil {
+			err = errors.Wrapf(err, "%s: %s of '%s' %s", api, c.Op, c.VirtualServer, c.RealServer)
+			break
+		}
+	}
+	return tx.Commit(ctx, err), err
+}
+
+func (j *Journal) put(ctx context.Context, e Entry) Entry {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	e.Revision = j.next
+	e.Time = time.Now()
+	j.pushLocked(e)
+	if j.conf.File != "" {
+		if err := j.appendLocked(e); err != nil {
+			logger.Errorf(ctx, "journal: write '%s': %v", j.conf.File, err)
+		}
+	}
+	return e
+}
+
+func (j *Journal) pushLocked(e Entry) {
+	j.entries = append(j.entries, e)
+	if n := len(j.entries) - j.conf.MaxEntries; n > 0 {
+		j.entries = append(j.entries[:0:0], j.entries[n:]...)
+	}
+	if e.Revision >= j.next {
+		j.next = e.Revision + 1
+	}
+}
+
+func (j *Journal) indexLocked(revision uint64) (int, bool) {
+	if len(j.entries) == 0 || revision < j.entries[0].Revision {
+		return 0, false
+	}
+	i := int(revision - j.entries[0].Revision)
+	return i, i < len(j.entries)
+}
+
+//appendLocked appends entry to file; file is compacted when it has twice as many entries as are kept
+func (j *Journal) appendLocked(e Entry) error {
+	if j.appended >= 2*j.conf.MaxEntries {
+		if err := j.compactLocked(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	if f, err = os.OpenFile(j.conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err == nil {
+		j.appended++
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (j *Journal) compactLocked() error {
+	dir := filepath.Dir(j.conf.File)
+	f, err := ioutil.TempFile(dir, filepath.Base(j.conf.File)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range j.entries {
+		if err = enc.Encode(j.entries[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.conf.File)
+	}
+	if err == nil {
+		j.appended = len(j.entries)
+	}
+	return err
+}
+
+//inverse change which reverts this one
+func (c Change) inverse() Change {
+	ret := Change{Op: OpUpdate, VirtualServer: c.VirtualServer, RealServer: c.RealServer, Before: c.After, After: c.Before}
+	switch c.Op {
+	case OpAdd:
+		ret.Op = OpRemove
+	case OpRemove:
+		ret.Op = OpAdd
+	}
+	return ret
+}
+
+//apply makes change; absent virtual and real servers are added
+func (c Change) apply(ctx context.Context, admin ipvsAdm.Admin) error {
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(c.VirtualServer)
+	if err != nil {
+		return err
+	}
+	if c.RealServer == "" {
+		if c.Op == OpRemove {
+			err = admin.RemoveVirtualServer(ctx, identity)
+			if errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+				err = nil
+			}
+			return err
+		}
+		if c.After == nil {
+			return errors.Wrap(ErrInvalid, "no state after change")
+		}
+		return admin.UpdateVirtualServer(ctx, c.After.VirtualServer(identity), ipvsAdm.ForceAddIfNotExist{})
+	}
+	address := ipvsAdm.Address(c.RealServer)
+	if c.Op == OpRemove {
+		err = admin.RemoveRealServer(ctx, identity, address)
+		if errors.Is(err, ipvsAdm.ErrRealServerNotExist) || errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+			err = nil
+		}
+		return err
+	}
+	if c.After == nil {
+		return errors.Wrap(ErrInvalid, "no state after change")
+	}
+	return admin.UpdateRealServer(ctx, identity, c.After.RealServer(address), ipvsAdm.ForceAddIfNotExist{})
+}
+
+//VirtualServer virtual server item tells state of
+func (it *Item) VirtualServer(identity ipvsAdm.VirtualServerIdentity) ipvsAdm.VirtualServer {
+	return ipvsAdm.VirtualServer{
+		Identity:       identity,
+		ScheduleMethod: ipvsAdm.ScheduleMethod(it.ScheduleMethod),
+	}
+}
+
+//RealServer real server item tells state of
+func (it *Item) RealServer(address ipvsAdm.Address) ipvsAdm.RealServer {
+	return ipvsAdm.RealServer{
+		Address:         address,
+		PacketForwarder: ipvsAdm.PacketForwarder(it.PacketForwarder),
+		Weight:          it.Weight,
+		UpperThreshold:  it.UpperThreshold,
+		LowerThreshold:  it.LowerThreshold,
+	}
+}
+
+func virtualServerItem(vs ipvsAdm.VirtualServer) *Item {
+	return &Item{ScheduleMethod: string(vs.ScheduleMethod)}
+}
+
+func realServerItem(rs ipvsAdm.RealServer) *Item {
+	return &Item{
+		PacketForwarder: string(rs.PacketForwarder),
+		Weight:          rs.Weight,
+		UpperThreshold:  rs.UpperThreshold,
+		LowerThreshold:  rs.LowerThreshold,
+	}
+}
@@ -0,0 +1,139 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thataway/ipvs/internal/caller"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func Test_Journal(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "journal")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	conf := Config{File: filepath.Join(dir, "journal.jsonl"), MaxEntries: 10}
+	j, err := Open(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	adm := j.Admin(kernel)
+	vs1, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	rs := func(addr string, w uint32) ipvsAdm.RealServer {
+		return ipvsAdm.RealServer{Address: ipvsAdm.Address(addr), PacketForwarder: "dr", Weight: w}
+	}
+	dump := func() map[string][]ipvsAdm.RealServer {
+		ret := make(map[string][]ipvsAdm.RealServer)
+		_ = kernel.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+			key := ipvsAdm.IdentityString(vs.Identity) + " " + string(vs.ScheduleMethod)
+			ret[key] = []ipvsAdm.RealServer{}
+			err := kernel.ListRealServers(ctx, vs.Identity, func(r ipvsAdm.RealServer) error {
+				ret[key] = append(ret[key], r)
+				return nil
+			})
+			sort.Slice(ret[key], func(i, k int) bool {
+				return ret[key][i].Address < ret[key][k].Address
+			})
+			return err
+		})
+		return ret
+	}
+
+	//calls out of tx are not recorded
+	assert.NoError(t, adm.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: vs1, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	assert.Equal(t, uint64(0), j.Revision())
+
+	c1, tx := j.Begin(ctx, "UpdateRealServers", caller.Identity{Address: "10.1.1.1:5000", Principals: []string{"mtls:ops"}}, json.RawMessage(`{"a":1}`))
+	assert.NoError(t, adm.UpdateRealServer(c1, vs1, rs("10.0.1.1:80", 1), ipvsAdm.ForceAddIfNotExist{}))
+	assert.NoError(t, adm.UpdateRealServer(c1, vs1, rs("10.0.1.2:80", 1), ipvsAdm.ForceAddIfNotExist{}))
+	e := tx.Commit(c1, nil)
+	assert.Equal(t, uint64(1), e.Revision)
+	assert.Equal(t, "10.1.1.1:5000", e.Caller)
+	assert.Equal(t, []string{"mtls:ops"}, e.Principals)
+	assert.Len(t, e.Changes, 2)
+	state1 := dump()
+
+	c2, tx := j.Begin(ctx, "UpdateVirtualServers", caller.Identity{Address: "10.1.1.2:5000"}, nil)
+	assert.NoError(t, adm.UpdateRealServer(c2, vs1, rs("10.0.1.2:80", 7)))
+	assert.NoError(t, adm.UpdateRealServer(c2, vs1, rs("10.0.1.2:80", 7)))
+	assert.NoError(t, adm.UpdateVirtualServer(c2, ipvsAdm.VirtualServer{Identity: vs1, ScheduleMethod: "wrr"}))
+	assert.NoError(t, adm.RemoveVirtualServer(c2, vs1))
+	assert.Error(t, adm.RemoveVirtualServer(c2, vs1))
+	e = tx.Commit(c2, nil)
+	assert.Equal(t, []Change{
+		{Op: OpUpdate, VirtualServer: "tcp://10.0.0.1:80", RealServer: "10.0.1.2:80",
+			Before: &Item{PacketForwarder: "dr", Weight: 1}, After: &Item{PacketForwarder: "dr", Weight: 7}},
+		{Op: OpUpdate, VirtualServer: "tcp://10.0.0.1:80",
+			Before: &Item{ScheduleMethod: "rr"}, After: &Item{ScheduleMethod: "wrr"}},
+		{Op: OpRemove, VirtualServer: "tcp://10.0.0.1:80", RealServer: "10.0.1.1:80",
+			Before: &Item{PacketForwarder: "dr", Weight: 1}},
+		{Op: OpRemove, VirtualServer: "tcp://10.0.0.1:80", RealServer: "10.0.1.2:80",
+			Before: &Item{PacketForwarder: "dr", Weight: 7}},
+		{Op: OpRemove, VirtualServer: "tcp://10.0.0.1:80",
+			Before: &Item{ScheduleMethod: "wrr"}},
+	}, e.Changes)
+	assert.Empty(t, dump())
+
+	//journal survives restart
+	j, err = Open(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(2), j.Revision())
+
+	admin := caller.Identity{Address: "10.1.1.3:5000", Principals: []string{"unix-user:root"}}
+	_, err = j.Rollback(ctx, kernel, 2, caller.Identity{})
+	assert.ErrorIs(t, err, ErrInvalid)
+	e, err = j.Rollback(ctx, kernel, 1, admin)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), e.Revision)
+	assert.Equal(t, "Rollback", e.Method)
+	assert.Equal(t, state1, dump())
+
+	//rollback is journaled too, so it can be rolled back
+	_, err = j.Rollback(ctx, kernel, 2, admin)
+	assert.NoError(t, err)
+	assert.Empty(t, dump())
+
+	h := NewHandler(j, func(ctx context.Context, revision uint64) (Entry, error) {
+		return j.Rollback(ctx, kernel, revision, admin)
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?limit=2", nil))
+	var list struct {
+		Revision uint64    `json:"revision"`
+		Entries  []Summary `json:"entries"`
+	}
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, uint64(4), list.Revision)
+	if assert.Len(t, list.Entries, 2) {
+		assert.Equal(t, uint64(4), list.Entries[0].Revision)
+		assert.Equal(t, uint64(3), list.Entries[1].Revision)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"request":{"a":1}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/100", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/rollback", bytes.NewBufferString(`{"revision":1}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, state1, dump())
+}
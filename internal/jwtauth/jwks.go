@@ -0,0 +1,119 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	//jwks JSON web key set
+	jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+
+	publicKey struct {
+		kid string
+		alg string
+		key crypto.PublicKey
+	}
+)
+
+//parseJWKS parses signature keys of key set; keys of other use or unknown type are skipped
+func parseJWKS(data []byte) ([]publicKey, error) {
+	var set jwks
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrap(err, "parse JWKS")
+	}
+	var ret []publicKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk := publicKey{kid: k.Kid, alg: k.Alg}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			pk.key, err = rsaKey(k)
+		case "EC":
+			pk.key, err = ecKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "JWKS key #%v '%s'", i, k.Kid)
+		}
+		ret = append(ret, pk)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("JWKS has no signature keys")
+	}
+	return ret, nil
+}
+
+func rsaKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := decodeInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	var e *big.Int
+	if e, err = decodeInt(k.E); err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 {
+		return nil, errors.New("bad RSA exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func ecKey(k jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.Errorf("unsupported curve '%s'", k.Crv)
+	}
+	x, err := decodeInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	var y *big.Int
+	if y, err = decodeInt(k.Y); err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("bad base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,295 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/protos/pkg/api/ipvs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*//Sample of config
+jwt:
+  jwks-file: /etc/ipvs/jwks.json
+  #jwks-url: https://idp.example/.well-known/jwks.json
+  refresh-interval: 30s
+  issuer: https://idp.example
+  audience: ipvs
+  leeway: 30s
+  groups-claim: groups
+  required: false
+*/
+
+//AuthorizationMetadata request metadata key bearer token is passed in
+const AuthorizationMetadata = "authorization"
+
+type (
+	//Config JWT authentication config; keys are taken from JWKS file or URL
+	Config struct {
+		JWKSFile        string        `mapstructure:"jwks-file"`
+		JWKSURL         string        `mapstructure:"jwks-url"`
+		RefreshInterval time.Duration `mapstructure:"refresh-interval"`
+		Issuer          string        `mapstructure:"issuer"`
+		Audience        string        `mapstructure:"audience"`
+		Leeway          time.Duration `mapstructure:"leeway"`
+		SubjectClaim    string        `mapstructure:"subject-claim"`
+		GroupsClaim     string        `mapstructure:"groups-claim"`
+		Required        bool          `mapstructure:"required"`
+	}
+
+	//Claims claims of verified token
+	Claims map[string]interface{}
+
+	//Authenticator verifies bearer tokens of API calls
+	Authenticator struct {
+		conf   Config
+		client *http.Client
+
+		mx      sync.RWMutex
+		keys    []publicKey
+		modTime time.Time
+	}
+
+	claimsKey struct{}
+)
+
+const (
+	defRefreshInterval = 30 * time.Second
+	defSubjectClaim    = "sub"
+)
+
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+//New makes authenticator and loads keys; Run keeps them fresh
+func New(conf Config) (*Authenticator, error) {
+	const api = "jwtauth/New"
+
+	if (conf.JWKSFile == "") == (conf.JWKSURL == "") {
+		return nil, errors.Errorf("%s: exactly one of jwks-file and jwks-url is expected", api)
+	}
+	if conf.Issuer == "" || conf.Audience == "" {
+		return nil, errors.Errorf("%s: issuer and audience are required", api)
+	}
+	if conf.RefreshInterval <= 0 {
+		conf.RefreshInterval = defRefreshInterval
+	}
+	if conf.SubjectClaim == "" {
+		conf.SubjectClaim = defSubjectClaim
+	}
+	ret := &Authenticator{conf: conf, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := ret.refresh(context.Background()); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	return ret, nil
+}
+
+//Run reloads keys until context is done; file is reloaded when it is changed
+func (a *Authenticator) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.conf.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.refresh(ctx); err != nil {
+			logger.Errorf(ctx, "jwtauth: reload keys, previous ones are still in use: %v", err)
+		}
+	}
+}
+
+func (a *Authenticator) refresh(ctx context.Context) error {
+	var data []byte
+	var modTime time.Time
+	if a.conf.JWKSFile != "" {
+		st, err := os.Stat(a.conf.JWKSFile)
+		if err != nil {
+			return err
+		}
+		a.mx.RLock()
+		unchanged := st.ModTime().Equal(a.modTime)
+		a.mx.RUnlock()
+		if unchanged {
+			return nil
+		}
+		modTime = st.ModTime()
+		if data, err = ioutil.ReadFile(a.conf.JWKSFile); err != nil {
+			return err
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.conf.JWKSURL, nil)
+		if err != nil {
+			return err
+		}
+		var resp *http.Response
+		if resp, err = a.client.Do(req); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("fetch '%s': unexpected status '%s'", a.conf.JWKSURL, resp.Status)
+		}
+		if data, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return err
+		}
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.keys, a.modTime = keys, modTime
+	return nil
+}
+
+//Verify checks signature, issuer, audience and lifetime of token
+func (a *Authenticator) Verify(token string) (Claims, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(validMethods), jwt.WithoutClaimsValidation())
+	unverified, _, err := parser.ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	kid, _ := unverified.Header["kid"].(string)
+	candidates := a.candidates(kid, unverified.Method.Alg())
+	if len(candidates) == 0 {
+		return nil, errors.Errorf("no key for kid '%s' and alg '%s'", kid, unverified.Method.Alg())
+	}
+	var claims jwt.MapClaims
+	for _, k := range candidates {
+		claims = jwt.MapClaims{}
+		_, err = parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+			return k.key, nil
+		})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !claims.VerifyExpiresAt(now.Add(-a.conf.Leeway).Unix(), true) {
+		return nil, errors.New("token is expired or has no expiry")
+	}
+	if !claims.VerifyNotBefore(now.Add(a.conf.Leeway).Unix(), false) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if !claims.VerifyIssuer(a.conf.Issuer, true) {
+		return nil, errors.New("token has unexpected issuer")
+	}
+	if !claims.VerifyAudience(a.conf.Audience, true) {
+		return nil, errors.New("token has unexpected audience")
+	}
+	return Claims(claims), nil
+}
+
+func (a *Authenticator) candidates(kid, alg string) []publicKey {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	var ret []publicKey
+	for _, k := range a.keys {
+		if kid != "" && k.kid != kid || k.alg != "" && k.alg != alg {
+			continue
+		}
+		switch k.key.(type) {
+		case *rsa.PublicKey:
+			if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") {
+				continue
+			}
+		case *ecdsa.PublicKey:
+			if !strings.HasPrefix(alg, "ES") {
+				continue
+			}
+		}
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+//UnaryInterceptor verifies bearer token of API calls; claims of valid one are put to context;
+//call without token passes unless token is required
+func (a *Authenticator) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/"+ipvs.IpvsAdmin_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	ctx, err := a.Authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+//Authenticate verifies bearer token of call of method and puts its claims to context; it gives
+//Unauthenticated error when token is bad or it is required but missing
+func (a *Authenticator) Authenticate(ctx context.Context, method string) (context.Context, error) {
+	token := bearerToken(ctx)
+	if token == "" {
+		if a.conf.Required {
+			return ctx, status.Error(codes.Unauthenticated, "bearer token is required")
+		}
+		return ctx, nil
+	}
+	claims, err := a.Verify(token)
+	if err != nil {
+		logger.Warnf(ctx, "jwtauth: '%s' is refused: %v", method, err)
+		return ctx, status.Errorf(codes.Unauthenticated, "bad bearer token: %v", err)
+	}
+	return context.WithValue(ctx, claimsKey{}, claims), nil
+}
+
+//Principals gives resolver of caller principals: 'jwt:<subject>' and 'jwt-group:<group>' for every group
+func (a *Authenticator) Principals(ctx context.Context) []string {
+	claims := ClaimsFrom(ctx)
+	if claims == nil {
+		return nil
+	}
+	var ret []string
+	if sub, _ := claims[a.conf.SubjectClaim].(string); sub != "" {
+		ret = append(ret, "jwt:"+sub)
+	}
+	if a.conf.GroupsClaim != "" {
+		switch g := claims[a.conf.GroupsClaim].(type) {
+		case string:
+			ret = append(ret, "jwt-group:"+g)
+		case []interface{}:
+			for _, v := range g {
+				if s, ok := v.(string); ok {
+					ret = append(ret, "jwt-group:"+s)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+//ClaimsFrom claims of verified token call is made with; nil if there is no one
+func ClaimsFrom(ctx context.Context) Claims {
+	c, _ := ctx.Value(claimsKey{}).(Claims)
+	return c
+}
+
+func bearerToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(AuthorizationMetadata) {
+		if parts := strings.SplitN(strings.TrimSpace(v), " ", 2); len(parts) == 2 && strings.EqualFold(parts[0], "bearer") {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
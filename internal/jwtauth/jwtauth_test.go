@@ -0,0 +1,165 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, k *rsa.PrivateKey) jwk {
+	return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) jwk {
+	return jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: b64(k.X.Bytes()), Y: b64(k.Y.Bytes())}
+}
+
+func writeJWKS(t *testing.T, file string, keys ...jwk) {
+	data, _ := json.Marshal(jwks{Keys: keys})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func Test_Authenticator(t *testing.T) {
+	rsaKey1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaKey2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, file, rsaJWK("k1", rsaKey1), ecJWK("e1", ecKey))
+
+	a, err := New(Config{
+		JWKSFile:    file,
+		Issuer:      "https://idp.test",
+		Audience:    "ipvs",
+		GroupsClaim: "groups",
+		Required:    true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	claims := func(mod func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":    "https://idp.test",
+			"aud":    []string{"ipvs", "other"},
+			"sub":    "ci-bot",
+			"exp":    now.Add(time.Hour).Unix(),
+			"groups": []string{"deployers"},
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	call := func(token string) (Claims, []string, error) {
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(AuthorizationMetadata, "Bearer "+token))
+		}
+		var got Claims
+		var principals []string
+		_, e := a.UnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/ipvs.IpvsAdmin/ListVirtualServers"},
+			func(ctx context.Context, _ interface{}) (interface{}, error) {
+				got, principals = ClaimsFrom(ctx), a.Principals(ctx)
+				return nil, nil
+			})
+		return got, principals, e
+	}
+
+	c, principals, err := call(sign(t, jwt.SigningMethodRS256, "k1", rsaKey1, claims(nil)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ci-bot", c["sub"])
+		assert.Equal(t, []string{"jwt:ci-bot", "jwt-group:deployers"}, principals)
+	}
+	_, _, err = call(sign(t, jwt.SigningMethodES256, "", ecKey, claims(nil)))
+	assert.NoError(t, err)
+
+	for name, token := range map[string]string{
+		"none":         "",
+		"unknown key":  sign(t, jwt.SigningMethodRS256, "k2", rsaKey2, claims(nil)),
+		"forged":       sign(t, jwt.SigningMethodRS256, "k1", rsaKey2, claims(nil)),
+		"expired":      sign(t, jwt.SigningMethodRS256, "k1", rsaKey1, claims(func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() })),
+		"no expiry":    sign(t, jwt.SigningMethodRS256, "k1", rsaKey1, claims(func(c jwt.MapClaims) { delete(c, "exp") })),
+		"not yet":      sign(t, jwt.SigningMethodRS256, "k1", rsaKey1, claims(func(c jwt.MapClaims) { c["nbf"] = now.Add(time.Hour).Unix() })),
+		"bad issuer":   sign(t, jwt.SigningMethodRS256, "k1", rsaKey1, claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.test" })),
+		"bad audience": sign(t, jwt.SigningMethodRS256, "k1", rsaKey1, claims(func(c jwt.MapClaims) { c["aud"] = "other" })),
+		"hmac":         sign(t, jwt.SigningMethodHS256, "k1", []byte("secret"), claims(nil)),
+	} {
+		_, _, err = call(token)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), name)
+	}
+
+	//keys are rotated by file reload
+	writeJWKS(t, file, rsaJWK("k2", rsaKey2))
+	later := now.Add(time.Minute)
+	_ = os.Chtimes(file, later, later)
+	assert.NoError(t, a.refresh(context.Background()))
+	_, _, err = call(sign(t, jwt.SigningMethodRS256, "k2", rsaKey2, claims(nil)))
+	assert.NoError(t, err)
+	_, _, err = call(sign(t, jwt.SigningMethodRS256, "k1", rsaKey1, claims(nil)))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	//broken file keeps previous keys
+	_ = ioutil.WriteFile(file, []byte("{"), 0600)
+	_ = os.Chtimes(file, later.Add(time.Minute), later.Add(time.Minute))
+	assert.Error(t, a.refresh(context.Background()))
+	_, _, err = call(sign(t, jwt.SigningMethodRS256, "k2", rsaKey2, claims(nil)))
+	assert.NoError(t, err)
+
+	//keys from URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwks{Keys: []jwk{ecJWK("e1", ecKey)}})
+	}))
+	defer srv.Close()
+	var b *Authenticator
+	if b, err = New(Config{JWKSURL: srv.URL, Issuer: "https://idp.test", Audience: "ipvs"}); assert.NoError(t, err) {
+		_, err = b.Verify(sign(t, jwt.SigningMethodES256, "e1", ecKey, claims(nil)))
+		assert.NoError(t, err)
+	}
+
+	for _, conf := range []Config{
+		{Issuer: "i", Audience: "a"},
+		{JWKSFile: file, JWKSURL: srv.URL, Issuer: "i", Audience: "a"},
+		{JWKSURL: srv.URL, Audience: "a"},
+		{JWKSFile: filepath.Join(t.TempDir(), "none.json"), Issuer: "i", Audience: "a"},
+	} {
+		_, err = New(conf)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,80 @@
+package lease
+
+import (
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+leases:
+  file: /var/lib/ipvs/leases.json
+  default-ttl: 30s
+  max-ttl: 5m
+  drain-period: 10s
+  sweep-interval: 1s
+  virtual-servers:
+    - virtual-server: tcp://10.0.0.1:80
+      owners: ["mtls:team-a-*", "jwt:team-b"]
+      max-leases: 100
+*/
+
+type (
+	//Config lease registry config; leases are kept in file so they outlive restarts of service
+	Config struct {
+		File           string                `mapstructure:"file"`
+		DefaultTTL     time.Duration         `mapstructure:"default-ttl"`
+		MaxTTL         time.Duration         `mapstructure:"max-ttl"`
+		DrainPeriod    time.Duration         `mapstructure:"drain-period"`
+		SweepInterval  time.Duration         `mapstructure:"sweep-interval"`
+		VirtualServers []VirtualServerConfig `mapstructure:"virtual-servers"`
+	}
+
+	//VirtualServerConfig virtual server is open for self-registration; owners are glob patterns
+	//of principals callers hold leases as; empty owners list means any identified caller is allowed
+	VirtualServerConfig struct {
+		VirtualServer string   `mapstructure:"virtual-server"`
+		Owners        []string `mapstructure:"owners"`
+		MaxLeases     int      `mapstructure:"max-leases"`
+	}
+)
+
+const (
+	defTTL           = 30 * time.Second
+	defMaxTTL        = 5 * time.Minute
+	defSweepInterval = time.Second
+)
+
+//Normalize fills defaults and validates config
+func (c *Config) Normalize() error {
+	const api = "lease/Config"
+
+	if c.DefaultTTL <= 0 {
+		c.DefaultTTL = defTTL
+	}
+	if c.MaxTTL <= 0 {
+		c.MaxTTL = defMaxTTL
+	}
+	if c.DefaultTTL > c.MaxTTL {
+		return errors.Errorf("%s: default-ttl(%v) > max-ttl(%v)", api, c.DefaultTTL, c.MaxTTL)
+	}
+	if c.DrainPeriod < 0 {
+		c.DrainPeriod = 0
+	}
+	if c.SweepInterval <= 0 {
+		c.SweepInterval = defSweepInterval
+	}
+	for _, vs := range c.VirtualServers {
+		if _, err := ipvsAdm.ParseVirtualServerIdentity(vs.VirtualServer); err != nil {
+			return errors.Wrap(err, api)
+		}
+		for _, o := range vs.Owners {
+			if _, err := path.Match(o, ""); err != nil {
+				return errors.Errorf("%s: '%s' has bad owner pattern '%s'", api, vs.VirtualServer, o)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package lease
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/authz"
+	"github.com/thataway/ipvs/internal/httpjson"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	//Guard refuses caller to change leases of virtual server
+	Guard func(ctx context.Context, virtualServer string) error
+
+	//Principals tells principals of caller; leases are held by them
+	Principals func(ctx context.Context) []string
+
+	handler struct {
+		reg        *Registry
+		guard      Guard
+		principals Principals
+	}
+)
+
+//NewHandler makes http.Handler exposes leases as JSON; guard (if any) checks every change. Owner of
+//lease is principal of caller: owner in request (if any) must be one of principals caller has, and
+//callers nobody identifies may not hold leases. Without principals owner in request is taken as is
+//
+//	GET    /?virtual-server=...  - list leases
+//	POST   /                     - {"owner", "virtualServer", "realServer": {...}, "ttl": "30s"} registers real server
+//	POST   /{id}/heartbeat       - {"owner"} renews lease
+//	DELETE /{id}?owner=...       - releases lease
+func NewHandler(reg *Registry, guard Guard, principals Principals) http.Handler {
+	return &handler{reg: reg, guard: guard, principals: principals}
+}
+
+//ServeHTTP impl http.Handler
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg := h.reg
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		leases := reg.List(r.URL.Query().Get("virtual-server"))
+		httpjson.Write(w, http.StatusOK, struct {
+			Leases []Lease `json:"leases"`
+		}{leases})
+	case path == "" && r.Method == http.MethodPost:
+		var req struct {
+			RegisterRequest
+			TTL string `json:"ttl"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil {
+				writeError(w, errors.Wrapf(ErrInvalid, "ttl: %v", err))
+				return
+			}
+			req.RegisterRequest.TTL = d
+		}
+		if err := h.check(r.Context(), req.VirtualServer); err != nil {
+			writeError(w, err)
+			return
+		}
+		var err error
+		if req.Owner, err = h.owner(r.Context(), req.Owner); err != nil {
+			writeError(w, err)
+			return
+		}
+		l, err := reg.Register(r.Context(), req.RegisterRequest)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, l)
+	case strings.HasSuffix(path, "/heartbeat") && r.Method == http.MethodPost:
+		var req struct {
+			Owner string `json:"owner"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		id := strings.TrimSuffix(path, "/heartbeat")
+		if err := h.checkLease(r.Context(), id); err != nil {
+			writeError(w, err)
+			return
+		}
+		var err error
+		if req.Owner, err = h.owner(r.Context(), req.Owner); err != nil {
+			writeError(w, err)
+			return
+		}
+		l, err := reg.Renew(r.Context(), id, req.Owner)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, l)
+	case path != "" && !strings.Contains(path, "/") && r.Method == http.MethodDelete:
+		if err := h.checkLease(r.Context(), path); err != nil {
+			writeError(w, err)
+			return
+		}
+		owner, err := h.owner(r.Context(), r.URL.Query().Get("owner"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err = reg.Release(r.Context(), path, owner); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (h *handler) check(ctx context.Context, virtualServer string) error {
+	if h.guard == nil {
+		return nil
+	}
+	return h.guard(ctx, virtualServer)
+}
+
+//checkLease checks virtual server of lease; unknown lease is left to registry to refuse
+func (h *handler) checkLease(ctx context.Context, id string) error {
+	if vs, ok := h.reg.virtualServerOf(id); ok {
+		return h.check(ctx, vs)
+	}
+	return nil
+}
+
+//owner principal of caller lease is held by; claimed owner must be one of principals of caller
+func (h *handler) owner(ctx context.Context, claimed string) (string, error) {
+	if h.principals == nil {
+		return claimed, nil
+	}
+	var named []string
+	for _, p := range h.principals(ctx) {
+		if p != authz.PrincipalAnonymous {
+			named = append(named, p)
+		}
+	}
+	if len(named) == 0 {
+		return "", errors.Wrap(ErrNotAllowed, "caller is not identified; leases are held by principals of callers")
+	}
+	if claimed == "" {
+		return named[0], nil
+	}
+	for _, p := range named {
+		if p == claimed {
+			return claimed, nil
+		}
+	}
+	return "", errors.Wrapf(ErrNotAllowed, "owner '%s' is not principal of caller", claimed)
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, dest interface{}) error {
+	if err := httpjson.Decode(w, r, 64*1024, dest); err != nil {
+		return errors.Wrapf(ErrInvalid, "decode request: %v", err)
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if _, ok := status.FromError(err); ok {
+		httpjson.Status(w, err)
+		return
+	}
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrInvalid):
+		code = http.StatusBadRequest
+	case errors.Is(err, ErrNotAllowed):
+		code = http.StatusForbidden
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		code = http.StatusConflict
+	case errors.Is(err, ErrLimit):
+		code = http.StatusUnprocessableEntity
+	}
+	httpjson.Error(w, code, err)
+}
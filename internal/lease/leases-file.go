@@ -0,0 +1,96 @@
+package lease
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+//leasesFile leases are kept in; heartbeats are not saved, so leases loaded back are given one TTL
+//for owners to renew them
+type leasesFile struct {
+	SavedAt time.Time `json:"savedAt"`
+	Leases  []Lease   `json:"leases"`
+}
+
+//load loads leases are saved before; real servers they hold stay in the kernel table while
+//service is down, so leases are to expire and remove them as usual
+func (reg *Registry) load() error {
+	if reg.conf.File == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(reg.conf.File), 0700); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(reg.conf.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st leasesFile
+	if err = json.Unmarshal(data, &st); err != nil {
+		return errors.Wrapf(err, "'%s'", reg.conf.File)
+	}
+	now := reg.now()
+	for _, v := range st.Leases {
+		l := &lease{id: v.ID, owner: v.Owner, draining: v.Draining, expiresAt: v.ExpiresAt}
+		if l.identity, err = ipvsAdm.ParseVirtualServerIdentity(v.VirtualServer); err != nil {
+			return errors.Wrapf(err, "'%s': lease '%s'", reg.conf.File, v.ID)
+		}
+		l.vs = ipvsAdm.IdentityString(l.identity)
+		if l.realServer, err = v.RealServer.toAdm(); err != nil {
+			return errors.Wrapf(err, "'%s': lease '%s'", reg.conf.File, v.ID)
+		}
+		if l.ttl, err = time.ParseDuration(v.TTL); err != nil {
+			return errors.Wrapf(err, "'%s': lease '%s'", reg.conf.File, v.ID)
+		}
+		if !l.draining {
+			l.expiresAt = now.Add(l.ttl)
+		}
+		reg.leases[l.id] = l
+		reg.slots[slotKey{vs: l.vs, addr: l.realServer.Address}] = l.id
+	}
+	return nil
+}
+
+//saveLocked writes leases file atomically
+func (reg *Registry) saveLocked() error {
+	if reg.conf.File == "" {
+		return nil
+	}
+	st := leasesFile{SavedAt: time.Now(), Leases: make([]Lease, 0, len(reg.leases))}
+	for _, l := range reg.leases {
+		st.Leases = append(st.Leases, l.view())
+	}
+	sort.Slice(st.Leases, func(i, j int) bool {
+		return st.Leases[i].ID < st.Leases[j].ID
+	})
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(reg.conf.File), filepath.Base(reg.conf.File)+".*"); err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, reg.conf.File)
+}
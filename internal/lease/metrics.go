@@ -0,0 +1,59 @@
+package lease
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type registryMetrics struct {
+	expirations *prometheus.CounterVec
+}
+
+var (
+	_ prometheus.Collector = (*Registry)(nil)
+
+	activeLeasesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("ipvs", "lease", "active"),
+		"Count of active real server leases",
+		[]string{"virtual_server"}, nil,
+	)
+)
+
+func newRegistryMetrics() *registryMetrics {
+	return &registryMetrics{
+		expirations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ipvs",
+			Subsystem: "lease",
+			Name:      "expirations_total",
+			Help:      "Count of expired real server leases",
+		}, []string{"virtual_server"}),
+	}
+}
+
+func (rm *registryMetrics) expired(vs string) {
+	rm.expirations.WithLabelValues(vs).Inc()
+}
+
+//Describe impl prometheus.Collector
+func (reg *Registry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeLeasesDesc
+	reg.metrics.expirations.Describe(ch)
+}
+
+//Collect impl prometheus.Collector
+func (reg *Registry) Collect(ch chan<- prometheus.Metric) {
+	active := make(map[string]float64, len(reg.allowed))
+	for vs := range reg.allowed {
+		active[vs] = 0
+	}
+	reg.mx.Lock()
+	for _, l := range reg.leases {
+		if !l.draining {
+			active[l.vs]++
+		}
+	}
+	reg.mx.Unlock()
+	for vs, n := range active {
+		ch <- prometheus.MustNewConstMetric(activeLeasesDesc, prometheus.GaugeValue, n, vs)
+	}
+	reg.metrics.expirations.Collect(ch)
+}
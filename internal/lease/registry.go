@@ -0,0 +1,417 @@
+package lease
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+var (
+	//ErrNotFound lease or virtual server is not found
+	ErrNotFound = errors.New("not found")
+
+	//ErrNotAllowed virtual server is not open for registration or owner is not allowed
+	ErrNotAllowed = errors.New("not allowed")
+
+	//ErrConflict real server slot is held by another owner
+	ErrConflict = errors.New("conflict")
+
+	//ErrLimit limit of leases is reached
+	ErrLimit = errors.New("limit is reached")
+
+	//ErrInvalid invalid request
+	ErrInvalid = errors.New("invalid argument")
+)
+
+type (
+	//RealServer real server is claimed by lease
+	RealServer struct {
+		Address         string `json:"address"`
+		PacketForwarder string `json:"packetForwarder"`
+		Weight          uint32 `json:"weight"`
+		UpperThreshold  uint32 `json:"upperThreshold,omitempty"`
+		LowerThreshold  uint32 `json:"lowerThreshold,omitempty"`
+	}
+
+	//RegisterRequest claims real server slot under virtual server
+	RegisterRequest struct {
+		Owner         string        `json:"owner"`
+		VirtualServer string        `json:"virtualServer"`
+		RealServer    RealServer    `json:"realServer"`
+		TTL           time.Duration `json:"-"`
+	}
+
+	//Lease registered real server
+	Lease struct {
+		ID            string     `json:"id"`
+		Owner         string     `json:"owner"`
+		VirtualServer string     `json:"virtualServer"`
+		RealServer    RealServer `json:"realServer"`
+		TTL           string     `json:"ttl"`
+		ExpiresAt     time.Time  `json:"expiresAt"`
+		Draining      bool       `json:"draining,omitempty"`
+	}
+
+	//Registry lease registry of real servers
+	Registry struct {
+		admin   ipvsAdm.Admin
+		conf    Config
+		allowed map[string]VirtualServerConfig
+		now     func() time.Time
+		metrics *registryMetrics
+
+		mx     sync.Mutex
+		leases map[string]*lease
+		slots  map[slotKey]string
+	}
+
+	lease struct {
+		id         string
+		owner      string
+		identity   ipvsAdm.VirtualServerIdentity
+		vs         string
+		realServer ipvsAdm.RealServer
+		ttl        time.Duration
+		expiresAt  time.Time
+		draining   bool
+	}
+
+	slotKey struct {
+		vs   string
+		addr ipvsAdm.Address
+	}
+)
+
+//NewRegistry makes lease registry
+func NewRegistry(admin ipvsAdm.Admin, conf Config) (*Registry, error) {
+	const api = "lease/NewRegistry"
+
+	if err := conf.Normalize(); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	ret := &Registry{
+		admin:   admin,
+		conf:    conf,
+		allowed: make(map[string]VirtualServerConfig),
+		now:     time.Now,
+		metrics: newRegistryMetrics(),
+		leases:  make(map[string]*lease),
+		slots:   make(map[slotKey]string),
+	}
+	for _, vs := range conf.VirtualServers {
+		identity, _ := ipvsAdm.ParseVirtualServerIdentity(vs.VirtualServer)
+		ret.allowed[ipvsAdm.IdentityString(identity)] = vs
+	}
+	if err := ret.load(); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	return ret, nil
+}
+
+//Register claims real server slot or renews the one is held by the same owner; real servers
+//are present in the kernel table but not held by leases are not taken over
+func (reg *Registry) Register(ctx context.Context, req RegisterRequest) (Lease, error) {
+	const api = "lease/Register"
+
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(req.VirtualServer)
+	if err != nil {
+		return Lease{}, errors.Wrapf(ErrInvalid, "%s: %v", api, err)
+	}
+	vs := ipvsAdm.IdentityString(identity)
+	if err = reg.checkOwner(vs, req.Owner); err != nil {
+		return Lease{}, errors.Wrap(err, api)
+	}
+	var rs ipvsAdm.RealServer
+	if rs, err = req.RealServer.toAdm(); err != nil {
+		return Lease{}, errors.Wrapf(ErrInvalid, "%s: %v", api, err)
+	}
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = reg.conf.DefaultTTL
+	}
+	if ttl > reg.conf.MaxTTL {
+		ttl = reg.conf.MaxTTL
+	}
+
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	key := slotKey{vs: vs, addr: rs.Address}
+	l := reg.leases[reg.slots[key]]
+	if l != nil && l.owner != req.Owner {
+		return Lease{}, errors.Wrapf(ErrConflict, "%s: real server '%s' of '%s' is held by '%s'",
+			api, rs.Address, vs, l.owner)
+	}
+	if l == nil {
+		if limit := reg.allowed[vs].MaxLeases; limit > 0 && reg.countLeases(vs) >= limit {
+			return Lease{}, errors.Wrapf(ErrLimit, "%s: '%s' has %v leases", api, vs, limit)
+		}
+		var present bool
+		if present, err = reg.isPresent(ctx, identity, rs.Address); err != nil {
+			return Lease{}, errors.Wrap(err, api)
+		}
+		if present {
+			return Lease{}, errors.Wrapf(ErrConflict, "%s: real server '%s' of '%s' is not registered by lease",
+				api, rs.Address, vs)
+		}
+		var id string
+		if id, err = newLeaseID(); err != nil {
+			return Lease{}, errors.Wrap(err, api)
+		}
+		l = &lease{id: id, owner: req.Owner, identity: identity, vs: vs}
+	}
+	err = reg.admin.UpdateRealServer(ctx, identity, rs, ipvsAdm.ForceAddIfNotExist{})
+	if err != nil {
+		if errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+			return Lease{}, errors.Wrapf(ErrNotFound, "%s: virtual server '%s'", api, vs)
+		}
+		return Lease{}, errors.Wrap(err, api)
+	}
+	l.realServer, l.ttl, l.draining = rs, ttl, false
+	l.expiresAt = reg.now().Add(ttl)
+	reg.leases[l.id] = l
+	reg.slots[key] = l.id
+	if err = reg.saveLocked(); err != nil {
+		logger.Errorf(ctx, "lease: save leases: %v", err)
+	}
+	logger.Debugf(ctx, "lease: '%s' holds real server '%s' of '%s' until %v",
+		l.owner, rs.Address, vs, l.expiresAt)
+	return l.view(), nil
+}
+
+//Renew renews lease by heartbeat
+func (reg *Registry) Renew(_ context.Context, id string, owner string) (Lease, error) {
+	const api = "lease/Renew"
+
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	l, err := reg.ownLease(id, owner)
+	if err != nil {
+		return Lease{}, errors.Wrap(err, api)
+	}
+	if l.draining {
+		return Lease{}, errors.Wrapf(ErrNotFound, "%s: lease '%s' is expired", api, id)
+	}
+	l.expiresAt = reg.now().Add(l.ttl)
+	return l.view(), nil
+}
+
+//Release deregisters real server and drops lease
+func (reg *Registry) Release(ctx context.Context, id string, owner string) error {
+	const api = "lease/Release"
+
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	l, err := reg.ownLease(id, owner)
+	if err != nil {
+		return errors.Wrap(err, api)
+	}
+	if err = reg.remove(ctx, l); err != nil {
+		return errors.Wrap(err, api)
+	}
+	logger.Infof(ctx, "lease: '%s' has released real server '%s' of '%s'",
+		l.owner, l.realServer.Address, l.vs)
+	return nil
+}
+
+//List lists leases; empty virtualServer means all
+func (reg *Registry) List(virtualServer string) []Lease {
+	if virtualServer != "" {
+		if identity, err := ipvsAdm.ParseVirtualServerIdentity(virtualServer); err == nil {
+			virtualServer = ipvsAdm.IdentityString(identity)
+		}
+	}
+	reg.mx.Lock()
+	ret := make([]Lease, 0, len(reg.leases))
+	for _, l := range reg.leases {
+		if virtualServer == "" || l.vs == virtualServer {
+			ret = append(ret, l.view())
+		}
+	}
+	reg.mx.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].VirtualServer != ret[j].VirtualServer {
+			return ret[i].VirtualServer < ret[j].VirtualServer
+		}
+		return ret[i].RealServer.Address < ret[j].RealServer.Address
+	})
+	return ret
+}
+
+//virtualServerOf virtual server of lease
+func (reg *Registry) virtualServerOf(id string) (string, bool) {
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	if l := reg.leases[id]; l != nil {
+		return l.vs, true
+	}
+	return "", false
+}
+
+//Run expires leases until context is done
+func (reg *Registry) Run(ctx context.Context) {
+	ticker := time.NewTicker(reg.conf.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reg.sweep(ctx)
+		}
+	}
+}
+
+func (reg *Registry) sweep(ctx context.Context) {
+	now := reg.now()
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	for _, l := range reg.leases {
+		if now.Before(l.expiresAt) {
+			continue
+		}
+		if !l.draining {
+			l.draining = true
+			reg.metrics.expired(l.vs)
+			logger.Warnf(ctx, "lease: '%s' lease of real server '%s' of '%s' is expired",
+				l.owner, l.realServer.Address, l.vs)
+			if reg.conf.DrainPeriod > 0 {
+				rs := l.realServer
+				rs.Weight = 0
+				err := reg.admin.UpdateRealServer(ctx, l.identity, rs)
+				if err != nil {
+					logger.Errorf(ctx, "lease: drain real server '%s' of '%s': %v", rs.Address, l.vs, err)
+				}
+				if err = reg.saveLocked(); err != nil {
+					logger.Errorf(ctx, "lease: save leases: %v", err)
+				}
+				continue
+			}
+		}
+		if now.Before(l.expiresAt.Add(reg.conf.DrainPeriod)) {
+			continue
+		}
+		if err := reg.remove(ctx, l); err != nil {
+			logger.Errorf(ctx, "lease: remove real server '%s' of '%s': %v", l.realServer.Address, l.vs, err)
+		}
+	}
+}
+
+func (reg *Registry) remove(ctx context.Context, l *lease) error {
+	err := reg.admin.RemoveRealServer(ctx, l.identity, l.realServer.Address, ipvsAdm.KeepCalmIfNotExist{})
+	if err != nil && !errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+		return err
+	}
+	delete(reg.leases, l.id)
+	delete(reg.slots, slotKey{vs: l.vs, addr: l.realServer.Address})
+	if err = reg.saveLocked(); err != nil {
+		logger.Errorf(ctx, "lease: save leases: %v", err)
+	}
+	return nil
+}
+
+//isPresent tells if real server is present in the kernel table
+func (reg *Registry) isPresent(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, addr ipvsAdm.Address) (bool, error) {
+	var ret bool
+	err := reg.admin.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+		ret = ret || rs.Address == addr
+		return nil
+	})
+	if errors.Is(err, ipvsAdm.ErrVirtualServerNotExist) {
+		return false, nil
+	}
+	return ret, err
+}
+
+func (reg *Registry) checkOwner(vs string, owner string) error {
+	if owner == "" {
+		return errors.Wrap(ErrInvalid, "owner is empty")
+	}
+	conf, ok := reg.allowed[vs]
+	if !ok {
+		return errors.Wrapf(ErrNotAllowed, "virtual server '%s' is not open for registration", vs)
+	}
+	if len(conf.Owners) == 0 {
+		return nil
+	}
+	for _, o := range conf.Owners {
+		if ok, _ := path.Match(o, owner); ok {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrNotAllowed, "owner '%s' may not register in '%s'", owner, vs)
+}
+
+func (reg *Registry) ownLease(id string, owner string) (*lease, error) {
+	l := reg.leases[id]
+	if l == nil {
+		return nil, errors.Wrapf(ErrNotFound, "lease '%s'", id)
+	}
+	if l.owner != owner {
+		return nil, errors.Wrapf(ErrNotAllowed, "lease '%s' is held by another owner", id)
+	}
+	return l, nil
+}
+
+func (reg *Registry) countLeases(vs string) int {
+	var n int
+	for _, l := range reg.leases {
+		if l.vs == vs {
+			n++
+		}
+	}
+	return n
+}
+
+func (l *lease) view() Lease {
+	return Lease{
+		ID:            l.id,
+		Owner:         l.owner,
+		VirtualServer: l.vs,
+		RealServer: RealServer{
+			Address:         string(l.realServer.Address),
+			PacketForwarder: string(l.realServer.PacketForwarder),
+			Weight:          l.realServer.Weight,
+			UpperThreshold:  l.realServer.UpperThreshold,
+			LowerThreshold:  l.realServer.LowerThreshold,
+		},
+		TTL:       l.ttl.String(),
+		ExpiresAt: l.expiresAt,
+		Draining:  l.draining,
+	}
+}
+
+func (rs RealServer) toAdm() (ipvsAdm.RealServer, error) {
+	ret := ipvsAdm.RealServer{
+		Address:         ipvsAdm.Address(rs.Address),
+		PacketForwarder: ipvsAdm.PacketForwarder(rs.PacketForwarder),
+		Weight:          rs.Weight,
+		UpperThreshold:  rs.UpperThreshold,
+		LowerThreshold:  rs.LowerThreshold,
+	}
+	if _, _, err := ret.Address.ToHostPort(); err != nil {
+		return ret, err
+	}
+	if err := ret.PacketForwarder.Valid(); err != nil {
+		return ret, err
+	}
+	if ret.LowerThreshold > ret.UpperThreshold {
+		return ret, errors.Errorf("lowerThreshold(%v) > upperThreshold(%v)", ret.LowerThreshold, ret.UpperThreshold)
+	}
+	return ret, nil
+}
+
+func newLeaseID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,141 @@
+package lease
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func Test_Leases(t *testing.T) {
+	const vs = "tcp://10.0.0.1:80"
+	ctx := context.Background()
+	adm := ipvsAdm.NewMemoryAdmin()
+	id, _ := ipvsAdm.ParseVirtualServerIdentity(vs)
+	err := adm.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: id, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	dir, err := ioutil.TempDir("", "leases")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	conf := Config{
+		File:        filepath.Join(dir, "leases.json"),
+		DefaultTTL:  10 * time.Second,
+		DrainPeriod: 5 * time.Second,
+		VirtualServers: []VirtualServerConfig{
+			{VirtualServer: vs, Owners: []string{"a", "b"}, MaxLeases: 2},
+		},
+	}
+	reg, err := NewRegistry(adm, conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	reg.now = func() time.Time { return now }
+	reals := func() map[ipvsAdm.Address]uint32 {
+		ret := make(map[ipvsAdm.Address]uint32)
+		_ = adm.ListRealServers(ctx, id, func(rs ipvsAdm.RealServer) error {
+			ret[rs.Address] = rs.Weight
+			return nil
+		})
+		return ret
+	}
+
+	rs := RealServer{Address: "10.1.1.1:80", PacketForwarder: "dr", Weight: 3}
+	l, err := reg.Register(ctx, RegisterRequest{Owner: "a", VirtualServer: vs, RealServer: rs})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.1.1.1:80": 3}, reals())
+
+	_, err = reg.Register(ctx, RegisterRequest{Owner: "b", VirtualServer: vs, RealServer: rs})
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = reg.Register(ctx, RegisterRequest{Owner: "c", VirtualServer: vs, RealServer: rs})
+	assert.ErrorIs(t, err, ErrNotAllowed)
+	_, err = reg.Register(ctx, RegisterRequest{Owner: "a", VirtualServer: "tcp://10.0.0.2:80", RealServer: rs})
+	assert.ErrorIs(t, err, ErrNotAllowed)
+	_, err = reg.Renew(ctx, l.ID, "b")
+	assert.ErrorIs(t, err, ErrNotAllowed)
+
+	l2, err := reg.Register(ctx, RegisterRequest{Owner: "b", VirtualServer: vs,
+		RealServer: RealServer{Address: "10.1.1.2:80", PacketForwarder: "dr", Weight: 1}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = reg.Register(ctx, RegisterRequest{Owner: "b", VirtualServer: vs,
+		RealServer: RealServer{Address: "10.1.1.3:80", PacketForwarder: "dr", Weight: 1}})
+	assert.ErrorIs(t, err, ErrLimit)
+
+	now = now.Add(8 * time.Second)
+	_, err = reg.Renew(ctx, l.ID, "a")
+	assert.NoError(t, err)
+	now = now.Add(4 * time.Second)
+	reg.sweep(ctx)
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.1.1.1:80": 3, "10.1.1.2:80": 0}, reals())
+	if leases := reg.List(vs); assert.Len(t, leases, 2) {
+		assert.True(t, leases[1].Draining)
+	}
+	_, err = reg.Renew(ctx, l2.ID, "b")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	now = now.Add(5 * time.Second)
+	reg.sweep(ctx)
+	assert.Equal(t, map[ipvsAdm.Address]uint32{"10.1.1.1:80": 3}, reals())
+	assert.Len(t, reg.List(""), 1)
+
+	//real servers are not registered by leases are not taken over
+	assert.NoError(t, adm.UpdateRealServer(ctx, id, ipvsAdm.RealServer{Address: "10.1.1.9:80", PacketForwarder: "dr", Weight: 1},
+		ipvsAdm.ForceAddIfNotExist{}))
+	_, err = reg.Register(ctx, RegisterRequest{Owner: "a", VirtualServer: vs,
+		RealServer: RealServer{Address: "10.1.1.9:80", PacketForwarder: "dr", Weight: 5}})
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.NoError(t, adm.RemoveRealServer(ctx, id, "10.1.1.9:80"))
+
+	//leases outlive restart of registry
+	if reg, err = NewRegistry(adm, conf); !assert.NoError(t, err) {
+		return
+	}
+	if leases := reg.List(vs); assert.Len(t, leases, 1) {
+		assert.Equal(t, l.ID, leases[0].ID)
+		assert.Equal(t, "a", leases[0].Owner)
+	}
+	_, err = reg.Register(ctx, RegisterRequest{Owner: "a", VirtualServer: vs, RealServer: rs})
+	assert.NoError(t, err)
+
+	//owner of lease is principal of caller
+	srv := httptest.NewServer(NewHandler(reg, nil, func(ctx context.Context) []string {
+		return []string{"a"}
+	}))
+	defer srv.Close()
+	body, _ := json.Marshal(map[string]interface{}{"owner": "b"})
+	resp, err := http.Post(srv.URL+"/"+l.ID+"/heartbeat", "application/json", bytes.NewReader(body))
+	if assert.NoError(t, err) {
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	resp, err = http.Post(srv.URL+"/"+l.ID+"/heartbeat", "application/json", bytes.NewReader([]byte("{}")))
+	if assert.NoError(t, err) {
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/"+l.ID+"?owner=a", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	assert.Empty(t, reals())
+}
@@ -0,0 +1,43 @@
+package meta
+
+import (
+	"context"
+
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+type forgettingAdmin struct {
+	ipvsAdm.Admin
+	store *Store
+}
+
+//Admin wraps admin; metadata of removed virtual and real servers is dropped
+func (s *Store) Admin(admin ipvsAdm.Admin) ipvsAdm.Admin {
+	return &forgettingAdmin{Admin: admin, store: s}
+}
+
+//RemoveVirtualServer impl ipvsAdm.Admin
+func (impl *forgettingAdmin) RemoveVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, opts ...ipvsAdm.AdminOption) error {
+	if err := impl.Admin.RemoveVirtualServer(ctx, identity, opts...); err != nil {
+		return err
+	}
+	impl.forget(ctx, identity, "")
+	return nil
+}
+
+//RemoveRealServer impl ipvsAdm.Admin
+func (impl *forgettingAdmin) RemoveRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, address ipvsAdm.Address, opts ...ipvsAdm.AdminOption) error {
+	if err := impl.Admin.RemoveRealServer(ctx, identity, address, opts...); err != nil {
+		return err
+	}
+	impl.forget(ctx, identity, address)
+	return nil
+}
+
+//forget the kernel table is already changed, so failed save is only reported
+func (impl *forgettingAdmin) forget(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, address ipvsAdm.Address) {
+	if err := impl.store.forget(identity, address); err != nil {
+		logger.Errorf(ctx, "meta: save '%s': %v", impl.store.conf.File, err)
+	}
+}
@@ -0,0 +1,111 @@
+package meta
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/ipvs/internal/httpjson"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type (
+	//Guard refuses caller to replace metadata of item with the given one
+	Guard func(ctx context.Context, it Item) error
+
+	handler struct {
+		s     *Store
+		guard Guard
+	}
+)
+
+//NewHandler makes http.Handler exposes metadata as JSON; guard (if any) checks every change
+//
+//	GET    /?selector=...&virtual-server=...       - list items with labels are matched by selector
+//	PUT    /                                       - {"virtualServer", "realServer", "labels", "annotations"} replaces metadata
+//	DELETE /?virtual-server=...&real-server=...    - removes metadata
+func NewHandler(s *Store, guard Guard) http.Handler {
+	return &handler{s: s, guard: guard}
+}
+
+//ServeHTTP impl http.Handler
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Trim(r.URL.Path, "/") != "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		var sel labels.Selector
+		if v := q.Get("selector"); v != "" {
+			var err error
+			if sel, err = ParseSelector(v); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		vs := q.Get("virtual-server")
+		if vs != "" {
+			it := Item{VirtualServer: vs}
+			if _, err := it.normalize(); err != nil {
+				writeError(w, err)
+				return
+			}
+			vs = it.VirtualServer
+		}
+		items := h.s.List(sel, vs)
+		if items == nil {
+			items = []Item{}
+		}
+		httpjson.Write(w, http.StatusOK, struct {
+			Items []Item `json:"items"`
+		}{items})
+	case http.MethodPut:
+		var it Item
+		if err := httpjson.Decode(w, r, 256*1024, &it); err != nil {
+			writeError(w, errors.Wrapf(ErrInvalid, "decode request: %v", err))
+			return
+		}
+		it, err := h.set(r.Context(), it)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, it)
+	case http.MethodDelete:
+		if _, err := h.set(r.Context(), Item{VirtualServer: q.Get("virtual-server"), RealServer: q.Get("real-server")}); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) set(ctx context.Context, it Item) (Item, error) {
+	if _, err := it.normalize(); err != nil {
+		return Item{}, errors.Wrap(err, "meta/set")
+	}
+	if h.guard != nil {
+		if err := h.guard(ctx, it); err != nil {
+			return Item{}, err
+		}
+	}
+	return h.s.Set(it)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if _, ok := status.FromError(err); ok {
+		httpjson.Status(w, err)
+		return
+	}
+	code := http.StatusInternalServerError
+	if errors.Is(err, ErrInvalid) {
+		code = http.StatusBadRequest
+	}
+	httpjson.Error(w, code, err)
+}
@@ -0,0 +1,249 @@
+package meta
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+/*//Sample of config
+metadata:
+  file: /var/lib/ipvs/metadata.json
+*/
+
+//ErrInvalid invalid item or selector
+var ErrInvalid = errors.New("invalid metadata")
+
+type (
+	//Config metadata store config
+	Config struct {
+		File string
+	}
+
+	//Item labels and annotations of virtual server or, if RealServer is set, of real server
+	Item struct {
+		VirtualServer string            `json:"virtualServer"`
+		RealServer    string            `json:"realServer,omitempty"`
+		Labels        map[string]string `json:"labels,omitempty"`
+		Annotations   map[string]string `json:"annotations,omitempty"`
+	}
+
+	//Store keeps labels and annotations of virtual and real servers
+	Store struct {
+		conf Config
+
+		mx    sync.RWMutex
+		items map[itemKey]Item
+	}
+
+	itemKey struct {
+		virtualServer string
+		realServer    string
+	}
+
+	metaFile struct {
+		SavedAt time.Time `json:"savedAt"`
+		Items   []Item    `json:"items"`
+	}
+)
+
+//Open opens store and loads metadata saved before; metadata is kept in memory when no file is specified
+func Open(conf Config) (*Store, error) {
+	const api = "meta/Open"
+
+	ret := &Store{conf: conf, items: make(map[itemKey]Item)}
+	if conf.File == "" {
+		return ret, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.File), 0700); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	data, err := ioutil.ReadFile(conf.File)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	var st metaFile
+	if err = json.Unmarshal(data, &st); err != nil {
+		return nil, errors.Wrapf(err, "%s: '%s'", api, conf.File)
+	}
+	for _, it := range st.Items {
+		var key itemKey
+		if key, err = it.normalize(); err != nil {
+			return nil, errors.Wrapf(err, "%s: '%s'", api, conf.File)
+		}
+		ret.items[key] = it
+	}
+	return ret, nil
+}
+
+//ParseSelector parses label selector like 'team=a,env in (prod,stage),!legacy'
+func ParseSelector(s string) (labels.Selector, error) {
+	sel, err := labels.Parse(s)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalid, "selector '%s': %v", s, err)
+	}
+	return sel, nil
+}
+
+//Set replaces metadata of item; item without labels and annotations is removed
+func (s *Store) Set(it Item) (Item, error) {
+	const api = "meta/Set"
+
+	key, err := it.normalize()
+	if err != nil {
+		return Item{}, errors.Wrap(err, api)
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	prev, had := s.items[key]
+	if len(it.Labels) == 0 && len(it.Annotations) == 0 {
+		delete(s.items, key)
+	} else {
+		s.items[key] = it
+	}
+	if err = s.saveLocked(); err != nil {
+		if had {
+			s.items[key] = prev
+		} else {
+			delete(s.items, key)
+		}
+		return Item{}, errors.Wrap(err, api)
+	}
+	return it, nil
+}
+
+//Get metadata of virtual server or, if realServer is not empty, of real server
+func (s *Store) Get(virtualServer ipvsAdm.VirtualServerIdentity, realServer ipvsAdm.Address) Item {
+	key := itemKey{virtualServer: ipvsAdm.IdentityString(virtualServer), realServer: string(realServer)}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if it, ok := s.items[key]; ok {
+		return it
+	}
+	return Item{VirtualServer: key.virtualServer, RealServer: key.realServer}
+}
+
+//List lists items with labels are matched by selector; nil selector matches all
+func (s *Store) List(sel labels.Selector, virtualServer string) []Item {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	var ret []Item
+	for key, it := range s.items {
+		if virtualServer != "" && key.virtualServer != virtualServer {
+			continue
+		}
+		if sel == nil || sel.Matches(labels.Set(it.Labels)) {
+			ret = append(ret, it)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].VirtualServer != ret[j].VirtualServer {
+			return ret[i].VirtualServer < ret[j].VirtualServer
+		}
+		return ret[i].RealServer < ret[j].RealServer
+	})
+	return ret
+}
+
+//Matches tells if labels of virtual server or, if realServer is not empty, of real server are matched by selector
+func (s *Store) Matches(sel labels.Selector, virtualServer ipvsAdm.VirtualServerIdentity, realServer ipvsAdm.Address) bool {
+	if sel == nil {
+		return true
+	}
+	return sel.Matches(labels.Set(s.Get(virtualServer, realServer).Labels))
+}
+
+func (s *Store) forget(virtualServer ipvsAdm.VirtualServerIdentity, realServer ipvsAdm.Address) error {
+	vs := ipvsAdm.IdentityString(virtualServer)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	var n int
+	for key := range s.items {
+		if key.virtualServer == vs && (realServer == "" || key.realServer == string(realServer)) {
+			delete(s.items, key)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+//saveLocked writes store file atomically
+func (s *Store) saveLocked() error {
+	if s.conf.File == "" {
+		return nil
+	}
+	st := metaFile{SavedAt: time.Now(), Items: make([]Item, 0, len(s.items))}
+	for _, it := range s.items {
+		st.Items = append(st.Items, it)
+	}
+	sort.Slice(st.Items, func(i, j int) bool {
+		if st.Items[i].VirtualServer != st.Items[j].VirtualServer {
+			return st.Items[i].VirtualServer < st.Items[j].VirtualServer
+		}
+		return st.Items[i].RealServer < st.Items[j].RealServer
+	})
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(s.conf.File), filepath.Base(s.conf.File)+".*"); err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.conf.File)
+}
+
+//normalize validates item and brings its virtual server to canonical form
+func (it *Item) normalize() (itemKey, error) {
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(it.VirtualServer)
+	if err != nil {
+		return itemKey{}, errors.Wrapf(ErrInvalid, "virtual server '%s': %v", it.VirtualServer, err)
+	}
+	it.VirtualServer = ipvsAdm.IdentityString(identity)
+	if it.RealServer != "" {
+		if _, _, err = ipvsAdm.Address(it.RealServer).ToHostPort(); err != nil {
+			return itemKey{}, errors.Wrapf(ErrInvalid, "real server '%s': %v", it.RealServer, err)
+		}
+	}
+	for k, v := range it.Labels {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return itemKey{}, errors.Wrapf(ErrInvalid, "label key '%s': %s", k, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return itemKey{}, errors.Wrapf(ErrInvalid, "label '%s' value '%s': %s", k, v, strings.Join(errs, "; "))
+		}
+	}
+	for k := range it.Annotations {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return itemKey{}, errors.Wrapf(ErrInvalid, "annotation key '%s': %s", k, strings.Join(errs, "; "))
+		}
+	}
+	return itemKey{virtualServer: it.VirtualServer, realServer: it.RealServer}, nil
+}
@@ -0,0 +1,91 @@
+package meta
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_Store(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "meta")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	conf := Config{File: filepath.Join(dir, "metadata.json")}
+	s, err := Open(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	vs1, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	vs2, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.2:80")
+
+	_, err = s.Set(Item{VirtualServer: "TCP://10.0.0.1:80", Labels: map[string]string{"team": "a", "env": "prod"},
+		Annotations: map[string]string{"owner": "Team A <a@example.com>"}})
+	assert.NoError(t, err)
+	_, err = s.Set(Item{VirtualServer: "tcp://10.0.0.1:80", RealServer: "10.0.1.1:80", Labels: map[string]string{"zone": "z1"}})
+	assert.NoError(t, err)
+	_, err = s.Set(Item{VirtualServer: "tcp://10.0.0.2:80", Labels: map[string]string{"team": "b", "env": "stage"}})
+	assert.NoError(t, err)
+	_, err = s.Set(Item{VirtualServer: "tcp://10.0.0.2:80", Labels: map[string]string{"bad key": "x"}})
+	assert.ErrorIs(t, err, ErrInvalid)
+	_, err = ParseSelector("env in (prod")
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	sel, err := ParseSelector("env in (prod,test),team")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, s.Matches(sel, vs1, ""))
+	assert.False(t, s.Matches(sel, vs2, ""))
+	if items := s.List(sel, ""); assert.Len(t, items, 1) {
+		assert.Equal(t, "tcp://10.0.0.1:80", items[0].VirtualServer)
+	}
+
+	//metadata survives restart and goes away with its virtual server
+	s, err = Open(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, s.List(nil, ""), 3)
+	kernel := ipvsAdm.NewMemoryAdmin()
+	assert.NoError(t, kernel.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: vs1, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	assert.NoError(t, s.Admin(kernel).RemoveVirtualServer(ctx, vs1))
+	assert.Len(t, s.List(nil, ""), 1)
+
+	h := NewHandler(s, func(_ context.Context, it Item) error {
+		if it.Labels["team"] == "root" {
+			return status.Error(codes.PermissionDenied, "denied")
+		}
+		return nil
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/",
+		bytes.NewBufferString(`{"virtualServer":"udp://10.0.0.3:53","labels":{"team":"c"}}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/",
+		bytes.NewBufferString(`{"virtualServer":"udp://10.0.0.3:53","labels":{"team":"root"}}`)))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?selector=team%3Dc", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"virtualServer":"udp://10.0.0.3:53"`)
+	assert.NotContains(t, w.Body.String(), `10.0.0.2`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/?virtual-server=udp://10.0.0.3:53", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Len(t, s.List(nil, ""), 1)
+}
@@ -0,0 +1,191 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	pkgNet "github.com/thataway/common-lib/pkg/net"
+	"github.com/thataway/ipvs/internal/caller"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/metadata"
+)
+
+//ClientSubjectMetadata subject of verified client certificate is passed to API in
+const ClientSubjectMetadata = "x-ipvs-client-subject"
+
+//gatewayPrefix headers with it are passed to gRPC metadata by gateway
+const gatewayPrefix = "Grpc-Metadata-"
+
+//Front terminates mutual TLS on public endpoint and proxies gRPC and HTTP calls to API server
+//listening on internal endpoint; internal endpoint must not be reachable by others
+//because client subject is trusted on connections accepted on it (see caller.TrustedProxy)
+type Front struct {
+	reloader *Reloader
+	backend  *pkgNet.Endpoint
+	grpc     *httputil.ReverseProxy
+	http     *httputil.ReverseProxy
+
+	errMx   sync.Mutex
+	lastErr string
+}
+
+//NewFront makes front of API server is listening on backend endpoint
+func NewFront(reloader *Reloader, backend *pkgNet.Endpoint) (*Front, error) {
+	addr, err := backend.Address()
+	if err != nil {
+		return nil, errors.Wrap(err, "mtls/NewFront")
+	}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, backend.Network(), addr)
+	}
+	ret := &Front{reloader: reloader, backend: backend}
+	ret.grpc = &httputil.ReverseProxy{
+		Director:      ret.director,
+		FlushInterval: -1,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(string, string, *tls.Config) (net.Conn, error) {
+				return dial(context.Background())
+			},
+		},
+		ErrorHandler: ret.proxyError,
+	}
+	ret.http = &httputil.ReverseProxy{
+		Director:      ret.director,
+		FlushInterval: -1,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dial(ctx)
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     time.Minute,
+		},
+		ErrorHandler: ret.proxyError,
+	}
+	return ret, nil
+}
+
+//Serve serves public endpoint until context is done
+func (f *Front) Serve(ctx context.Context, endpoint *pkgNet.Endpoint) error {
+	const api = "mtls/Serve"
+
+	l, err := pkgNet.Listen(endpoint)
+	if err != nil {
+		return errors.Wrap(err, api)
+	}
+	conf := f.reloader.TLSConfig()
+	getConf := conf.GetConfigForClient
+	conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		ret, e := getConf(hello)
+		f.reportReload(ctx)
+		return ret, e
+	}
+	srv := &http.Server{
+		Handler:   f,
+		TLSConfig: conf,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	logger.Infof(ctx, "mtls: '%s' is served by TLS and proxied to '%s'", endpoint.FQN(), f.backend.FQN())
+	err = srv.ServeTLS(l, "", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return errors.Wrap(err, api)
+}
+
+//ServeHTTP impl http.Handler
+func (f *Front) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//client must not tell its identity
+	for k := range r.Header {
+		if strings.EqualFold(k, ClientSubjectMetadata) || strings.EqualFold(k, gatewayPrefix+ClientSubjectMetadata) {
+			r.Header.Del(k)
+		}
+	}
+	r.Header.Del("X-Forwarded-For")
+	subject := ""
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		subject = Subject(r.TLS.PeerCertificates[0])
+	}
+	if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		r.Header.Set(ClientSubjectMetadata, subject)
+		f.grpc.ServeHTTP(w, r)
+		return
+	}
+	r.Header.Set(gatewayPrefix+ClientSubjectMetadata, subject)
+	f.http.ServeHTTP(w, r)
+}
+
+func (f *Front) director(r *http.Request) {
+	r.URL.Scheme = "http"
+	r.URL.Host = "ipvs"
+	r.Host = "ipvs"
+}
+
+func (f *Front) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Errorf(r.Context(), "mtls: proxy '%s' to '%s': %v", r.URL.Path, f.backend.FQN(), err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func (f *Front) reportReload(ctx context.Context) {
+	var msg string
+	if err := f.reloader.LastError(); err != nil {
+		msg = err.Error()
+	}
+	f.errMx.Lock()
+	defer f.errMx.Unlock()
+	if msg == f.lastErr {
+		return
+	}
+	if f.lastErr = msg; msg != "" {
+		logger.Errorf(ctx, "mtls: reload certificates, previous ones are still in use: %s", msg)
+	} else {
+		logger.Info(ctx, "mtls: certificates are reloaded")
+	}
+}
+
+//Subject identity of client certificate; common name or, if it is empty, the full subject
+func Subject(cert *x509.Certificate) string {
+	if cn := cert.Subject.CommonName; cn != "" {
+		return cn
+	}
+	return cert.Subject.String()
+}
+
+//ClientSubject subject of client certificate the call is made with; empty if TLS is not in use;
+//subject is trusted only when it is told by front, so calls over other connections have no one
+func ClientSubject(ctx context.Context) string {
+	if !caller.FromTrustedProxy(ctx) {
+		return ""
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(ClientSubjectMetadata); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+//Principals principal of caller is identified by client certificate, like 'mtls:<subject>'
+func Principals(ctx context.Context) []string {
+	if s := ClientSubject(ctx); s != "" {
+		return []string{"mtls:" + s}
+	}
+	return nil
+}
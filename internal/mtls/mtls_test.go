@@ -0,0 +1,228 @@
+package mtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pkgNet "github.com/thataway/common-lib/pkg/net"
+	"github.com/thataway/ipvs/internal/caller"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+//issue gives PEM of certificate and key
+func (ca *testCA) issue(t *testing.T, cn string, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func Test_Front(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	write := func(name string, data []byte) string {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	certPem, keyPem := ca.issue(t, "ipvs", 10, x509.ExtKeyUsageServerAuth)
+	conf := Config{
+		Cert:     write("server.crt", certPem),
+		Key:      write("server.key", keyPem),
+		ClientCA: write("ca.crt", ca.pem),
+	}
+	reloader, err := NewReloader(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	//API server behind front: gRPC and HTTP on one plain socket
+	var mx sync.Mutex
+	var grpcSubjects []string
+	grpcSrv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		//subject is told by calls over connection from front only
+		assert.Empty(t, ClientSubject(ctx))
+		p, _ := peer.FromContext(ctx)
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: p.Addr, AuthInfo: caller.ProxyAuthInfo{}})
+		mx.Lock()
+		grpcSubjects = append(grpcSubjects, ClientSubject(ctx))
+		mx.Unlock()
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(grpcSrv, health.NewServer())
+	backendHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcSrv.ServeHTTP(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(r.Header.Get(gatewayPrefix + ClientSubjectMetadata)))
+	})
+	sock := filepath.Join(dir, "internal.sock")
+	backendL, err := net.Listen("unix", sock)
+	if !assert.NoError(t, err) {
+		return
+	}
+	backend := &http.Server{Handler: h2c.NewHandler(backendHandler, &http2.Server{})}
+	go func() { _ = backend.Serve(backendL) }()
+	defer backend.Close()
+
+	internal, _ := pkgNet.ParseEndpoint("unix://" + sock)
+	front, err := NewFront(reloader, internal)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	_ = l.Close()
+	public, _ := pkgNet.ParseEndpoint("tcp://" + addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = front.Serve(ctx, public) }()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientPem, clientKeyPem := ca.issue(t, "operator", 20, x509.ExtKeyUsageClientAuth)
+	clientCert, _ := tls.X509KeyPair(clientPem, clientKeyPem)
+	clientConf := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}
+
+	httpClient := func(c *tls.Config) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: c}, Timeout: 5 * time.Second}
+	}
+	var resp *http.Response
+	assert.Eventually(t, func() bool {
+		resp, err = httpClient(clientConf).Get("https://" + addr + "/v1/anything")
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, "operator", string(body))
+	}
+
+	//client without certificate is refused
+	_, err = httpClient(&tls.Config{RootCAs: roots}).Get("https://" + addr + "/v1/anything")
+	assert.Error(t, err)
+
+	//client can not tell its subject itself
+	req, _ := http.NewRequest(http.MethodGet, "https://"+addr+"/v1/anything", nil)
+	req.Header.Set(gatewayPrefix+ClientSubjectMetadata, "admin")
+	if resp, err = httpClient(clientConf).Do(req); assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, "operator", string(body))
+	}
+
+	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientConf)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cc.Close()
+	hr, err := grpc_health_v1.NewHealthClient(cc).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, hr.GetStatus())
+	}
+	mx.Lock()
+	assert.Equal(t, []string{"operator"}, grpcSubjects)
+	mx.Unlock()
+
+	//server certificate is reloaded without restart
+	certPem, keyPem = ca.issue(t, "ipvs", 11, x509.ExtKeyUsageServerAuth)
+	write("server.crt", certPem)
+	write("server.key", keyPem)
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(conf.Cert, later, later)
+	_ = os.Chtimes(conf.Key, later, later)
+	var conn *tls.Conn
+	if conn, err = tls.Dial("tcp", addr, clientConf); assert.NoError(t, err) {
+		assert.Equal(t, int64(11), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+		_ = conn.Close()
+	}
+	assert.NoError(t, reloader.LastError())
+
+	//broken files leave previous certificates in use
+	write("server.key", []byte("garbage"))
+	_ = os.Chtimes(conf.Key, later.Add(time.Minute), later.Add(time.Minute))
+	if conn, err = tls.Dial("tcp", addr, clientConf); assert.NoError(t, err) {
+		assert.Equal(t, int64(11), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+		_ = conn.Close()
+	}
+	assert.Error(t, reloader.LastError())
+
+	for _, c := range []Config{
+		{Cert: conf.Cert, Key: conf.Key},
+		{Cert: conf.Cert, ClientCA: conf.ClientCA},
+		{Cert: conf.Cert, Key: conf.Key, ClientCA: conf.ClientCA, MinVersion: "0.9"},
+	} {
+		_, err = NewReloader(c)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,164 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*//Sample of config
+server:
+  endpoint: tcp://0.0.0.0:9006
+  tls:
+    cert: /etc/ipvs/tls/server.crt
+    key: /etc/ipvs/tls/server.key
+    client-ca: /etc/ipvs/tls/clients-ca.crt
+    min-version: "1.2"
+    internal-endpoint: unix:///run/ipvs/api/internal.sock
+*/
+
+type (
+	//Config TLS config; client certificates are required and verified by client CA
+	Config struct {
+		Cert       string
+		Key        string
+		ClientCA   string
+		MinVersion string
+	}
+
+	//Reloader gives TLS config which follows changes of certificate, key and client CA files
+	Reloader struct {
+		conf       Config
+		minVersion uint16
+
+		mx      sync.Mutex
+		stamps  [3]time.Time
+		current *tls.Config
+		lastErr error
+	}
+)
+
+//NewReloader loads certificates; later they are reloaded on handshakes when files are changed
+func NewReloader(conf Config) (*Reloader, error) {
+	const api = "mtls/NewReloader"
+
+	if conf.Cert == "" || conf.Key == "" {
+		return nil, errors.Errorf("%s: cert and key are required", api)
+	}
+	if conf.ClientCA == "" {
+		return nil, errors.Errorf("%s: client-ca is required", api)
+	}
+	ret := &Reloader{conf: conf}
+	var err error
+	if ret.minVersion, err = ParseVersion(conf.MinVersion); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	if err = ret.reload(); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	return ret, nil
+}
+
+//TLSConfig server config; every handshake gets the latest loaded certificates
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c := r.config()
+			return &c.Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config(), nil
+		},
+	}
+}
+
+//LastError error of latest reload; nil if certificates are up to date
+func (r *Reloader) LastError() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.lastErr
+}
+
+//config reloads files if they are changed; on failure previous certificates stay in use
+func (r *Reloader) config() *tls.Config {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	stamps, err := r.modTimes()
+	if err == nil && stamps == r.stamps {
+		return r.current
+	}
+	if err == nil {
+		err = r.reloadLocked()
+	}
+	r.lastErr = err
+	return r.current
+}
+
+func (r *Reloader) reload() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.reloadLocked()
+}
+
+func (r *Reloader) reloadLocked() error {
+	stamps, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(r.conf.Cert, r.conf.Key); err != nil {
+		return errors.Wrap(err, "load key pair")
+	}
+	var pem []byte
+	if pem, err = ioutil.ReadFile(r.conf.ClientCA); err != nil {
+		return errors.Wrap(err, "load client CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.Errorf("no certificates are found in '%s'", r.conf.ClientCA)
+	}
+	r.current = &tls.Config{
+		MinVersion:   r.minVersion,
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	r.stamps = stamps
+	return nil
+}
+
+func (r *Reloader) modTimes() ([3]time.Time, error) {
+	var ret [3]time.Time
+	for i, f := range []string{r.conf.Cert, r.conf.Key, r.conf.ClientCA} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return ret, err
+		}
+		ret[i] = st.ModTime()
+	}
+	return ret, nil
+}
+
+//ParseVersion parses TLS version like '1.2'; empty string means 1.2
+func ParseVersion(s string) (uint16, error) {
+	switch strings.TrimSpace(s) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	}
+	return 0, errors.Errorf("unsupported TLS version '%s'", s)
+}
@@ -0,0 +1,124 @@
+package notify
+
+import (
+	"context"
+
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+type notifyingAdmin struct {
+	ipvsAdm.Admin
+	n      *Notifier
+	source string
+}
+
+//Admin wraps admin; successful mutations which change the kernel table are published as events of source
+func (n *Notifier) Admin(admin ipvsAdm.Admin, source string) ipvsAdm.Admin {
+	if n == nil || len(n.hooks) == 0 {
+		return admin
+	}
+	return &notifyingAdmin{Admin: admin, n: n, source: source}
+}
+
+//UpdateVirtualServer impl ipvsAdm.Admin
+func (impl *notifyingAdmin) UpdateVirtualServer(ctx context.Context, vs ipvsAdm.VirtualServer, opts ...ipvsAdm.AdminOption) error {
+	before, found := impl.findVirtualServer(ctx, vs.Identity)
+	if err := impl.Admin.UpdateVirtualServer(ctx, vs, opts...); err != nil {
+		return err
+	}
+	op := OpAdd
+	if found {
+		if before.ScheduleMethod == vs.ScheduleMethod {
+			return nil
+		}
+		op = OpUpdate
+	}
+	impl.n.Publish(ctx, Event{
+		Source:        impl.source,
+		Op:            op,
+		VirtualServer: ipvsAdm.IdentityString(vs.Identity),
+		State:         &State{ScheduleMethod: string(vs.ScheduleMethod)},
+	})
+	return nil
+}
+
+//RemoveVirtualServer impl ipvsAdm.Admin
+func (impl *notifyingAdmin) RemoveVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, opts ...ipvsAdm.AdminOption) error {
+	_, found := impl.findVirtualServer(ctx, identity)
+	if err := impl.Admin.RemoveVirtualServer(ctx, identity, opts...); err != nil || !found {
+		return err
+	}
+	impl.n.Publish(ctx, Event{
+		Source:        impl.source,
+		Op:            OpRemove,
+		VirtualServer: ipvsAdm.IdentityString(identity),
+	})
+	return nil
+}
+
+//UpdateRealServer impl ipvsAdm.Admin
+func (impl *notifyingAdmin) UpdateRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, rs ipvsAdm.RealServer, opts ...ipvsAdm.AdminOption) error {
+	before, found := impl.findRealServer(ctx, identity, rs.Address)
+	if err := impl.Admin.UpdateRealServer(ctx, identity, rs, opts...); err != nil {
+		return err
+	}
+	op := OpAdd
+	if found {
+		if before == rs {
+			return nil
+		}
+		op = OpUpdate
+	}
+	impl.n.Publish(ctx, Event{
+		Source:        impl.source,
+		Op:            op,
+		VirtualServer: ipvsAdm.IdentityString(identity),
+		RealServer:    string(rs.Address),
+		State: &State{
+			PacketForwarder: string(rs.PacketForwarder),
+			Weight:          rs.Weight,
+			UpperThreshold:  rs.UpperThreshold,
+			LowerThreshold:  rs.LowerThreshold,
+		},
+	})
+	return nil
+}
+
+//RemoveRealServer impl ipvsAdm.Admin
+func (impl *notifyingAdmin) RemoveRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, address ipvsAdm.Address, opts ...ipvsAdm.AdminOption) error {
+	_, found := impl.findRealServer(ctx, identity, address)
+	if err := impl.Admin.RemoveRealServer(ctx, identity, address, opts...); err != nil || !found {
+		return err
+	}
+	impl.n.Publish(ctx, Event{
+		Source:        impl.source,
+		Op:            OpRemove,
+		VirtualServer: ipvsAdm.IdentityString(identity),
+		RealServer:    string(address),
+	})
+	return nil
+}
+
+func (impl *notifyingAdmin) findVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity) (ipvsAdm.VirtualServer, bool) {
+	var ret ipvsAdm.VirtualServer
+	var found bool
+	_ = impl.Admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		if !found && ipvsAdm.IsIdentitiesEq(vs.Identity, identity) {
+			ret, found = vs, true
+		}
+		return nil
+	})
+	return ret, found
+}
+
+func (impl *notifyingAdmin) findRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, address ipvsAdm.Address) (ipvsAdm.RealServer, bool) {
+	var ret ipvsAdm.RealServer
+	var found bool
+	_ = impl.Admin.ListRealServers(ctx, identity, func(rs ipvsAdm.RealServer) error {
+		if !found && rs.Address == address {
+			ret, found = rs, true
+		}
+		return nil
+	})
+	return ret, found
+}
@@ -0,0 +1,350 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+)
+
+/*//Sample of config
+notify:
+  webhooks:
+    - name: cmdb
+      url: http://127.0.0.1:8089/ipvs-events
+      secret: s3cr3t
+      timeout: 5s
+    - name: chat
+      url: http://127.0.0.1:8090/hooks/ipvs
+      sources: [api, drift]
+  max-attempts: 5
+  backoff: 1s
+  max-backoff: 1m
+  queue-size: 1024
+  dead-letter-file: /var/lib/ipvs/notify-dead-letter.jsonl
+*/
+
+//Sources of changes; drift is the kernel table found empty and refilled by replay of stored state,
+//other differences between the kernel table and stored state are not detected
+const (
+	SourceAPI         = "api"
+	SourceDiscovery   = "discovery"
+	SourceDrift       = "drift"
+	SourceHealthcheck = "healthcheck"
+	SourceLease       = "lease"
+)
+
+//Ops of change
+const (
+	OpAdd    = "add"
+	OpUpdate = "update"
+	OpRemove = "remove"
+)
+
+//Headers of delivery
+const (
+	//HeaderSignature 'sha256=' followed by hex of HMAC-SHA256 of timestamp, '.' and body keyed by webhook secret;
+	//receiver is to refuse deliveries with stale timestamp, so captured ones are not replayed
+	HeaderSignature = "X-Ipvs-Signature"
+
+	//HeaderTimestamp unix time in seconds delivery is sent at; every attempt has its own
+	HeaderTimestamp = "X-Ipvs-Timestamp"
+
+	//HeaderEventID id of event
+	HeaderEventID = "X-Ipvs-Event-Id"
+)
+
+type (
+	//Config notifications config
+	Config struct {
+		Webhooks       []WebhookConfig `mapstructure:"webhooks"`
+		MaxAttempts    int             `mapstructure:"max-attempts"`
+		Backoff        time.Duration   `mapstructure:"backoff"`
+		MaxBackoff     time.Duration   `mapstructure:"max-backoff"`
+		QueueSize      int             `mapstructure:"queue-size"`
+		DeadLetterFile string          `mapstructure:"dead-letter-file"`
+	}
+
+	//WebhookConfig one endpoint events are sent to; empty sources means all of them
+	WebhookConfig struct {
+		Name    string        `mapstructure:"name"`
+		URL     string        `mapstructure:"url"`
+		Secret  string        `mapstructure:"secret"`
+		Timeout time.Duration `mapstructure:"timeout"`
+		Sources []string      `mapstructure:"sources"`
+	}
+
+	//Event one change of the kernel table
+	Event struct {
+		ID            string    `json:"id"`
+		Time          time.Time `json:"time"`
+		Source        string    `json:"source"`
+		Op            string    `json:"op"`
+		VirtualServer string    `json:"virtualServer"`
+		RealServer    string    `json:"realServer,omitempty"`
+		State         *State    `json:"state,omitempty"`
+	}
+
+	//State of virtual or real server after change
+	State struct {
+		ScheduleMethod  string `json:"scheduleMethod,omitempty"`
+		PacketForwarder string `json:"packetForwarder,omitempty"`
+		Weight          uint32 `json:"weight"`
+		UpperThreshold  uint32 `json:"upperThreshold,omitempty"`
+		LowerThreshold  uint32 `json:"lowerThreshold,omitempty"`
+	}
+
+	//DeadLetter event is failed to be delivered
+	DeadLetter struct {
+		Time    time.Time `json:"time"`
+		Webhook string    `json:"webhook"`
+		Error   string    `json:"error"`
+		Event   Event     `json:"event"`
+	}
+
+	//Notifier sends events to webhooks; every webhook has its own queue so slow one does not delay others
+	Notifier struct {
+		conf   Config
+		client *http.Client
+		hooks  []*hook
+
+		deadMx sync.Mutex
+	}
+
+	hook struct {
+		WebhookConfig
+		sources map[string]bool
+		queue   chan Event
+	}
+
+	//errPermanent delivery is not retried
+	errPermanent struct {
+		error
+	}
+)
+
+const (
+	defMaxAttempts = 5
+	defBackoff     = time.Second
+	defMaxBackoff  = time.Minute
+	defQueueSize   = 1024
+	defTimeout     = 5 * time.Second
+)
+
+//New makes notifier; Run delivers events
+func New(conf Config) (*Notifier, error) {
+	const api = "notify/New"
+
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = defMaxAttempts
+	}
+	if conf.Backoff <= 0 {
+		conf.Backoff = defBackoff
+	}
+	if conf.MaxBackoff < conf.Backoff {
+		conf.MaxBackoff = defMaxBackoff
+		if conf.MaxBackoff < conf.Backoff {
+			conf.MaxBackoff = conf.Backoff
+		}
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = defQueueSize
+	}
+	if conf.DeadLetterFile != "" {
+		if err := os.MkdirAll(filepath.Dir(conf.DeadLetterFile), 0700); err != nil {
+			return nil, errors.Wrap(err, api)
+		}
+	}
+	ret := &Notifier{conf: conf, client: &http.Client{}}
+	for i, wh := range conf.Webhooks {
+		if wh.Name == "" {
+			return nil, errors.Errorf("%s: webhook #%v has no name", api, i)
+		}
+		u, err := url.Parse(wh.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("%s: webhook '%s' has bad URL '%s'", api, wh.Name, wh.URL)
+		}
+		if wh.Timeout <= 0 {
+			wh.Timeout = defTimeout
+		}
+		h := &hook{WebhookConfig: wh, queue: make(chan Event, conf.QueueSize)}
+		if len(wh.Sources) > 0 {
+			h.sources = make(map[string]bool)
+			for _, s := range wh.Sources {
+				switch s {
+				case SourceAPI, SourceDiscovery, SourceDrift, SourceHealthcheck, SourceLease:
+					h.sources[s] = true
+				default:
+					return nil, errors.Errorf("%s: webhook '%s' has unknown source '%s'", api, wh.Name, s)
+				}
+			}
+		}
+		ret.hooks = append(ret.hooks, h)
+	}
+	return ret, nil
+}
+
+//Publish queues event to webhooks; it never blocks, event that does not fit queue goes to dead letters
+func (n *Notifier) Publish(ctx context.Context, ev Event) {
+	if n == nil {
+		return
+	}
+	if ev.ID == "" {
+		ev.ID = newID()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, h := range n.hooks {
+		if h.sources != nil && !h.sources[ev.Source] {
+			continue
+		}
+		select {
+		case h.queue <- ev:
+		default:
+			n.deadLetter(ctx, h, ev, errors.New("queue is full"))
+		}
+	}
+}
+
+//Run delivers queued events until context is done; events are left in queues go to dead letters
+func (n *Notifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, h := range n.hooks {
+		wg.Add(1)
+		go func(h *hook) {
+			defer wg.Done()
+			n.runHook(ctx, h)
+		}(h)
+	}
+	wg.Wait()
+}
+
+func (n *Notifier) runHook(ctx context.Context, h *hook) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case ev := <-h.queue:
+					n.deadLetter(ctx, h, ev, ctx.Err())
+				default:
+					return
+				}
+			}
+		case ev := <-h.queue:
+			if err := n.deliver(ctx, h, ev); err != nil {
+				n.deadLetter(ctx, h, ev, err)
+			}
+		}
+	}
+}
+
+//deliver sends event with retries; backoff doubles after every failed attempt
+func (n *Notifier) deliver(ctx context.Context, h *hook, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	backoff := n.conf.Backoff
+	for attempt := 1; ; attempt++ {
+		if err = n.send(ctx, h, ev.ID, body); err == nil {
+			return nil
+		}
+		var perm errPermanent
+		if errors.As(err, &perm) || attempt >= n.conf.MaxAttempts {
+			return errors.Wrapf(err, "attempt %v", attempt)
+		}
+		logger.Warnf(ctx, "notify: webhook '%s' attempt %v: %v", h.Name, attempt, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > n.conf.MaxBackoff {
+			backoff = n.conf.MaxBackoff
+		}
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, h *hook, id string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventID, id)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(HeaderTimestamp, ts)
+	if h.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign([]byte(h.Secret), ts, body))
+	}
+	var resp *http.Response
+	if resp, err = n.client.Do(req); err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests:
+		return errors.Errorf("unexpected status '%s'", resp.Status)
+	}
+	return errPermanent{errors.Errorf("unexpected status '%s'", resp.Status)}
+}
+
+//deadLetter appends event is failed to be delivered to dead letter file
+func (n *Notifier) deadLetter(ctx context.Context, h *hook, ev Event, reason error) {
+	logger.Errorf(ctx, "notify: webhook '%s' lost event '%s': %v", h.Name, ev.ID, reason)
+	if n.conf.DeadLetterFile == "" {
+		return
+	}
+	line, err := json.Marshal(DeadLetter{Time: time.Now(), Webhook: h.Name, Error: reason.Error(), Event: ev})
+	if err != nil {
+		return
+	}
+	n.deadMx.Lock()
+	defer n.deadMx.Unlock()
+	var f *os.File
+	if f, err = os.OpenFile(n.conf.DeadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		logger.Errorf(ctx, "notify: write dead letter '%s': %v", n.conf.DeadLetterFile, err)
+	}
+}
+
+//Sign value of signature header of body is sent at timestamp
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(timestamp + "."))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,129 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func Test_Notifier(t *testing.T) {
+	var mx sync.Mutex
+	var got []Event
+	var attempts int
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mx.Lock()
+		defer mx.Unlock()
+		if attempts++; attempts%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ts := r.Header.Get(HeaderTimestamp)
+		if sec, e := strconv.ParseInt(ts, 10, 64); e != nil || time.Since(time.Unix(sec, 0)) > time.Minute {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get(HeaderSignature) != Sign([]byte("s3cr3t"), ts, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var ev Event
+		_ = json.Unmarshal(body, &ev)
+		assert.Equal(t, ev.ID, r.Header.Get(HeaderEventID))
+		got = append(got, ev)
+	}))
+	defer flaky.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	n, err := New(Config{
+		Webhooks: []WebhookConfig{
+			{Name: "flaky", URL: flaky.URL, Secret: "s3cr3t"},
+			{Name: "rejecting", URL: rejecting.URL, Sources: []string{SourceAPI}},
+		},
+		MaxAttempts:    3,
+		Backoff:        time.Millisecond,
+		DeadLetterFile: deadLetters,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Run(ctx)
+		close(done)
+	}()
+
+	kernel := ipvsAdm.NewMemoryAdmin()
+	api := n.Admin(kernel, SourceAPI)
+	discovery := n.Admin(kernel, SourceDiscovery)
+	identity, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	vs := ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: "rr"}
+	rs := ipvsAdm.RealServer{Address: "10.0.1.1:80", PacketForwarder: "dr", Weight: 1}
+	assert.NoError(t, api.UpdateVirtualServer(ctx, vs, ipvsAdm.ForceAddIfNotExist{}))
+	//nothing is changed so nothing is sent
+	assert.NoError(t, api.UpdateVirtualServer(ctx, vs))
+	assert.NoError(t, discovery.UpdateRealServer(ctx, identity, rs, ipvsAdm.ForceAddIfNotExist{}))
+	//failed mutation is not sent
+	assert.Error(t, discovery.RemoveRealServer(ctx, identity, "10.0.1.2:80"))
+
+	assert.Eventually(t, func() bool {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(got) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	mx.Lock()
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, SourceAPI, got[0].Source)
+		assert.Equal(t, OpAdd, got[0].Op)
+		assert.Equal(t, "tcp://10.0.0.1:80", got[0].VirtualServer)
+		assert.Equal(t, SourceDiscovery, got[1].Source)
+		assert.Equal(t, "10.0.1.1:80", got[1].RealServer)
+		assert.Equal(t, "dr", got[1].State.PacketForwarder)
+	}
+	mx.Unlock()
+	cancel()
+	<-done
+
+	f, err := os.Open(deadLetters)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	var letters []DeadLetter
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var dl DeadLetter
+		if assert.NoError(t, json.Unmarshal(sc.Bytes(), &dl)) {
+			letters = append(letters, dl)
+		}
+	}
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "rejecting", letters[0].Webhook)
+		assert.Equal(t, SourceAPI, letters[0].Event.Source)
+	}
+
+	for _, c := range []Config{
+		{Webhooks: []WebhookConfig{{URL: flaky.URL}}},
+		{Webhooks: []WebhookConfig{{Name: "a", URL: "ftp://x"}}},
+		{Webhooks: []WebhookConfig{{Name: "a", URL: flaky.URL, Sources: []string{"nope"}}}},
+	} {
+		_, err = New(c)
+		assert.Error(t, err)
+	}
+}
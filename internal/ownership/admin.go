@@ -0,0 +1,51 @@
+package ownership
+
+import (
+	"context"
+
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+type recordingAdmin struct {
+	ipvsAdm.Admin
+	reg *Registry
+}
+
+//Admin wraps admin; virtual servers it creates become owned, removed ones stop being owned
+func (reg *Registry) Admin(admin ipvsAdm.Admin) ipvsAdm.Admin {
+	return &recordingAdmin{Admin: admin, reg: reg}
+}
+
+//UpdateVirtualServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) UpdateVirtualServer(ctx context.Context, vs ipvsAdm.VirtualServer, opts ...ipvsAdm.AdminOption) error {
+	if impl.reg.IsOwned(vs.Identity) {
+		return impl.Admin.UpdateVirtualServer(ctx, vs, opts...)
+	}
+	var existed bool
+	_ = impl.Admin.ListVirtualServers(ctx, func(v ipvsAdm.VirtualServer) error {
+		existed = existed || ipvsAdm.IsIdentitiesEq(v.Identity, vs.Identity)
+		return nil
+	})
+	if err := impl.Admin.UpdateVirtualServer(ctx, vs, opts...); err != nil || existed {
+		return err
+	}
+	impl.save(ctx, vs.Identity, true)
+	return nil
+}
+
+//RemoveVirtualServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) RemoveVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, opts ...ipvsAdm.AdminOption) error {
+	if err := impl.Admin.RemoveVirtualServer(ctx, identity, opts...); err != nil {
+		return err
+	}
+	impl.save(ctx, identity, false)
+	return nil
+}
+
+//save the kernel table is already changed, so failed save is only reported
+func (impl *recordingAdmin) save(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, owned bool) {
+	if err := impl.reg.setOwned(identity, owned); err != nil {
+		logger.Errorf(ctx, "ownership: save '%s': %v", impl.reg.conf.File, err)
+	}
+}
@@ -0,0 +1,192 @@
+package ownership
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+ownership:
+  file: /var/lib/ipvs/owned.json
+  strict: true
+*/
+
+//Owners of virtual server
+const (
+	OwnerSelf    = "self"
+	OwnerForeign = "foreign"
+)
+
+type (
+	//Config ownership registry config
+	Config struct {
+		File   string
+		Strict bool
+	}
+
+	//Registry remembers virtual servers are created by this service; others are foreign
+	Registry struct {
+		conf Config
+
+		mx    sync.RWMutex
+		owned map[string]bool
+	}
+
+	ownedFile struct {
+		SavedAt        time.Time `json:"savedAt"`
+		VirtualServers []string  `json:"virtualServers"`
+	}
+)
+
+//Open opens registry and loads virtual servers are owned before
+func Open(conf Config) (*Registry, error) {
+	const api = "ownership/Open"
+
+	ret := &Registry{conf: conf, owned: make(map[string]bool)}
+	if conf.File == "" {
+		if conf.Strict {
+			//registry forgets owned virtual servers on restart and refuses changes of all of them
+			return nil, errors.Errorf("%s: strict ownership needs file", api)
+		}
+		return ret, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.File), 0700); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	data, err := ioutil.ReadFile(conf.File)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	var st ownedFile
+	if err = json.Unmarshal(data, &st); err != nil {
+		return nil, errors.Wrapf(err, "%s: '%s'", api, conf.File)
+	}
+	for _, s := range st.VirtualServers {
+		var identity ipvsAdm.VirtualServerIdentity
+		if identity, err = ipvsAdm.ParseVirtualServerIdentity(s); err != nil {
+			return nil, errors.Wrapf(err, "%s: '%s'", api, conf.File)
+		}
+		ret.owned[ipvsAdm.IdentityString(identity)] = true
+	}
+	return ret, nil
+}
+
+//Strict changes of foreign virtual servers are refused unless they are overridden
+func (reg *Registry) Strict() bool {
+	return reg.conf.Strict
+}
+
+//IsOwned tells if virtual server is created by this service
+func (reg *Registry) IsOwned(identity ipvsAdm.VirtualServerIdentity) bool {
+	reg.mx.RLock()
+	defer reg.mx.RUnlock()
+	return reg.owned[ipvsAdm.IdentityString(identity)]
+}
+
+//Owner owner of virtual server
+func (reg *Registry) Owner(identity ipvsAdm.VirtualServerIdentity) string {
+	if reg.IsOwned(identity) {
+		return OwnerSelf
+	}
+	return OwnerForeign
+}
+
+//Owned lists virtual servers are created by this service
+func (reg *Registry) Owned() []string {
+	reg.mx.RLock()
+	defer reg.mx.RUnlock()
+	ret := make([]string, 0, len(reg.owned))
+	for s := range reg.owned {
+		ret = append(ret, s)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+//Foreign picks virtual servers are present in the kernel table but not created by this service
+func (reg *Registry) Foreign(ctx context.Context, admin ipvsAdm.Admin, identities ...ipvsAdm.VirtualServerIdentity) ([]string, error) {
+	const api = "ownership/Foreign"
+
+	if len(identities) == 0 {
+		return nil, nil
+	}
+	present := make(map[string]bool)
+	err := admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		present[ipvsAdm.IdentityString(vs.Identity)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	reg.mx.RLock()
+	defer reg.mx.RUnlock()
+	var ret []string
+	seen := make(map[string]bool)
+	for _, identity := range identities {
+		key := ipvsAdm.IdentityString(identity)
+		if present[key] && !reg.owned[key] && !seen[key] {
+			seen[key] = true
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
+}
+
+func (reg *Registry) setOwned(identity ipvsAdm.VirtualServerIdentity, owned bool) error {
+	key := ipvsAdm.IdentityString(identity)
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+	if reg.owned[key] == owned {
+		return nil
+	}
+	if owned {
+		reg.owned[key] = true
+	} else {
+		delete(reg.owned, key)
+	}
+	return reg.saveLocked()
+}
+
+//saveLocked writes registry file atomically
+func (reg *Registry) saveLocked() error {
+	if reg.conf.File == "" {
+		return nil
+	}
+	st := ownedFile{SavedAt: time.Now(), VirtualServers: make([]string, 0, len(reg.owned))}
+	for s := range reg.owned {
+		st.VirtualServers = append(st.VirtualServers, s)
+	}
+	sort.Strings(st.VirtualServers)
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(reg.conf.File), filepath.Base(reg.conf.File)+".*"); err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, reg.conf.File)
+}
@@ -0,0 +1,61 @@
+package ownership
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func Test_Registry(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "ownership")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	conf := Config{File: filepath.Join(dir, "owned.json")}
+	reg, err := Open(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	adm := reg.Admin(kernel)
+	own, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	foreign, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.2:80")
+	absent, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.3:80")
+
+	assert.NoError(t, kernel.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: foreign, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	assert.NoError(t, adm.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: own, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	//updating foreign one does not make it owned
+	assert.NoError(t, adm.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: foreign, ScheduleMethod: "wrr"}))
+	assert.Equal(t, OwnerSelf, reg.Owner(own))
+	assert.Equal(t, OwnerForeign, reg.Owner(foreign))
+
+	ff, err := reg.Foreign(ctx, kernel, own, foreign, absent, foreign)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tcp://10.0.0.2:80"}, ff)
+
+	//ownership survives restart
+	reg, err = Open(conf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"tcp://10.0.0.1:80"}, reg.Owned())
+	assert.NoError(t, reg.Admin(kernel).RemoveVirtualServer(ctx, own))
+	assert.Empty(t, reg.Owned())
+	reg, err = Open(conf)
+	if assert.NoError(t, err) {
+		assert.Empty(t, reg.Owned())
+	}
+
+	//strict registry would forget owned virtual servers on restart
+	_, err = Open(Config{Strict: true})
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package peercred
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+/*//Sample of config
+server:
+  endpoint: tcp://127.0.0.1:9006
+  unix-socket:
+    endpoint: unix:///run/ipvs/api.sock
+    mode: "0660"
+    owner: root
+    group: ipvs
+*/
+
+//AuthType auth type of peer credentials
+const AuthType = "peercred"
+
+//AuthInfo credentials of local process connected over unix domain socket
+type AuthInfo struct {
+	credentials.CommonAuthInfo
+	UID   uint32
+	GID   uint32
+	PID   int32
+	User  string
+	Group string
+}
+
+//AuthType implements credentials.AuthInfo
+func (AuthInfo) AuthType() string {
+	return AuthType
+}
+
+//selfPID connections of own process (gateway proxy, TLS front) are not identified by peer credentials
+var selfPID = int32(os.Getpid())
+
+type transportCredentials struct {
+	selfPID int32
+}
+
+//NewCredentials makes gRPC server transport credentials which identify callers connected over
+//unix domain socket by SO_PEERCRED; other connections pass through as is
+func NewCredentials() credentials.TransportCredentials {
+	return transportCredentials{selfPID: selfPID}
+}
+
+//ClientHandshake implements credentials.TransportCredentials
+func (transportCredentials) ClientHandshake(_ context.Context, _ string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+
+//ServerHandshake implements credentials.TransportCredentials
+func (c transportCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	uc := unixConn(conn)
+	if uc == nil {
+		return conn, nil, nil
+	}
+	info, err := peerCredentials(uc)
+	if err != nil || info.PID == c.selfPID {
+		//caller without credentials stays anonymous
+		return conn, nil, nil
+	}
+	if u, e := user.LookupId(strconv.FormatUint(uint64(info.UID), 10)); e == nil {
+		info.User = u.Username
+	}
+	if g, e := user.LookupGroupId(strconv.FormatUint(uint64(info.GID), 10)); e == nil {
+		info.Group = g.Name
+	}
+	info.SecurityLevel = credentials.NoSecurity
+	return conn, info, nil
+}
+
+//Info implements credentials.TransportCredentials
+func (transportCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: AuthType}
+}
+
+//Clone implements credentials.TransportCredentials
+func (c transportCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+//OverrideServerName implements credentials.TransportCredentials
+func (transportCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+//FromContext peer credentials of caller; false if caller is not local process on unix domain socket
+func FromContext(ctx context.Context) (AuthInfo, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return AuthInfo{}, false
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	return info, ok
+}
+
+//Principals resolver of caller principals: 'unix-uid:<uid>', 'unix-gid:<gid>'
+//and 'unix-user:<name>', 'unix-group:<name>' when names are known
+func Principals(ctx context.Context) []string {
+	info, ok := FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	ret := []string{
+		"unix-uid:" + strconv.FormatUint(uint64(info.UID), 10),
+		"unix-gid:" + strconv.FormatUint(uint64(info.GID), 10),
+	}
+	if info.User != "" {
+		ret = append(ret, "unix-user:"+info.User)
+	}
+	if info.Group != "" {
+		ret = append(ret, "unix-group:"+info.Group)
+	}
+	return ret
+}
+
+func unixConn(conn net.Conn) *net.UnixConn {
+	for {
+		switch c := conn.(type) {
+		case *net.UnixConn:
+			return c
+		case *cmux.MuxConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package peercred
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/soheilhy/cmux"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func Test_Credentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is linux only")
+	}
+	type seen struct {
+		principals []string
+		info       AuthInfo
+		identified bool
+	}
+	//check calls server is started anew, so credentials take selfPID test has set
+	check := func() (ret seen) {
+		sock := filepath.Join(t.TempDir(), "api.sock")
+		l, err := net.Listen("unix", sock)
+		if !assert.NoError(t, err) {
+			return ret
+		}
+		calls := make(chan seen, 1)
+		srv := grpc.NewServer(grpc.Creds(NewCredentials()),
+			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				c := seen{principals: Principals(ctx)}
+				c.info, c.identified = FromContext(ctx)
+				calls <- c
+				return handler(ctx, req)
+			}))
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+		mx := cmux.New(l)
+		match := mx.Match(cmux.Any())
+		go func() { _ = srv.Serve(match) }()
+		go func() { _ = mx.Serve() }()
+		defer srv.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, "unix://"+sock, grpc.WithInsecure(), grpc.WithBlock())
+		if !assert.NoError(t, err) {
+			return ret
+		}
+		defer conn.Close()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		if assert.NoError(t, err) {
+			ret = <-calls
+		}
+		return ret
+	}
+
+	//own process is not identified
+	c := check()
+	assert.False(t, c.identified)
+	assert.Nil(t, c.principals)
+
+	selfPID = -1
+	defer func() { selfPID = int32(os.Getpid()) }()
+	c = check()
+	if assert.True(t, c.identified) {
+		assert.Equal(t, uint32(os.Getuid()), c.info.UID)
+		assert.Equal(t, int32(os.Getpid()), c.info.PID)
+		assert.Contains(t, c.principals, "unix-uid:"+strconv.Itoa(os.Getuid()))
+		assert.Contains(t, c.principals, "unix-gid:"+strconv.Itoa(os.Getgid()))
+	}
+}
+
+func Test_SocketAccess(t *testing.T) {
+	access, err := SocketConfig{Mode: "0600", Owner: strconv.Itoa(os.Getuid())}.Access()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, SocketAccess{Mode: 0600, UID: os.Getuid(), GID: -1}, access)
+	for _, c := range []SocketConfig{{Mode: "rw"}, {Mode: "1777"}, {Owner: "no-such-user-here"}, {Group: "no-such-group-here"}} {
+		_, err = c.Access()
+		assert.Error(t, err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	stale, _ := net.Listen("unix", sock)
+	staleSt, _ := os.Stat(sock)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- access.Apply(context.Background(), sock, staleSt)
+	}()
+	time.Sleep(2 * socketPollInterval)
+	_ = os.Remove(sock)
+	l, err := net.Listen("unix", sock)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket access is not applied")
+	}
+	st, _ := os.Stat(sock)
+	assert.Equal(t, os.FileMode(0600), st.Mode().Perm())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, access.Apply(ctx, filepath.Join(t.TempDir(), "none.sock"), nil))
+}
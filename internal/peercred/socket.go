@@ -0,0 +1,101 @@
+package peercred
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	//SocketConfig access to unix domain socket API server listens on
+	SocketConfig struct {
+		Mode  string `mapstructure:"mode"`
+		Owner string `mapstructure:"owner"`
+		Group string `mapstructure:"group"`
+	}
+
+	//SocketAccess resolved access to socket file; negative UID or GID keeps it as is
+	SocketAccess struct {
+		Mode os.FileMode
+		UID  int
+		GID  int
+	}
+)
+
+const socketPollInterval = 50 * time.Millisecond
+
+//Access resolves mode, owner and group of config; names and numeric ids are accepted
+func (c SocketConfig) Access() (SocketAccess, error) {
+	const api = "peercred/SocketConfig.Access"
+
+	ret := SocketAccess{Mode: 0660, UID: -1, GID: -1}
+	if c.Mode != "" {
+		m, err := strconv.ParseUint(c.Mode, 8, 32)
+		if err != nil || m > 0777 {
+			return ret, errors.Errorf("%s: bad mode '%s'", api, c.Mode)
+		}
+		ret.Mode = os.FileMode(m)
+	}
+	if c.Owner != "" {
+		id := c.Owner
+		if _, err := strconv.Atoi(id); err != nil {
+			u, e := user.Lookup(c.Owner)
+			if e != nil {
+				return ret, errors.Wrap(e, api)
+			}
+			id = u.Uid
+		}
+		ret.UID, _ = strconv.Atoi(id)
+	}
+	if c.Group != "" {
+		id := c.Group
+		if _, err := strconv.Atoi(id); err != nil {
+			g, e := user.LookupGroup(c.Group)
+			if e != nil {
+				return ret, errors.Wrap(e, api)
+			}
+			id = g.Gid
+		}
+		ret.GID, _ = strconv.Atoi(id)
+	}
+	return ret, nil
+}
+
+//Apply waits until socket appears (it is made when API server starts listening) and sets its owner and mode;
+//stale is socket left by previous run which is replaced by new one; connecting to socket needs write
+//permission so new socket stays owner-only until mode is set with usual umask
+func (a SocketAccess) Apply(ctx context.Context, path string, stale os.FileInfo) error {
+	const api = "peercred/SocketAccess.Apply"
+
+	ticker := time.NewTicker(socketPollInterval)
+	defer ticker.Stop()
+	for {
+		st, err := os.Stat(path)
+		if err == nil && st.Mode()&os.ModeSocket != 0 && !sameSocket(st, stale) {
+			break
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, api)
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), api)
+		case <-ticker.C:
+		}
+	}
+	if a.UID >= 0 || a.GID >= 0 {
+		if err := os.Chown(path, a.UID, a.GID); err != nil {
+			return errors.Wrap(err, api)
+		}
+	}
+	return errors.Wrap(os.Chmod(path, a.Mode), api)
+}
+
+//sameSocket inode of removed socket may be reused by new one so modification time is compared too
+func sameSocket(st, stale os.FileInfo) bool {
+	return stale != nil && os.SameFile(st, stale) && st.ModTime().Equal(stale.ModTime())
+}
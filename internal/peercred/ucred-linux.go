@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package peercred
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func peerCredentials(conn *net.UnixConn) (AuthInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return AuthInfo{}, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return AuthInfo{}, errors.Wrap(err, "get SO_PEERCRED")
+	}
+	return AuthInfo{UID: cred.Uid, GID: cred.Gid, PID: cred.Pid}, nil
+}
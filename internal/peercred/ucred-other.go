@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package peercred
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+func peerCredentials(*net.UnixConn) (AuthInfo, error) {
+	return AuthInfo{}, errors.New("SO_PEERCRED is not supported on this platform")
+}
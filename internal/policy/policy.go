@@ -0,0 +1,246 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+policy:
+  virtual-server-cidrs: [10.0.0.0/24, fd00::/64]
+  virtual-server-ports: ["80", "443", "8000-8999"]
+  real-server-cidrs: [10.1.0.0/16]
+  real-server-ports: ["1024-65535"]
+  schedule-methods: [rr, wrr, wlc]
+  packet-forwarders: [dr, tun]
+  max-virtual-servers: 50
+  max-real-servers: 100
+*/
+
+type (
+	//Config policy config; empty list or zero limit does not restrict anything
+	Config struct {
+		VirtualServerCIDRs []string `mapstructure:"virtual-server-cidrs"`
+		VirtualServerPorts []string `mapstructure:"virtual-server-ports"`
+		RealServerCIDRs    []string `mapstructure:"real-server-cidrs"`
+		RealServerPorts    []string `mapstructure:"real-server-ports"`
+		ScheduleMethods    []string `mapstructure:"schedule-methods"`
+		PacketForwarders   []string `mapstructure:"packet-forwarders"`
+		MaxVirtualServers  int      `mapstructure:"max-virtual-servers"`
+		MaxRealServers     int      `mapstructure:"max-real-servers"`
+	}
+
+	//Violation one broken rule
+	Violation struct {
+		Subject     string
+		Field       string
+		Description string
+	}
+
+	//Policy guardrails of changes are accepted by API
+	Policy struct {
+		vsNets     []*net.IPNet
+		vsPorts    []portRange
+		rsNets     []*net.IPNet
+		rsPorts    []portRange
+		schedulers map[ipvsAdm.ScheduleMethod]bool
+		forwarders map[ipvsAdm.PacketForwarder]bool
+		maxVS      int
+		maxRS      int
+	}
+
+	portRange struct {
+		from, to uint32
+	}
+)
+
+//New makes policy from config
+func New(conf Config) (*Policy, error) {
+	const api = "policy/New"
+
+	ret := &Policy{maxVS: conf.MaxVirtualServers, maxRS: conf.MaxRealServers}
+	var err error
+	if ret.vsNets, err = parseCIDRs(conf.VirtualServerCIDRs); err != nil {
+		return nil, errors.Wrapf(err, "%s: virtual-server-cidrs", api)
+	}
+	if ret.rsNets, err = parseCIDRs(conf.RealServerCIDRs); err != nil {
+		return nil, errors.Wrapf(err, "%s: real-server-cidrs", api)
+	}
+	if ret.vsPorts, err = parsePortRanges(conf.VirtualServerPorts); err != nil {
+		return nil, errors.Wrapf(err, "%s: virtual-server-ports", api)
+	}
+	if ret.rsPorts, err = parsePortRanges(conf.RealServerPorts); err != nil {
+		return nil, errors.Wrapf(err, "%s: real-server-ports", api)
+	}
+	if len(conf.ScheduleMethods) > 0 {
+		ret.schedulers = make(map[ipvsAdm.ScheduleMethod]bool)
+		for _, s := range conf.ScheduleMethods {
+			sm := ipvsAdm.ScheduleMethod(strings.ToLower(s))
+			if err = sm.Valid(); err != nil {
+				return nil, errors.Wrapf(err, "%s: schedule-methods", api)
+			}
+			ret.schedulers[sm] = true
+		}
+	}
+	if len(conf.PacketForwarders) > 0 {
+		ret.forwarders = make(map[ipvsAdm.PacketForwarder]bool)
+		for _, s := range conf.PacketForwarders {
+			pf := ipvsAdm.PacketForwarder(strings.ToLower(s))
+			if err = pf.Valid(); err != nil {
+				return nil, errors.Wrapf(err, "%s: packet-forwarders", api)
+			}
+			ret.forwarders[pf] = true
+		}
+	}
+	if conf.MaxVirtualServers < 0 || conf.MaxRealServers < 0 {
+		return nil, errors.Errorf("%s: limits must not be negative", api)
+	}
+	return ret, nil
+}
+
+//CheckVirtualServer checks address, port and schedule method of virtual server
+func (p *Policy) CheckVirtualServer(vs ipvsAdm.VirtualServer) []Violation {
+	subject := ipvsAdm.IdentityString(vs.Identity)
+	var ret []Violation
+	if addr, ok := vs.Identity.(ipvsAdm.VirtualServerAddress); ok {
+		ret = append(ret, checkAddress(subject, "virtual_server.address", addr.Address, p.vsNets, p.vsPorts)...)
+	}
+	if p.schedulers != nil && !p.schedulers[vs.ScheduleMethod] {
+		ret = append(ret, Violation{
+			Subject:     subject,
+			Field:       "virtual_server.schedule_method",
+			Description: fmt.Sprintf("schedule method '%s' is not allowed", vs.ScheduleMethod),
+		})
+	}
+	return ret
+}
+
+//CheckRealServer checks address, port and packet forwarder of real server
+func (p *Policy) CheckRealServer(identity ipvsAdm.VirtualServerIdentity, rs ipvsAdm.RealServer) []Violation {
+	subject := ipvsAdm.IdentityString(identity) + " " + string(rs.Address)
+	ret := checkAddress(subject, "real_server.address", rs.Address, p.rsNets, p.rsPorts)
+	if p.forwarders != nil && !p.forwarders[rs.PacketForwarder] {
+		ret = append(ret, Violation{
+			Subject:     subject,
+			Field:       "real_server.packet_forwarder",
+			Description: fmt.Sprintf("packet forwarder '%s' is not allowed", rs.PacketForwarder),
+		})
+	}
+	return ret
+}
+
+//LimitsVirtualServersCount true if count of virtual servers is limited
+func (p *Policy) LimitsVirtualServersCount() bool {
+	return p != nil && p.maxVS > 0
+}
+
+//CheckVirtualServersCount checks count of virtual servers this service is going to own
+func (p *Policy) CheckVirtualServersCount(n int) []Violation {
+	if p.maxVS == 0 || n <= p.maxVS {
+		return nil
+	}
+	return []Violation{{
+		Subject:     "virtual_servers",
+		Field:       "max-virtual-servers",
+		Description: fmt.Sprintf("%v virtual servers exceed limit %v", n, p.maxVS),
+	}}
+}
+
+//CheckRealServersCount checks count of real servers virtual server is going to have
+func (p *Policy) CheckRealServersCount(identity ipvsAdm.VirtualServerIdentity, n int) []Violation {
+	if p.maxRS == 0 || n <= p.maxRS {
+		return nil
+	}
+	return []Violation{{
+		Subject:     ipvsAdm.IdentityString(identity),
+		Field:       "max-real-servers",
+		Description: fmt.Sprintf("%v real servers exceed limit %v", n, p.maxRS),
+	}}
+}
+
+func checkAddress(subject, field string, address ipvsAdm.Address, nets []*net.IPNet, ports []portRange) []Violation {
+	if len(nets) == 0 && len(ports) == 0 {
+		return nil
+	}
+	host, port, err := address.ToHostPort()
+	if err != nil {
+		return []Violation{{Subject: subject, Field: field, Description: err.Error()}}
+	}
+	var ret []Violation
+	if len(nets) > 0 {
+		ip := net.ParseIP(host)
+		if ip == nil || !containsIP(nets, ip) {
+			ret = append(ret, Violation{
+				Subject:     subject,
+				Field:       field,
+				Description: fmt.Sprintf("address '%s' is out of allowed CIDRs", host),
+			})
+		}
+	}
+	if len(ports) > 0 && !containsPort(ports, port) {
+		ret = append(ret, Violation{
+			Subject:     subject,
+			Field:       field,
+			Description: fmt.Sprintf("port %v is out of allowed ranges", port),
+		})
+	}
+	return ret
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []portRange, port uint32) bool {
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(ss []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+//parsePortRanges parses ranges like '80' or '8000-8999'
+func parsePortRanges(ss []string) ([]portRange, error) {
+	ret := make([]portRange, 0, len(ss))
+	for _, s := range ss {
+		bounds := strings.SplitN(strings.TrimSpace(s), "-", 2)
+		var r portRange
+		from, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+		if err != nil {
+			return nil, errors.Errorf("bad port range '%s'", s)
+		}
+		r.from, r.to = uint32(from), uint32(from)
+		if len(bounds) == 2 {
+			var to uint64
+			if to, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16); err != nil || uint32(to) < r.from {
+				return nil, errors.Errorf("bad port range '%s'", s)
+			}
+			r.to = uint32(to)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
@@ -0,0 +1,60 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func Test_Policy(t *testing.T) {
+	p, err := New(Config{
+		VirtualServerCIDRs: []string{"10.0.0.0/24"},
+		VirtualServerPorts: []string{"80", "8000-8999"},
+		RealServerCIDRs:    []string{"10.0.1.0/24"},
+		ScheduleMethods:    []string{"rr", "WRR"},
+		PacketForwarders:   []string{"dr"},
+		MaxVirtualServers:  2,
+		MaxRealServers:     3,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	vs := func(s string, sm ipvsAdm.ScheduleMethod) ipvsAdm.VirtualServer {
+		identity, _ := ipvsAdm.ParseVirtualServerIdentity(s)
+		return ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: sm}
+	}
+	assert.Empty(t, p.CheckVirtualServer(vs("tcp://10.0.0.1:80", "rr")))
+	assert.Empty(t, p.CheckVirtualServer(vs("tcp://10.0.0.1:8080", "wrr")))
+	assert.Empty(t, p.CheckVirtualServer(vs("fwmark://10", "rr")))
+	assert.Len(t, p.CheckVirtualServer(vs("tcp://10.0.1.1:80", "rr")), 1)
+	assert.Len(t, p.CheckVirtualServer(vs("tcp://10.0.0.1:22", "sh")), 2)
+	assert.Len(t, p.CheckVirtualServer(vs("tcp://192.168.0.1:22", "rr")), 2)
+
+	identity := vs("tcp://10.0.0.1:80", "rr").Identity
+	rs := ipvsAdm.RealServer{Address: "10.0.1.1:8080", PacketForwarder: "dr"}
+	assert.Empty(t, p.CheckRealServer(identity, rs))
+	rs.PacketForwarder = "nat"
+	if v := p.CheckRealServer(identity, rs); assert.Len(t, v, 1) {
+		assert.Equal(t, "real_server.packet_forwarder", v[0].Field)
+	}
+	rs.Address = "10.0.2.1:8080"
+	assert.Len(t, p.CheckRealServer(identity, rs), 2)
+
+	assert.Empty(t, p.CheckVirtualServersCount(2))
+	assert.Len(t, p.CheckVirtualServersCount(3), 1)
+	assert.Empty(t, p.CheckRealServersCount(identity, 3))
+	assert.Len(t, p.CheckRealServersCount(identity, 4), 1)
+
+	for _, c := range []Config{
+		{VirtualServerCIDRs: []string{"10.0.0.0"}},
+		{RealServerPorts: []string{"90-80"}},
+		{VirtualServerPorts: []string{"70000"}},
+		{ScheduleMethods: []string{"nope"}},
+		{PacketForwarders: []string{"nope"}},
+		{MaxRealServers: -1},
+	} {
+		_, err = New(c)
+		assert.Error(t, err, "%+v", c)
+	}
+}
@@ -0,0 +1,318 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto" //nolint:staticcheck
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thataway/common-lib/logger"
+	"github.com/thataway/ipvs/internal/caller"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+/*//Sample of config
+rate-limit:
+  rate: 100
+  burst: 1000
+  max-batch-size: 1000
+  overrides:
+    - principals: ["mtls:ops-*", "unix-user:root"]
+      rate: 1000
+      burst: 10000
+      max-batch-size: 10000
+*/
+
+//Reasons of rejection
+const (
+	ReasonRate  = "rate"
+	ReasonBatch = "batch"
+)
+
+type (
+	//Config limits of Update* calls; every item of batch costs one token of caller's bucket;
+	//zero rate or max batch size means no limit
+	Config struct {
+		Limits    `mapstructure:",squash"`
+		Overrides []OverrideConfig `mapstructure:"overrides"`
+	}
+
+	//Limits token bucket and batch size limits
+	Limits struct {
+		Rate         float64 `mapstructure:"rate"`
+		Burst        int     `mapstructure:"burst"`
+		MaxBatchSize int     `mapstructure:"max-batch-size"`
+	}
+
+	//OverrideConfig limits of callers any of principals (glob patterns) matches; the first matched override is taken
+	OverrideConfig struct {
+		Limits     `mapstructure:",squash"`
+		Principals []string `mapstructure:"principals"`
+	}
+
+	//Option option of limiter
+	Option interface {
+		isRateLimitOption()
+	}
+
+	//WithResolver adds resolver of caller principals; callers are told apart by principals
+	WithResolver struct {
+		Resolver func(ctx context.Context) []string
+	}
+
+	//Limiter limits rate and batch size of Update* calls of every caller
+	Limiter struct {
+		limits     []limits
+		resolvers  []func(ctx context.Context) []string
+		rejections *prometheus.CounterVec
+
+		mx         sync.Mutex
+		buckets    map[string]*bucket
+		overflow   *bucket
+		maxBuckets int
+		lastSweep  time.Time
+	}
+
+	limits struct {
+		Limits
+		patterns []string
+	}
+
+	bucket struct {
+		limiter  *rate.Limiter
+		lastSeen time.Time
+		refill   time.Duration
+	}
+)
+
+func (WithResolver) isRateLimitOption() {}
+
+const (
+	//idleTTL bucket of caller idle for longer is dropped once it has refilled (see bucket.idle)
+	idleTTL = 10 * time.Minute
+
+	//maxBuckets callers are kept in own buckets at most; callers over it share overflow bucket
+	maxBuckets = 10000
+
+	anonymous = "anonymous"
+)
+
+var _ prometheus.Collector = (*Limiter)(nil)
+
+//New makes limiter
+func New(conf Config, opts ...Option) (*Limiter, error) {
+	const api = "ratelimit/New"
+
+	ret := &Limiter{
+		buckets:    make(map[string]*bucket),
+		maxBuckets: maxBuckets,
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ipvs",
+			Subsystem: "ratelimit",
+			Name:      "rejections_total",
+			Help:      "calls are rejected by rate or batch size limits",
+		}, []string{"method", "reason"}),
+	}
+	for i, o := range conf.Overrides {
+		if len(o.Principals) == 0 {
+			return nil, errors.Errorf("%s: override #%v has no principals", api, i)
+		}
+		for _, p := range o.Principals {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, errors.Errorf("%s: override #%v: bad pattern '%s'", api, i, p)
+			}
+		}
+		l, err := o.Limits.normalize()
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: override #%v", api, i)
+		}
+		ret.limits = append(ret.limits, limits{Limits: l, patterns: o.Principals})
+	}
+	l, err := conf.Limits.normalize()
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	ret.limits = append(ret.limits, limits{Limits: l, patterns: []string{"*"}})
+	for _, o := range opts {
+		if r, ok := o.(WithResolver); ok && r.Resolver != nil {
+			ret.resolvers = append(ret.resolvers, r.Resolver)
+		}
+	}
+	return ret, nil
+}
+
+//normalize defaults burst to cover one rate second and the largest batch
+func (l Limits) normalize() (Limits, error) {
+	if l.Rate < 0 || l.Burst < 0 || l.MaxBatchSize < 0 {
+		return l, errors.New("limits must not be negative")
+	}
+	if l.Rate > 0 && l.Burst == 0 {
+		l.Burst = int(l.Rate + 0.5)
+		if l.Burst < 1 {
+			l.Burst = 1
+		}
+		if l.Burst < l.MaxBatchSize {
+			l.Burst = l.MaxBatchSize
+		}
+	}
+	if l.Rate > 0 && l.MaxBatchSize > l.Burst {
+		return l, errors.Errorf("burst %v is less than max batch size %v so the largest batch never passes", l.Burst, l.MaxBatchSize)
+	}
+	return l, nil
+}
+
+//Allow takes tokens for batch of caller; it gives ResourceExhausted error when batch is too large
+//or the caller is over its rate; service calls it once batch is expanded by selectors, so size is
+//the number of items batch really changes
+func (l *Limiter) Allow(ctx context.Context, method string, size int) error {
+	principals := l.principals(ctx)
+	lim := l.limitsOf(principals)
+	if lim.MaxBatchSize > 0 && size > lim.MaxBatchSize {
+		return l.reject(ctx, method, ReasonBatch, errors.Errorf("batch of %v items exceeds max size %v", size, lim.MaxBatchSize), 0,
+			&errdetails.QuotaFailure_Violation{
+				Subject:     "batch-size",
+				Description: "max batch size is exceeded",
+			})
+	}
+	if lim.Rate <= 0 {
+		return nil
+	}
+	if size < 1 {
+		size = 1
+	}
+	key := callerKey(ctx, principals)
+	now := time.Now()
+	r := l.bucketOf(key, lim.Limits, now).ReserveN(now, size)
+	if !r.OK() {
+		return l.reject(ctx, method, ReasonBatch, errors.Errorf("batch of %v items exceeds burst %v", size, lim.Burst), 0,
+			&errdetails.QuotaFailure_Violation{
+				Subject:     "batch-size",
+				Description: "batch is larger than burst",
+			})
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return l.reject(ctx, method, ReasonRate, errors.Errorf("rate of '%s' is exceeded", key), delay,
+			&errdetails.QuotaFailure_Violation{
+				Subject:     key,
+				Description: "rate limit is exceeded",
+			})
+	}
+	return nil
+}
+
+func (l *Limiter) reject(ctx context.Context, method, reason string, err error, retry time.Duration, v *errdetails.QuotaFailure_Violation) error {
+	l.rejections.WithLabelValues(method, reason).Inc()
+	logger.Warnf(ctx, "ratelimit: '%s' is rejected by %s limit: %v", method, reason, err)
+	st := status.New(codes.ResourceExhausted, err.Error())
+	details := []proto.Message{&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{v}}}
+	if retry > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(retry)})
+	}
+	if st2, e := st.WithDetails(details...); e == nil {
+		return st2.Err()
+	}
+	return st.Err()
+}
+
+func (l *Limiter) principals(ctx context.Context) []string {
+	var ret []string
+	for _, r := range l.resolvers {
+		ret = append(ret, r(ctx)...)
+	}
+	return ret
+}
+
+func (l *Limiter) limitsOf(principals []string) limits {
+	for _, lim := range l.limits[:len(l.limits)-1] {
+		for _, p := range lim.patterns {
+			for _, s := range principals {
+				if ok, _ := path.Match(p, s); ok {
+					return lim
+				}
+			}
+		}
+	}
+	return l.limits[len(l.limits)-1]
+}
+
+func (l *Limiter) bucketOf(key string, lim Limits, now time.Time) *rate.Limiter {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if now.Sub(l.lastSweep) > idleTTL {
+		l.sweep(now)
+	}
+	b := l.buckets[key]
+	if b == nil && len(l.buckets) >= l.maxBuckets {
+		if l.overflow == nil {
+			l.overflow = &bucket{limiter: rate.NewLimiter(rate.Limit(lim.Rate), lim.Burst)}
+		}
+		b = l.overflow
+	}
+	if b == nil {
+		b = &bucket{
+			limiter: rate.NewLimiter(rate.Limit(lim.Rate), lim.Burst),
+			refill:  time.Duration(float64(lim.Burst) / lim.Rate * float64(time.Second)),
+		}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+	return b.limiter
+}
+
+//sweep drops buckets of idle callers
+func (l *Limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if b.idle(now) {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+//idle bucket is unused for longer than idleTTL and long enough to refill from empty, so caller gets
+//no more tokens from fresh bucket than it would get from this one
+func (b *bucket) idle(now time.Time) bool {
+	unused := now.Sub(b.lastSeen)
+	return unused > idleTTL && unused > b.refill
+}
+
+//Describe impl prometheus.Collector
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	l.rejections.Describe(ch)
+}
+
+//Collect impl prometheus.Collector
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.rejections.Collect(ch)
+}
+
+//callerKey identity bucket of caller is kept by: its principals or host of anonymous caller; host is told
+//by caller.Address so forwarded-for addresses clients set themselves do not give them fresh buckets
+func callerKey(ctx context.Context, principals []string) string {
+	var named []string
+	for _, p := range principals {
+		if p != anonymous {
+			named = append(named, p)
+		}
+	}
+	if len(named) > 0 {
+		sort.Strings(named)
+		return strings.Join(named, ",")
+	}
+	host := caller.Address(ctx)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return "host:" + host
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type principalKey struct{}
+
+func Test_Limiter(t *testing.T) {
+	l, err := New(Config{
+		Limits: Limits{Rate: 1, Burst: 3, MaxBatchSize: 3},
+		Overrides: []OverrideConfig{
+			{Principals: []string{"mtls:ops-*"}, Limits: Limits{MaxBatchSize: 100}},
+		},
+	}, WithResolver{Resolver: func(ctx context.Context) []string {
+		if p, _ := ctx.Value(principalKey{}).(string); p != "" {
+			return []string{p}
+		}
+		return nil
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	callFrom := func(principal, host, forwardedFor string, size int) error {
+		ctx := context.WithValue(context.Background(), principalKey{}, principal)
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(host), Port: 5000}})
+		if forwardedFor != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", forwardedFor))
+		}
+		return l.Allow(ctx, "UpdateRealServers", size)
+	}
+	call := func(principal, host string, size int) error {
+		return callFrom(principal, host, "", size)
+	}
+
+	//batch size
+	err = call("jwt:ci", "127.0.0.1", 4)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, 1.0, testutil.ToFloat64(l.rejections.WithLabelValues("UpdateRealServers", ReasonBatch)))
+
+	//rate: every item costs token
+	assert.NoError(t, call("jwt:ci", "127.0.0.1", 2))
+	assert.NoError(t, call("jwt:ci", "127.0.0.1", 1))
+	err = call("jwt:ci", "127.0.0.1", 1)
+	if assert.Equal(t, codes.ResourceExhausted, status.Code(err)) {
+		var retry *errdetails.RetryInfo
+		for _, d := range status.Convert(err).Details() {
+			if r, ok := d.(*errdetails.RetryInfo); ok {
+				retry = r
+			}
+		}
+		if assert.NotNil(t, retry) {
+			assert.True(t, retry.GetRetryDelay().AsDuration() > 0)
+		}
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(l.rejections.WithLabelValues("UpdateRealServers", ReasonRate)))
+
+	//other callers have their own buckets; anonymous ones are told apart by source host
+	assert.NoError(t, call("jwt:other", "127.0.0.1", 3))
+	assert.NoError(t, call("", "127.0.0.2", 3))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(call("", "127.0.0.2", 1)))
+	assert.NoError(t, call("", "127.0.0.3", 1))
+	//forwarded-for addresses clients set themselves do not give them fresh buckets
+	assert.Equal(t, codes.ResourceExhausted, status.Code(callFrom("", "127.0.0.2", "198.51.100.1", 1)))
+
+	//override lifts limits
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, call("mtls:ops-1", "127.0.0.1", 50))
+	}
+
+	//callers over the cap share overflow bucket
+	l.maxBuckets = len(l.buckets)
+	assert.NoError(t, call("", "127.0.0.4", 3))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(call("", "127.0.0.5", 1)))
+	assert.Len(t, l.buckets, l.maxBuckets)
+
+	for _, c := range []Config{
+		{Limits: Limits{Rate: -1}},
+		{Limits: Limits{Rate: 1, Burst: 2, MaxBatchSize: 3}},
+		{Overrides: []OverrideConfig{{Limits: Limits{Rate: 1}}}},
+		{Overrides: []OverrideConfig{{Principals: []string{"["}}}},
+	} {
+		_, err = New(c)
+		assert.Error(t, err)
+	}
+	if l, err = New(Config{Limits: Limits{Rate: 10, MaxBatchSize: 50}}); assert.NoError(t, err) {
+		assert.Equal(t, 50, l.limits[0].Burst)
+	}
+}
+
+func Test_SweepKeepsRefillingBuckets(t *testing.T) {
+	l, err := New(Config{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	slow := Limits{Rate: 1.0 / 600, Burst: 5}
+	fast := Limits{Rate: 10, Burst: 10}
+	t0 := time.Now()
+	assert.True(t, l.bucketOf("slow", slow, t0).ReserveN(t0, 5).OK())
+	assert.True(t, l.bucketOf("fast", fast, t0).ReserveN(t0, 10).OK())
+
+	//bucket refilling for 50 minutes outlives idle TTL, so caller can not get burst back by idling
+	t1 := t0.Add(idleTTL + time.Minute)
+	l.bucketOf("other", fast, t1)
+	assert.Contains(t, l.buckets, "slow")
+	assert.NotContains(t, l.buckets, "fast")
+	assert.False(t, l.bucketOf("slow", slow, t1).AllowN(t1, 5))
+
+	t2 := t1.Add(time.Hour)
+	l.bucketOf("other", fast, t2)
+	assert.NotContains(t, l.buckets, "slow")
+}
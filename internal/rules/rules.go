@@ -0,0 +1,238 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/pkg/errors"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+rules:
+  - name: sh-needs-dr
+    target: real-server
+    expression: 'virtualServer.scheduleMethod != "sh" || realServer.packetForwarder == "dr"'
+    message: sh scheduler needs dr forwarder
+  - name: weights-sum-100
+    target: real-server
+    expression: 'op == "delete" || totalWeight == 100'
+    message: weights of real servers must sum to 100
+  - name: no-privileged-ports
+    target: virtual-server
+    expression: 'op == "delete" || virtualServer.port == 0 || virtualServer.port >= 1024'
+*/
+
+//Targets of rule
+const (
+	TargetVirtualServer = "virtual-server"
+	TargetRealServer    = "real-server"
+)
+
+//Ops rules are evaluated for
+const (
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+type (
+	//Config CEL rule; expression must evaluate to true for change to be accepted
+	//
+	//	virtual-server rules see: op, virtualServer
+	//	real-server rules see:    op, virtualServer, realServer, realServers, totalWeight
+	//
+	//virtualServer: {identity, protocol, host, port, firewallMark, scheduleMethod}
+	//realServer:    {address, host, port, packetForwarder, weight, upperThreshold, lowerThreshold}
+	//realServers:   real servers virtual server is going to have after batch; totalWeight is sum of their weights
+	Config struct {
+		Name       string `mapstructure:"name"`
+		Target     string `mapstructure:"target"`
+		Expression string `mapstructure:"expression"`
+		Message    string `mapstructure:"message"`
+	}
+
+	//Failure rule change does not pass
+	Failure struct {
+		Rule    string
+		Message string
+	}
+
+	//RuleSet compiled rules
+	RuleSet struct {
+		vsRules []rule
+		rsRules []rule
+	}
+
+	rule struct {
+		name    string
+		message string
+		prg     cel.Program
+	}
+)
+
+//New compiles rules
+func New(confs []Config) (*RuleSet, error) {
+	const api = "rules/New"
+
+	vsEnv, err := cel.NewEnv(
+		cel.Variable("op", cel.StringType),
+		cel.Variable("virtualServer", cel.MapType(cel.StringType, cel.DynType)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	var rsEnv *cel.Env
+	rsEnv, err = cel.NewEnv(
+		cel.Variable("op", cel.StringType),
+		cel.Variable("virtualServer", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("realServer", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("realServers", cel.ListType(cel.MapType(cel.StringType, cel.DynType))),
+		cel.Variable("totalWeight", cel.IntType),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	ret := new(RuleSet)
+	seen := make(map[string]bool)
+	for i, c := range confs {
+		if c.Name == "" {
+			return nil, errors.Errorf("%s: rule #%v has no name", api, i)
+		}
+		if seen[c.Name] {
+			return nil, errors.Errorf("%s: rule '%s' is duplicated", api, c.Name)
+		}
+		seen[c.Name] = true
+		env := vsEnv
+		switch c.Target {
+		case TargetVirtualServer:
+		case TargetRealServer:
+			env = rsEnv
+		default:
+			return nil, errors.Errorf("%s: rule '%s' has unknown target '%s'", api, c.Name, c.Target)
+		}
+		ast, iss := env.Compile(c.Expression)
+		if iss != nil && iss.Err() != nil {
+			return nil, errors.Errorf("%s: rule '%s': %v", api, c.Name, iss.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, errors.Errorf("%s: rule '%s' evaluates to %v but bool is expected", api, c.Name, ast.OutputType())
+		}
+		var prg cel.Program
+		if prg, err = env.Program(ast); err != nil {
+			return nil, errors.Wrapf(err, "%s: rule '%s'", api, c.Name)
+		}
+		r := rule{name: c.Name, message: c.Message, prg: prg}
+		if r.message == "" {
+			r.message = "rule is not satisfied: " + c.Expression
+		}
+		if env == vsEnv {
+			ret.vsRules = append(ret.vsRules, r)
+		} else {
+			ret.rsRules = append(ret.rsRules, r)
+		}
+	}
+	return ret, nil
+}
+
+//CheckVirtualServer evaluates virtual server rules; vs has only identity when op is delete
+func (rs *RuleSet) CheckVirtualServer(op string, vs ipvsAdm.VirtualServer) []Failure {
+	if len(rs.vsRules) == 0 {
+		return nil
+	}
+	return eval(rs.vsRules, map[string]interface{}{
+		"op":            op,
+		"virtualServer": virtualServerVal(vs),
+	})
+}
+
+//CheckRealServer evaluates real server rules; group is real servers virtual server is going to have after batch
+func (rs *RuleSet) CheckRealServer(op string, vs ipvsAdm.VirtualServer, real ipvsAdm.RealServer, group []ipvsAdm.RealServer) []Failure {
+	if len(rs.rsRules) == 0 {
+		return nil
+	}
+	reals := make([]interface{}, 0, len(group))
+	var total int64
+	for _, r := range group {
+		reals = append(reals, realServerVal(r))
+		total += int64(r.Weight)
+	}
+	return eval(rs.rsRules, map[string]interface{}{
+		"op":            op,
+		"virtualServer": virtualServerVal(vs),
+		"realServer":    realServerVal(real),
+		"realServers":   reals,
+		"totalWeight":   total,
+	})
+}
+
+//HasRealServerRules tells if there are rules of real servers
+func (rs *RuleSet) HasRealServerRules() bool {
+	return len(rs.rsRules) > 0
+}
+
+func eval(rules []rule, vars map[string]interface{}) []Failure {
+	var ret []Failure
+	for _, r := range rules {
+		out, _, err := r.prg.Eval(vars)
+		if err != nil {
+			ret = append(ret, Failure{Rule: r.name, Message: fmt.Sprintf("rule is failed to evaluate: %v", err)})
+			continue
+		}
+		if ok, _ := out.Value().(bool); !ok {
+			ret = append(ret, Failure{Rule: r.name, Message: r.message})
+		}
+	}
+	return ret
+}
+
+func virtualServerVal(vs ipvsAdm.VirtualServer) map[string]interface{} {
+	ret := map[string]interface{}{
+		"identity":       "",
+		"protocol":       "",
+		"host":           "",
+		"port":           int64(0),
+		"firewallMark":   int64(0),
+		"scheduleMethod": string(vs.ScheduleMethod),
+	}
+	switch t := vs.Identity.(type) {
+	case ipvsAdm.VirtualServerAddress:
+		ret["identity"] = ipvsAdm.IdentityString(t)
+		ret["protocol"] = strings.ToLower(string(t.NetworkProtocol))
+		host, port := splitAddress(t.Address)
+		ret["host"], ret["port"] = host, port
+	case ipvsAdm.VirtualServerFMark:
+		ret["identity"] = ipvsAdm.IdentityString(t)
+		ret["firewallMark"] = int64(t.FirewallMark)
+	}
+	return ret
+}
+
+func realServerVal(rs ipvsAdm.RealServer) map[string]interface{} {
+	host, port := splitAddress(rs.Address)
+	return map[string]interface{}{
+		"address":         string(rs.Address),
+		"host":            host,
+		"port":            port,
+		"packetForwarder": string(rs.PacketForwarder),
+		"weight":          int64(rs.Weight),
+		"upperThreshold":  int64(rs.UpperThreshold),
+		"lowerThreshold":  int64(rs.LowerThreshold),
+	}
+}
+
+func splitAddress(a ipvsAdm.Address) (string, int64) {
+	host, port, err := net.SplitHostPort(string(a))
+	if err != nil {
+		return string(a), 0
+	}
+	p, _ := strconv.ParseInt(port, 10, 64)
+	return host, p
+}
+
+//String impl fmt.Stringer
+func (f Failure) String() string {
+	return "rule '" + f.Rule + "': " + f.Message
+}
@@ -0,0 +1,65 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func Test_RuleSet(t *testing.T) {
+	rs, err := New([]Config{
+		{
+			Name:       "sh-needs-dr",
+			Target:     TargetRealServer,
+			Expression: `virtualServer.scheduleMethod != "sh" || realServer.packetForwarder == "dr"`,
+			Message:    "sh scheduler needs dr forwarder",
+		},
+		{
+			Name:       "weights-sum-100",
+			Target:     TargetRealServer,
+			Expression: `op == "delete" || totalWeight == 100`,
+		},
+		{
+			Name:       "no-privileged-ports",
+			Target:     TargetVirtualServer,
+			Expression: `op == "delete" || virtualServer.port == 0 || virtualServer.port >= 1024`,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	vs := func(s string, sm ipvsAdm.ScheduleMethod) ipvsAdm.VirtualServer {
+		identity, _ := ipvsAdm.ParseVirtualServerIdentity(s)
+		return ipvsAdm.VirtualServer{Identity: identity, ScheduleMethod: sm}
+	}
+	assert.Empty(t, rs.CheckVirtualServer(OpUpdate, vs("tcp://10.0.0.1:8080", "rr")))
+	assert.Empty(t, rs.CheckVirtualServer(OpUpdate, vs("fwmark://5", "rr")))
+	assert.Empty(t, rs.CheckVirtualServer(OpDelete, vs("tcp://10.0.0.1:80", "")))
+	if ff := rs.CheckVirtualServer(OpUpdate, vs("tcp://10.0.0.1:80", "rr")); assert.Len(t, ff, 1) {
+		assert.Equal(t, "no-privileged-ports", ff[0].Rule)
+	}
+
+	r1 := ipvsAdm.RealServer{Address: "10.0.1.1:80", PacketForwarder: "nat", Weight: 60}
+	r2 := ipvsAdm.RealServer{Address: "10.0.1.2:80", PacketForwarder: "dr", Weight: 40}
+	group := []ipvsAdm.RealServer{r1, r2}
+	assert.Empty(t, rs.CheckRealServer(OpUpdate, vs("tcp://10.0.0.1:80", "rr"), r1, group))
+	if ff := rs.CheckRealServer(OpUpdate, vs("tcp://10.0.0.1:80", "sh"), r1, group); assert.Len(t, ff, 1) {
+		assert.Equal(t, Failure{Rule: "sh-needs-dr", Message: "sh scheduler needs dr forwarder"}, ff[0])
+	}
+	if ff := rs.CheckRealServer(OpUpdate, vs("tcp://10.0.0.1:80", "rr"), r2, group[1:]); assert.Len(t, ff, 1) {
+		assert.Equal(t, "weights-sum-100", ff[0].Rule)
+	}
+	assert.Empty(t, rs.CheckRealServer(OpDelete, vs("tcp://10.0.0.1:80", "rr"), r1, group[1:]))
+
+	for _, c := range []Config{
+		{Name: "", Target: TargetVirtualServer, Expression: "true"},
+		{Name: "a", Target: "nope", Expression: "true"},
+		{Name: "a", Target: TargetVirtualServer, Expression: "realServer.weight > 0"},
+		{Name: "a", Target: TargetVirtualServer, Expression: "virtualServer.port"},
+		{Name: "a", Target: TargetVirtualServer, Expression: "(("},
+	} {
+		_, err = New([]Config{c})
+		assert.Error(t, err, "%+v", c)
+	}
+}
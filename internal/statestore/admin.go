@@ -0,0 +1,131 @@
+package statestore
+
+import (
+	"context"
+
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+type recordingAdmin struct {
+	ipvsAdm.Admin
+	store *Store
+}
+
+//Admin wraps admin; successful mutations are recorded into store
+func (s *Store) Admin(admin ipvsAdm.Admin) ipvsAdm.Admin {
+	return &recordingAdmin{Admin: admin, store: s}
+}
+
+//UpdateVirtualServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) UpdateVirtualServer(ctx context.Context, vs ipvsAdm.VirtualServer, opts ...ipvsAdm.AdminOption) error {
+	if err := impl.Admin.UpdateVirtualServer(ctx, vs, opts...); err != nil {
+		return err
+	}
+	s := impl.store
+	s.mx.Lock()
+	key := ipvsAdm.IdentityString(vs.Identity)
+	if svc := s.services[key]; svc != nil {
+		svc.virtualServer = vs
+	} else {
+		s.services[key] = &storedService{virtualServer: vs, reals: make(map[ipvsAdm.Address]ipvsAdm.RealServer)}
+	}
+	version := s.changedLocked()
+	s.mx.Unlock()
+	impl.save(ctx, version)
+	return nil
+}
+
+//RemoveVirtualServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) RemoveVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, opts ...ipvsAdm.AdminOption) error {
+	if err := impl.Admin.RemoveVirtualServer(ctx, identity, opts...); err != nil {
+		return err
+	}
+	s := impl.store
+	s.mx.Lock()
+	key := ipvsAdm.IdentityString(identity)
+	var version uint64
+	if _, ok := s.services[key]; ok {
+		delete(s.services, key)
+		version = s.changedLocked()
+	}
+	s.mx.Unlock()
+	impl.save(ctx, version)
+	return nil
+}
+
+//UpdateRealServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) UpdateRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, rs ipvsAdm.RealServer, opts ...ipvsAdm.AdminOption) error {
+	if err := impl.Admin.UpdateRealServer(ctx, identity, rs, opts...); err != nil {
+		return err
+	}
+	key := ipvsAdm.IdentityString(identity)
+	s := impl.store
+	s.mx.Lock()
+	svc := s.services[key]
+	s.mx.Unlock()
+	if svc == nil {
+		//virtual server is made not by API; take it from the kernel table
+		vs, found := impl.findVirtualServer(ctx, identity)
+		if !found {
+			return nil
+		}
+		svc = &storedService{virtualServer: vs, reals: make(map[ipvsAdm.Address]ipvsAdm.RealServer)}
+	}
+	s.mx.Lock()
+	if cur := s.services[key]; cur != nil {
+		svc = cur
+	} else {
+		s.services[key] = svc
+	}
+	var version uint64
+	if cur, ok := svc.reals[rs.Address]; !ok || cur != rs {
+		svc.reals[rs.Address] = rs
+		version = s.changedLocked()
+	}
+	s.mx.Unlock()
+	impl.save(ctx, version)
+	return nil
+}
+
+//RemoveRealServer impl ipvsAdm.Admin
+func (impl *recordingAdmin) RemoveRealServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity, address ipvsAdm.Address, opts ...ipvsAdm.AdminOption) error {
+	if err := impl.Admin.RemoveRealServer(ctx, identity, address, opts...); err != nil {
+		return err
+	}
+	s := impl.store
+	s.mx.Lock()
+	var version uint64
+	if svc := s.services[ipvsAdm.IdentityString(identity)]; svc != nil {
+		if _, ok := svc.reals[address]; ok {
+			delete(svc.reals, address)
+			version = s.changedLocked()
+		}
+	}
+	s.mx.Unlock()
+	impl.save(ctx, version)
+	return nil
+}
+
+func (impl *recordingAdmin) findVirtualServer(ctx context.Context, identity ipvsAdm.VirtualServerIdentity) (ipvsAdm.VirtualServer, bool) {
+	var ret ipvsAdm.VirtualServer
+	var found bool
+	_ = impl.Admin.ListVirtualServers(ctx, func(vs ipvsAdm.VirtualServer) error {
+		if !found && ipvsAdm.IsIdentitiesEq(vs.Identity, identity) {
+			ret, found = vs, true
+		}
+		return nil
+	})
+	return ret, found
+}
+
+//save waits for state of version to be on disk; the kernel table is already changed, so failed save
+//is only reported
+func (impl *recordingAdmin) save(ctx context.Context, version uint64) {
+	if version == 0 {
+		return
+	}
+	if err := impl.store.save(version); err != nil {
+		logger.Errorf(ctx, "statestore: save '%s': %v", impl.store.path, err)
+	}
+}
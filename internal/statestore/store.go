@@ -0,0 +1,306 @@
+package statestore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thataway/common-lib/logger"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+/*//Sample of config
+state-store:
+  enable: true
+  dir: /var/lib/ipvs
+  check-interval: 10s
+*/
+
+//FileName name of state file in store directory
+const FileName = "state.json"
+
+type (
+	//Config state store config
+	Config struct {
+		Dir           string
+		CheckInterval time.Duration
+	}
+
+	//VirtualServer virtual server is kept in store
+	VirtualServer struct {
+		VirtualServer  string       `json:"virtualServer"`
+		ScheduleMethod string       `json:"scheduleMethod"`
+		RealServers    []RealServer `json:"realServers,omitempty"`
+	}
+
+	//RealServer real server is kept in store
+	RealServer struct {
+		Address         string `json:"address"`
+		PacketForwarder string `json:"packetForwarder"`
+		Weight          uint32 `json:"weight"`
+		UpperThreshold  uint32 `json:"upperThreshold,omitempty"`
+		LowerThreshold  uint32 `json:"lowerThreshold,omitempty"`
+	}
+
+	//Store keeps state accepted by API on disk and replays it into the kernel table
+	Store struct {
+		conf Config
+		path string
+
+		mx       sync.Mutex
+		services map[string]*storedService
+		version  uint64
+		saved    uint64
+
+		//saveMx one write of state file at a time; version of state written is kept in saved
+		saveMx sync.Mutex
+	}
+
+	storedService struct {
+		virtualServer ipvsAdm.VirtualServer
+		reals         map[ipvsAdm.Address]ipvsAdm.RealServer
+	}
+
+	stateFile struct {
+		SavedAt        time.Time       `json:"savedAt"`
+		VirtualServers []VirtualServer `json:"virtualServers"`
+	}
+)
+
+const defCheckInterval = 10 * time.Second
+
+//Open opens store and loads state saved before
+func Open(conf Config) (*Store, error) {
+	const api = "statestore/Open"
+
+	if conf.Dir == "" {
+		return nil, errors.Errorf("%s: no dir is specified", api)
+	}
+	if conf.CheckInterval <= 0 {
+		conf.CheckInterval = defCheckInterval
+	}
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	ret := &Store{
+		conf:     conf,
+		path:     filepath.Join(conf.Dir, FileName),
+		services: make(map[string]*storedService),
+	}
+	data, err := ioutil.ReadFile(ret.path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, api)
+	}
+	var st stateFile
+	if err = json.Unmarshal(data, &st); err != nil {
+		return nil, errors.Wrapf(err, "%s: '%s'", api, ret.path)
+	}
+	for _, vs := range st.VirtualServers {
+		var svc *storedService
+		if svc, err = vs.toStored(); err != nil {
+			return nil, errors.Wrapf(err, "%s: '%s'", api, ret.path)
+		}
+		ret.services[ipvsAdm.IdentityString(svc.virtualServer.Identity)] = svc
+	}
+	return ret, nil
+}
+
+//State lists stored virtual servers
+func (s *Store) State() []VirtualServer {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.stateLocked()
+}
+
+//Replay applies stored state to the kernel table
+func (s *Store) Replay(ctx context.Context, admin ipvsAdm.Admin) error {
+	const api = "statestore/Replay"
+
+	s.mx.Lock()
+	services := make([]storedService, 0, len(s.services))
+	for _, svc := range s.services {
+		c := storedService{virtualServer: svc.virtualServer, reals: make(map[ipvsAdm.Address]ipvsAdm.RealServer)}
+		for a, rs := range svc.reals {
+			c.reals[a] = rs
+		}
+		services = append(services, c)
+	}
+	s.mx.Unlock()
+	var failed int
+	for _, svc := range services {
+		vs := ipvsAdm.IdentityString(svc.virtualServer.Identity)
+		err := admin.UpdateVirtualServer(ctx, svc.virtualServer, ipvsAdm.ForceAddIfNotExist{})
+		if err != nil {
+			logger.Errorf(ctx, "statestore: replay virtual server '%s': %v", vs, err)
+			failed++
+			continue
+		}
+		for _, rs := range svc.reals {
+			if err = admin.UpdateRealServer(ctx, svc.virtualServer.Identity, rs, ipvsAdm.ForceAddIfNotExist{}); err != nil {
+				logger.Errorf(ctx, "statestore: replay real server '%s' of '%s': %v", rs.Address, vs, err)
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%s: %v item(s) are not replayed", api, failed)
+	}
+	logger.Infof(ctx, "statestore: %v virtual server(s) are replayed", len(services))
+	return nil
+}
+
+//Run replays stored state whenever the kernel table is found empty until context is done; if state
+//is not replayed at startup the table empty at startup is left as is until it is found filled
+func (s *Store) Run(ctx context.Context, admin ipvsAdm.Admin, replayed bool) {
+	ticker := time.NewTicker(s.conf.CheckInterval)
+	defer ticker.Stop()
+	armed := replayed
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mx.Lock()
+		stored := len(s.services)
+		s.mx.Unlock()
+		if stored == 0 {
+			continue
+		}
+		var present int
+		err := admin.ListVirtualServers(ctx, func(ipvsAdm.VirtualServer) error {
+			present++
+			return nil
+		})
+		if err != nil {
+			logger.Errorf(ctx, "statestore: list virtual servers: %v", err)
+			continue
+		}
+		if present > 0 || !armed {
+			armed = armed || present > 0
+			continue
+		}
+		logger.Warn(ctx, "statestore: kernel table is found empty; replay stored state")
+		if err = s.Replay(ctx, admin); err != nil {
+			logger.Errorf(ctx, "%v", err)
+		}
+	}
+}
+
+func (s *Store) stateLocked() []VirtualServer {
+	ret := make([]VirtualServer, 0, len(s.services))
+	for key, svc := range s.services {
+		item := VirtualServer{
+			VirtualServer:  key,
+			ScheduleMethod: string(svc.virtualServer.ScheduleMethod),
+		}
+		for _, rs := range svc.reals {
+			item.RealServers = append(item.RealServers, RealServer{
+				Address:         string(rs.Address),
+				PacketForwarder: string(rs.PacketForwarder),
+				Weight:          rs.Weight,
+				UpperThreshold:  rs.UpperThreshold,
+				LowerThreshold:  rs.LowerThreshold,
+			})
+		}
+		sort.Slice(item.RealServers, func(i, j int) bool {
+			return item.RealServers[i].Address < item.RealServers[j].Address
+		})
+		ret = append(ret, item)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].VirtualServer < ret[j].VirtualServer
+	})
+	return ret
+}
+
+//changedLocked marks state in memory changed; it gives version save is to reach
+func (s *Store) changedLocked() uint64 {
+	s.version++
+	return s.version
+}
+
+//save writes state file atomically once state of version is not on disk yet; concurrent callers
+//share one write of state with all their changes, and state is not locked while file is written
+func (s *Store) save(version uint64) error {
+	s.saveMx.Lock()
+	defer s.saveMx.Unlock()
+	s.mx.Lock()
+	if s.saved >= version {
+		s.mx.Unlock()
+		return nil
+	}
+	st := stateFile{SavedAt: time.Now(), VirtualServers: s.stateLocked()}
+	upto := s.version
+	s.mx.Unlock()
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(s.conf.Dir, FileName+".*"); err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	s.saved = upto
+	s.mx.Unlock()
+	return nil
+}
+
+func (vs VirtualServer) toStored() (*storedService, error) {
+	identity, err := ipvsAdm.ParseVirtualServerIdentity(vs.VirtualServer)
+	if err != nil {
+		return nil, err
+	}
+	ret := &storedService{
+		virtualServer: ipvsAdm.VirtualServer{
+			Identity:       identity,
+			ScheduleMethod: ipvsAdm.ScheduleMethod(vs.ScheduleMethod),
+		},
+		reals: make(map[ipvsAdm.Address]ipvsAdm.RealServer, len(vs.RealServers)),
+	}
+	if err = ret.virtualServer.ScheduleMethod.Valid(); err != nil {
+		return nil, err
+	}
+	for _, rs := range vs.RealServers {
+		r := ipvsAdm.RealServer{
+			Address:         ipvsAdm.Address(rs.Address),
+			PacketForwarder: ipvsAdm.PacketForwarder(rs.PacketForwarder),
+			Weight:          rs.Weight,
+			UpperThreshold:  rs.UpperThreshold,
+			LowerThreshold:  rs.LowerThreshold,
+		}
+		if _, _, err = r.Address.ToHostPort(); err != nil {
+			return nil, err
+		}
+		if err = r.PacketForwarder.Valid(); err != nil {
+			return nil, err
+		}
+		ret.reals[r.Address] = r
+	}
+	return ret, nil
+}
@@ -0,0 +1,129 @@
+package statestore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ipvsAdm "github.com/thataway/ipvs/pkg/net/ipvs"
+)
+
+func Test_Store(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "statestore")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open(Config{Dir: dir, CheckInterval: 10 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	kernel := ipvsAdm.NewMemoryAdmin()
+	adm := store.Admin(kernel)
+	vs1, _ := ipvsAdm.ParseVirtualServerIdentity("tcp://10.0.0.1:80")
+	vs2, _ := ipvsAdm.ParseVirtualServerIdentity("udp://10.0.0.2:53")
+	rs := func(addr string, w uint32) ipvsAdm.RealServer {
+		return ipvsAdm.RealServer{Address: ipvsAdm.Address(addr), PacketForwarder: "dr", Weight: w}
+	}
+	assert.NoError(t, adm.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: vs1, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	assert.NoError(t, adm.UpdateRealServer(ctx, vs1, rs("10.0.1.1:80", 1), ipvsAdm.ForceAddIfNotExist{}))
+	assert.NoError(t, adm.UpdateRealServer(ctx, vs1, rs("10.0.1.2:80", 1), ipvsAdm.ForceAddIfNotExist{}))
+	assert.NoError(t, adm.UpdateRealServer(ctx, vs1, rs("10.0.1.2:80", 5)))
+	assert.NoError(t, adm.RemoveRealServer(ctx, vs1, "10.0.1.1:80"))
+	//virtual server is made by another party is taken from the kernel table
+	assert.NoError(t, kernel.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: vs2, ScheduleMethod: "wrr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	assert.NoError(t, adm.UpdateRealServer(ctx, vs2, rs("10.0.2.1:53", 1), ipvsAdm.ForceAddIfNotExist{}))
+	//failed op is not recorded
+	assert.Error(t, adm.UpdateRealServer(ctx, ipvsAdm.VirtualServerFMark{FirewallMark: 1}, rs("10.0.3.1:80", 1)))
+
+	expected := []VirtualServer{
+		{VirtualServer: "tcp://10.0.0.1:80", ScheduleMethod: "rr", RealServers: []RealServer{
+			{Address: "10.0.1.2:80", PacketForwarder: "dr", Weight: 5},
+		}},
+		{VirtualServer: "udp://10.0.0.2:53", ScheduleMethod: "wrr", RealServers: []RealServer{
+			{Address: "10.0.2.1:53", PacketForwarder: "dr", Weight: 1},
+		}},
+	}
+	assert.Equal(t, expected, store.State())
+
+	//state survives restart
+	store, err = Open(Config{Dir: dir, CheckInterval: 10 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, expected, store.State())
+	kernel = ipvsAdm.NewMemoryAdmin()
+	assert.NoError(t, store.Replay(ctx, kernel))
+	var reals []ipvsAdm.RealServer
+	_ = kernel.ListRealServers(ctx, vs1, func(r ipvsAdm.RealServer) error {
+		reals = append(reals, r)
+		return nil
+	})
+	assert.Equal(t, []ipvsAdm.RealServer{rs("10.0.1.2:80", 5)}, reals)
+
+	//empty kernel table is refilled
+	go store.Run(ctx, kernel, true)
+	assert.NoError(t, kernel.RemoveVirtualServer(ctx, vs1))
+	assert.NoError(t, kernel.RemoveVirtualServer(ctx, vs2))
+	assert.Eventually(t, func() bool {
+		var n int
+		_ = kernel.ListVirtualServers(ctx, func(ipvsAdm.VirtualServer) error {
+			n++
+			return nil
+		})
+		return n == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, store.Admin(kernel).RemoveVirtualServer(ctx, vs1))
+	store, err = Open(Config{Dir: dir})
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected[1:], store.State())
+	}
+
+	//concurrent changes share writes of state file but all of them reach it
+	adm = store.Admin(kernel)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, adm.UpdateRealServer(ctx, vs2, rs(fmt.Sprintf("10.0.4.%v:53", i+1), 1), ipvsAdm.ForceAddIfNotExist{}))
+		}(i)
+	}
+	wg.Wait()
+	if store, err = Open(Config{Dir: dir}); assert.NoError(t, err) && assert.Len(t, store.State(), 1) {
+		assert.Len(t, store.State()[0].RealServers, 51)
+	}
+
+	//table is left empty when state is not replayed at startup until it is found filled
+	kernel = ipvsAdm.NewMemoryAdmin()
+	count := func() int {
+		var n int
+		_ = kernel.ListVirtualServers(ctx, func(ipvsAdm.VirtualServer) error {
+			n++
+			return nil
+		})
+		return n
+	}
+	store.conf.CheckInterval = 10 * time.Millisecond
+	go store.Run(ctx, kernel, false)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, count())
+	assert.NoError(t, kernel.UpdateVirtualServer(ctx, ipvsAdm.VirtualServer{Identity: vs1, ScheduleMethod: "rr"},
+		ipvsAdm.ForceAddIfNotExist{}))
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, kernel.RemoveVirtualServer(ctx, vs1))
+	assert.Eventually(t, func() bool {
+		return count() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,34 @@
+package watch
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+//ServeHTTP impl http.Handler; streams events as newline delimited JSON
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	vs := r.URL.Query().Get("virtual-server")
+	events := h.Subscribe(r.Context(), 256)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for ev := range events {
+		if vs != "" && ev.VirtualServer != vs {
+			continue
+		}
+		if enc.Encode(ev) != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package watch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	//KindRealServerUp real server has passed health checks
+	KindRealServerUp = "real-server-up"
+
+	//KindRealServerDown real server has failed health checks
+	KindRealServerDown = "real-server-down"
+
+	//KindFallbackOn sorry server is added to virtual server
+	KindFallbackOn = "fallback-on"
+
+	//KindFallbackOff sorry server is withdrawn from virtual server
+	KindFallbackOff = "fallback-off"
+
+	//KindPriorityGroupSwitch active priority group of virtual server is changed
+	KindPriorityGroupSwitch = "priority-group-switch"
+)
+
+type (
+	//Event an event about IPVS state
+	Event struct {
+		Time          time.Time `json:"time"`
+		Source        string    `json:"source"`
+		Kind          string    `json:"kind"`
+		VirtualServer string    `json:"virtualServer,omitempty"`
+		RealServer    string    `json:"realServer,omitempty"`
+		Message       string    `json:"message,omitempty"`
+	}
+
+	//Hub delivers events to subscribers
+	Hub struct {
+		mx   sync.Mutex
+		subs map[chan Event]struct{}
+	}
+)
+
+//NewHub makes events hub
+func NewHub() *Hub {
+	return &Hub{subs: make(map[chan Event]struct{})}
+}
+
+//Publish sends event to all subscribers; slow subscribers lose events
+func (h *Hub) Publish(ev Event) {
+	if h == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+//Subscribe gets events until context is done
+func (h *Hub) Subscribe(ctx context.Context, bufSize int) <-chan Event {
+	ch := make(chan Event, bufSize)
+	h.mx.Lock()
+	h.subs[ch] = struct{}{}
+	h.mx.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.mx.Lock()
+		delete(h.subs, ch)
+		h.mx.Unlock()
+		close(ch)
+	}()
+	return ch
+}
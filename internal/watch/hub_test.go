@@ -0,0 +1,44 @@
+package watch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HubHTTPStream(t *testing.T) {
+	hub := NewHub()
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?virtual-server=tcp://1.1.1.1:80", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Eventually(t, func() bool {
+		hub.mx.Lock()
+		defer hub.mx.Unlock()
+		return len(hub.subs) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	hub.Publish(Event{Kind: KindFallbackOn, VirtualServer: "tcp://2.2.2.2:80"})
+	hub.Publish(Event{Kind: KindRealServerDown, VirtualServer: "tcp://1.1.1.1:80", RealServer: "3.3.3.3:80"})
+
+	var ev Event
+	sc := bufio.NewScanner(resp.Body)
+	if assert.True(t, sc.Scan()) && assert.NoError(t, json.Unmarshal(sc.Bytes(), &ev)) {
+		assert.Equal(t, KindRealServerDown, ev.Kind)
+		assert.Equal(t, "3.3.3.3:80", ev.RealServer)
+		assert.False(t, ev.Time.IsZero())
+	}
+}
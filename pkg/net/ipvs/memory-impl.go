@@ -0,0 +1,169 @@
+package ipvs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//NewMemoryAdmin makes in-memory inst of Ipvs.Admin (is useful for tests and dry runs)
+func NewMemoryAdmin() Admin {
+	return new(memoryIpvsAdmin)
+}
+
+type (
+	memoryIpvsAdmin struct {
+		mx       sync.Mutex
+		services []*memoryVirtualServer
+	}
+
+	memoryVirtualServer struct {
+		VirtualServer
+		reals []RealServer
+	}
+)
+
+const memoryImpl = "memoryIpvsAdmin"
+
+//ListVirtualServers impl IpvsAdmin
+func (impl *memoryIpvsAdmin) ListVirtualServers(_ context.Context, consumer VirtualServerConsumer) error {
+	impl.mx.Lock()
+	services := make([]VirtualServer, 0, len(impl.services))
+	for _, s := range impl.services {
+		services = append(services, s.VirtualServer)
+	}
+	impl.mx.Unlock()
+	for _, s := range services {
+		if err := consumer(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ListRealServers impl IpvsAdmin
+func (impl *memoryIpvsAdmin) ListRealServers(_ context.Context, identity VirtualServerIdentity, consumer RealServerConsumer) error {
+	const api = memoryImpl + "/ListRealServers"
+
+	impl.mx.Lock()
+	vs := impl.find(identity)
+	var reals []RealServer
+	if vs != nil {
+		reals = append(reals, vs.reals...)
+	}
+	impl.mx.Unlock()
+	if vs == nil {
+		return errors.Wrap(ErrVirtualServerNotExist, api)
+	}
+	for _, rs := range reals {
+		if err := consumer(rs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//UpdateVirtualServer impl IpvsAdmin
+func (impl *memoryIpvsAdmin) UpdateVirtualServer(_ context.Context, vServer VirtualServer, opts ...AdminOption) error {
+	const api = memoryImpl + "/UpdateVirtualServer"
+
+	impl.mx.Lock()
+	defer impl.mx.Unlock()
+	if vs := impl.find(vServer.Identity); vs != nil {
+		vs.ScheduleMethod = vServer.ScheduleMethod
+		return nil
+	}
+	if !hasAdminOption(opts, ForceAddIfNotExist{}) {
+		return errors.Wrap(ErrVirtualServerNotExist, api)
+	}
+	impl.services = append(impl.services, &memoryVirtualServer{VirtualServer: vServer})
+	return nil
+}
+
+//RemoveVirtualServer impl IpvsAdmin
+func (impl *memoryIpvsAdmin) RemoveVirtualServer(_ context.Context, identity VirtualServerIdentity, opts ...AdminOption) error {
+	const api = memoryImpl + "/RemoveVirtualServer"
+
+	impl.mx.Lock()
+	defer impl.mx.Unlock()
+	for i, s := range impl.services {
+		if IsIdentitiesEq(s.Identity, identity) {
+			impl.services = append(impl.services[:i], impl.services[i+1:]...)
+			return nil
+		}
+	}
+	if hasAdminOption(opts, KeepCalmIfNotExist{}) {
+		return nil
+	}
+	return errors.Wrap(ErrVirtualServerNotExist, api)
+}
+
+//UpdateRealServer impl IpvsAdmin
+func (impl *memoryIpvsAdmin) UpdateRealServer(_ context.Context, identity VirtualServerIdentity, realServer RealServer, opts ...AdminOption) error {
+	const api = memoryImpl + "/UpdateRealServer"
+
+	if _, _, err := realServer.Address.ToHostPort(); err != nil {
+		return errors.Wrap(err, api)
+	}
+	if err := realServer.PacketForwarder.Valid(); err != nil {
+		return errors.Wrap(err, api)
+	}
+	impl.mx.Lock()
+	defer impl.mx.Unlock()
+	vs := impl.find(identity)
+	if vs == nil {
+		return errors.Wrap(ErrVirtualServerNotExist, api)
+	}
+	for i := range vs.reals {
+		if vs.reals[i].Address == realServer.Address {
+			vs.reals[i] = realServer
+			return nil
+		}
+	}
+	if !hasAdminOption(opts, ForceAddIfNotExist{}) {
+		return errors.Wrap(ErrRealServerNotExist, api)
+	}
+	vs.reals = append(vs.reals, realServer)
+	return nil
+}
+
+//RemoveRealServer impl IpvsAdmin
+func (impl *memoryIpvsAdmin) RemoveRealServer(_ context.Context, identity VirtualServerIdentity, addr Address, opts ...AdminOption) error {
+	const api = memoryImpl + "/RemoveRealServer"
+
+	impl.mx.Lock()
+	defer impl.mx.Unlock()
+	vs := impl.find(identity)
+	if vs == nil {
+		return errors.Wrap(ErrVirtualServerNotExist, api)
+	}
+	for i := range vs.reals {
+		if vs.reals[i].Address == addr {
+			vs.reals = append(vs.reals[:i], vs.reals[i+1:]...)
+			return nil
+		}
+	}
+	if hasAdminOption(opts, KeepCalmIfNotExist{}) {
+		return nil
+	}
+	return errors.Wrap(ErrRealServerNotExist, api)
+}
+
+func (impl *memoryIpvsAdmin) find(identity VirtualServerIdentity) *memoryVirtualServer {
+	for _, s := range impl.services {
+		if IsIdentitiesEq(s.Identity, identity) {
+			return s
+		}
+	}
+	return nil
+}
+
+func hasAdminOption(opts []AdminOption, o AdminOption) bool {
+	for i := range opts {
+		if opts[i] == o {
+			return true
+		}
+	}
+	return false
+}
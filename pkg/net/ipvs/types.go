@@ -4,6 +4,7 @@ import (
 	"net"
 	"reflect"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -116,6 +117,55 @@ func (VirtualServerAddress) isVirtualServerIdentity() {}
 
 func (VirtualServerFMark) isVirtualServerIdentity() {}
 
+//String impl fmt.Stringer -> 'tcp://host:port'
+func (a VirtualServerAddress) String() string {
+	return string(a.NetworkProtocol) + "://" + string(a.Address)
+}
+
+//String impl fmt.Stringer -> 'fwmark://mark'
+func (m VirtualServerFMark) String() string {
+	return fwMarkScheme + "://" + strconv.FormatUint(uint64(m.FirewallMark), 10)
+}
+
+//ParseVirtualServerIdentity parses identity from 'tcp://host:port', 'udp://host:port' or 'fwmark://mark'
+func ParseVirtualServerIdentity(s string) (VirtualServerIdentity, error) {
+	const api = "ParseVirtualServerIdentity"
+
+	parts := strings.SplitN(strings.TrimSpace(s), "://", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("%s: '%s' has no scheme", api, s)
+	}
+	scheme := strings.ToLower(parts[0])
+	if scheme == fwMarkScheme {
+		m, e := strconv.ParseUint(parts[1], 10, 32)
+		if e != nil {
+			return nil, errors.Wrapf(e, "%s: '%s'", api, s)
+		}
+		return VirtualServerFMark{FirewallMark: uint32(m)}, nil
+	}
+	ret := VirtualServerAddress{
+		NetworkProtocol: NetworkProtocol(scheme),
+		Address:         Address(parts[1]),
+	}
+	if e := ret.NetworkProtocol.Valid(); e != nil {
+		return nil, errors.Wrapf(e, "%s: '%s'", api, s)
+	}
+	if _, _, e := ret.Address.ToHostPort(); e != nil {
+		return nil, errors.Wrapf(e, "%s: '%s'", api, s)
+	}
+	return ret, nil
+}
+
+//IdentityString identity string representation to use as a key
+func IdentityString(identity VirtualServerIdentity) string {
+	if s, ok := identity.(interface{ String() string }); ok {
+		return s.String()
+	}
+	return ""
+}
+
+const fwMarkScheme = "fwmark"
+
 //IsIdentitiesEq is Identities equal
 func IsIdentitiesEq(l, r VirtualServerIdentity) bool {
 	t1 := reflect.TypeOf(l)